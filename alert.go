@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 告警事件类型
+const (
+	alertUpstreamFailures = "upstream_failures"
+	alertTransformPanics  = "transform_panics"
+	alertBudgetExceeded   = "budget_exceeded"
+	alertQuotaExceeded    = "quota_exceeded"
+)
+
+// alerter负责统计上游失败并异步推送告警到webhook
+type alerter struct {
+	url       string        // webhook地址
+	threshold int           // 窗口内失败次数阈值
+	window    time.Duration // 统计窗口
+	cooldown  time.Duration // 同类事件的冷却时间
+	client    *http.Client  // 推送告警使用的HTTP客户端
+	panicMax  int           // 一小时内允许的转换panic次数
+
+	mu       sync.Mutex
+	failures map[string][]time.Time // 每个上游的失败时间
+	lastSent map[string]time.Time   // 每种事件上次推送的时间
+	panics   []time.Time            // 最近一小时转换panic的时间
+}
+
+// alertPayload是推送给webhook的内容，text和content分别兼容Slack和Discord
+type alertPayload struct {
+	Text     string `json:"text"`
+	Content  string `json:"content"`
+	Event    string `json:"event"`
+	Upstream string `json:"upstream,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Count    int    `json:"count"`
+	Time     string `json:"time"`
+}
+
+// newAlerter根据配置创建alerter，未配置webhook时返回nil
+func newAlerter(cfg *config) *alerter {
+	if "" == cfg.AlertWebhookUrl {
+		return nil
+	}
+
+	threshold := cfg.AlertFailureThreshold
+	if threshold <= 0 {
+		threshold = 5
+	}
+	window := cfg.AlertFailureWindow
+	if window <= 0 {
+		window = 5
+	}
+	cooldown := cfg.AlertCooldown
+	if cooldown <= 0 {
+		cooldown = 30
+	}
+	panicMax := cfg.AlertPanicThreshold
+	if panicMax <= 0 {
+		panicMax = defaultPanicThreshold
+	}
+
+	return &alerter{
+		url:       cfg.AlertWebhookUrl,
+		threshold: threshold,
+		window:    time.Duration(window) * time.Minute,
+		cooldown:  time.Duration(cooldown) * time.Minute,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		panicMax:  panicMax,
+		failures:  make(map[string][]time.Time),
+		lastSent:  make(map[string]time.Time),
+	}
+}
+
+// recordFailure记录一次上游失败，窗口内失败次数达到阈值时触发告警
+func (a *alerter) recordFailure(upstream string, sample string) {
+	if nil == a {
+		return
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	recent := a.failures[upstream][:0]
+	for _, t := range a.failures[upstream] {
+		if now.Sub(t) < a.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	a.failures[upstream] = recent
+	count := len(recent)
+	a.mu.Unlock()
+
+	if count < a.threshold {
+		return
+	}
+
+	if len(sample) > 500 {
+		sample = sample[:500] + "..."
+	}
+
+	text := fmt.Sprintf("[override] %s upstream failed %d times in %s: %s", upstream, count, a.window, sample)
+	a.notify(alertUpstreamFailures, upstream, sample, count, text)
+}
+
+// recordExhausted在当天花费达到预算或租户配额用完而拒绝请求时触发告警，subject为租户，预算时为空
+func (a *alerter) recordExhausted(event string, subject string, reason string) {
+	if nil == a {
+		return
+	}
+
+	text := "[override] daily budget exhausted, chat requests are rejected: " + reason
+	if alertQuotaExceeded == event {
+		text = fmt.Sprintf("[override] quota of tenant %s exhausted, requests are rejected: %s", subject, reason)
+	}
+	a.notify(event, "", reason, 1, text)
+}
+
+// notify推送告警，同类事件在冷却时间内只推送一次，推送过程不阻塞调用方
+func (a *alerter) notify(event string, upstream string, sample string, count int, text string) {
+	if nil == a {
+		return
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	if last, ok := a.lastSent[event]; ok && now.Sub(last) < a.cooldown {
+		a.mu.Unlock()
+		return
+	}
+	a.lastSent[event] = now
+	a.mu.Unlock()
+
+	payload := alertPayload{
+		Text:     text,
+		Content:  text,
+		Event:    event,
+		Upstream: upstream,
+		Error:    sample,
+		Count:    count,
+		Time:     now.UTC().Format(time.RFC3339),
+	}
+
+	go a.send(payload)
+}
+
+// send将告警内容POST到webhook
+func (a *alerter) send(payload alertPayload) {
+	body, err := json.Marshal(payload)
+	if nil != err {
+		logError("marshal alert failed: %s\n", err.Error())
+		return
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if nil != err {
+		logError("send alert failed: %s\n", err.Error())
+		return
+	}
+	defer closeIO(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		logError("send alert failed, status: %d\n", resp.StatusCode)
+	}
+}
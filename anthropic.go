@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// messages处理Anthropic Messages API格式的/v1/messages请求：转换为Chat Completions请求后
+// 按聊天请求处理（模型映射、配额、重试等都与/v1/chat/completions相同），再把响应和流式事件转换回Anthropic格式
+func (s *ProxyService) messages(c *gin.Context) {
+	body, release, err := readBody(c.Request.Body)
+	if nil != err {
+		release()
+		abortAnthropic(c, bodyReadStatus(err), err.Error())
+		return
+	}
+	chat, err := anthropicToChat(body)
+	release()
+	if nil != err {
+		abortAnthropic(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Anthropic格式的客户端用x-api-key传递密钥，转为Authorization后统计、配额和tenant_models都按同一个密钥区分
+	if key := c.GetHeader("X-Api-Key"); "" != key && "" == c.GetHeader("Authorization") {
+		c.Request.Header.Set("Authorization", "Bearer "+key)
+	}
+	// 响应体需要逐个事件转换，不压缩
+	c.Request.Body = io.NopCloser(bytes.NewReader(chat))
+	c.Request.ContentLength = int64(len(chat))
+	c.Request.Header.Del("Accept-Encoding")
+	writer := &anthropicWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+
+	s.completions(c)
+	writer.finish()
+}
+
+// anthropicToChat把Anthropic Messages API的请求体转换为Chat Completions的请求体
+func anthropicToChat(body []byte) ([]byte, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, errors.New("request body is not valid JSON")
+	}
+	req := gjson.ParseBytes(body)
+	if "" == req.Get("model").String() {
+		return nil, errors.New("model: field required")
+	}
+	if !req.Get("messages").IsArray() {
+		return nil, errors.New("messages: field required")
+	}
+
+	var messages []any
+	if system := anthropicText(req.Get("system")); "" != system {
+		messages = append(messages, map[string]any{"role": "system", "content": system})
+	}
+	for i, message := range req.Get("messages").Array() {
+		converted, err := anthropicMessage(message)
+		if nil != err {
+			return nil, fmt.Errorf("messages.%d: %w", i, err)
+		}
+		messages = append(messages, converted...)
+	}
+
+	chat := map[string]any{"model": req.Get("model").String(), "messages": messages}
+	if maxTokens := req.Get("max_tokens"); maxTokens.Exists() {
+		chat["max_tokens"] = maxTokens.Int()
+	}
+	for _, name := range []string{"temperature", "top_p"} {
+		if value := req.Get(name); value.Exists() {
+			chat[name] = value.Value()
+		}
+	}
+	if stop := req.Get("stop_sequences"); stop.IsArray() {
+		chat["stop"] = stop.Value()
+	}
+	if user := req.Get("metadata.user_id").String(); "" != user {
+		chat["user"] = user
+	}
+	// 流式请求需要最后的usage，才能在message_delta中返回Token数
+	if req.Get("stream").Bool() {
+		chat["stream"] = true
+		chat["stream_options"] = map[string]any{"include_usage": true}
+	}
+
+	if tools := req.Get("tools"); tools.IsArray() {
+		var functions []any
+		for i, tool := range tools.Array() {
+			if !tool.Get("input_schema").Exists() {
+				return nil, fmt.Errorf("tools.%d: server tool %s is not supported", i, tool.Get("type").String())
+			}
+			function := map[string]any{"name": tool.Get("name").String(), "parameters": json.RawMessage(tool.Get("input_schema").Raw)}
+			if description := tool.Get("description").String(); "" != description {
+				function["description"] = description
+			}
+			functions = append(functions, map[string]any{"type": "function", "function": function})
+		}
+		chat["tools"] = functions
+	}
+	if choice := req.Get("tool_choice"); choice.Exists() {
+		switch choice.Get("type").String() {
+		case "auto":
+			chat["tool_choice"] = "auto"
+		case "any":
+			chat["tool_choice"] = "required"
+		case "none":
+			chat["tool_choice"] = "none"
+		case "tool":
+			chat["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": choice.Get("name").String()}}
+		default:
+			return nil, fmt.Errorf("tool_choice: unsupported type %q", choice.Get("type").String())
+		}
+		if choice.Get("disable_parallel_tool_use").Bool() {
+			chat["parallel_tool_calls"] = false
+		}
+	}
+
+	return json.Marshal(chat)
+}
+
+// anthropicText返回字符串或内容块数组中的文本，多个文本块用换行连接
+func anthropicText(content gjson.Result) string {
+	if gjson.String == content.Type {
+		return content.String()
+	}
+
+	var texts []string
+	for _, block := range content.Array() {
+		if "text" == block.Get("type").String() {
+			texts = append(texts, block.Get("text").String())
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// anthropicMessage把一条Anthropic消息转换为Chat Completions的消息。用户消息中的tool_result
+// 转换为单独的tool消息，放在用户消息的其他内容之前；思考内容不转发
+func anthropicMessage(message gjson.Result) ([]any, error) {
+	role := message.Get("role").String()
+	if "user" != role && "assistant" != role {
+		return nil, fmt.Errorf("unsupported role %q", role)
+	}
+	content := message.Get("content")
+	if gjson.String == content.Type {
+		return []any{map[string]any{"role": role, "content": content.String()}}, nil
+	}
+	if !content.IsArray() {
+		return nil, errors.New("content must be a string or an array")
+	}
+
+	var converted, parts, toolCalls []any
+	var texts []string
+	images := false
+	for _, block := range content.Array() {
+		switch blockType := block.Get("type").String(); blockType {
+		case "text":
+			texts = append(texts, block.Get("text").String())
+			parts = append(parts, map[string]any{"type": "text", "text": block.Get("text").String()})
+		case "image":
+			url := block.Get("source.url").String()
+			if "base64" == block.Get("source.type").String() {
+				url = fmt.Sprintf("data:%s;base64,%s", block.Get("source.media_type").String(), block.Get("source.data").String())
+			}
+			images = true
+			parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}})
+		case "tool_use":
+			arguments := block.Get("input").Raw
+			if "" == arguments {
+				arguments = "{}"
+			}
+			toolCalls = append(toolCalls, map[string]any{
+				"id":       block.Get("id").String(),
+				"type":     "function",
+				"function": map[string]any{"name": block.Get("name").String(), "arguments": arguments},
+			})
+		case "tool_result":
+			result := anthropicText(block.Get("content"))
+			if block.Get("is_error").Bool() && "" == result {
+				result = "error"
+			}
+			converted = append(converted, map[string]any{"role": "tool", "tool_call_id": block.Get("tool_use_id").String(), "content": result})
+		case "thinking", "redacted_thinking":
+		default:
+			return nil, fmt.Errorf("unsupported content block type %q", blockType)
+		}
+	}
+
+	if "assistant" == role {
+		assistant := map[string]any{"role": role, "content": nil}
+		if len(texts) > 0 {
+			assistant["content"] = strings.Join(texts, "\n")
+		}
+		if len(toolCalls) > 0 {
+			assistant["tool_calls"] = toolCalls
+		}
+		return append(converted, assistant), nil
+	}
+
+	// 只有文本时合并为字符串，兼容不支持内容数组的上游
+	switch {
+	case images:
+		converted = append(converted, map[string]any{"role": role, "content": parts})
+	case len(texts) > 0:
+		converted = append(converted, map[string]any{"role": role, "content": strings.Join(texts, "\n")})
+	}
+
+	return converted, nil
+}
+
+// anthropicStopReason把finish_reason转换为Anthropic的stop_reason
+func anthropicStopReason(reason string) string {
+	switch reason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	}
+
+	return "end_turn"
+}
+
+// anthropicId把Chat Completions的响应ID转换为Anthropic风格的消息ID
+func anthropicId(id string) string {
+	id = strings.TrimPrefix(id, "chatcmpl-")
+	if "" == id {
+		id = "override"
+	}
+	return "msg_" + id
+}
+
+// anthropicUsage把usage转换为Anthropic的格式，命中缓存的Token不计入input_tokens
+func anthropicUsage(usage gjson.Result) map[string]any {
+	cached := usage.Get("prompt_tokens_details.cached_tokens").Int()
+	result := map[string]any{
+		"input_tokens":  usage.Get("prompt_tokens").Int() - cached,
+		"output_tokens": usage.Get("completion_tokens").Int(),
+	}
+	if cached > 0 {
+		result["cache_read_input_tokens"] = cached
+	}
+
+	return result
+}
+
+// chatToAnthropic把非流式的Chat Completions响应转换为Anthropic的消息
+func chatToAnthropic(body []byte) []byte {
+	resp := gjson.ParseBytes(body)
+	message := resp.Get("choices.0.message")
+
+	content := []any{}
+	if text := message.Get("content").String(); "" != text {
+		content = append(content, map[string]any{"type": "text", "text": text})
+	}
+	for _, call := range message.Get("tool_calls").Array() {
+		content = append(content, map[string]any{
+			"type":  "tool_use",
+			"id":    call.Get("id").String(),
+			"name":  call.Get("function.name").String(),
+			"input": toolInput(call.Get("function.arguments").String()),
+		})
+	}
+
+	result, _ := json.Marshal(map[string]any{
+		"id":            anthropicId(resp.Get("id").String()),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         resp.Get("model").String(),
+		"content":       content,
+		"stop_reason":   anthropicStopReason(resp.Get("choices.0.finish_reason").String()),
+		"stop_sequence": nil,
+		"usage":         anthropicUsage(resp.Get("usage")),
+	})
+	return result
+}
+
+// toolInput返回工具调用的参数，参数不是合法的JSON对象时返回空对象
+func toolInput(arguments string) json.RawMessage {
+	if !gjson.Valid(arguments) || !gjson.Parse(arguments).IsObject() {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// anthropicErrorType返回状态码对应的Anthropic错误类型
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	}
+
+	return "api_error"
+}
+
+// anthropicError返回Anthropic格式的错误，body是代理或上游返回的错误响应
+func anthropicError(status int, body []byte) []byte {
+	message := gjson.GetBytes(body, "error.message").String()
+	if "" == message {
+		message = strings.TrimSpace(string(body))
+	}
+	if "" == message {
+		message = http.StatusText(status)
+	}
+
+	result, _ := json.Marshal(map[string]any{
+		"type":  "error",
+		"error": map[string]any{"type": anthropicErrorType(status), "message": message},
+	})
+	return result
+}
+
+// abortAnthropic返回Anthropic格式的错误，用于转换请求之前的错误
+func abortAnthropic(c *gin.Context, status int, message string) {
+	setRecentError(c, message)
+	c.Abort()
+	c.Data(status, "application/json", anthropicError(status, []byte(message)))
+}
+
+// anthropicWriter把聊天请求的响应转换为Anthropic格式：流式响应逐个事件转换，
+// 其他响应（包括代理和上游的错误）缓存到请求结束后整体转换
+type anthropicWriter struct {
+	gin.ResponseWriter
+	stream  *anthropicStream // 上游返回流式响应时非nil
+	buf     bytes.Buffer
+	started bool
+}
+
+func (w *anthropicWriter) Write(data []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		if http.StatusOK == w.Status() && isEventStream(w.Header().Get("Content-Type")) {
+			w.stream = newAnthropicStream()
+		}
+	}
+	if nil == w.stream {
+		return w.buf.Write(data)
+	}
+
+	if events := w.stream.translate(data); len(events) > 0 {
+		if _, err := w.ResponseWriter.Write(events); nil != err {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *anthropicWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeaderNow和Flush在缓存响应时不写出响应头，留给finish设置
+func (w *anthropicWriter) WriteHeaderNow() {
+	if nil != w.stream {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *anthropicWriter) Flush() {
+	if nil != w.stream {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// finish在聊天请求处理完后写出转换后的响应，流式响应补发结束事件
+func (w *anthropicWriter) finish() {
+	if nil != w.stream {
+		if events := w.stream.close(); len(events) > 0 {
+			_, _ = w.ResponseWriter.Write(events)
+			w.ResponseWriter.Flush()
+		}
+		return
+	}
+
+	status := w.Status()
+	body := w.buf.Bytes()
+	if http.StatusOK == status {
+		body = chatToAnthropic(body)
+	} else if status >= 400 {
+		body = anthropicError(status, body)
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.ResponseWriter.Write(body)
+}
+
+// anthropicStream把Chat Completions的流式响应转换为Anthropic的事件：message_start、
+// 每个文本或工具调用一组content_block_start/delta/stop，最后是message_delta和message_stop。
+// 上游可能交替发送多个工具调用的参数，而内容块结束后不能再发送它的delta，所以第一个工具调用的块
+// 打开后一直保持到流结束，期间收到的文本和其他工具调用缓存起来，结束时依次作为完整的内容块发送
+type anthropicStream struct {
+	buf     []byte
+	started bool                      // 已发送message_start
+	block   int                       // 当前打开的内容块，-1为没有
+	text    bool                      // 当前打开的是文本块
+	next    int                       // 下一个内容块的序号
+	tool    int                       // 正在发送的工具调用的index，-1为没有
+	pending []*anthropicPending       // 工具调用的块打开期间收到的其他内容
+	waiting map[int]*anthropicPending // 缓存的工具调用，按index
+	stop    string                    // 收到的finish_reason
+	usage   gjson.Result
+	done    bool // 已发送结束事件
+}
+
+// anthropicPending是缓存的一段文本或一个工具调用
+type anthropicPending struct {
+	tool    bool
+	id      string
+	name    string
+	content strings.Builder // 文本或工具调用的参数
+}
+
+// newAnthropicStream创建anthropicStream
+func newAnthropicStream() *anthropicStream {
+	return &anthropicStream{block: -1, tool: -1, waiting: make(map[int]*anthropicPending)}
+}
+
+// anthropicEvent返回一个Anthropic格式的SSE事件
+func anthropicEvent(name string, data any) []byte {
+	content, _ := json.Marshal(data)
+	return []byte("event: " + name + "\ndata: " + string(content) + "\n\n")
+}
+
+// translate按行解析写入的流式响应，返回转换后的事件
+func (a *anthropicStream) translate(data []byte) []byte {
+	a.buf = append(a.buf, data...)
+	var out []byte
+	rest := a.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSpace(rest[:i])
+		rest = rest[i+1:]
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+
+		payload := bytes.TrimSpace(line[5:])
+		if bytes.Equal(payload, []byte("[DONE]")) {
+			out = append(out, a.close()...)
+			continue
+		}
+		out = append(out, a.chunk(gjson.ParseBytes(payload))...)
+	}
+	a.buf = append(a.buf[:0], rest...)
+
+	return out
+}
+
+// chunk转换一个Chat Completions的流式事件
+func (a *anthropicStream) chunk(chunk gjson.Result) []byte {
+	if a.done {
+		return nil
+	}
+
+	var out []byte
+	if !a.started {
+		out = append(out, a.start(chunk)...)
+	}
+	if usage := chunk.Get("usage"); usage.IsObject() {
+		a.usage = usage
+	}
+
+	choice := chunk.Get("choices.0")
+	if text := choice.Get("delta.content").String(); "" != text {
+		switch {
+		case a.tool >= 0:
+			if last := len(a.pending) - 1; last >= 0 && !a.pending[last].tool {
+				a.pending[last].content.WriteString(text)
+			} else {
+				p := &anthropicPending{}
+				p.content.WriteString(text)
+				a.pending = append(a.pending, p)
+			}
+		case a.text:
+			out = append(out, a.delta(map[string]any{"type": "text_delta", "text": text})...)
+		default:
+			out = append(out, a.open(map[string]any{"type": "text", "text": ""})...)
+			a.text = true
+			out = append(out, a.delta(map[string]any{"type": "text_delta", "text": text})...)
+		}
+	}
+	for _, call := range choice.Get("delta.tool_calls").Array() {
+		index := int(call.Get("index").Int())
+		arguments := call.Get("function.arguments").String()
+		if p, ok := a.waiting[index]; ok {
+			p.content.WriteString(arguments)
+			continue
+		}
+		if a.tool >= 0 && index != a.tool {
+			p := &anthropicPending{tool: true, id: call.Get("id").String(), name: call.Get("function.name").String()}
+			p.content.WriteString(arguments)
+			a.waiting[index] = p
+			a.pending = append(a.pending, p)
+			continue
+		}
+		if a.tool < 0 {
+			out = append(out, a.open(map[string]any{
+				"type": "tool_use", "id": call.Get("id").String(), "name": call.Get("function.name").String(), "input": map[string]any{},
+			})...)
+			a.tool = index
+		}
+		if "" != arguments {
+			out = append(out, a.delta(map[string]any{"type": "input_json_delta", "partial_json": arguments})...)
+		}
+	}
+	if reason := choice.Get("finish_reason"); gjson.String == reason.Type {
+		a.stop = reason.String()
+	}
+
+	return out
+}
+
+// start返回message_start事件
+func (a *anthropicStream) start(chunk gjson.Result) []byte {
+	a.started = true
+	return anthropicEvent("message_start", map[string]any{
+		"type": "message_start",
+		"message": map[string]any{
+			"id": anthropicId(chunk.Get("id").String()), "type": "message", "role": "assistant",
+			"model": chunk.Get("model").String(), "content": []any{}, "stop_reason": nil, "stop_sequence": nil,
+			"usage": map[string]any{"input_tokens": 0, "output_tokens": 0},
+		},
+	})
+}
+
+// open结束当前的内容块并开始新的内容块
+func (a *anthropicStream) open(block map[string]any) []byte {
+	out := a.closeBlock()
+	a.block = a.next
+	a.next++
+	return append(out, anthropicEvent("content_block_start", map[string]any{"type": "content_block_start", "index": a.block, "content_block": block})...)
+}
+
+// delta返回当前内容块的content_block_delta事件
+func (a *anthropicStream) delta(delta map[string]any) []byte {
+	return anthropicEvent("content_block_delta", map[string]any{"type": "content_block_delta", "index": a.block, "delta": delta})
+}
+
+// flush把缓存的文本或工具调用作为一个完整的内容块发送
+func (a *anthropicStream) flush(p *anthropicPending) []byte {
+	if !p.tool {
+		out := a.open(map[string]any{"type": "text", "text": ""})
+		out = append(out, a.delta(map[string]any{"type": "text_delta", "text": p.content.String()})...)
+		return append(out, a.closeBlock()...)
+	}
+
+	out := a.open(map[string]any{"type": "tool_use", "id": p.id, "name": p.name, "input": map[string]any{}})
+	if p.content.Len() > 0 {
+		out = append(out, a.delta(map[string]any{"type": "input_json_delta", "partial_json": p.content.String()})...)
+	}
+	return append(out, a.closeBlock()...)
+}
+
+// closeBlock结束当前的内容块
+func (a *anthropicStream) closeBlock() []byte {
+	if a.block < 0 {
+		return nil
+	}
+	index := a.block
+	a.block = -1
+	a.text = false
+	return anthropicEvent("content_block_stop", map[string]any{"type": "content_block_stop", "index": index})
+}
+
+// close在流结束时补发结束事件，只执行一次。没有收到finish_reason或中途出错时发送error事件
+func (a *anthropicStream) close() []byte {
+	if a.done {
+		return nil
+	}
+	a.done = true
+
+	var out []byte
+	if !a.started {
+		out = append(out, a.start(gjson.Result{})...)
+	}
+	out = append(out, a.closeBlock()...)
+	for _, p := range a.pending {
+		out = append(out, a.flush(p)...)
+	}
+	if "" == a.stop || "error" == a.stop {
+		return append(out, anthropicEvent("error", map[string]any{
+			"type":  "error",
+			"error": map[string]any{"type": "api_error", "message": "upstream stream ended before the response was complete"},
+		})...)
+	}
+
+	out = append(out, anthropicEvent("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": anthropicStopReason(a.stop), "stop_sequence": nil},
+		"usage": anthropicUsage(a.usage),
+	})...)
+	return append(out, anthropicEvent("message_stop", map[string]any{"type": "message_stop"})...)
+}
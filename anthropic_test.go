@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"override/internal/sse"
+)
+
+// sameJSON检查两个JSON的内容相同，不考虑字段顺序
+func sameJSON(t *testing.T, got []byte, want string) bool {
+	t.Helper()
+
+	var a, b any
+	if err := json.Unmarshal(got, &a); nil != err {
+		t.Fatalf("%v: %s", err, got)
+	}
+	if err := json.Unmarshal([]byte(want), &b); nil != err {
+		t.Fatalf("%v: %s", err, want)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// TestAnthropicToChat检查Anthropic请求转换为Chat Completions请求，以及不支持的请求返回的错误
+func TestAnthropicToChat(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string // 转换后的请求，为空时检查错误
+		err  string
+	}{
+		{
+			"system and parameters",
+			`{"model":"claude","max_tokens":100,"temperature":0.5,"top_p":0.9,"stop_sequences":["END"],"metadata":{"user_id":"u1"},
+			  "system":[{"type":"text","text":"be brief"},{"type":"text","text":"be kind"}],"messages":[{"role":"user","content":"hi"}]}`,
+			`{"model":"claude","max_tokens":100,"temperature":0.5,"top_p":0.9,"stop":["END"],"user":"u1",
+			  "messages":[{"role":"system","content":"be brief\nbe kind"},{"role":"user","content":"hi"}]}`,
+			"",
+		},
+		{
+			"stream asks for usage",
+			`{"model":"claude","stream":true,"system":"s","messages":[{"role":"user","content":"hi"}]}`,
+			`{"model":"claude","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"}]}`,
+			"",
+		},
+		{
+			"text blocks merged",
+			`{"model":"claude","messages":[{"role":"user","content":[{"type":"text","text":"a"},{"type":"text","text":"b"}]}]}`,
+			`{"model":"claude","messages":[{"role":"user","content":"a\nb"}]}`,
+			"",
+		},
+		{
+			"images",
+			`{"model":"claude","messages":[{"role":"user","content":[{"type":"text","text":"look"},
+			  {"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}},
+			  {"type":"image","source":{"type":"url","url":"https://example.com/a.png"}}]}]}`,
+			`{"model":"claude","messages":[{"role":"user","content":[{"type":"text","text":"look"},
+			  {"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}},
+			  {"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}]}`,
+			"",
+		},
+		{
+			"tool use and results",
+			`{"model":"claude","messages":[
+			  {"role":"assistant","content":[{"type":"thinking","thinking":"hmm"},{"type":"text","text":"checking"},
+			    {"type":"tool_use","id":"t1","name":"get","input":{"q":1}},{"type":"tool_use","id":"t2","name":"list"}]},
+			  {"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":[{"type":"text","text":"42"}]},
+			    {"type":"tool_result","tool_use_id":"t2","is_error":true},{"type":"text","text":"go on"}]}]}`,
+			`{"model":"claude","messages":[
+			  {"role":"assistant","content":"checking","tool_calls":[
+			    {"id":"t1","type":"function","function":{"name":"get","arguments":"{\"q\":1}"}},
+			    {"id":"t2","type":"function","function":{"name":"list","arguments":"{}"}}]},
+			  {"role":"tool","tool_call_id":"t1","content":"42"},
+			  {"role":"tool","tool_call_id":"t2","content":"error"},
+			  {"role":"user","content":"go on"}]}`,
+			"",
+		},
+		{
+			"tools and tool_choice",
+			`{"model":"claude","messages":[{"role":"user","content":"hi"}],
+			  "tools":[{"name":"get","description":"fetch","input_schema":{"type":"object"}},{"name":"list","input_schema":{}}],
+			  "tool_choice":{"type":"tool","name":"get","disable_parallel_tool_use":true}}`,
+			`{"model":"claude","messages":[{"role":"user","content":"hi"}],
+			  "tools":[{"type":"function","function":{"name":"get","description":"fetch","parameters":{"type":"object"}}},
+			    {"type":"function","function":{"name":"list","parameters":{}}}],
+			  "tool_choice":{"type":"function","function":{"name":"get"}},"parallel_tool_calls":false}`,
+			"",
+		},
+		{
+			"tool_choice any",
+			`{"model":"claude","messages":[{"role":"user","content":"hi"}],"tool_choice":{"type":"any"}}`,
+			`{"model":"claude","messages":[{"role":"user","content":"hi"}],"tool_choice":"required"}`,
+			"",
+		},
+		{"invalid json", `{"model":`, "", "request body is not valid JSON"},
+		{"no model", `{"messages":[]}`, "", "model: field required"},
+		{"no messages", `{"model":"claude"}`, "", "messages: field required"},
+		{"bad role", `{"model":"claude","messages":[{"role":"system","content":"hi"}]}`, "", `messages.0: unsupported role "system"`},
+		{"bad content", `{"model":"claude","messages":[{"role":"user","content":1}]}`, "", "messages.0: content must be a string or an array"},
+		{"bad block", `{"model":"claude","messages":[{"role":"user","content":"a"},{"role":"user","content":[{"type":"document"}]}]}`, "", `messages.1: unsupported content block type "document"`},
+		{"server tool", `{"model":"claude","messages":[],"tools":[{"type":"web_search_20250305","name":"web_search"}]}`, "", "tools.0: server tool web_search_20250305 is not supported"},
+		{"bad tool_choice", `{"model":"claude","messages":[],"tool_choice":{"type":"some"}}`, "", `tool_choice: unsupported type "some"`},
+	}
+	for _, tt := range tests {
+		chat, err := anthropicToChat([]byte(tt.body))
+		if "" != tt.err {
+			if nil == err || tt.err != err.Error() {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !sameJSON(t, chat, tt.want) {
+			t.Errorf("%s: got %s\nwant %s", tt.name, chat, tt.want)
+		}
+	}
+}
+
+// TestChatToAnthropic检查非流式响应的转换：文本和工具调用转为内容块，命中缓存的Token单独统计
+func TestChatToAnthropic(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			"text",
+			`{"id":"chatcmpl-abc","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],
+			  "usage":{"prompt_tokens":10,"completion_tokens":2}}`,
+			`{"id":"msg_abc","type":"message","role":"assistant","model":"gpt-4o","content":[{"type":"text","text":"hello"}],
+			  "stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":2}}`,
+		},
+		{
+			"tool calls with cache",
+			`{"id":"x","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"let me check","tool_calls":[
+			    {"id":"c1","type":"function","function":{"name":"get","arguments":"{\"q\":1}"}},
+			    {"id":"c2","type":"function","function":{"name":"list","arguments":"not json"}}]},"finish_reason":"tool_calls"}],
+			  "usage":{"prompt_tokens":10,"completion_tokens":5,"prompt_tokens_details":{"cached_tokens":4}}}`,
+			`{"id":"msg_x","type":"message","role":"assistant","model":"gpt-4o","content":[{"type":"text","text":"let me check"},
+			    {"type":"tool_use","id":"c1","name":"get","input":{"q":1}},{"type":"tool_use","id":"c2","name":"list","input":{}}],
+			  "stop_reason":"tool_use","stop_sequence":null,"usage":{"input_tokens":6,"output_tokens":5,"cache_read_input_tokens":4}}`,
+		},
+		{
+			"length without content",
+			`{"choices":[{"message":{"role":"assistant","content":null},"finish_reason":"length"}]}`,
+			`{"id":"msg_override","type":"message","role":"assistant","model":"","content":[],
+			  "stop_reason":"max_tokens","stop_sequence":null,"usage":{"input_tokens":0,"output_tokens":0}}`,
+		},
+	}
+	for _, tt := range tests {
+		if got := chatToAnthropic([]byte(tt.body)); !sameJSON(t, got, tt.want) {
+			t.Errorf("%s: got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// anthropicBlock是客户端按事件拼接得到的一个内容块
+type anthropicBlock struct {
+	Type  string
+	Id    string
+	Name  string
+	Input string // 文本或工具调用的参数
+}
+
+// anthropicEvents像客户端一样解析Anthropic的流式事件，检查message_start在最前面，
+// 内容块的序号依次递增，每个delta和stop都属于当前打开的内容块。返回内容块和最后一个事件
+func anthropicEvents(t *testing.T, stream []byte) ([]anthropicBlock, gjson.Result) {
+	t.Helper()
+
+	var blocks []anthropicBlock
+	var last gjson.Result
+	open := -1
+	reader := sse.NewReader(bytes.NewReader(stream))
+	for i := 0; ; i++ {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			if open >= 0 {
+				t.Fatalf("block %d not stopped", open)
+			}
+			return blocks, last
+		}
+		if nil != err {
+			t.Fatal(err)
+		}
+		last = gjson.ParseBytes(event.Data)
+		if event.Name != last.Get("type").String() {
+			t.Fatalf("event %s with data type %s", event.Name, last.Get("type").String())
+		}
+		if (0 == i) != ("message_start" == event.Name) {
+			t.Fatalf("event %d is %s", i, event.Name)
+		}
+
+		index := int(last.Get("index").Int())
+		switch event.Name {
+		case "content_block_start":
+			if open >= 0 || len(blocks) != index {
+				t.Fatalf("start of block %d while block %d is open after %d blocks", index, open, len(blocks))
+			}
+			open = index
+			block := last.Get("content_block")
+			blocks = append(blocks, anthropicBlock{Type: block.Get("type").String(), Id: block.Get("id").String(), Name: block.Get("name").String()})
+		case "content_block_delta":
+			if open != index {
+				t.Fatalf("delta for block %d while block %d is open: %s", index, open, event.Data)
+			}
+			blocks[index].Input += last.Get("delta.text").String() + last.Get("delta.partial_json").String()
+		case "content_block_stop":
+			if open != index {
+				t.Fatalf("stop of block %d while block %d is open", index, open)
+			}
+			open = -1
+		case "message_delta", "message_stop", "error":
+			if open >= 0 {
+				t.Fatalf("%s while block %d is open", event.Name, open)
+			}
+		}
+	}
+}
+
+// chatChunks把Chat Completions的流式事件拼成响应体
+func chatChunks(chunks ...string) []byte {
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		buf.WriteString("data: " + chunk + "\n\n")
+	}
+	return buf.Bytes()
+}
+
+// TestAnthropicStream检查流式事件的转换。交替到达的工具调用参数不能发给已结束的内容块，
+// 第一个工具调用之后的内容在流结束时依次作为完整的内容块发送
+func TestAnthropicStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		blocks []anthropicBlock
+		last   string // 最后一个事件
+	}{
+		{
+			"text",
+			chatChunks(
+				`{"id":"chatcmpl-1","model":"m","choices":[{"delta":{"role":"assistant","content":""}}]}`,
+				`{"choices":[{"delta":{"content":"Hel"}}]}`,
+				`{"choices":[{"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2}}`,
+				`[DONE]`,
+			),
+			[]anthropicBlock{{Type: "text", Input: "Hello"}},
+			`{"type":"message_stop"}`,
+		},
+		{
+			"text then tool calls",
+			chatChunks(
+				`{"choices":[{"delta":{"content":"checking"}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"c1","function":{"name":"get","arguments":""}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"1}"}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"id":"c2","function":{"name":"list","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+				`[DONE]`,
+			),
+			[]anthropicBlock{{Type: "text", Input: "checking"}, {Type: "tool_use", Id: "c1", Name: "get", Input: `{"q":1}`}, {Type: "tool_use", Id: "c2", Name: "list", Input: "{}"}},
+			`{"type":"message_stop"}`,
+		},
+		{
+			"interleaved tool calls",
+			chatChunks(
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"c1","function":{"name":"get","arguments":"{\"a\""}},{"index":1,"id":"c2","function":{"name":"put","arguments":"{\"b\""}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":1,"function":{"arguments":":2}"}}]}}]}`,
+				`{"choices":[{"delta":{"content":"and"}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":2,"id":"c3","function":{"name":"del","arguments":""}}]}}]}`,
+				`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":":1}"}}]}}]}`,
+				`{"choices":[{"delta":{"content":" more"},"finish_reason":"tool_calls"}]}`,
+				`[DONE]`,
+			),
+			[]anthropicBlock{
+				{Type: "tool_use", Id: "c1", Name: "get", Input: `{"a":1}`},
+				{Type: "tool_use", Id: "c2", Name: "put", Input: `{"b":2}`},
+				{Type: "text", Input: "and"},
+				{Type: "tool_use", Id: "c3", Name: "del"},
+				{Type: "text", Input: " more"},
+			},
+			`{"type":"message_stop"}`,
+		},
+		{
+			"no finish_reason",
+			chatChunks(`{"choices":[{"delta":{"content":"Hel"}}]}`),
+			[]anthropicBlock{{Type: "text", Input: "Hel"}},
+			`{"type":"error","error":{"type":"api_error","message":"upstream stream ended before the response was complete"}}`,
+		},
+		{
+			"empty",
+			nil,
+			nil,
+			`{"type":"error","error":{"type":"api_error","message":"upstream stream ended before the response was complete"}}`,
+		},
+	}
+	for _, tt := range tests {
+		// 逐字节写入，检查跨写入的行能正确拼接
+		a := newAnthropicStream()
+		var out []byte
+		for i := range tt.stream {
+			out = append(out, a.translate(tt.stream[i:i+1])...)
+		}
+		out = append(out, a.close()...)
+		if more := a.close(); nil != more {
+			t.Errorf("%s: second close returned %s", tt.name, more)
+		}
+
+		blocks, last := anthropicEvents(t, out)
+		if !reflect.DeepEqual(tt.blocks, blocks) {
+			t.Errorf("%s: blocks = %+v, want %+v\n%s", tt.name, blocks, tt.blocks, out)
+		}
+		if !sameJSON(t, []byte(last.Raw), tt.last) {
+			t.Errorf("%s: last event = %s, want %s", tt.name, last.Raw, tt.last)
+		}
+	}
+
+	// message_delta带有stop_reason和usage
+	out := newAnthropicStream().translate(chatChunks(
+		`{"choices":[{"delta":{"content":"a"},"finish_reason":"length"}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":1,"prompt_tokens_details":{"cached_tokens":8}}}`,
+		`[DONE]`,
+	))
+	want := `{"type":"message_delta","delta":{"stop_reason":"max_tokens","stop_sequence":null},"usage":{"input_tokens":2,"output_tokens":1,"cache_read_input_tokens":8}}`
+	if !bytes.Contains(out, []byte("event: message_delta\n")) {
+		t.Fatalf("no message_delta: %s", out)
+	}
+	delta := bytes.SplitN(bytes.SplitN(out, []byte("event: message_delta\ndata: "), 2)[1], []byte("\n"), 2)[0]
+	if !sameJSON(t, delta, want) {
+		t.Errorf("message_delta = %s, want %s", delta, want)
+	}
+}
+
+// TestAnthropicError检查状态码对应的错误类型，以及从代理或上游的错误响应中取出错误信息
+func TestAnthropicError(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		kind    string
+		message string
+	}{
+		{http.StatusBadRequest, `{"error":{"message":"bad model"}}`, "invalid_request_error", "bad model"},
+		{http.StatusMethodNotAllowed, "", "invalid_request_error", "Method Not Allowed"},
+		{http.StatusUnauthorized, "invalid key\n", "authentication_error", "invalid key"},
+		{http.StatusForbidden, "", "permission_error", "Forbidden"},
+		{http.StatusNotFound, "", "not_found_error", "Not Found"},
+		{http.StatusRequestEntityTooLarge, "", "request_too_large", "Request Entity Too Large"},
+		{http.StatusTooManyRequests, `{"error":{"message":"slow down","type":"rate_limit"}}`, "rate_limit_error", "slow down"},
+		{http.StatusServiceUnavailable, "", "overloaded_error", "Service Unavailable"},
+		{529, "busy", "overloaded_error", "busy"},
+		{http.StatusBadGateway, "", "api_error", "Bad Gateway"},
+		{http.StatusInternalServerError, `{"error":{}}`, "api_error", `{"error":{}}`},
+	}
+	for _, tt := range tests {
+		result := gjson.ParseBytes(anthropicError(tt.status, []byte(tt.body)))
+		if "error" != result.Get("type").String() || tt.kind != result.Get("error.type").String() || tt.message != result.Get("error.message").String() {
+			t.Errorf("anthropicError(%d, %q) = %s, want %s %q", tt.status, tt.body, result.Raw, tt.kind, tt.message)
+		}
+	}
+}
+
+// TestAnthropicMessages检查/v1/messages把请求转换后发给上游，并把响应、流式事件和错误转换回Anthropic格式
+func TestAnthropicMessages(t *testing.T) {
+	var received []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(received), "limited"):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = io.WriteString(w, `{"error":{"message":"slow down"}}`)
+		case gjson.GetBytes(received, "stream").Bool():
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write(chatChunks(
+				`{"id":"chatcmpl-s","model":"deepseek-chat","choices":[{"delta":{"content":"Hi"},"finish_reason":"stop"}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":1}}`,
+				`[DONE]`,
+			))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"id":"chatcmpl-n","model":"deepseek-chat","choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`)
+		}
+	}))
+	defer upstream.Close()
+	_, proxy := newTestProxy(t, &config{ChatModelDefault: "deepseek-chat"}, upstream.URL)
+	header := map[string]string{featuresHeader: featureNoLocale}
+
+	status, _, body := postTest(t, proxy, "/v1/messages", `{"model":"claude","max_tokens":10,"system":"s","messages":[{"role":"user","content":"hello"}]}`, header)
+	if http.StatusOK != status || !sameJSON(t, []byte(body), `{"id":"msg_n","type":"message","role":"assistant","model":"deepseek-chat",
+		"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":3,"output_tokens":1}}`) {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	if want := `[{"role":"system","content":"s"},{"role":"user","content":"hello"}]`; !sameJSON(t, []byte(gjson.GetBytes(received, "messages").Raw), want) {
+		t.Errorf("upstream messages = %s, want %s", gjson.GetBytes(received, "messages").Raw, want)
+	}
+
+	status, _, body = postTest(t, proxy, "/v1/messages", `{"model":"claude","stream":true,"messages":[{"role":"user","content":"hello"}]}`, header)
+	if http.StatusOK != status {
+		t.Fatalf("stream status %d: %s", status, body)
+	}
+	if blocks, last := anthropicEvents(t, []byte(body)); !reflect.DeepEqual([]anthropicBlock{{Type: "text", Input: "Hi"}}, blocks) || "message_stop" != last.Get("type").String() {
+		t.Errorf("stream = %s", body)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		kind    string
+		message string
+	}{
+		{"invalid request", `{"model":"claude"}`, http.StatusBadRequest, "invalid_request_error", "messages: field required"},
+		{"upstream error", `{"model":"claude","messages":[{"role":"user","content":"limited"}]}`, http.StatusTooManyRequests, "rate_limit_error", "slow down"},
+	}
+	for _, tt := range tests {
+		status, _, body := postTest(t, proxy, "/v1/messages", tt.body, header)
+		result := gjson.Parse(body)
+		if tt.status != status || tt.kind != result.Get("error.type").String() || tt.message != result.Get("error.message").String() {
+			t.Errorf("%s: status %d: %s", tt.name, status, body)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// 根据地址识别出的上游类型，除azure外都通过各自的OpenAI兼容接口访问
+const (
+	detectedAnthropic = "anthropic"
+	detectedGemini    = "gemini"
+	detectedOllama    = "ollama"
+)
+
+// detectApiType根据上游地址的主机名推断上游类型，无法识别时返回空字符串
+func detectApiType(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if nil != err {
+		return ""
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case strings.HasSuffix(host, ".openai.azure.com"):
+		return apiTypeAzure
+	case "api.anthropic.com" == host:
+		return detectedAnthropic
+	case "generativelanguage.googleapis.com" == host:
+		return detectedGemini
+	case "11434" == u.Port():
+		return detectedOllama
+	}
+
+	return ""
+}
+
+// resolveChatApiType在未配置chat_api_type时根据chat_api_base推断上游类型，并检查该类型需要的配置
+func resolveChatApiType(cfg *config) error {
+	if "" != cfg.ChatApiType {
+		if err := checkApiType(cfg.ChatApiType); nil != err {
+			return fmt.Errorf("chat_api_type: %w", err)
+		}
+		return checkCompanionFields(cfg.ChatApiType, cfg)
+	}
+
+	detected := detectApiType(cfg.ChatApiBase)
+	if "" == detected {
+		return nil
+	}
+	log.Printf("chat_api_type is not set, detected %s from chat_api_base\n", detected)
+	if apiTypeAzure == detected {
+		cfg.ChatApiType = apiTypeAzure
+	}
+
+	return checkCompanionFields(detected, cfg)
+}
+
+// checkCompanionFields检查上游类型需要同时配置的字段，缺少时返回说明如何配置的错误
+func checkCompanionFields(apiType string, cfg *config) error {
+	base := strings.TrimSuffix(cfg.ChatApiBase, "#")
+	u, err := url.Parse(base)
+	if nil != err {
+		return fmt.Errorf("invalid chat_api_base: %w", err)
+	}
+
+	switch apiType {
+	case apiTypeAzure:
+		if !strings.Contains(u.Path, "/openai/deployments/") {
+			return fmt.Errorf("azure chat_api_base must include the deployment, e.g. https://NAME.openai.azure.com/openai/deployments/DEPLOYMENT; use chat_model_routes for models on other deployments")
+		}
+		if "" == u.Query().Get("api-version") && "" == cfg.ChatQueryParams["api-version"] {
+			return fmt.Errorf("azure requires api-version in chat_api_base or chat_query_params")
+		}
+	case detectedGemini:
+		if !strings.Contains(u.Path, "/openai") {
+			return fmt.Errorf("gemini chat_api_base must point at its OpenAI-compatible API, e.g. https://generativelanguage.googleapis.com/v1beta/openai")
+		}
+	case detectedAnthropic, detectedOllama:
+		if !strings.HasSuffix(strings.TrimRight(u.Path, "/"), "/v1") {
+			log.Printf("warning: %s chat_api_base usually ends with /v1 to use its OpenAI-compatible API\n", apiType)
+		}
+	}
+
+	return nil
+}
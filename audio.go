@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// passthroughHeaders是直接转发的接口返回给客户端的响应头
+var passthroughHeaders = []string{"Content-Type", "Content-Length", "Content-Disposition"}
+
+// audioApiBase返回音频接口的上游地址，未配置audio_api_base时使用chat_api_base
+func (s *ProxyService) audioApiBase() string {
+	if "" == s.cfg.AudioApiBase {
+		return s.cfg.ChatApiBase
+	}
+	return s.cfg.AudioApiBase
+}
+
+// audioTarget返回音频接口的上游，未配置audio_api_base和audio_api_key时使用Chat的配置
+func (s *ProxyService) audioTarget(path string) *upstreamTarget {
+	return &upstreamTarget{
+		name:         "audio",
+		url:          upstreamUrl(s.audioApiBase(), path),
+		keys:         s.audioKeys,
+		organization: s.cfg.ChatApiOrganization,
+		project:      s.cfg.ChatApiProject,
+	}
+}
+
+// audioModel返回audio_model_map映射后的模型，没有配置映射的模型原样使用
+func (s *ProxyService) audioModel(model string) string {
+	if mapped, ok := s.cfg.AudioModelMap[model]; ok {
+		return mapped
+	}
+	return model
+}
+
+// audioSpeech处理/v1/audio/speech请求，请求体是JSON，响应是音频
+func (s *ProxyService) audioSpeech(c *gin.Context) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	rec := s.stats.begin(c, "audio")
+	defer s.finishRecord(c, rec)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	rec.Model = gjson.GetBytes(body, "model").String()
+	rec.MappedModel = s.audioModel(rec.Model)
+	if rec.MappedModel != rec.Model {
+		body, _ = sjson.SetBytes(body, "model", rec.MappedModel)
+	}
+
+	target := s.audioTarget("/audio/speech")
+	target.forwarded = s.forwardedHeaders(c)
+	s.useTarget(c, rec, target)
+	resp, err := s.doUpstream(ctx, target, body)
+	s.relayPassthrough(c, target, resp, err)
+}
+
+// audioTranscriptions处理/v1/audio/transcriptions请求。上传的文件边读边转发，不在内存中缓存，
+// 因此被上游拒绝的密钥不能换密钥重试
+func (s *ProxyService) audioTranscriptions(c *gin.Context) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	rec := s.stats.begin(c, "audio")
+	defer s.finishRecord(c, rec)
+
+	mediaType, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if nil != err || !strings.HasPrefix(mediaType, "multipart/") || "" == params["boundary"] {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "request body must be multipart/form-data")
+		return
+	}
+
+	// 在另一个goroutine中改写model字段并写入管道，上游边读边发送
+	pr, pw := io.Pipe()
+	defer closeIO(pr)
+	form := multipart.NewWriter(pw)
+	models := make(chan [2]string, 1)
+	go func() {
+		pw.CloseWithError(s.rewriteAudioForm(multipart.NewReader(c.Request.Body, params["boundary"]), form, models))
+	}()
+
+	target := s.audioTarget("/audio/transcriptions")
+	target.forwarded = s.forwardedHeaders(c)
+	s.useTarget(c, rec, target)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.url, pr)
+	if nil != err {
+		abortWithError(c, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	key := target.keys.pick()
+	target.setHeaders(req, key)
+
+	resp, err := s.send(req)
+	if nil == err && (http.StatusUnauthorized == resp.StatusCode || http.StatusForbidden == resp.StatusCode) {
+		s.keyRejected(target.keys, key, resp.StatusCode)
+	}
+	select {
+	case model := <-models:
+		rec.Model, rec.MappedModel = model[0], model[1]
+	default:
+	}
+	s.relayPassthrough(c, target, resp, err)
+}
+
+// rewriteAudioForm把客户端的表单逐个字段复制到form，model字段按audio_model_map映射
+func (s *ProxyService) rewriteAudioForm(src *multipart.Reader, form *multipart.Writer, models chan<- [2]string) error {
+	for {
+		part, err := src.NextRawPart()
+		if io.EOF == err {
+			return form.Close()
+		}
+		if nil != err {
+			return err
+		}
+
+		if "model" == part.FormName() {
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			if nil != err {
+				return err
+			}
+			model := string(value)
+			mapped := s.audioModel(model)
+			select {
+			case models <- [2]string{model, mapped}:
+			default:
+			}
+			if err = form.WriteField("model", mapped); nil != err {
+				return err
+			}
+			continue
+		}
+
+		dst, err := form.CreatePart(part.Header)
+		if nil != err {
+			return err
+		}
+		if _, err = io.Copy(dst, part); nil != err {
+			return err
+		}
+	}
+}
+
+// relayPassthrough把音频、图片等接口的上游响应原样转发给客户端，二进制内容边读边发送
+func (s *ProxyService) relayPassthrough(c *gin.Context, target *upstreamTarget, resp *http.Response, err error) {
+	if nil != err {
+		switch kind, message := s.upstreamError(target.name, err); kind {
+		case upstreamCanceled:
+			c.AbortWithStatus(http.StatusRequestTimeout)
+		case upstreamTimeout:
+			abortWithError(c, http.StatusGatewayTimeout, "timeout_error", message)
+		default:
+			abortWithError(c, http.StatusBadGateway, "upstream_error", message)
+		}
+		return
+	}
+	defer closeIO(resp.Body)
+	s.recordRequestId(c, resp)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		sample := s.sanitizeLogBody(body)
+		logError("request %s failed: %s\n", s.label(target.name), sample)
+		s.upstreamFailed(target.name, sample)
+		setRecentError(c, sample)
+		c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		return
+	}
+	s.stats.recordUpstream(target.name, "")
+
+	for _, name := range passthroughHeaders {
+		if value := resp.Header.Get(name); "" != value {
+			c.Header(name, value)
+		}
+	}
+	c.Status(resp.StatusCode)
+	_, _ = io.Copy(flushWriter{c.Writer}, resp.Body)
+}
+
+// flushWriter每次写入后立即flush，让客户端尽早开始播放音频
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+// Write实现io.Writer
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+	return n, err
+}
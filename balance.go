@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// chat_balance的取值
+const (
+	balanceRoundRobin = "round_robin" // 轮流使用各个上游
+	balanceAffinity   = "affinity"    // 同一个对话固定使用同一个上游，以命中上游的前缀缓存
+)
+
+// backendCooldown是上游失败后不再被选中的时长
+const backendCooldown = 30 * time.Second
+
+// backendPool在chat_api_base和chat_api_bases之间分配聊天请求
+type backendPool struct {
+	bases []string // 所有上游的基础地址
+	mode  string   // 分配方式
+
+	mu       sync.Mutex
+	next     int
+	failedAt map[string]time.Time // 最近失败的上游及失败时间
+}
+
+// newBackendPool创建backendPool，没有配置chat_api_bases时返回nil
+func newBackendPool(cfg *config) (*backendPool, error) {
+	switch cfg.ChatBalance {
+	case "", balanceRoundRobin, balanceAffinity:
+	default:
+		return nil, fmt.Errorf("unsupported chat_balance: %s", cfg.ChatBalance)
+	}
+	if 0 == len(cfg.ChatApiBases) {
+		return nil, nil
+	}
+
+	pool := &backendPool{mode: cfg.ChatBalance, failedAt: make(map[string]time.Time)}
+	seen := make(map[string]bool)
+	for _, base := range append([]string{cfg.ChatApiBase}, cfg.ChatApiBases...) {
+		if "" == base || seen[base] {
+			continue
+		}
+		seen[base] = true
+		pool.bases = append(pool.bases, base)
+	}
+
+	return pool, nil
+}
+
+// healthy返回上游是否可用，调用方需持有锁
+func (p *backendPool) healthy(base string) bool {
+	failed, ok := p.failedAt[base]
+	return !ok || time.Since(failed) >= backendCooldown
+}
+
+// roundRobin轮流返回一个可用的上游，全部失败时仍按顺序返回，调用方需持有锁
+func (p *backendPool) roundRobin() string {
+	for i := 0; i < len(p.bases); i++ {
+		base := p.bases[(p.next+i)%len(p.bases)]
+		if p.healthy(base) {
+			p.next = (p.next + i + 1) % len(p.bases)
+			return base
+		}
+	}
+
+	base := p.bases[p.next]
+	p.next = (p.next + 1) % len(p.bases)
+	return base
+}
+
+// pick为对话conversation选择上游，返回选中的上游和是否按亲和性选中；conversation为空或对应的上游不可用时轮流选择
+func (p *backendPool) pick(conversation string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if balanceAffinity == p.mode && "" != conversation {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(conversation))
+		base := p.bases[h.Sum32()%uint32(len(p.bases))]
+		if p.healthy(base) {
+			return base, true
+		}
+	}
+
+	return p.roundRobin(), false
+}
+
+// result记录上游请求的结果，失败的上游在backendCooldown内不再被选中
+func (p *backendPool) result(base string, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if failed {
+		p.failedAt[base] = time.Now()
+	} else {
+		delete(p.failedAt, base)
+	}
+}
+
+// conversationId返回聊天请求所属对话的标识：优先使用copilot_thread_id，否则使用系统提示和第一条用户消息的哈希。
+// 需要在删除字段之前调用，copilot_thread_id被strip规则删除时也不会转发给上游
+func conversationId(body []byte) string {
+	if id := gjson.GetBytes(body, "copilot_thread_id").String(); "" != id {
+		return id
+	}
+
+	var system, user string
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		switch message.Get("role").String() {
+		case "system":
+			if "" == system {
+				system = messageText(message)
+			}
+		case "user":
+			if "" == user {
+				user = messageText(message)
+			}
+		}
+	}
+	if "" == system && "" == user {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(system + "\x00" + user))
+	return hex.EncodeToString(sum[:])
+}
+
+// balanceChat在配置了chat_api_bases时为使用chat_api_base的聊天请求选择上游，并把结果记录到访问日志
+func (s *ProxyService) balanceChat(rec *usageRecord, target *upstreamTarget, conversation string) {
+	if nil == s.backends {
+		return
+	}
+	if route, ok := s.cfg.ChatModelRoutes[target.route]; ok && "" != route.Url {
+		return
+	}
+
+	base, affine := s.backends.pick(conversation)
+	target.backend = base
+	target.url = withQuery(upstreamUrl(base, s.cfg.ChatApiPath), s.cfg.ChatQueryParams)
+
+	decision := "backend=" + redactUrl(base)
+	if balanceAffinity == s.backends.mode {
+		id := conversation
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		if affine {
+			decision += " affinity=" + id
+		} else {
+			decision += " affinity=" + id + " fallback=round_robin"
+			if "" != conversation {
+				log.Printf("affinity backend for %s is unhealthy, using %s\n", id, redactUrl(base))
+			}
+		}
+	}
+	rec.Backend = decision
+}
+
+// backendResult记录负载均衡选中的上游的请求结果，传输错误和5xx视为失败
+func (s *ProxyService) backendResult(target *upstreamTarget, status int, err error) {
+	if nil == s.backends || "" == target.backend || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	s.backends.result(target.backend, nil != err || status >= 500)
+}
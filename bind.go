@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultBind是没有配置bind时的监听地址，只接受本机的连接
+const defaultBind = "127.0.0.1:8181"
+
+// unixBindPrefix是unix socket监听地址的前缀
+const unixBindPrefix = "unix://"
+
+// parseBind校验监听地址，返回net.Listen使用的network和address。
+// 支持host:port、:port和unix:///path/to.sock
+func parseBind(key string, bind string) (string, string, error) {
+	if path, ok := strings.CutPrefix(bind, unixBindPrefix); ok {
+		if "" == path {
+			return "", "", fmt.Errorf("%s %q: missing socket path, expected unix:///path/to.sock", key, bind)
+		}
+		return "unix", path, nil
+	}
+
+	host, port, err := net.SplitHostPort(bind)
+	if nil != err {
+		// 只写了主机（如0.0.0.0）时提示加上端口
+		if host := strings.Trim(bind, "[]"); !strings.Contains(host, ":") || nil != net.ParseIP(host) {
+			return "", "", fmt.Errorf("%s %q: missing port, use %s", key, bind, net.JoinHostPort(host, "8181"))
+		}
+		return "", "", fmt.Errorf("%s %q: expected host:port, :port or unix:///path/to.sock", key, bind)
+	}
+	if number, err := strconv.Atoi(port); nil != err || number < 0 || number > 65535 {
+		return "", "", fmt.Errorf("%s %q: invalid port %q", key, bind, port)
+	}
+	if strings.ContainsAny(host, " /") {
+		return "", "", fmt.Errorf("%s %q: invalid host %q", key, bind, host)
+	}
+
+	return "tcp", bind, nil
+}
+
+// listenBind监听校验过的地址。unix socket文件已经存在时先删除，上次异常退出留下的文件不会导致监听失败
+func listenBind(network string, address string) (net.Listener, error) {
+	if "unix" == network {
+		if info, err := os.Stat(address); nil == err && 0 != info.Mode()&os.ModeSocket {
+			_ = os.Remove(address)
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+// listenAddr返回监听地址的可读形式
+func listenAddr(listener net.Listener) string {
+	if "unix" == listener.Addr().Network() {
+		return unixBindPrefix + listener.Addr().String()
+	}
+
+	return listener.Addr().String()
+}
+
+// logListening在开始监听后记录实际的监听地址和协议
+func logListening(name string, listener net.Listener, h2c bool) {
+	protocol := "http/1.1"
+	if h2c {
+		protocol += "+h2c"
+	}
+	if _, ok := listener.(*proxyListener); ok {
+		protocol += ", proxy protocol"
+	}
+	log.Printf("%s listening on %s (tls: off, %s)\n", name, listenAddr(listener), protocol)
+}
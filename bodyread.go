@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 未配置时读取请求头和请求体的最长时间
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultBodyReadTimeout   = 30 * time.Second
+)
+
+// errSlowBody表示客户端没有在body_read_timeout_seconds内发完请求体
+var errSlowBody = errors.New("request body not received in time")
+
+// configTimeout把秒数配置转换为时长：0使用默认值，负数为不限制
+func configTimeout(seconds int, fallback time.Duration) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case 0 == seconds:
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// deadlineBody在请求体读完或出错时清除连接的读取期限，之后连接上的读取（例如检测客户端断开）不受影响
+type deadlineBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	cleared bool
+	onSlow  func()
+}
+
+// Read实现io.Reader，超过期限时返回errSlowBody
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if nil == err {
+		return n, nil
+	}
+
+	// 超时后保留已经过期的期限，net/http丢弃剩余的请求体时不会再等待客户端，响应后关闭连接
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b.cleared = true
+		b.onSlow()
+		return n, errSlowBody
+	}
+	b.clear()
+	return n, err
+}
+
+// clear清除读取期限，请求体超时后不再清除
+func (b *deadlineBody) clear() {
+	if !b.cleared {
+		b.cleared = true
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+}
+
+// bodyDeadline是限制读取请求体时间的中间件，客户端长时间不发完请求体时读取返回errSlowBody。
+// 音频转写的上传边读边转发，不受限制
+func (s *ProxyService) bodyDeadline(c *gin.Context) {
+	timeout := configTimeout(s.cfg.BodyReadTimeout, defaultBodyReadTimeout)
+	if 0 == timeout || http.MethodPost != c.Request.Method || strings.HasSuffix(c.Request.URL.Path, "/audio/transcriptions") {
+		return
+	}
+
+	// 连接不支持设置期限时（例如HTTP/2）不限制
+	rc := http.NewResponseController(c.Writer)
+	if err := rc.SetReadDeadline(time.Now().Add(timeout)); nil != err {
+		return
+	}
+
+	body := &deadlineBody{ReadCloser: c.Request.Body, rc: rc, onSlow: func() {
+		c.Header("Connection", "close")
+		log.Printf("slow client %s: %s request body not received within %s\n", c.ClientIP(), c.Request.URL.Path, timeout)
+		s.metrics.inc("override_slow_body_total")
+	}}
+	c.Request.Body = body
+	c.Next()
+	body.clear()
+}
+
+// bodyReadStatus返回读取请求体失败时的状态码：客户端发送太慢为408，其他为400
+func bodyReadStatus(err error) int {
+	if errors.Is(err, errSlowBody) {
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
+}
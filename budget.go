@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// budgetStep是budget_downgrade中的一级：当天的花费达到daily_budget的percent时改用model或拒绝聊天请求
+type budgetStep struct {
+	Percent float64 `json:"percent"` // daily_budget的百分比
+	Model   string  `json:"model"`   // 改用的模型
+	Block   bool    `json:"block"`   // 拒绝聊天请求
+}
+
+// budgetTracker统计当天（UTC）的花费，按budget_downgrade决定聊天请求是否降级。
+// 花费在请求结束时累加，检查时只比较缓存的值，不查询数据库
+type budgetTracker struct {
+	limit float64
+	steps []budgetStep // 按percent从高到低排列
+
+	mu    sync.Mutex
+	day   int64 // spent所属的UTC日期
+	spent float64
+}
+
+// newBudgetTracker创建budgetTracker，未配置budget_downgrade时返回nil。配置了stats_db时从中读取当天已有的花费
+func newBudgetTracker(cfg *config, db *statsDB) (*budgetTracker, error) {
+	if 0 == len(cfg.BudgetDowngrade) {
+		return nil, nil
+	}
+	if cfg.DailyBudget <= 0 {
+		return nil, errors.New("budget_downgrade requires a positive daily_budget")
+	}
+	for i, step := range cfg.BudgetDowngrade {
+		if step.Percent <= 0 {
+			return nil, fmt.Errorf("budget_downgrade[%d]: percent must be positive", i)
+		}
+		if "" == step.Model && !step.Block {
+			return nil, fmt.Errorf("budget_downgrade[%d]: model or block is required", i)
+		}
+	}
+
+	t := &budgetTracker{limit: cfg.DailyBudget, steps: slices.Clone(cfg.BudgetDowngrade)}
+	slices.SortFunc(t.steps, func(a, b budgetStep) int {
+		switch {
+		case a.Percent > b.Percent:
+			return -1
+		case a.Percent < b.Percent:
+			return 1
+		}
+		return 0
+	})
+
+	now := time.Now()
+	t.day = budgetDay(now)
+	if nil != db {
+		rows, err := db.query(context.Background(), time.Unix(t.day*86400, 0), time.Time{}, nil)
+		if nil != err {
+			return nil, fmt.Errorf("read today's spend from stats_db: %w", err)
+		}
+		for _, row := range rows {
+			t.spent += row["cost"].(float64)
+		}
+	}
+
+	return t, nil
+}
+
+// budgetDay返回t所在的UTC日期
+func budgetDay(t time.Time) int64 {
+	return t.Unix() / 86400
+}
+
+// add在请求结束时计入花费
+func (t *budgetTracker) add(cost float64) {
+	if nil == t || cost <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if day := budgetDay(time.Now()); day != t.day {
+		t.day, t.spent = day, 0
+	}
+	t.spent += cost
+}
+
+// current返回当天花费达到的最高一级和花费，没有达到任何一级时返回nil
+func (t *budgetTracker) current() (*budgetStep, float64) {
+	if nil == t {
+		return nil, 0
+	}
+
+	t.mu.Lock()
+	spent := t.spent
+	if budgetDay(time.Now()) != t.day {
+		spent = 0
+	}
+	t.mu.Unlock()
+
+	percent := spent / t.limit * 100
+	for i := range t.steps {
+		if percent >= t.steps[i].Percent {
+			return &t.steps[i], spent
+		}
+	}
+
+	return nil, spent
+}
+
+// budgetModel按当天的花费决定聊天请求使用的模型，返回的model为空表示拒绝请求；
+// 没有达到任何一级、已经使用降级的模型或原样转发请求体时原样返回
+func (s *ProxyService) budgetModel(model string) (string, bool) {
+	step, spent := s.budget.current()
+	if nil == step {
+		return model, false
+	}
+	if step.Block {
+		reason := fmt.Sprintf("daily spend %.4f reached %g%% of daily_budget %g", spent, step.Percent, s.cfg.DailyBudget)
+		log.Println("chat request blocked:", reason)
+		s.alerter.recordExhausted(alertBudgetExceeded, "", reason)
+		return "", true
+	}
+	if step.Model == model || s.cfg.ChatRawPassthrough {
+		return model, false
+	}
+
+	log.Printf("chat request downgraded from %s to %s: daily spend %.4f reached %g%% of daily_budget %g\n", model, step.Model, spent, step.Percent, s.cfg.DailyBudget)
+	return step.Model, true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/tidwall/sjson"
+)
+
+// 超过这个大小的缓冲区不放回bufferPool，避免偶尔的大请求长期占用内存
+const maxPooledBuffer = 1 << 20
+
+// bufferPool复用读取请求体的缓冲区
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// inPlace让sjson在新值不比旧值长时直接修改原来的切片，不再分配新的请求体
+var inPlace = &sjson.Options{Optimistic: true, ReplaceInPlace: true}
+
+// readBody把r读入从bufferPool取出的缓冲区，返回的切片只在调用release之前有效。release之后缓冲区会被其他请求复用，
+// 不能保留返回的切片，也不能交给release之后仍在运行的goroutine，需要时先用bytes.Clone复制
+func readBody(r io.Reader) ([]byte, func(), error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	_, err := buf.ReadFrom(r)
+
+	release := func() {
+		if buf.Cap() <= maxPooledBuffer {
+			bufferPool.Put(buf)
+		}
+	}
+
+	return buf.Bytes(), release, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// codexBenchBody是一个典型的代码补全请求：几KB的prompt和suffix以及Copilot常带的参数
+func codexBenchBody() []byte {
+	prompt := "// Path: src/server/handler.go\npackage server\n\n" + strings.Repeat("func handle(w http.ResponseWriter, r *http.Request) {\n\tw.WriteHeader(200)\n}\n\n", 60)
+	suffix := strings.Repeat("\n// TODO: more handlers\n", 20)
+	return []byte(`{"prompt":` + jsonString(prompt) + `,"suffix":` + jsonString(suffix) +
+		`,"max_tokens":500,"temperature":0,"top_p":1,"n":1,"stop":["\n\n"],"stream":true,"extra":{"language":"go","next_indent":0,"trim_by_indentation":true}}`)
+}
+
+// jsonString把s编码为JSON字符串
+func jsonString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+func TestReadBody(t *testing.T) {
+	body := codexBenchBody()
+	got, release, err := readBody(bytes.NewReader(body))
+	if nil != err || !bytes.Equal(body, got) {
+		t.Fatalf("readBody = %d bytes, %v", len(got), err)
+	}
+	release()
+
+	// 归还后缓冲区会被下一次读取复用，之前返回的切片不能再使用
+	again, release, err := readBody(strings.NewReader("{}"))
+	if nil != err || "{}" != string(again) {
+		t.Fatalf("readBody = %q, %v", again, err)
+	}
+	release()
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	body := codexBenchBody()
+	b.Run("ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadAll(bytes.NewReader(body)); nil != err {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			_, release, err := readBody(bytes.NewReader(body))
+			if nil != err {
+				b.Fatal(err)
+			}
+			release()
+		}
+	})
+}
+
+// BenchmarkCodexPipeline测量代码补全请求从读取请求体、转换到创建上游请求的开销
+func BenchmarkCodexPipeline(b *testing.B) {
+	s, _ := newTestProxy(b, &config{}, "http://127.0.0.1:1")
+	target := s.codexTarget()
+	body := codexBenchBody()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		read, release, err := readBody(bytes.NewReader(body))
+		if nil != err {
+			b.Fatal(err)
+		}
+		transformed, _, _ := s.transformCodex(read)
+		if _, err = target.newRequest(context.Background(), transformed, "sk-codex-test"); nil != err {
+			b.Fatal(err)
+		}
+		release()
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// 自检结果
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// checkResult是自检表格中的一行
+type checkResult struct {
+	name    string
+	result  string
+	elapsed time.Duration
+	detail  string
+}
+
+// checker依次执行自检并收集结果
+type checker struct {
+	s       *ProxyService
+	results []checkResult
+}
+
+// add记录一项自检结果
+func (k *checker) add(name string, result string, elapsed time.Duration, detail string) {
+	k.results = append(k.results, checkResult{name: name, result: result, elapsed: elapsed, detail: detail})
+}
+
+// failed返回是否有自检失败
+func (k *checker) failed() bool {
+	for _, r := range k.results {
+		if checkFail == r.result {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorText返回隐藏了密钥的错误信息
+func (k *checker) errorText(err error) string {
+	return k.s.sanitizeLogBody([]byte(err.Error()))
+}
+
+// runCheck执行check子命令：读取配置，检查代理、各上游的连通性和密钥以及模型映射，输出结果表格，有失败项时返回1
+func runCheck() int {
+	cfg := readConfig()
+	k := &checker{s: &ProxyService{cfg: cfg}}
+
+	client, err := getClient(cfg)
+	if nil == err {
+		err = resolveChatApiType(cfg)
+	}
+	if nil == err {
+		_, err = inheritChat(cfg)
+	}
+	var routeKeys map[string]*keyPool
+	if nil == err {
+		routeKeys, err = newRouteKeys(cfg)
+	}
+	var tokens *tokenSource
+	if nil == err {
+		tokens, err = newTokenSource(cfg, client)
+	}
+	if nil != err {
+		k.add("config", checkFail, 0, k.errorText(cfg.sources.describeError(err)))
+		k.print(os.Stdout)
+		return 1
+	}
+	if "" != cfg.sources.routesFile {
+		k.add("config", checkPass, 0, "config.json, "+cfg.sources.routesFile)
+	} else {
+		k.add("config", checkPass, 0, "config.json")
+	}
+
+	k.s.client = client
+	k.s.chatKeys = newKeyPool("chat", cfg.ChatApiKey, cfg.ChatApiKeys, cfg.BadKeyCooldown)
+	k.s.codexKeys = newKeyPool("codex", cfg.CodexApiKey, cfg.CodexApiKeys, cfg.BadKeyCooldown)
+	k.s.routeKeys = routeKeys
+	k.s.tokens = tokens
+
+	if "" != cfg.ProxyUrl {
+		k.checkProxy(cfg.ProxyUrl)
+	}
+	if "" == cfg.ChatApiBase {
+		k.add("chat", checkWarn, 0, "disabled: chat_api_base is empty")
+	} else {
+		k.checkUpstream(k.s.chatTarget(cfg.ChatModelDefault), pingChatBody(cfg.ChatModelDefault))
+	}
+	for _, model := range sortedKeys(cfg.ChatModelRoutes) {
+		if target := k.s.chatTarget(model); !k.s.chatDisabled(target) {
+			k.checkUpstream(target, pingChatBody(model))
+		}
+	}
+	if "" == cfg.CodexApiBase {
+		k.add("codex", checkWarn, 0, "disabled: codex_api_base is empty")
+	} else {
+		k.checkUpstream(k.s.codexTarget(), pingCodexBody())
+	}
+	if "" != cfg.ChatApiBase {
+		k.checkModels()
+	}
+
+	k.print(os.Stdout)
+	if k.failed() {
+		return 1
+	}
+
+	return 0
+}
+
+// checkProxy检查能否与代理建立TCP连接
+func (k *checker) checkProxy(proxyUrl string) {
+	u, err := url.Parse(proxyUrl)
+	if nil != err {
+		k.add("proxy", checkFail, 0, k.errorText(err))
+		return
+	}
+
+	host := u.Host
+	if "" == u.Port() {
+		port := "80"
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if nil != err {
+		k.add("proxy", checkFail, time.Since(start), k.errorText(err))
+		return
+	}
+	closeIO(conn)
+	k.add("proxy", checkPass, time.Since(start), redactUrl(proxyUrl))
+}
+
+// phaseTimer记录一次请求中DNS、TCP和TLS各阶段的耗时和错误，同一阶段以第一次成功或最后一次失败为准
+type phaseTimer struct {
+	mu     sync.Mutex
+	starts map[string]time.Time
+	done   map[string]checkResult
+	reused bool
+}
+
+// start记录阶段开始的时间
+func (p *phaseTimer) start(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.starts[phase]; !ok {
+		p.starts[phase] = time.Now()
+	}
+}
+
+// finish记录阶段的结果
+func (p *phaseTimer) finish(phase string, detail string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if prev, ok := p.done[phase]; ok && checkPass == prev.result {
+		return
+	}
+	result := checkResult{result: checkPass, elapsed: time.Since(p.starts[phase]), detail: detail}
+	if nil != err {
+		result.result, result.detail = checkFail, err.Error()
+	}
+	p.done[phase] = result
+}
+
+// trace返回记录各阶段的httptrace.ClientTrace
+func (p *phaseTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { p.start("dns") },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			addrs := make([]string, 0, len(info.Addrs))
+			for _, addr := range info.Addrs {
+				addrs = append(addrs, addr.String())
+			}
+			p.finish("dns", fmt.Sprint(addrs), info.Err)
+		},
+		ConnectStart: func(string, string) { p.start("tcp") },
+		ConnectDone: func(network string, addr string, err error) {
+			p.finish("tcp", addr, err)
+		},
+		TLSHandshakeStart: func() { p.start("tls") },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			p.finish("tls", tlsDetail(state), err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.mu.Lock()
+			p.reused = info.Reused
+			p.mu.Unlock()
+		},
+	}
+}
+
+// tlsDetail返回TLS版本和协商的应用层协议
+func tlsDetail(state tls.ConnectionState) string {
+	detail := tls.VersionName(state.Version)
+	if "" != state.NegotiatedProtocol {
+		detail += " " + state.NegotiatedProtocol
+	}
+
+	return detail
+}
+
+// checkUpstream用最小的请求检查上游的连通性和密钥
+func (k *checker) checkUpstream(target *upstreamTarget, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	timer := &phaseTimer{starts: make(map[string]time.Time), done: make(map[string]checkResult)}
+	ctx = httptrace.WithClientTrace(ctx, timer.trace())
+
+	key, err := target.credential(ctx)
+	if nil != err {
+		k.add(target.name, checkFail, 0, k.errorText(err))
+		return
+	}
+	req, err := target.newRequest(ctx, body, key)
+	if nil != err {
+		k.add(target.name, checkFail, 0, k.errorText(err))
+		return
+	}
+
+	start := time.Now()
+	resp, err := k.s.send(req)
+	elapsed := time.Since(start)
+
+	timer.mu.Lock()
+	for _, phase := range []string{"dns", "tcp", "tls"} {
+		if result, ok := timer.done[phase]; ok {
+			k.add(target.name+" "+phase, result.result, result.elapsed, k.s.sanitizeLogBody([]byte(result.detail)))
+		}
+	}
+	if timer.reused {
+		k.add(target.name+" connect", checkPass, 0, "reused connection")
+	}
+	timer.mu.Unlock()
+
+	name := target.name + " request"
+	if nil != err {
+		k.add(name, checkFail, elapsed, k.errorText(err))
+		return
+	}
+	defer closeIO(resp.Body)
+
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	detail := fmt.Sprintf("%s key %s HTTP %d", redactUrl(target.url), redactSecret(key), resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		k.add(name, checkPass, elapsed, detail)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		k.add(name, checkFail, elapsed, detail+": credentials rejected: "+k.s.sanitizeLogBody(content))
+	default:
+		k.add(name, checkFail, elapsed, detail+": "+k.s.sanitizeLogBody(content))
+	}
+}
+
+// checkModels检查Chat上游的模型列表中是否有模型映射的目标，上游不提供/models时只给出警告
+func (k *checker) checkModels() {
+	start := time.Now()
+	models, err := k.s.fetchModels()
+	if nil != err {
+		k.add("chat models", checkWarn, time.Since(start), k.errorText(err))
+		return
+	}
+	k.add("chat models", checkPass, time.Since(start), fmt.Sprintf("%d models", len(models)))
+
+	k.s.checkModelTargets(models, func(name string, model string) {
+		k.add(name, checkWarn, 0, model+" is not in the upstream model list")
+	})
+}
+
+// print输出自检结果表格
+func (k *checker) print(w io.Writer) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "CHECK\tRESULT\tTIME\tDETAIL")
+
+	counts := make(map[string]int)
+	for _, r := range k.results {
+		elapsed := "-"
+		if r.elapsed > 0 {
+			elapsed = r.elapsed.Round(100 * time.Microsecond).String()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", r.name, r.result, elapsed, r.detail)
+		counts[r.result]++
+	}
+	_ = table.Flush()
+
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed\n", counts[checkPass], counts[checkWarn], counts[checkFail])
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// coalescedResponse是领头请求拿到的上游响应，等待同一请求的其他请求直接使用
+type coalescedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// chatFlight是一个进行中的非流式聊天请求
+type chatFlight struct {
+	done     chan struct{}
+	response *coalescedResponse // 领头请求没有拿到上游响应时为nil
+	waiters  int
+}
+
+// chatCoalescer合并进行中的相同聊天请求：非流式请求只向上游发送一次，流式请求只记录重复
+type chatCoalescer struct {
+	mu      sync.Mutex
+	flights map[string]*chatFlight
+	streams map[string]int // 进行中的流式请求数
+}
+
+// newChatCoalescer创建chatCoalescer，未开启chat_coalesce时返回nil
+func newChatCoalescer(cfg *config) *chatCoalescer {
+	if !cfg.ChatCoalesce {
+		return nil
+	}
+
+	return &chatCoalescer{flights: make(map[string]*chatFlight), streams: make(map[string]int)}
+}
+
+// coalesceKey根据客户端、上游地址和转换后的请求体计算请求的key，不同客户端的请求不会合并
+func coalesceKey(c *gin.Context, url string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(tenantOf(c) + "\x00" + url + "\x00"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// coalesceTicket是一个请求在chatCoalescer中的登记，方法对nil安全
+type coalesceTicket struct {
+	k      *chatCoalescer
+	key    string
+	flight *chatFlight // 领头请求登记的请求，其他情况为nil
+	stream bool
+	once   sync.Once
+}
+
+// publish在领头请求拿到上游响应后调用，把响应交给等待的请求
+func (t *coalesceTicket) publish(response *coalescedResponse) {
+	if nil == t || nil == t.flight {
+		return
+	}
+
+	t.once.Do(func() {
+		t.k.mu.Lock()
+		delete(t.k.flights, t.key)
+		t.k.mu.Unlock()
+
+		t.flight.response = response
+		close(t.flight.done)
+	})
+}
+
+// finish在请求结束时调用：领头请求没有拿到响应时让等待的请求各自请求上游，流式请求减少计数
+func (t *coalesceTicket) finish() {
+	if nil == t {
+		return
+	}
+
+	if t.stream {
+		t.once.Do(func() {
+			t.k.mu.Lock()
+			if t.k.streams[t.key]--; t.k.streams[t.key] <= 0 {
+				delete(t.k.streams, t.key)
+			}
+			t.k.mu.Unlock()
+		})
+		return
+	}
+	t.publish(nil)
+}
+
+// coalesceChat在开启chat_coalesce时合并相同的聊天请求，需要在排队之前调用。
+// 已有相同的非流式请求在进行时等待它的响应并直接返回给客户端，此时第二个返回值为true；
+// 否则返回的登记需要在拿到上游响应后publish，并在请求结束时finish
+func (s *ProxyService) coalesceChat(ctx context.Context, c *gin.Context, target *upstreamTarget, body []byte, cancel context.CancelFunc) (*coalesceTicket, bool) {
+	k := s.coalescer
+	if nil == k {
+		return nil, false
+	}
+	key := coalesceKey(c, target.url, body)
+
+	// 流式响应边生成边转发，无法合并，只记录重复的请求
+	if gjson.GetBytes(body, "stream").Bool() {
+		k.mu.Lock()
+		k.streams[key]++
+		count := k.streams[key]
+		k.mu.Unlock()
+		if count > 1 {
+			log.Printf("WARNING: %d identical streaming chat requests in flight (%s)\n", count, key[:12])
+			s.metrics.inc("override_chat_duplicates_total", "stream", "true")
+		}
+		return &coalesceTicket{k: k, key: key, stream: true}, false
+	}
+
+	k.mu.Lock()
+	flight, ok := k.flights[key]
+	if !ok {
+		flight = &chatFlight{done: make(chan struct{})}
+		k.flights[key] = flight
+		k.mu.Unlock()
+		return &coalesceTicket{k: k, key: key, flight: flight}, false
+	}
+	flight.waiters++
+	waiters := flight.waiters
+	k.mu.Unlock()
+
+	log.Printf("coalescing identical chat request (%s), %d waiting\n", key[:12], waiters)
+	s.metrics.inc("override_chat_duplicates_total", "stream", "false")
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		c.AbortWithStatus(http.StatusRequestTimeout)
+		return nil, true
+	}
+
+	// 领头请求失败时各自请求上游
+	response := flight.response
+	if nil == response {
+		return nil, false
+	}
+
+	c.Header("X-Override-Coalesced", "true")
+	c.Status(response.status)
+	if "" != response.contentType {
+		c.Header("Content-Type", response.contentType)
+	}
+	s.relayBody(c, "chat", response.contentType, bytes.NewReader(response.body), cancel)
+	return nil, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestCoalesceLeaderReadError检查领头请求读取上游响应体失败时返回错误，等待的相同请求各自请求上游，
+// 而不是拿到不完整的响应
+func TestCoalesceLeaderReadError(t *testing.T) {
+	request := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+	complete := `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`
+	var attempts atomic.Int32
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if 1 == attempts.Add(1) {
+			close(arrived)
+			<-release
+			// 声明完整的长度，只发送一半就断开连接
+			w.Header().Set("Content-Length", "1000")
+			_, _ = io.WriteString(w, complete[:len(complete)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = io.WriteString(w, complete)
+	}))
+	defer upstream.Close()
+
+	s, proxy := newTestProxy(t, &config{ChatCoalesce: true}, upstream.URL)
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	post := func() <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			resp, err := proxy.Client().Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(request))
+			if nil != err {
+				done <- result{err: err}
+				return
+			}
+			defer closeIO(resp.Body)
+			body, err := io.ReadAll(resp.Body)
+			done <- result{resp.StatusCode, string(body), err}
+		}()
+		return done
+	}
+
+	leader := post()
+	<-arrived
+	waiter := post()
+	waitFor(t, func() bool {
+		s.coalescer.mu.Lock()
+		defer s.coalescer.mu.Unlock()
+		for _, flight := range s.coalescer.flights {
+			return 1 == flight.waiters
+		}
+		return false
+	})
+	close(release)
+
+	first := <-leader
+	if nil != first.err || http.StatusBadGateway != first.status {
+		t.Fatalf("leader: status = %d, err = %v: %s", first.status, first.err, first.body)
+	}
+	second := <-waiter
+	if nil != second.err || http.StatusOK != second.status || !strings.Contains(second.body, `"content":"ok"`) {
+		t.Fatalf("waiter: status = %d, err = %v: %s", second.status, second.err, second.body)
+	}
+	if 2 != attempts.Load() {
+		t.Fatalf("upstream attempts = %d, want 2", attempts.Load())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// acceptsGzip判断客户端是否接受gzip编码
+func acceptsGzip(c *gin.Context) bool {
+	for _, part := range strings.Split(c.GetHeader("Accept-Encoding"), ",") {
+		encoding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(encoding), "gzip") {
+			continue
+		}
+
+		return strings.ReplaceAll(params, " ", "") != "q=0"
+	}
+
+	return false
+}
+
+// upstreamEncoding返回原样转发时上游响应的Content-Encoding，此时net/http没有解压响应体。
+// 不是原样转发或上游没有压缩时为空
+func upstreamEncoding(target *upstreamTarget, resp *http.Response) string {
+	encoding := resp.Header.Get("Content-Encoding")
+	if !target.raw || resp.Uncompressed || strings.EqualFold(encoding, "identity") {
+		return ""
+	}
+	return encoding
+}
+
+// relayBody把上游响应体转发给客户端，客户端接受gzip且响应体超过gzip_min_size时压缩，SSE流不压缩。
+// 已经设置了Content-Encoding（原样转发上游压缩的响应）时不解析也不再压缩
+func (s *ProxyService) relayBody(c *gin.Context, endpoint string, contentType string, src io.Reader, cancel context.CancelFunc) {
+	if "" != c.Writer.Header().Get("Content-Encoding") {
+		s.relayEncoded(c, endpoint, src, cancel)
+		return
+	}
+
+	// SSE流每读到一个事件都立即发送给客户端
+	if isEventStream(contentType) {
+		s.relayStream(c, endpoint, src, cancel)
+		return
+	}
+
+	// 非流式响应超过max_response_bytes时不转发，返回502
+	if limit := s.cfg.MaxResponseBytes; limit > 0 {
+		body, _ := io.ReadAll(io.LimitReader(src, int64(limit)+1))
+		if len(body) > limit {
+			cancel()
+			logError("%s response dropped: exceeded max_response_bytes (%d)\n", endpoint, limit)
+			abortWithError(c, http.StatusBadGateway, "upstream_error", fmt.Sprintf("upstream response exceeds max_response_bytes (%d)", limit))
+			return
+		}
+		src = bytes.NewReader(body)
+	}
+
+	// 统一各上游的finish_reason和logprobs
+	if strings.Contains(contentType, "json") {
+		body, _ := io.ReadAll(src)
+		if !featuresOf(c).has(featureRawFinish) {
+			if normalized := s.normalizeChoices(body, false); nil != normalized {
+				body = normalized
+			}
+		}
+		if rewritten := s.rewriteLogprobs(endpoint, body); nil != rewritten {
+			body = rewritten
+		}
+		src = bytes.NewReader(body)
+	}
+
+	minSize := s.cfg.GzipMinSize
+	if minSize <= 0 || !acceptsGzip(c) {
+		_, _ = io.Copy(c.Writer, src)
+		return
+	}
+
+	// 先读取阈值大小的内容，不足阈值时原样返回
+	buf := make([]byte, minSize)
+	n, err := io.ReadFull(src, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		_, _ = c.Writer.Write(buf[:n])
+		return
+	}
+
+	c.Writer.Header().Del("Content-Length")
+	c.Header("Content-Encoding", "gzip")
+	c.Header("Vary", "Accept-Encoding")
+
+	gz := gzip.NewWriter(c.Writer)
+	if _, err = gz.Write(buf[:n]); nil == err {
+		_, _ = io.Copy(gz, src)
+	}
+	closeIO(gz)
+}
+
+// relayEncoded原样转发压缩的响应体，每次读到内容都立即发送，压缩的流式响应不会被缓冲。
+// 超过max_response_bytes（按压缩后的大小）时断开
+func (s *ProxyService) relayEncoded(c *gin.Context, endpoint string, src io.Reader, cancel context.CancelFunc) {
+	buf := make([]byte, 32<<10)
+	written := 0
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			written += n
+			if limit := s.cfg.MaxResponseBytes; limit > 0 && written > limit {
+				cancel()
+				logError("%s response truncated: exceeded max_response_bytes (%d)\n", endpoint, limit)
+				return
+			}
+			if _, err := c.Writer.Write(buf[:n]); nil != err {
+				return
+			}
+			c.Writer.Flush()
+		}
+		if nil != err {
+			return
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipBytes压缩content
+func gzipBytes(t *testing.T, content string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(content)); nil != err {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); nil != err {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gunzipString解压content
+func gunzipString(t *testing.T, content string) string {
+	t.Helper()
+
+	gz, err := gzip.NewReader(strings.NewReader(content))
+	if nil != err {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(gz)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0", false},
+		{"br, deflate", false},
+	}
+	for _, tt := range tests {
+		c, _ := newTestContext(http.MethodPost, "/", nil)
+		c.Request.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(c); tt.want != got {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestChatResponseGzip(t *testing.T) {
+	large := `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"` +
+		strings.Repeat("func main() {}\\n", 200) + `"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}`
+	small := `{"id":"chatcmpl-2","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`
+	stream := "data: {\"id\":\"chatcmpl-3\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"" + strings.Repeat("x", 2000) + "\"}}]}\n\ndata: [DONE]\n\n"
+
+	tests := []struct {
+		name           string
+		contentType    string
+		upstream       string
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"large json", "application/json", large, "gzip", true},
+		{"client without gzip", "application/json", large, "", false},
+		{"gzip refused", "application/json", large, "gzip;q=0", false},
+		{"below gzip_min_size", "application/json", small, "gzip", false},
+		{"event stream", "text/event-stream", stream, "gzip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				_, _ = io.WriteString(w, tt.upstream)
+			}))
+			defer upstream.Close()
+
+			_, proxy := newTestProxy(t, &config{GzipMinSize: 1024}, upstream.URL)
+			header := map[string]string{"Accept-Encoding": tt.acceptEncoding}
+			status, respHeader, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, header)
+			if http.StatusOK != status {
+				t.Fatalf("status = %d, body %s", status, body)
+			}
+			if gzipped := "gzip" == respHeader.Get("Content-Encoding"); tt.gzipped != gzipped {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", respHeader.Get("Content-Encoding"), tt.gzipped)
+			}
+			if tt.gzipped {
+				body = gunzipString(t, body)
+				if "Accept-Encoding" != respHeader.Get("Vary") {
+					t.Errorf("Vary = %q, want Accept-Encoding", respHeader.Get("Vary"))
+				}
+			}
+			if !strings.Contains(body, `"chatcmpl-`) {
+				t.Fatalf("unexpected body %q", body)
+			}
+			if !isEventStream(tt.contentType) && len(tt.upstream) != len(body) {
+				t.Errorf("client got %d bytes, want %d", len(body), len(tt.upstream))
+			}
+		})
+	}
+}
+
+// TestChatErrorResponseGzip检查记录错误时读取过的响应体仍然完整地压缩后返回给客户端，上游压缩的响应体先解压再记录
+func TestChatErrorResponseGzip(t *testing.T) {
+	message := `{"error":{"message":"` + strings.Repeat("context length exceeded. ", 100) + `","type":"invalid_request_error"}}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(gzipBytes(t, message))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, message)
+	}))
+	defer upstream.Close()
+
+	s, proxy := newTestProxy(t, &config{GzipMinSize: 1024}, upstream.URL)
+	header := map[string]string{"Accept-Encoding": "gzip"}
+	status, respHeader, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, header)
+	if http.StatusBadRequest != status {
+		t.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if "gzip" != respHeader.Get("Content-Encoding") {
+		t.Fatalf("Content-Encoding = %q, want gzip", respHeader.Get("Content-Encoding"))
+	}
+	if got := gunzipString(t, body); message != got {
+		t.Fatalf("client got %q, want the full upstream error", got)
+	}
+
+	waitFor(t, func() bool { return len(s.recent.entries()) > 0 })
+	if logged := s.recent.entries()[0].Error; !strings.HasPrefix(logged, `{"error":{"message":"context length exceeded.`) {
+		t.Fatalf("logged error is not the decoded body: %q", logged)
+	}
+}
+
+// TestRawPassthroughEncoding检查原样转发时客户端的Accept-Encoding转发给上游，上游压缩的响应体和Content-Encoding
+// 原样返回，不解压也不再次压缩；客户端不接受压缩时由net/http解压
+func TestRawPassthroughEncoding(t *testing.T) {
+	chat := `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"` +
+		strings.Repeat("func main() {}\\n", 200) + `"},"finish_reason":"stop"}]}`
+	codex := "data: {\"id\":\"cmpl-1\",\"object\":\"text_completion\",\"choices\":[{\"index\":0,\"text\":\"" + strings.Repeat("x", 2000) + "\"}]}\n\ndata: [DONE]\n\n"
+
+	tests := []struct {
+		name           string
+		path           string
+		request        string
+		contentType    string
+		upstream       string
+		acceptEncoding string
+	}{
+		{"chat", "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, "application/json", chat, "gzip"},
+		{"codex stream", "/v1/engines/copilot-codex/completions", `{"prompt":"func main() {","stream":true}`, "text/event-stream", codex, "gzip"},
+		{"client without gzip", "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, "application/json", chat, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := gzipBytes(t, tt.upstream)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if "" != tt.acceptEncoding && tt.acceptEncoding != r.Header.Get("Accept-Encoding") {
+					t.Errorf("upstream Accept-Encoding = %q, want the client's %q", r.Header.Get("Accept-Encoding"), tt.acceptEncoding)
+				}
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Encoding", "gzip")
+				_, _ = w.Write(compressed)
+			}))
+			defer upstream.Close()
+
+			cfg := &config{ChatRawPassthrough: true, CodexRawPassthrough: true, GzipMinSize: 1}
+			_, proxy := newTestProxy(t, cfg, upstream.URL)
+			header := map[string]string{"Accept-Encoding": tt.acceptEncoding}
+			status, respHeader, body := postTest(t, proxy, tt.path, tt.request, header)
+			if http.StatusOK != status {
+				t.Fatalf("status = %d, body %q", status, body)
+			}
+
+			if "" == tt.acceptEncoding {
+				if "" != respHeader.Get("Content-Encoding") || tt.upstream != body {
+					t.Fatalf("Content-Encoding = %q, body %q, want the decoded upstream body", respHeader.Get("Content-Encoding"), body)
+				}
+				return
+			}
+			if "gzip" != respHeader.Get("Content-Encoding") {
+				t.Fatalf("Content-Encoding = %q, want gzip", respHeader.Get("Content-Encoding"))
+			}
+			if !bytes.Equal(compressed, []byte(body)) {
+				t.Fatalf("client got %d bytes, want the %d compressed upstream bytes unchanged", len(body), len(compressed))
+			}
+			if plain := gunzipString(t, body); tt.upstream != plain {
+				t.Fatalf("decoded body %q", plain)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// unknownConfigKeys返回raw中在t里没有对应json标签的配置项，逐层检查结构体、结构体的列表和映射，
+// 每项附带最接近的有效配置项
+func unknownConfigKeys(raw json.RawMessage, t reflect.Type, path string) []string {
+	for reflect.Pointer == t.Kind() {
+		t = t.Elem()
+	}
+
+	// 配置档的值是完整配置的子集
+	if reflect.TypeOf(profileSet{}) == t {
+		var profiles map[string]json.RawMessage
+		if nil != json.Unmarshal(raw, &profiles) {
+			return nil
+		}
+		var problems []string
+		for _, name := range sortedKeys(profiles) {
+			problems = append(problems, unknownConfigKeys(profiles[name], reflect.TypeOf(config{}), path+name+".")...)
+		}
+		return problems
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		var items []json.RawMessage
+		if nil != json.Unmarshal(raw, &items) {
+			return nil
+		}
+		var problems []string
+		for i, item := range items {
+			problems = append(problems, unknownConfigKeys(item, t.Elem(), fmt.Sprintf("%s%d.", path, i))...)
+		}
+		return problems
+	case reflect.Map:
+		var items map[string]json.RawMessage
+		if nil != json.Unmarshal(raw, &items) {
+			return nil
+		}
+		var problems []string
+		for _, key := range sortedKeys(items) {
+			problems = append(problems, unknownConfigKeys(items[key], t.Elem(), path+key+".")...)
+		}
+		return problems
+	case reflect.Struct:
+	default:
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if nil != json.Unmarshal(raw, &fields) {
+		return nil
+	}
+
+	known := make(map[string]reflect.Type)
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if "" == name || "-" == name {
+			continue
+		}
+		known[name] = t.Field(i).Type
+		names = append(names, name)
+	}
+
+	var problems []string
+	for _, key := range sortedKeys(fields) {
+		fieldType, ok := known[key]
+		if ok {
+			problems = append(problems, unknownConfigKeys(fields[key], fieldType, path+key+".")...)
+			continue
+		}
+
+		problem := path + key
+		if match := closestName(key, names); "" != match {
+			problem += fmt.Sprintf(" (did you mean %s?)", match)
+		}
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
+
+// closestName返回names中与name编辑距离最小且足够接近的名称，没有时返回空字符串
+func closestName(name string, names []string) string {
+	best, bestDistance := "", len(name)/3+2
+	for _, candidate := range names {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+
+	return best
+}
+
+// editDistance返回两个字符串的Levenshtein编辑距离
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
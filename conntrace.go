@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// connTrace记录上游请求的连接过程，上游请求失败时用来区分是DNS、连接、TLS还是HTTP层的问题。
+// 同一个请求重试时记录最后一次
+type connTrace struct {
+	mu    sync.Mutex
+	start time.Time
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	dns          time.Duration // 为0表示没有进行这一阶段，例如复用连接
+	connect      time.Duration
+	tls          time.Duration
+
+	wroteRequest bool
+	wrote        time.Time // 请求写完的时间
+	gotFirstByte bool
+	reused       bool
+	remote       string // 实际连接的地址，使用代理时为代理的地址
+	tlsVersion   string
+	tlsCipher    string
+}
+
+// withConnTrace返回记录连接过程的ctx
+func withConnTrace(ctx context.Context) (context.Context, *connTrace) {
+	t := &connTrace{start: time.Now()}
+	return httptrace.WithClientTrace(ctx, t.clientTrace()), t
+}
+
+// clientTrace返回更新t的httptrace.ClientTrace
+func (t *connTrace) clientTrace() *httptrace.ClientTrace {
+	locked := func(f func()) {
+		t.mu.Lock()
+		f()
+		t.mu.Unlock()
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { locked(func() { t.dnsStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { locked(func() { t.dns = time.Since(t.dnsStart) }) },
+		ConnectStart: func(string, string) {
+			locked(func() { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(_ string, addr string, _ error) {
+			locked(func() {
+				t.connect = time.Since(t.connectStart)
+				t.remote = addr
+			})
+		},
+		TLSHandshakeStart: func() { locked(func() { t.tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			locked(func() {
+				t.tls = time.Since(t.tlsStart)
+				if nil == err {
+					t.setTLS(state)
+				}
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			locked(func() {
+				t.reused = info.Reused
+				t.wroteRequest, t.gotFirstByte = false, false
+				if nil != info.Conn {
+					t.remote = info.Conn.RemoteAddr().String()
+				}
+				// 复用的连接不会再握手，从连接上取TLS信息
+				if conn, ok := info.Conn.(*tls.Conn); ok && info.Reused {
+					t.setTLS(conn.ConnectionState())
+				}
+			})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			locked(func() { t.wroteRequest, t.wrote = true, time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			locked(func() { t.gotFirstByte = true })
+		},
+	}
+}
+
+// sentAt返回最后一次请求写完的时间，没有写出请求时返回开始时间
+func (t *connTrace) sentAt() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.wrote.IsZero() {
+		return t.start
+	}
+	return t.wrote
+}
+
+// setTLS记录TLS版本和加密套件，调用方需持有锁
+func (t *connTrace) setTLS(state tls.ConnectionState) {
+	t.tlsVersion = tls.VersionName(state.Version)
+	t.tlsCipher = tls.CipherSuiteName(state.CipherSuite)
+}
+
+// milliseconds把阶段耗时格式化为毫秒，没有进行的阶段为-
+func milliseconds(d time.Duration) string {
+	if 0 == d {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.1f", float64(d.Microseconds())/1000)
+}
+
+// String返回连接过程的摘要
+func (t *connTrace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	text := fmt.Sprintf("dns_ms=%s connect_ms=%s tls_ms=%s wrote_request=%t got_first_byte=%t reused=%t elapsed_ms=%s",
+		milliseconds(t.dns), milliseconds(t.connect), milliseconds(t.tls), t.wroteRequest, t.gotFirstByte, t.reused, milliseconds(time.Since(t.start)))
+	if "" != t.remote {
+		text += " remote=" + t.remote
+	}
+	if "" != t.tlsVersion {
+		text += fmt.Sprintf(" tls=%q cipher=%s", t.tlsVersion, t.tlsCipher)
+	}
+
+	return text
+}
+
+// logConnTrace在上游请求失败时记录连接过程，客户端主动取消的请求不记录
+func (s *ProxyService) logConnTrace(upstream string, kind string, t *connTrace) {
+	if upstreamCanceled == kind {
+		return
+	}
+
+	log.Printf("upstream %s connection: %s\n", s.label(upstream), t)
+}
+
+// addConnTiming在开启debug时把连接各阶段的耗时加入Server-Timing
+func (s *ProxyService) addConnTiming(timing *serverTiming, t *connTrace) {
+	if !s.cfg.Debug {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, phase := range []timingPhase{{"upstream-dns", t.dns}, {"upstream-connect", t.connect}, {"upstream-tls", t.tls}} {
+		if phase.dur > 0 {
+			timing.add(phase.name, phase.dur)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 对话统计的默认空闲时间和/stats中列出的对话数
+const (
+	defaultConversationIdle = 30 * time.Minute
+	conversationTop         = 20
+)
+
+// conversationTurn是一次聊天请求所属的对话，在请求开始时取出，结束时计入统计
+type conversationTurn struct {
+	id       string // 对话标识的哈希
+	messages int    // 请求中的消息数
+	bytes    int    // 客户端请求体的大小
+}
+
+// conversationStats是一个对话的累计统计，只有计数和大小，不保存消息内容
+type conversationStats struct {
+	Id               string  `json:"id"`
+	Model            string  `json:"model"`    // 最近一次请求映射后的模型
+	Turns            int64   `json:"turns"`    // 请求数
+	Errors           int64   `json:"errors"`   // 失败的请求数
+	Messages         int     `json:"messages"` // 最近一次请求中的消息数
+	RequestBytes     int64   `json:"request_bytes"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	Started          string  `json:"started"`
+	LastSeen         string  `json:"last_seen"`
+
+	lastSeen   time.Time
+	summarized bool // 空闲后已经输出过汇总日志，有新请求时重置
+}
+
+// conversationTracker在内存中按对话汇总聊天请求，超过conversation_stats个对话时淘汰最久没有请求的
+type conversationTracker struct {
+	max  int
+	idle time.Duration
+
+	mu    sync.Mutex
+	order *list.List // 最近有请求的对话在前，元素是*conversationStats
+	items map[string]*list.Element
+}
+
+// newConversationTracker创建conversationTracker，未配置conversation_stats时返回nil
+func newConversationTracker(cfg *config) *conversationTracker {
+	if cfg.ConversationStats <= 0 {
+		return nil
+	}
+
+	idle := time.Duration(cfg.ConversationIdle) * time.Minute
+	if idle <= 0 {
+		idle = defaultConversationIdle
+	}
+
+	return &conversationTracker{
+		max:   cfg.ConversationStats,
+		idle:  idle,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// newConversationTurn返回聊天请求所属的对话，对话标识再取一次哈希，copilot_thread_id不会出现在统计中
+func newConversationTurn(conversation string, messages int, bytes int) *conversationTurn {
+	sum := sha256.Sum256([]byte(conversation))
+	return &conversationTurn{id: hex.EncodeToString(sum[:8]), messages: messages, bytes: bytes}
+}
+
+// record在请求结束时把请求计入所属的对话
+func (t *conversationTracker) record(rec *usageRecord) {
+	if nil == t || nil == rec.turn {
+		return
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stats *conversationStats
+	if element, ok := t.items[rec.turn.id]; ok {
+		t.order.MoveToFront(element)
+		stats = element.Value.(*conversationStats)
+	} else {
+		stats = &conversationStats{Id: rec.turn.id, Started: now.UTC().Format(time.RFC3339)}
+		t.items[stats.Id] = t.order.PushFront(stats)
+		if t.order.Len() > t.max {
+			oldest := t.order.Back()
+			t.order.Remove(oldest)
+			delete(t.items, oldest.Value.(*conversationStats).Id)
+		}
+	}
+
+	stats.Model = rec.MappedModel
+	stats.Turns++
+	if rec.Status >= 400 {
+		stats.Errors++
+	}
+	stats.Messages = rec.turn.messages
+	stats.RequestBytes += int64(rec.turn.bytes)
+	stats.PromptTokens += rec.PromptTokens
+	stats.CompletionTokens += rec.CompletionTokens
+	stats.Cost += rec.Cost
+	stats.lastSeen = now
+	stats.LastSeen = now.UTC().Format(time.RFC3339)
+	stats.summarized = false
+}
+
+// top返回Token用量最多的对话，用于/stats
+func (t *conversationTracker) top() []conversationStats {
+	t.mu.Lock()
+	result := make([]conversationStats, 0, t.order.Len())
+	for element := t.order.Front(); nil != element; element = element.Next() {
+		result = append(result, *element.Value.(*conversationStats))
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(result, func(a, b conversationStats) int {
+		return cmp.Compare(b.PromptTokens+b.CompletionTokens, a.PromptTokens+a.CompletionTokens)
+	})
+	if len(result) > conversationTop {
+		result = result[:conversationTop]
+	}
+
+	return result
+}
+
+// idleConversations返回空闲超过conversation_idle_minutes、还没有输出过汇总的对话，并标记为已输出
+func (t *conversationTracker) idleConversations() []conversationStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var idle []conversationStats
+	for element := t.order.Back(); nil != element; element = element.Prev() {
+		stats := element.Value.(*conversationStats)
+		if time.Since(stats.lastSeen) < t.idle {
+			break
+		}
+		if !stats.summarized {
+			stats.summarized = true
+			idle = append(idle, *stats)
+		}
+	}
+
+	return idle
+}
+
+// conversationLoop每分钟检查一次空闲的对话，为每个对话输出一行汇总。ProxyService关闭时退出
+func (s *ProxyService) conversationLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, stats := range s.stats.threads.idleConversations() {
+			log.Printf("%s %s idle: %d turns, %d errors, %d messages, %d request bytes, %d prompt tokens, %d completion tokens, cost %.4f, model %s, since %s\n",
+				s.label("conversation"), stats.Id, stats.Turns, stats.Errors, stats.Messages, stats.RequestBytes,
+				stats.PromptTokens, stats.CompletionTokens, stats.Cost, stats.Model, stats.Started)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// corpusKey是gin.Context中保存被抽中的语料的键
+const corpusKey = "override_corpus"
+
+const (
+	// defaultCorpusMaxMB是未配置corpus_max_mb时语料文件轮转的大小
+	defaultCorpusMaxMB = 100
+	// defaultCorpusMaxFiles是未配置corpus_max_files时保留的轮转文件数
+	defaultCorpusMaxFiles = 5
+	// corpusQueueSize是等待写入的语料条数，写入跟不上时丢弃新的语料
+	corpusQueueSize = 256
+	// maxCorpusCompletion是每条语料保存的补全内容的最大字节数
+	maxCorpusCompletion = 64 << 10
+)
+
+// corpusRecord是语料文件中的一行
+type corpusRecord struct {
+	Time       time.Time       `json:"time"`
+	Endpoint   string          `json:"endpoint"`
+	Model      string          `json:"model"`
+	Prompt     string          `json:"prompt,omitempty"`
+	Suffix     string          `json:"suffix,omitempty"`
+	Messages   json.RawMessage `json:"messages,omitempty"`
+	Completion string          `json:"completion,omitempty"`
+}
+
+// corpusSample是被抽中的请求，请求结束且成功时写入语料文件
+type corpusSample struct {
+	record     corpusRecord
+	completion *completionCapture // 未开启corpus_completions时为nil
+}
+
+// corpusWriter把抽中的请求异步追加到JSONL文件，文件超过corpus_max_mb时轮转
+type corpusWriter struct {
+	path        string
+	endpoints   []string
+	percent     float64
+	completions bool
+	maxSize     int64
+	maxFiles    int
+	metrics     *metrics
+
+	lines chan []byte
+	stop  chan struct{}
+	done  chan struct{}
+	file  *os.File
+	size  int64
+}
+
+// checkCorpus检查语料相关的配置
+func checkCorpus(cfg *config) error {
+	if "" == cfg.CorpusFile {
+		return nil
+	}
+	for _, endpoint := range cfg.CorpusEndpoints {
+		if "codex" != endpoint && "chat" != endpoint {
+			return fmt.Errorf("unsupported corpus_endpoints entry: %s, expected codex or chat", endpoint)
+		}
+	}
+	if cfg.CorpusSamplePercent < 0 || cfg.CorpusSamplePercent > 100 {
+		return fmt.Errorf("corpus_sample_percent must be between 0 and 100, got %g", cfg.CorpusSamplePercent)
+	}
+
+	return nil
+}
+
+// newCorpusWriter打开语料文件并启动后台写入，未配置corpus_file时返回nil
+func newCorpusWriter(cfg *config, m *metrics) (*corpusWriter, error) {
+	if "" == cfg.CorpusFile {
+		return nil, nil
+	}
+	if err := checkCorpus(cfg); nil != err {
+		return nil, err
+	}
+
+	w := &corpusWriter{
+		path:        cfg.CorpusFile,
+		endpoints:   cfg.CorpusEndpoints,
+		percent:     cfg.CorpusSamplePercent,
+		completions: cfg.CorpusCompletions,
+		maxSize:     int64(cfg.CorpusMaxMB) << 20,
+		maxFiles:    cfg.CorpusMaxFiles,
+		metrics:     m,
+		lines:       make(chan []byte, corpusQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if 0 == len(w.endpoints) {
+		w.endpoints = []string{"codex"}
+	}
+	if 0 == w.percent {
+		w.percent = 100
+	}
+	if w.maxSize <= 0 {
+		w.maxSize = defaultCorpusMaxMB << 20
+	}
+	if w.maxFiles <= 0 {
+		w.maxFiles = defaultCorpusMaxFiles
+	}
+	if err := w.open(); nil != err {
+		return nil, fmt.Errorf("corpus_file: %w", err)
+	}
+
+	// 语料中有用户的代码和对话，启动时明确提示
+	log.Printf("!!! corpus_file is set: %g%% of %s requests, including prompts and code, are written to %s\n",
+		w.percent, strings.Join(w.endpoints, " and "), w.path)
+	go w.writeLoop()
+
+	return w, nil
+}
+
+// open以追加方式打开语料文件并记录当前大小
+func (w *corpusWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if nil != err {
+		return err
+	}
+	info, err := file.Stat()
+	if nil != err {
+		closeIO(file)
+		return err
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// rotate把<file>.1到<file>.<n-1>依次后移，当前文件改名为<file>.1，再打开新文件
+func (w *corpusWriter) rotate() error {
+	closeIO(w.file)
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); nil != err {
+		logError("rotate corpus file failed: %v\n", err)
+	}
+	return w.open()
+}
+
+// write写入一行，写入前超过大小时先轮转
+func (w *corpusWriter) write(line []byte) {
+	if nil == w.file {
+		return
+	}
+	if w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); nil != err {
+			logError("reopen corpus file failed, corpus disabled: %v\n", err)
+			w.file = nil
+			return
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if nil != err {
+		logError("write corpus failed: %v\n", err)
+	}
+}
+
+// writeLoop在后台写入语料，停止时写完已经排队的语料再关闭文件
+func (w *corpusWriter) writeLoop() {
+	defer close(w.done)
+	for {
+		select {
+		case line := <-w.lines:
+			w.write(line)
+		case <-w.stop:
+			for {
+				select {
+				case line := <-w.lines:
+					w.write(line)
+				default:
+					if nil != w.file {
+						closeIO(w.file)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// enqueue把一行语料交给后台写入，队列已满时丢弃，不阻塞请求
+func (w *corpusWriter) enqueue(endpoint string, line []byte) {
+	select {
+	case w.lines <- line:
+		w.metrics.inc("override_corpus_records_total", "endpoint", endpoint)
+	default:
+		w.metrics.inc("override_corpus_dropped_total", "endpoint", endpoint)
+	}
+}
+
+// close停止后台写入并等待已排队的语料写完
+func (w *corpusWriter) close() {
+	if nil == w {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
+
+// sampled返回endpoint的请求是否被抽中
+func (w *corpusWriter) sampled(endpoint string) bool {
+	if nil == w || !slices.Contains(w.endpoints, endpoint) {
+		return false
+	}
+	return rand.Float64()*100 < w.percent
+}
+
+// keepCorpus在请求被抽中时保存转换后的提示，redact_patterns和codex_redact_paths已经在转换时生效
+func (s *ProxyService) keepCorpus(c *gin.Context, rec *usageRecord, body []byte) {
+	if !s.corpus.sampled(rec.Endpoint) {
+		return
+	}
+
+	// 原样转发的请求没有经过转换，这里再按redact_patterns替换一次
+	for _, path := range promptPaths(body) {
+		if text, n := s.redactText(gjson.GetBytes(body, path).String()); n > 0 {
+			body, _ = sjson.SetBytes(body, path, text)
+		}
+	}
+
+	sample := &corpusSample{record: corpusRecord{Endpoint: rec.Endpoint}}
+	if "chat" == rec.Endpoint {
+		if messages := gjson.GetBytes(body, "messages"); messages.IsArray() {
+			sample.record.Messages = json.RawMessage(messages.Raw)
+		}
+	} else {
+		sample.record.Prompt = gjson.GetBytes(body, "prompt").String()
+		sample.record.Suffix = gjson.GetBytes(body, "suffix").String()
+	}
+	c.Set(corpusKey, sample)
+}
+
+// corpusCapture在请求被抽中且开启corpus_completions时，让w同时累计上游返回的补全内容
+func (s *ProxyService) corpusCapture(c *gin.Context, contentType string, w io.Writer) io.Writer {
+	sample, _ := c.Keys[corpusKey].(*corpusSample)
+	if nil == sample || !s.corpus.completions {
+		return w
+	}
+
+	sample.completion = newCompletionCapture(contentType)
+	return io.MultiWriter(w, sample.completion)
+}
+
+// writeCorpus在被抽中的请求成功结束时写入语料，补全内容同样按redact_patterns替换
+func (s *ProxyService) writeCorpus(c *gin.Context, rec *usageRecord) {
+	sample, _ := c.Keys[corpusKey].(*corpusSample)
+	if nil == sample || nil == s.corpus || http.StatusOK != rec.Status {
+		return
+	}
+
+	sample.record.Time = rec.Time.UTC()
+	sample.record.Model = rec.MappedModel
+	if nil != sample.completion {
+		sample.record.Completion, _ = s.redactText(sample.completion.text())
+	}
+	line, err := json.Marshal(sample.record)
+	if nil != err {
+		logError("encode corpus record failed: %v\n", err)
+		return
+	}
+	s.corpus.enqueue(rec.Endpoint, append(line, '\n'))
+}
+
+// completionCapture从响应中累计第一个choice的补全内容，聊天为content，代码补全为text
+type completionCapture struct {
+	stream  bool
+	buf     []byte
+	content strings.Builder
+}
+
+// newCompletionCapture根据响应类型创建completionCapture
+func newCompletionCapture(contentType string) *completionCapture {
+	return &completionCapture{stream: isEventStream(contentType)}
+}
+
+// Write实现io.Writer，流式响应按行解析，非流式响应缓存整个body
+func (p *completionCapture) Write(data []byte) (int, error) {
+	if !p.stream {
+		if len(p.buf)+len(data) <= maxCaptureSize {
+			p.buf = append(p.buf, data...)
+		}
+		return len(data), nil
+	}
+
+	p.buf = append(p.buf, data...)
+	rest := p.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := bytes.TrimSpace(rest[:i])
+		rest = rest[i+1:]
+		if !bytes.HasPrefix(line, []byte("data:")) || p.content.Len() > maxCorpusCompletion {
+			continue
+		}
+
+		choice := gjson.GetBytes(bytes.TrimSpace(line[5:]), "choices.0")
+		p.content.WriteString(choice.Get("delta.content").String())
+		p.content.WriteString(choice.Get("text").String())
+	}
+	p.buf = append(p.buf[:0], rest...)
+
+	return len(data), nil
+}
+
+// text返回累计的补全内容
+func (p *completionCapture) text() string {
+	if !p.stream {
+		choice := gjson.GetBytes(p.buf, "choices.0")
+		if content := choice.Get("message.content"); content.Exists() {
+			return content.String()
+		}
+		return choice.Get("text").String()
+	}
+
+	return p.content.String()
+}
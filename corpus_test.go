@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCorpusCompletionWithRecovery检查同时开启chat_stream_recovery_seconds和corpus_completions时，
+// 语料中保存流式响应的补全内容
+func TestCorpusCompletionWithRecovery(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, content := range []string{"Hello", ", world"} {
+			_, _ = io.WriteString(w, `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"`+content+`"},"finish_reason":null}]}`+"\n\n")
+		}
+		_, _ = io.WriteString(w, `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`+"\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "corpus.jsonl")
+	cfg := &config{ChatStreamRecovery: 60, CorpusFile: path, CorpusEndpoints: []string{"chat"}, CorpusCompletions: true}
+	_, proxy := newTestProxy(t, cfg, upstream.URL)
+	status, _, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	if http.StatusOK != status {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+
+	var content []byte
+	waitFor(t, func() bool {
+		content, _ = os.ReadFile(path)
+		return len(content) > 0
+	})
+	var record corpusRecord
+	if err := json.Unmarshal(content, &record); nil != err {
+		t.Fatalf("corpus record %q: %v", content, err)
+	}
+	if "Hello, world" != record.Completion {
+		t.Fatalf("completion = %q, want %q", record.Completion, "Hello, world")
+	}
+}
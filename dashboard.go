@@ -0,0 +1,91 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed assets/dashboard.html
+var dashboardHTML []byte
+
+// recentErrors保存最近的错误日志，供dashboard和/admin/recent展示，只包含通过logError记录的日志
+var recentErrors = newLogRing(defaultRecentSize)
+
+// errorLog把错误日志写入recentErrors，时间格式与标准日志相同
+var errorLog = log.New(recentErrors, "", log.LstdFlags)
+
+// logError记录一条错误日志并保存到recentErrors，普通日志直接使用log包，避免挤掉最近的错误
+func logError(format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	_ = log.Output(2, line)
+	_ = errorLog.Output(2, line)
+}
+
+// logRing是保存最近若干行日志的环形缓冲，实现io.Writer以便作为errorLog的输出
+type logRing struct {
+	*ring[string]
+}
+
+// newLogRing创建容量为size的logRing
+func newLogRing(size int) *logRing {
+	return &logRing{newRing[string](size)}
+}
+
+// Write实现io.Writer，log包每次调用对应一行日志
+func (r *logRing) Write(p []byte) (int, error) {
+	r.add(string(p))
+	return len(p), nil
+}
+
+// redactSecret隐藏密钥中间部分
+func redactSecret(secret string) string {
+	if "" == secret {
+		return ""
+	}
+	if len(secret) <= 12 {
+		return "***"
+	}
+
+	return secret[:3] + "***" + secret[len(secret)-4:]
+}
+
+// configSummary返回隐藏了密钥的配置摘要
+func (s *ProxyService) configSummary() gin.H {
+	return gin.H{
+		"bind":               s.cfg.Bind,
+		"proxy_url":          redactSecret(s.cfg.ProxyUrl),
+		"timeout":            s.cfg.Timeout,
+		"codex_api_base":     s.cfg.CodexApiBase,
+		"codex_api_key":      redactSecret(s.cfg.CodexApiKey),
+		"chat_api_base":      s.cfg.ChatApiBase,
+		"chat_api_key":       redactSecret(s.cfg.ChatApiKey),
+		"chat_model_default": s.cfg.ChatModelDefault,
+		"chat_model_map":     s.cfg.ChatModelMap,
+		"chat_max_tokens":    s.cfg.ChatMaxTokens,
+		"chat_locale":        s.cfg.ChatLocale,
+		"stats_db":           s.cfg.StatsDb,
+		"storage":            s.cfg.Storage,
+		"alert_webhook":      "" != s.cfg.AlertWebhookUrl,
+	}
+}
+
+// dashboard返回内嵌的dashboard页面，页面数据通过dashboardData获取
+func (s *ProxyService) dashboard(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+}
+
+// dashboardData返回dashboard需要的实时数据
+func (s *ProxyService) dashboardData(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"config":              s.configSummary(),
+		"stats":               s.stats.snapshot(),
+		"upstreams":           s.stats.upstreamHealth(),
+		"requests_per_minute": s.stats.requestsPerMinute(),
+		"errors":              recentErrors.entries(),
+		"recent":              s.recent.entries(),
+	})
+}
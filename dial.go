@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// dialContextFunc是http.Transport.DialContext的函数类型
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newDialContext根据force_ipv4、dns_servers和host_overrides创建自定义的DialContext，都未配置时返回nil
+func newDialContext(cfg *config) dialContextFunc {
+	if !cfg.ForceIpv4 && 0 == len(cfg.DnsServers) && 0 == len(cfg.HostOverrides) {
+		return nil
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	resolver := net.DefaultResolver
+	if len(cfg.DnsServers) > 0 {
+		resolver = newResolver(cfg.DnsServers)
+	}
+
+	ipNetwork := "ip"
+	if cfg.ForceIpv4 {
+		ipNetwork = "ip4"
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if cfg.ForceIpv4 {
+			network = "tcp4"
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if nil != err {
+			return nil, err
+		}
+
+		// 指定了IP的主机直接连接，TLS的SNI仍然使用原始主机名
+		if ip, ok := cfg.HostOverrides[host]; ok {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		}
+		if nil != net.ParseIP(host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		ips, err := resolver.LookupIP(ctx, ipNetwork, host)
+		if nil != err {
+			logError("resolve %s (%s) via %v failed: %s\n", host, ipNetwork, dnsServersOf(cfg), err.Error())
+			return nil, err
+		}
+
+		var errs []error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if nil == err {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+
+		logError("dial %s failed, tried %v\n", host, ips)
+		return nil, errors.Join(errs...)
+	}
+}
+
+// newResolver创建轮流使用指定DNS服务器的解析器
+func newResolver(servers []string) *net.Resolver {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); nil != err {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs = append(addrs, server)
+	}
+
+	var next uint32
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := addrs[atomic.AddUint32(&next, 1)%uint32(len(addrs))]
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dnsServersOf返回日志中显示的DNS服务器
+func dnsServersOf(cfg *config) []string {
+	if 0 == len(cfg.DnsServers) {
+		return []string{"system"}
+	}
+
+	return cfg.DnsServers
+}
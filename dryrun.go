@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// isSecretName判断请求头或查询参数的名称是否像是密钥
+func isSecretName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, word := range []string{"authorization", "key", "token", "secret", "signature", "sig", "password"} {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactUrl返回隐藏了密钥类查询参数的地址
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if nil != err {
+		return rawUrl
+	}
+
+	query := u.Query()
+	for name, values := range query {
+		if !isSecretName(name) {
+			continue
+		}
+		for i := range values {
+			values[i] = redactSecret(values[i])
+		}
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "%2A", "*")
+	u.User = nil
+
+	return u.String()
+}
+
+// redactHeaders返回隐藏了密钥的请求头
+func redactHeaders(header http.Header) map[string]string {
+	result := make(map[string]string, len(header))
+	for name := range header {
+		value := header.Get(name)
+		if isSecretName(name) {
+			scheme, secret, ok := strings.Cut(value, " ")
+			if ok {
+				value = scheme + " " + redactSecret(secret)
+			} else {
+				value = redactSecret(value)
+			}
+		}
+		result[name] = value
+	}
+
+	return result
+}
+
+// transformPreview是一个请求转换后的结果
+type transformPreview struct {
+	body        []byte
+	requested   string
+	mapped      string
+	target      *upstreamTarget
+	rule        string // 匹配的chat_rules规则
+	passthrough bool
+}
+
+// previewTransform按当前配置转换请求体并选出上游，不发送请求
+func (s *ProxyService) previewTransform(endpoint string, body []byte, header http.Header, features featureSet) (*transformPreview, error) {
+	var transform func([]byte) ([]byte, string, string)
+	var targetOf func(string) *upstreamTarget
+	passthrough := false
+	switch endpoint {
+	case "chat":
+		transform = func(body []byte) ([]byte, string, string) {
+			return s.transformChat(body, header, features)
+		}
+		targetOf = s.chatTarget
+		passthrough = s.cfg.ChatRawPassthrough
+	case "codex":
+		transform, targetOf = s.transformCodex, func(string) *upstreamTarget {
+			return s.codexTarget()
+		}
+		passthrough = s.cfg.CodexRawPassthrough
+	default:
+		return nil, fmt.Errorf("unknown endpoint %q, expected chat or codex", endpoint)
+	}
+
+	// 原样转发时请求体不做任何修改，也不匹配规则
+	if passthrough {
+		transform = func(body []byte) ([]byte, string, string) {
+			requested, mapped := rawModel(body)
+			return body, requested, mapped
+		}
+	}
+
+	preview := &transformPreview{passthrough: passthrough}
+	if "chat" == endpoint && !passthrough {
+		if matched := s.matchChatRule(body); nil != matched {
+			preview.rule = matched.Name
+		}
+	}
+	preview.body, preview.requested, preview.mapped = transform(bytes.Clone(body))
+	preview.target = targetOf(preview.mapped)
+
+	return preview, nil
+}
+
+// previewRequest转换请求并返回将要发往上游的内容，不实际发送
+func (s *ProxyService) previewRequest(c *gin.Context, endpoint string, body []byte) (gin.H, error) {
+	preview, err := s.previewTransform(endpoint, body, c.Request.Header, s.requestFeatures(c))
+	if nil != err {
+		return nil, err
+	}
+	target := preview.target
+	req, err := target.newRequest(c.Request.Context(), preview.body, target.keys.current())
+	if nil != err {
+		return nil, err
+	}
+
+	route := target.route
+	if "" == route {
+		route = "default"
+	}
+
+	return gin.H{
+		"endpoint":     endpoint,
+		"model":        preview.requested,
+		"mapped_model": preview.mapped,
+		"upstream":     target.name,
+		"route":        route,
+		"rule":         preview.rule,
+		"url":          redactUrl(req.URL.String()),
+		"headers":      redactHeaders(req.Header),
+		"body":         json.RawMessage(preview.body),
+		"passthrough":  preview.passthrough,
+	}, nil
+}
+
+// dryRun返回转换后将要发往上游的请求，不实际发送
+func (s *ProxyService) dryRun(c *gin.Context, endpoint string) {
+	body, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	if !json.Valid(body) {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "request body is not valid JSON")
+		return
+	}
+
+	result, err := s.previewRequest(c, endpoint, body)
+	if nil != err {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// dryRunChat处理/admin/dry-run/chat请求
+func (s *ProxyService) dryRunChat(c *gin.Context) {
+	s.dryRun(c, "chat")
+}
+
+// dryRunCodex处理/admin/dry-run/codex请求
+func (s *ProxyService) dryRunCodex(c *gin.Context) {
+	s.dryRun(c, "codex")
+}
+
+// transformVersion是/v1/transform响应格式的版本，只在有不兼容的修改时增加
+const transformVersion = 1
+
+// configRevision返回生效配置的哈希，配置改变时随之改变
+func (s *ProxyService) configRevision() string {
+	data, _ := json.Marshal(s.cfg)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// transformRequest处理/v1/transform请求，返回转换结果供脚本和CI检查模型映射
+func (s *ProxyService) transformRequest(c *gin.Context) {
+	var req struct {
+		Endpoint string          `json:"endpoint"`
+		Body     json.RawMessage `json:"body"`
+	}
+	if err := c.ShouldBindJSON(&req); nil != err {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if !gjson.ParseBytes(req.Body).IsObject() {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "body must be a JSON object")
+		return
+	}
+
+	result, err := s.previewRequest(c, req.Endpoint, req.Body)
+	if nil != err {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	result["version"] = transformVersion
+	result["config_revision"] = s.configRevision()
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// envPrefix是覆盖配置项的环境变量前缀
+const envPrefix = "OVERRIDE_"
+
+// envValue是覆盖某个配置项的环境变量
+type envValue struct {
+	name  string // 实际使用的变量名
+	value string
+}
+
+// envConfigurable返回配置项能否用环境变量覆盖：字符串、布尔、数字和字符串列表
+func envConfigurable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return reflect.String == t.Elem().Kind()
+	}
+
+	return false
+}
+
+// envTypeName返回env-list中显示的类型
+func envTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice:
+		return "list (comma separated)"
+	}
+
+	return "int"
+}
+
+// envTags返回可以用环境变量覆盖的配置项的json标签
+func envTags() []string {
+	t := reflect.TypeOf(config{})
+	var tags []string
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if "" == tag || "-" == tag || !envConfigurable(t.Field(i).Type) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// normalizeEnvName去掉下划线并转为小写，OVERRIDE_CHATAPIBASE和OVERRIDE_CHAT_API_BASE得到相同的结果
+func normalizeEnvName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// envOverrides从环境变量中找出覆盖配置项的值，键为json标签。变量名可以是OVERRIDE_加大写的json标签，
+// 也可以省略其中的下划线，两者都存在时前者优先。同时返回无法对应到配置项的OVERRIDE_*变量，附带最接近的变量名
+func envOverrides(environ []string) (map[string]envValue, []string) {
+	tags := envTags()
+	normalized := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		normalized[normalizeEnvName(tag)] = tag
+	}
+
+	overrides := make(map[string]envValue)
+	var unknown []string
+	sort.Strings(environ)
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		suffix, ok := strings.CutPrefix(name, envPrefix)
+		if !ok {
+			continue
+		}
+
+		tag, found := normalized[normalizeEnvName(suffix)]
+		if !found {
+			problem := name
+			if match := closestName(strings.ToLower(suffix), tags); "" != match {
+				problem += fmt.Sprintf(" (did you mean %s?)", envPrefix+strings.ToUpper(match))
+			}
+			unknown = append(unknown, problem)
+			continue
+		}
+
+		// 与json标签完全一致的变量名优先
+		if existing, ok := overrides[tag]; ok && existing.name == envPrefix+strings.ToUpper(tag) {
+			continue
+		}
+		overrides[tag] = envValue{name: name, value: value}
+	}
+
+	return overrides, unknown
+}
+
+// applyEnvOverrides把环境变量中的值写入配置，无法解析的值被忽略
+func applyEnvOverrides(cfg *config, overrides map[string]envValue) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		tag := t.Field(i).Tag.Get("json")
+		if tag == "" {
+			continue
+		}
+
+		override, exists := overrides[tag]
+		if !exists {
+			continue
+		}
+		value := override.value
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.String {
+				field.Set(reflect.ValueOf(strings.Split(value, ",")))
+			}
+		case reflect.Bool:
+			if boolValue, err := strconv.ParseBool(value); err == nil {
+				field.SetBool(boolValue)
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+				field.SetInt(intValue)
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if uintValue, err := strconv.ParseUint(value, 10, 64); err == nil {
+				field.SetUint(uintValue)
+			}
+		case reflect.Float32, reflect.Float64:
+			if floatValue, err := strconv.ParseFloat(value, field.Type().Bits()); err == nil {
+				field.SetFloat(floatValue)
+			}
+		}
+	}
+}
+
+// envDisplayValue返回env-list中显示的值，密钥和地址中的凭据被隐藏
+func envDisplayValue(tag string, value string) string {
+	if isSecretName(tag) {
+		parts := strings.Split(value, ",")
+		for i := range parts {
+			parts[i] = redactSecret(parts[i])
+		}
+		return strings.Join(parts, ",")
+	}
+	if strings.Contains(value, "://") {
+		return redactUrl(value)
+	}
+
+	return value
+}
+
+// runEnvList执行env-list子命令，列出所有可以用环境变量覆盖的配置项、类型和当前环境中的值
+func runEnvList() int {
+	overrides, unknown := envOverrides(os.Environ())
+	t := reflect.TypeOf(config{})
+	types := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		types[tag] = t.Field(i).Type
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VARIABLE\tTYPE\tVALUE")
+	for _, tag := range envTags() {
+		value := "(unset)"
+		if override, ok := overrides[tag]; ok {
+			value = envDisplayValue(tag, override.value)
+			if override.name != envPrefix+strings.ToUpper(tag) {
+				value += " (from " + override.name + ")"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", envPrefix+strings.ToUpper(tag), envTypeName(types[tag]), value)
+	}
+	_ = w.Flush()
+
+	for _, problem := range unknown {
+		fmt.Printf("unknown variable: %s\n", problem)
+	}
+
+	return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// experimentPrefixSize是代码补全请求计算实验分组时使用的prompt前缀长度，文件变长时分组不变
+const experimentPrefixSize = 512
+
+// experiment是一个A/B实验：endpoint的请求按percent的比例改用model，其余请求作为对照组
+type experiment struct {
+	Endpoint string  `json:"endpoint"` // 实验的端点：chat或codex
+	Percent  float64 `json:"percent"`  // 使用model的请求比例（0-100）
+	Model    string  `json:"model"`    // 实验组使用的模型
+	Id       string  `json:"id"`       // 实验ID，出现在访问日志、/stats和X-Override-Experiment响应头中
+}
+
+// checkExperiments校验experiments，每个端点最多一个实验
+func checkExperiments(experiments []experiment) error {
+	seen := make(map[string]bool)
+	for i, e := range experiments {
+		switch {
+		case "chat" != e.Endpoint && "codex" != e.Endpoint:
+			return fmt.Errorf("experiments[%d]: unsupported endpoint: %s", i, e.Endpoint)
+		case "" == e.Id || "" == e.Model:
+			return fmt.Errorf("experiments[%d]: id and model are required", i)
+		case e.Percent < 0 || e.Percent > 100:
+			return fmt.Errorf("experiments[%d]: percent must be between 0 and 100", i)
+		case seen[e.Endpoint]:
+			return fmt.Errorf("experiments[%d]: only one experiment per endpoint is supported", i)
+		}
+		seen[e.Endpoint] = true
+	}
+
+	return nil
+}
+
+// experimentSubject返回决定实验分组的标识：聊天请求使用对话标识，代码补全请求使用编辑器会话和prompt前缀，
+// 同一个对话或同一处输入的重试不会换组。需要在转换请求体之前调用
+func (s *ProxyService) experimentSubject(c *gin.Context, endpoint string, body []byte) string {
+	if !slices.ContainsFunc(s.cfg.Experiments, func(e experiment) bool { return e.Endpoint == endpoint }) {
+		return ""
+	}
+
+	if "chat" == endpoint {
+		if id := conversationId(body); "" != id {
+			return tenantOf(c) + "\x00" + id
+		}
+		return ""
+	}
+
+	// 与supersedeKey一样去掉正在输入的最后一行
+	prompt := gjson.GetBytes(body, "prompt").String()
+	if i := strings.LastIndexByte(prompt, '\n'); i >= 0 {
+		prompt = prompt[:i]
+	}
+	if len(prompt) > experimentPrefixSize {
+		prompt = prompt[:experimentPrefixSize]
+	}
+	if "" == prompt {
+		return ""
+	}
+
+	return tenantOf(c) + "\x00" + c.GetHeader("Vscode-Sessionid") + "\x00" + prompt
+}
+
+// applyExperiment在正常的模型映射之后分配实验组：实验组改用实验的模型，两组都在访问日志、统计和响应头中标记，
+// 实验组的模型记录到rec.MappedModel
+func (s *ProxyService) applyExperiment(c *gin.Context, rec *usageRecord, subject string, body []byte) []byte {
+	if rec.features.has(featureRawModel) {
+		return body
+	}
+	for _, e := range s.cfg.Experiments {
+		if e.Endpoint != rec.Endpoint {
+			continue
+		}
+
+		// 没有可用的标识时随机分组
+		var bucket float64
+		if "" == subject {
+			bucket = rand.Float64() * 100
+		} else {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(e.Id + "\x00" + subject))
+			bucket = float64(h.Sum32()%10000) / 100
+		}
+
+		arm := "a"
+		if bucket < e.Percent {
+			arm = "b"
+			body, _ = sjson.SetBytesOptions(body, "model", e.Model, inPlace)
+			rec.MappedModel = e.Model
+		}
+		rec.Experiment = e.Id + ":" + arm
+		c.Header("X-Override-Experiment", rec.Experiment)
+		break
+	}
+
+	return body
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// featuresHeader是客户端按请求开启或关闭转换步骤的请求头，如X-Override-Features: no-locale, raw-model
+const featuresHeader = "X-Override-Features"
+
+// 客户端可以在X-Override-Features中使用的功能，未指定时按配置处理
+const (
+	featureNoLocale     = "no-locale"         // 不在聊天请求中追加回复语言的说明
+	featureRawModel     = "raw-model"         // 聊天请求不做模型映射和实验分组，使用客户端请求的模型
+	featureRawFinish    = "raw-finish-reason" // 不统一响应中的finish_reason
+	featureRawToolCalls = "raw-tool-calls"    // 不整理聊天响应中的工具调用，包括chat_sequential_tool_calls
+)
+
+// knownFeatures是功能及其说明，由/version返回
+var knownFeatures = []struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}{
+	{featureNoLocale, "do not append the reply locale instruction to chat requests"},
+	{featureRawModel, "send the requested chat model as is, skipping model maps, chat_rules models and experiments"},
+	{featureRawFinish, "pass finish_reason through as the upstream returned it, ignoring finish_reason_map"},
+	{featureRawToolCalls, "do not normalize tool calls in chat responses"},
+}
+
+// featureSet是一个请求选择的功能，nil表示没有选择任何功能
+type featureSet map[string]bool
+
+// has返回是否选择了功能name
+func (f featureSet) has(name string) bool {
+	return f[name]
+}
+
+// requestFeatures解析X-Override-Features，功能之间用逗号或空格分隔，不区分大小写。
+// 不认识的功能被忽略，开启debug时记录日志
+func (s *ProxyService) requestFeatures(c *gin.Context) featureSet {
+	header := c.GetHeader(featuresHeader)
+	if "" == header {
+		return nil
+	}
+
+	features := make(featureSet)
+	for _, name := range strings.FieldsFunc(strings.ToLower(header), func(r rune) bool { return ',' == r || ' ' == r }) {
+		known := false
+		for _, feature := range knownFeatures {
+			known = known || feature.Name == name
+		}
+		if !known {
+			if s.cfg.Debug {
+				log.Printf("ignoring unknown %s: %s\n", featuresHeader, name)
+			}
+			continue
+		}
+		features[name] = true
+	}
+
+	return features
+}
+
+// featuresOf返回请求记录中的功能，不统计用量的请求返回nil
+func featuresOf(c *gin.Context) featureSet {
+	if rec := recordOf(c.Keys); nil != rec {
+		return rec.features
+	}
+	return nil
+}
+
+// versionInfo返回程序的版本和客户端可以在X-Override-Features中使用的功能
+func versionInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version":  version,
+		"features": knownFeatures,
+	})
+}
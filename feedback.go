@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxFeedbackRequests是等待采纳反馈的最多请求数，超过时丢弃最早的请求
+	maxFeedbackRequests = 10000
+	// feedbackTTL是请求结束后接受采纳反馈的时长
+	feedbackTTL = time.Hour
+)
+
+// 一次采纳反馈的结果，记录在override_feedback_total中
+const (
+	feedbackAccepted = "accepted" // 补全被完整采纳
+	feedbackPartial  = "partial"  // 补全被部分采纳
+	feedbackRejected = "rejected" // 补全没有被采纳
+)
+
+// feedbackTarget是一个等待采纳反馈的请求
+type feedbackTarget struct {
+	id         string
+	endpoint   string
+	model      string // 映射后的模型
+	experiment string // 实验ID和分组，没有参与实验时为空
+	tenant     string
+	at         time.Time
+}
+
+// feedbackIndex按上游请求ID保存最近成功的补全请求，收到反馈时用来找到请求的模型和实验分组
+type feedbackIndex struct {
+	mu      sync.Mutex
+	pending map[string]*feedbackTarget
+	order   []*feedbackTarget // 按结束时间排列，用于丢弃最早和过期的请求
+}
+
+// newFeedbackIndex创建空的feedbackIndex
+func newFeedbackIndex() *feedbackIndex {
+	return &feedbackIndex{pending: make(map[string]*feedbackTarget)}
+}
+
+// expire丢弃过期的请求和超出数量的最早请求，调用方需持有锁
+func (f *feedbackIndex) expire(now time.Time) {
+	for len(f.order) > 0 && (len(f.order) > maxFeedbackRequests || now.Sub(f.order[0].at) > feedbackTTL) {
+		oldest := f.order[0]
+		f.order = f.order[1:]
+		if f.pending[oldest.id] == oldest {
+			delete(f.pending, oldest.id)
+		}
+	}
+}
+
+// remember在聊天或代码补全请求成功且上游返回了请求ID时保存请求，等待客户端的反馈
+func (f *feedbackIndex) remember(c *gin.Context, rec *usageRecord) {
+	id := c.Writer.Header().Get("X-Upstream-Request-Id")
+	if "" == id || http.StatusOK != rec.Status || ("chat" != rec.Endpoint && "codex" != rec.Endpoint) {
+		return
+	}
+
+	target := &feedbackTarget{
+		id:         id,
+		endpoint:   rec.Endpoint,
+		model:      rec.MappedModel,
+		experiment: rec.Experiment,
+		tenant:     rec.Tenant,
+		at:         time.Now(),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending[id] = target
+	f.order = append(f.order, target)
+	f.expire(target.at)
+}
+
+// take取出请求ID对应的请求，每个请求只接受一次反馈。请求不存在、已过期或来自另一个客户端时返回nil
+func (f *feedbackIndex) take(id string, tenant string) *feedbackTarget {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.expire(time.Now())
+	target, ok := f.pending[id]
+	if !ok || target.tenant != tenant {
+		return nil
+	}
+	delete(f.pending, id)
+	return target
+}
+
+// feedbackRequest是POST /v1/feedback的请求体
+type feedbackRequest struct {
+	RequestId string `json:"request_id"` // 响应头X-Upstream-Request-Id的值
+	Accepted  *bool  `json:"accepted"`
+	Partial   bool   `json:"partial"` // 只采纳了一部分，accepted为false时忽略
+}
+
+// completionFeedback处理POST /v1/feedback，把编辑器中补全是否被采纳汇总到请求的模型和实验分组。
+// 请求ID未知、已过期或已经反馈过时返回recorded为false，不返回错误
+func (s *ProxyService) completionFeedback(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	var req feedbackRequest
+	if err = json.Unmarshal(body, &req); nil != err || "" == req.RequestId || nil == req.Accepted {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", `body must be {"request_id": "...", "accepted": true or false, "partial": true or false}`)
+		return
+	}
+
+	target := s.feedbacks.take(req.RequestId, tenantOf(c))
+	if nil == target {
+		s.metrics.inc("override_feedback_unknown_total")
+		c.JSON(http.StatusOK, gin.H{"recorded": false, "reason": "unknown, expired or already recorded request_id"})
+		return
+	}
+
+	result := feedbackRejected
+	switch {
+	case *req.Accepted && req.Partial:
+		result = feedbackPartial
+	case *req.Accepted:
+		result = feedbackAccepted
+	}
+	s.stats.recordFeedback(target.model, target.experiment, result)
+	s.metrics.inc("override_feedback_total", "endpoint", target.endpoint, "model", target.model, "result", result)
+	c.JSON(http.StatusOK, gin.H{"recorded": true, "model": target.model, "experiment": target.experiment})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var (
+	// defaultChatStripFields是未配置chat_strip_fields时从聊天请求中删除的字段
+	defaultChatStripFields = []string{"intent", "intent_threshold", "intent_content"}
+	// defaultCodexStripFields是未配置codex_strip_fields时从代码补全请求中删除的字段
+	defaultCodexStripFields = []string{"extra", "nwo"}
+
+	// chatKnownFields是OpenAI聊天接口支持的顶层字段
+	chatKnownFields = []string{
+		"model", "messages", "temperature", "top_p", "n", "stream", "stream_options", "stop",
+		"max_tokens", "max_completion_tokens", "presence_penalty", "frequency_penalty",
+		"logit_bias", "logprobs", "top_logprobs", "user", "seed", "tools", "tool_choice",
+		"parallel_tool_calls", "functions", "function_call", "response_format", "service_tier",
+		"prediction",
+	}
+	// codexKnownFields是OpenAI补全接口支持的顶层字段
+	codexKnownFields = []string{
+		"model", "prompt", "suffix", "max_tokens", "temperature", "top_p", "n", "stream",
+		"stream_options", "logprobs", "echo", "stop", "presence_penalty", "frequency_penalty",
+		"best_of", "logit_bias", "user", "seed",
+	}
+
+	// seenFields记录已经打印过的未知字段，每个字段只打印一次
+	seenFields sync.Map
+)
+
+// stripFields删除请求体中的字段，支持a.b形式的嵌套路径
+func stripFields(body []byte, fields []string) []byte {
+	for _, field := range fields {
+		if "" == field {
+			continue
+		}
+		body, _ = sjson.DeleteBytes(body, field)
+	}
+
+	return body
+}
+
+// logUnknownFields在debug模式下打印请求中首次出现的未知顶层字段，方便配置需要删除的字段
+func logUnknownFields(endpoint string, body []byte, known []string, strip []string) {
+	var unknown []string
+	gjson.ParseBytes(body).ForEach(func(key, _ gjson.Result) bool {
+		field := key.String()
+		if slices.Contains(known, field) || slices.Contains(strip, field) {
+			return true
+		}
+		if _, seen := seenFields.LoadOrStore(endpoint+"."+field, true); !seen {
+			unknown = append(unknown, field)
+		}
+		return true
+	})
+
+	if len(unknown) > 0 {
+		log.Printf("unknown %s request fields: %s\n", endpoint, strings.Join(unknown, ", "))
+	}
+}
+
+// chatStripFields返回需要从聊天请求中删除的字段
+func (s *ProxyService) chatStripFields() []string {
+	if nil == s.cfg.ChatStripFields {
+		return defaultChatStripFields
+	}
+	return s.cfg.ChatStripFields
+}
+
+// codexStripFields返回需要从代码补全请求中删除的字段
+func (s *ProxyService) codexStripFields() []string {
+	if nil == s.cfg.CodexStripFields {
+		return defaultCodexStripFields
+	}
+	return s.cfg.CodexStripFields
+}
+
+const (
+	userFieldPassthrough = "passthrough" // 原样转发user字段
+	userFieldStrip       = "strip"       // 删除user字段
+	userFieldHash        = "hash"        // 用加盐的SHA-256替换user字段
+
+	// userSaltFile保存首次启动时生成的盐，保证重启后哈希结果不变
+	userSaltFile = "user_salt"
+)
+
+// checkUserFieldMode检查user_field_mode的取值
+func checkUserFieldMode(mode string) error {
+	switch mode {
+	case "", userFieldPassthrough, userFieldStrip, userFieldHash:
+		return nil
+	}
+	return fmt.Errorf("unsupported user_field_mode: %s", mode)
+}
+
+// loadUserSalt返回user_field_mode为hash时使用的盐，未配置user_field_salt时读取或生成userSaltFile
+func loadUserSalt(cfg *config) (string, error) {
+	if err := checkUserFieldMode(cfg.UserFieldMode); nil != err || userFieldHash != cfg.UserFieldMode {
+		return "", err
+	}
+
+	if "" != cfg.UserFieldSalt {
+		return cfg.UserFieldSalt, nil
+	}
+
+	content, err := os.ReadFile(userSaltFile)
+	if nil == err {
+		return strings.TrimSpace(string(content)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); nil != err {
+		return "", err
+	}
+	salt := hex.EncodeToString(buf)
+	if err = os.WriteFile(userSaltFile, []byte(salt+"\n"), 0600); nil != err {
+		return "", err
+	}
+	log.Println("generated user field salt in", userSaltFile)
+
+	return salt, nil
+}
+
+// transformUser按user_field_mode处理请求体中的user字段
+func (s *ProxyService) transformUser(body []byte) []byte {
+	user := gjson.GetBytes(body, "user")
+	if !user.Exists() {
+		return body
+	}
+
+	switch s.cfg.UserFieldMode {
+	case userFieldStrip:
+		body, _ = sjson.DeleteBytes(body, "user")
+	case userFieldHash:
+		sum := sha256.Sum256([]byte(s.userSalt + user.String()))
+		body, _ = sjson.SetBytes(body, "user", hex.EncodeToString(sum[:]))
+	}
+
+	return body
+}
+
+// transformPrediction处理prediction字段：映射后的模型不在prediction_models中时删除，
+// 开启codex_prediction的代码补全请求在上游支持时用suffix构造prediction
+func (s *ProxyService) transformPrediction(endpoint string, body []byte, model string) []byte {
+	if !slices.Contains(s.cfg.PredictionModels, model) {
+		body, _ = sjson.DeleteBytes(body, "prediction")
+		return body
+	}
+
+	if "codex" != endpoint || !s.cfg.CodexPrediction || gjson.GetBytes(body, "prediction").Exists() {
+		return body
+	}
+	suffix := gjson.GetBytes(body, "suffix").String()
+	if "" == suffix {
+		return body
+	}
+	body, _ = sjson.SetBytes(body, "prediction", map[string]string{"type": "content", "content": suffix})
+
+	return body
+}
+
+// capMaxTokens把max_tokens限制在limit以内，limit不大于0时不限制；开启inject_max_tokens且请求没有指定max_tokens时填入limit。
+// 请求使用max_completion_tokens时不再填入max_tokens，上游不接受同时指定两者
+func (s *ProxyService) capMaxTokens(body []byte, limit int) []byte {
+	if limit <= 0 {
+		return body
+	}
+
+	value := gjson.GetBytes(body, "max_tokens")
+	if value.Exists() && gjson.Null != value.Type {
+		if value.Int() > int64(limit) {
+			body, _ = sjson.SetBytesOptions(body, "max_tokens", limit, inPlace)
+		}
+		return body
+	}
+	if s.cfg.InjectMaxTokens && !gjson.GetBytes(body, "max_completion_tokens").Exists() {
+		body, _ = sjson.SetBytesOptions(body, "max_tokens", limit, inPlace)
+	}
+
+	return body
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestTransformPrediction(t *testing.T) {
+	prediction := `{"type":"content","content":"return a + b\n}"}`
+	tests := []struct {
+		name     string
+		cfg      config
+		endpoint string
+		model    string
+		body     string
+		want     string // 转换后的prediction，为空表示字段被删除
+	}{
+		{
+			name:     "chat model supports prediction",
+			cfg:      config{PredictionModels: []string{"gpt-4o"}},
+			endpoint: "chat",
+			model:    "gpt-4o",
+			body:     `{"model":"gpt-4o","prediction":` + prediction + `}`,
+			want:     prediction,
+		},
+		{
+			name:     "chat model without prediction support",
+			cfg:      config{PredictionModels: []string{"gpt-4o"}},
+			endpoint: "chat",
+			model:    "qwen2.5-coder",
+			body:     `{"model":"qwen2.5-coder","prediction":` + prediction + `}`,
+		},
+		{
+			name:     "prediction_models not configured",
+			endpoint: "chat",
+			model:    "gpt-4o",
+			body:     `{"model":"gpt-4o","prediction":` + prediction + `}`,
+		},
+		{
+			name:     "codex prediction built from suffix",
+			cfg:      config{PredictionModels: []string{InstructModel}, CodexPrediction: true},
+			endpoint: "codex",
+			model:    InstructModel,
+			body:     `{"prompt":"func add(a, b int) int {\n","suffix":"return a + b\n}"}`,
+			want:     prediction,
+		},
+		{
+			name:     "codex prediction from the client is kept",
+			cfg:      config{PredictionModels: []string{InstructModel}, CodexPrediction: true},
+			endpoint: "codex",
+			model:    InstructModel,
+			body:     `{"prompt":"x","suffix":"y","prediction":` + prediction + `}`,
+			want:     prediction,
+		},
+		{
+			name:     "codex without suffix",
+			cfg:      config{PredictionModels: []string{InstructModel}, CodexPrediction: true},
+			endpoint: "codex",
+			model:    InstructModel,
+			body:     `{"prompt":"x","suffix":""}`,
+		},
+		{
+			name:     "codex_prediction disabled",
+			cfg:      config{PredictionModels: []string{InstructModel}},
+			endpoint: "codex",
+			model:    InstructModel,
+			body:     `{"prompt":"x","suffix":"return a + b\n}"}`,
+		},
+		{
+			name:     "codex model without prediction support",
+			cfg:      config{CodexPrediction: true},
+			endpoint: "codex",
+			model:    InstructModel,
+			body:     `{"prompt":"x","suffix":"y","prediction":` + prediction + `}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ProxyService{cfg: &tt.cfg}
+			got := gjson.GetBytes(s.transformPrediction(tt.endpoint, []byte(tt.body), tt.model), "prediction")
+			if "" == tt.want {
+				if got.Exists() {
+					t.Fatalf("prediction = %s, want it removed", got.Raw)
+				}
+				return
+			}
+			if !reflect.DeepEqual(gjson.Parse(tt.want).Value(), got.Value()) {
+				t.Fatalf("prediction = %s, want %s", got.Raw, tt.want)
+			}
+		})
+	}
+}
+
+// TestTransformChatPredictionUsesMappedModel检查prediction_models按映射后的模型判断
+func TestTransformChatPredictionUsesMappedModel(t *testing.T) {
+	cfg := &config{
+		ChatModelMap:     map[string]string{"gpt-4o": "deepseek-chat", "gpt-4.1": "gpt-4.1-mini"},
+		PredictionModels: []string{"gpt-4.1-mini"},
+	}
+	s, _ := newTestProxy(t, cfg, "http://127.0.0.1:1")
+
+	for model, kept := range map[string]bool{"gpt-4o": false, "gpt-4.1": true} {
+		body := `{"model":"` + model + `","messages":[{"role":"user","content":"edit"}],"prediction":{"type":"content","content":"old code"}}`
+		out, _, mapped := s.transformChat([]byte(body), nil, nil)
+		if exists := gjson.GetBytes(out, "prediction").Exists(); kept != exists {
+			t.Errorf("%s -> %s: prediction kept = %v, want %v", model, mapped, exists, kept)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var (
+	// standardFinishReasons是OpenAI接口的finish_reason取值，原样转发
+	standardFinishReasons = []string{"stop", "length", "tool_calls", "content_filter", "function_call"}
+
+	// defaultFinishReasonMap是各上游常见的非标准finish_reason，finish_reason_map中的配置优先
+	defaultFinishReasonMap = map[string]string{
+		"eos":           "stop",
+		"eos_token":     "stop",
+		"end_turn":      "stop",
+		"stop_sequence": "stop",
+		"max_tokens":    "length",
+		"model_length":  "length",
+		"tool_use":      "tool_calls",
+		"safety":        "content_filter",
+		"recitation":    "content_filter",
+	}
+)
+
+// normalizeFinishReason把非标准的finish_reason转换为标准取值，未知的取值转换为stop
+func (s *ProxyService) normalizeFinishReason(reason string) string {
+	if mapped, ok := s.cfg.FinishReasonMap[reason]; ok {
+		return mapped
+	}
+	if slices.Contains(standardFinishReasons, reason) {
+		return reason
+	}
+	if mapped, ok := defaultFinishReasonMap[reason]; ok {
+		return mapped
+	}
+
+	if s.cfg.Debug {
+		log.Printf("unknown finish_reason %q, using stop\n", reason)
+	}
+	return "stop"
+}
+
+// normalizeChoices改写响应或流式事件中各choice的finish_reason，没有改动时返回nil。
+// 非流式响应的finish_reason为null时改为stop，流式事件中间的null是正常的
+func (s *ProxyService) normalizeChoices(data []byte, stream bool) []byte {
+	var changed []byte
+	gjson.GetBytes(data, "choices").ForEach(func(i, choice gjson.Result) bool {
+		reason := choice.Get("finish_reason")
+		var normalized string
+		switch {
+		case reason.Type == gjson.String:
+			normalized = s.normalizeFinishReason(reason.String())
+			if normalized == reason.String() {
+				return true
+			}
+		case !stream && choice.IsObject():
+			normalized = "stop"
+		default:
+			return true
+		}
+
+		if nil == changed {
+			changed = data
+		}
+		changed, _ = sjson.SetBytes(changed, "choices."+strconv.Itoa(int(i.Int()))+".finish_reason", normalized)
+		return true
+	})
+
+	return changed
+}
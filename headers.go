@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version是程序的版本，发布时通过-ldflags "-X main.version=v1.2.3"设置
+var version = "dev"
+
+// blockedHeaders是不转发给上游的客户端请求头，即使在forward_headers中：
+// 客户端的凭据、浏览器和编辑器的标识（如Copilot的机器ID），以及由override或net/http设置的请求头。
+// Accept-Encoding只在原样转发时由targetHeaders转发
+var blockedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Api-Key":             true,
+	"X-Api-Key":           true,
+	"X-Admin-Key":         true,
+	"Cookie":              true,
+	"Vscode-Machineid":    true,
+	"Vscode-Sessionid":    true,
+	"Editor-Device-Id":    true,
+	"Host":                true,
+	"Content-Length":      true,
+	"Content-Type":        true,
+	"Accept":              true,
+	"Accept-Encoding":     true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Transfer-Encoding":   true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Upgrade":             true,
+	"Expect":              true,
+}
+
+// checkForwardHeaders校验forward_headers，不允许列出不会转发的请求头，避免误以为已经转发
+func checkForwardHeaders(cfg *config) error {
+	for _, name := range cfg.ForwardHeaders {
+		if blockedHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("forward_headers: %s is never forwarded to the upstream", name)
+		}
+		if "" == strings.TrimSuffix(name, "*") {
+			return fmt.Errorf("forward_headers: %q matches every header", name)
+		}
+	}
+
+	return nil
+}
+
+// forwardMatch返回请求头name是否在forward_headers中，以*结尾的项按前缀匹配
+func forwardMatch(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		pattern = http.CanonicalHeaderKey(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedHeaders返回要转发给上游的客户端请求头：只转发forward_headers中列出的，
+// 并且不在blockedHeaders中。未配置forward_headers时不转发客户端的任何请求头
+func (s *ProxyService) forwardedHeaders(c *gin.Context) http.Header {
+	if 0 == len(s.cfg.ForwardHeaders) {
+		return nil
+	}
+
+	var forwarded http.Header
+	for name, values := range c.Request.Header {
+		if blockedHeaders[name] || !forwardMatch(s.cfg.ForwardHeaders, name) {
+			continue
+		}
+		if nil == forwarded {
+			forwarded = make(http.Header)
+		}
+		forwarded[name] = values
+	}
+
+	return forwarded
+}
+
+// headerTransport为所有上游请求设置User-Agent和upstream_headers，请求中已经设置的请求头（如密钥和模型路由的headers）不覆盖
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	headers   map[string]string
+}
+
+// newHeaderTransport创建headerTransport，未配置upstream_user_agent时使用override/<版本>
+func newHeaderTransport(cfg *config, base http.RoundTripper) *headerTransport {
+	userAgent := cfg.UpstreamUserAgent
+	if "" == userAgent {
+		userAgent = "override/" + version
+	}
+
+	return &headerTransport{base: base, userAgent: userAgent, headers: cfg.UpstreamHeaders}
+}
+
+// RoundTrip实现http.RoundTripper，在请求的副本上设置请求头
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if "" == req.Header.Get("User-Agent") {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	for name, value := range t.headers {
+		if "" == req.Header.Get(name) {
+			req.Header.Set(name, value)
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// targetHeaders返回转发给target的客户端请求头。原样转发时还转发客户端的Accept-Encoding，
+// 上游压缩的响应由relayBody连同Content-Encoding原样交给客户端
+func (s *ProxyService) targetHeaders(c *gin.Context, target *upstreamTarget) http.Header {
+	forwarded := s.forwardedHeaders(c)
+	encoding := c.GetHeader("Accept-Encoding")
+	if !target.raw || "" == encoding {
+		return forwarded
+	}
+
+	if nil == forwarded {
+		forwarded = make(http.Header)
+	}
+	forwarded.Set("Accept-Encoding", encoding)
+	return forwarded
+}
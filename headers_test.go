@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestUpstreamHeaders检查上游收到的请求头正好是代理设置的、upstream_headers和forward_headers中的，
+// 客户端的凭据和编辑器标识不转发，签名覆盖最终发送的User-Agent和upstream_headers
+func TestUpstreamHeaders(t *testing.T) {
+	type captured struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan captured, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- captured{r.Header.Clone(), body}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`)
+	}))
+	defer upstream.Close()
+
+	cfg := &config{
+		UpstreamUserAgent: "gateway-client/1.0",
+		UpstreamHeaders:   map[string]string{"X-Gateway-Tenant": "team-a"},
+		ForwardHeaders:    []string{"X-Stainless-*", "OpenAI-Beta"},
+		UpstreamHmac: &hmacConfig{
+			Secret:         "gateway-secret",
+			IncludeHeaders: []string{"date", "user-agent", "x-gateway-tenant"},
+		},
+	}
+	_, proxy := newTestProxy(t, cfg, upstream.URL)
+	status, _, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, map[string]string{
+		"Authorization":    "Bearer client-token",
+		"Cookie":           "session=1",
+		"Vscode-Machineid": "machine-1",
+		"Vscode-Sessionid": "session-1",
+		"Editor-Version":   "vscode/1.90.0",
+		"X-Stainless-Lang": "js",
+		"OpenAI-Beta":      "assistants=v2",
+	})
+	if http.StatusOK != status {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	got := <-requests
+
+	var names []string
+	for name := range got.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"Accept", "Accept-Encoding", "Authorization", "Content-Length", "Content-Type", "Date", "Openai-Beta", "User-Agent", "X-Gateway-Tenant", "X-Signature", "X-Stainless-Lang"}
+	if !reflect.DeepEqual(want, names) {
+		t.Fatalf("upstream headers = %v, want %v", names, want)
+	}
+
+	values := map[string]string{
+		"Accept":           "application/json",
+		"Authorization":    "Bearer sk-chat-test",
+		"User-Agent":       "gateway-client/1.0",
+		"X-Gateway-Tenant": "team-a",
+		"X-Stainless-Lang": "js",
+		"Openai-Beta":      "assistants=v2",
+	}
+	for name, value := range values {
+		if value != got.header.Get(name) {
+			t.Errorf("%s = %q, want %q", name, got.header.Get(name), value)
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte("gateway-secret"))
+	_, _ = io.WriteString(mac, "date:"+got.header.Get("Date")+"\nuser-agent:gateway-client/1.0\nx-gateway-tenant:team-a\n\n")
+	_, _ = mac.Write(got.body)
+	if signature := hex.EncodeToString(mac.Sum(nil)); signature != got.header.Get("X-Signature") {
+		t.Fatalf("X-Signature = %s, want %s over the headers sent", got.header.Get("X-Signature"), signature)
+	}
+}
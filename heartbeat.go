@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// heartbeatLoop每分钟检查一次流量：开启traffic_summary时输出上一分钟的请求数、错误数和Token数，
+// 超过idle_warning_minutes没有请求时记录一次提醒，直到重新有请求。ProxyService关闭时退出
+func (s *ProxyService) heartbeatLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	idleAfter := time.Duration(s.cfg.IdleWarningMinutes) * time.Minute
+	previous := s.stats.totals()
+	warned := false
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		current := s.stats.totals()
+		requests := current.Requests - previous.Requests
+		if s.cfg.TrafficSummary && requests > 0 {
+			log.Printf("%s: %d requests, %d errors, %d prompt tokens, %d completion tokens in the last minute\n",
+				s.label("traffic"), requests, current.Errors-previous.Errors,
+				current.PromptTokens-previous.PromptTokens, current.CompletionTokens-previous.CompletionTokens)
+		}
+		previous = current
+
+		if idleAfter <= 0 {
+			continue
+		}
+		if age := s.lastRequestAge(); age < idleAfter {
+			warned = false
+		} else if !warned {
+			warned = true
+			log.Printf("NOTICE: %s has handled no requests for %s, check that clients still use this proxy\n",
+				s.label("proxy"), age.Truncate(time.Second))
+		}
+	}
+}
+
+// lastRequestAge返回距最近一次真实请求的时间，启动后还没有请求时从启动时算起
+func (s *ProxyService) lastRequestAge() time.Duration {
+	last := time.Unix(s.traffic.last.Load(), 0)
+	if last.Before(s.stats.start) {
+		last = s.stats.start
+	}
+
+	return time.Since(last)
+}
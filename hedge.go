@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultHedgeBudget是未配置hedge_budget_percent时每分钟最多对冲的代码补全请求比例
+const defaultHedgeBudget = 10
+
+// codexHedger在代码补全请求超过hedge_delay_ms还没有响应时再发送一个相同的请求，使用先响应的一个。
+// 每分钟对冲的请求数不超过请求数的hedge_budget_percent，按当前分钟和上一分钟中较多的请求数计算
+type codexHedger struct {
+	delay   time.Duration
+	percent float64
+
+	mu       sync.Mutex
+	window   time.Time // 当前分钟的开始时间
+	requests int       // 当前分钟的请求数
+	hedged   int       // 当前分钟对冲的请求数
+	previous int       // 上一分钟的请求数
+}
+
+// checkHedge检查对冲相关的配置
+func checkHedge(cfg *config) error {
+	if cfg.HedgeBudget < 0 || cfg.HedgeBudget > 100 {
+		return fmt.Errorf("hedge_budget_percent must be between 0 and 100, got %g", cfg.HedgeBudget)
+	}
+	return nil
+}
+
+// newCodexHedger根据hedge_delay_ms创建codexHedger，未配置时返回nil
+func newCodexHedger(cfg *config) *codexHedger {
+	if cfg.HedgeDelay <= 0 {
+		return nil
+	}
+
+	h := &codexHedger{delay: time.Duration(cfg.HedgeDelay) * time.Millisecond, percent: cfg.HedgeBudget}
+	if 0 == h.percent {
+		h.percent = defaultHedgeBudget
+	}
+	return h
+}
+
+// roll在进入新的一分钟时重新计数，调用方需持有锁
+func (h *codexHedger) roll(now time.Time) {
+	window := now.Truncate(time.Minute)
+	if window.Equal(h.window) {
+		return
+	}
+
+	h.previous = 0
+	if window.Sub(h.window) == time.Minute {
+		h.previous = h.requests
+	}
+	h.window, h.requests, h.hedged = window, 0, 0
+}
+
+// request记录一个发往上游的代码补全请求
+func (h *codexHedger) request() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.roll(time.Now())
+	h.requests++
+}
+
+// allow在预算内时记录一次对冲并返回true
+func (h *codexHedger) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.roll(time.Now())
+	if float64(h.hedged+1) > float64(max(h.requests, h.previous))*h.percent/100 {
+		return false
+	}
+	h.hedged++
+	return true
+}
+
+// hedgeAttempt是一次上游请求的结果
+type hedgeAttempt struct {
+	resp  *http.Response
+	err   error
+	hedge bool // 是否为对冲的请求
+}
+
+// usable返回结果能否直接使用，网络错误和5xx时等待另一个请求
+func (a hedgeAttempt) usable() bool {
+	return nil == a.err && a.resp.StatusCode < http.StatusInternalServerError
+}
+
+// sendCodex发送代码补全请求，流式响应等到第一个数据事件。配置了hedge_delay_ms时，超过这段时间还没有响应就在
+// 预算和并发名额允许时向上游再发送一个相同的请求，使用先响应的一个并取消另一个。对冲的请求使用下一个密钥，
+// 占用的并发名额在两个请求都结束后归还
+func (s *ProxyService) sendCodex(ctx context.Context, target *upstreamTarget, body []byte) (*http.Response, error) {
+	if nil == s.hedger {
+		resp, err := s.doUpstream(ctx, target, body)
+		if nil == err {
+			resp, err = s.retryStream(ctx, target, body, resp)
+		}
+		return resp, err
+	}
+
+	// 没有被使用的请求在后台结束，可能晚于调用方归还请求体的缓冲区，两个请求使用各自的副本
+	body = bytes.Clone(body)
+	s.hedger.request()
+	results := make(chan hedgeAttempt, 2)
+	start := func(hedge bool) context.CancelFunc {
+		attempt, cancel := context.WithCancel(ctx)
+		go func() {
+			resp, err := s.doUpstream(attempt, target, body)
+			if nil == err {
+				resp, err = s.retryStream(attempt, target, body, resp)
+			}
+			results <- hedgeAttempt{resp: resp, err: err, hedge: hedge}
+		}()
+		return cancel
+	}
+
+	// cancels[0]为原来的请求，cancels[1]为对冲的请求
+	cancels := []context.CancelFunc{start(false)}
+	timer := time.NewTimer(s.hedger.delay)
+	defer timer.Stop()
+
+	pending := 1
+	var failed *hedgeAttempt
+	for {
+		select {
+		case <-timer.C:
+			if nil != ctx.Err() {
+				continue
+			}
+			// 对冲的请求同样受max_concurrency限制，没有空闲名额时不等待
+			if !s.scheduler.tryAcquire(priorityCodex) {
+				s.metrics.inc("override_codex_hedge_skipped_total", "reason", "concurrency")
+				continue
+			}
+			if !s.hedger.allow() {
+				s.scheduler.release()
+				s.metrics.inc("override_codex_hedge_skipped_total", "reason", "budget")
+				continue
+			}
+			s.metrics.inc("override_codex_hedged_total")
+			cancels = append(cancels, start(true))
+			pending++
+
+		case result := <-results:
+			pending--
+			if !result.usable() && pending > 0 {
+				failed = &result
+				continue
+			}
+			if nil != failed && nil == failed.err {
+				closeIO(failed.resp.Body)
+			}
+
+			winner, loser := 0, 1
+			if result.hedge {
+				winner, loser = 1, 0
+			}
+			if result.hedge && result.usable() {
+				s.metrics.inc("override_codex_hedge_wins_total")
+			}
+			if len(cancels) > 1 {
+				s.dropHedgeLoser(cancels[loser], results, pending > 0)
+			}
+			if nil != result.err {
+				cancels[winner]()
+				return nil, result.err
+			}
+			result.resp.Body = cancelBody{result.resp.Body, cancels[winner]}
+			return result.resp, nil
+		}
+	}
+}
+
+// dropHedgeLoser取消没有被使用的请求，在后台等它结束后关闭响应体并归还对冲请求占用的并发名额
+func (s *ProxyService) dropHedgeLoser(cancel context.CancelFunc, results chan hedgeAttempt, pending bool) {
+	cancel()
+	if !pending {
+		s.scheduler.release()
+		return
+	}
+
+	go func() {
+		if result := <-results; nil == result.err {
+			closeIO(result.resp.Body)
+		}
+		s.scheduler.release()
+	}()
+}
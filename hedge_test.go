@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// hedgeTransport让原来的请求在对冲的请求发出后立即成功，对冲的请求等到overwritten关闭后才读取请求体
+type hedgeTransport struct {
+	calls       atomic.Int32
+	hedged      chan struct{}
+	overwritten chan struct{}
+	sent        chan string
+}
+
+func (tr *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if 1 == tr.calls.Add(1) {
+		<-tr.hedged
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"choices":[{"index":0,"text":"}"}]}`)),
+			Request:    req,
+		}, nil
+	}
+
+	close(tr.hedged)
+	<-tr.overwritten
+	body, _ := io.ReadAll(req.Body)
+	tr.sent <- string(body)
+	return nil, req.Context().Err()
+}
+
+// TestHedgeLoserKeepsBody检查没有被使用的对冲请求在调用方归还并复用请求体的缓冲区之后，发送的仍是原来的请求体
+func TestHedgeLoserKeepsBody(t *testing.T) {
+	s, _ := newTestProxy(t, &config{HedgeDelay: 10, HedgeBudget: 100}, "http://127.0.0.1:1")
+	tr := &hedgeTransport{hedged: make(chan struct{}), overwritten: make(chan struct{}), sent: make(chan string, 1)}
+	s.client.Transport = tr
+
+	request := `{"prompt":"func main() {","max_tokens":16}`
+	body := []byte(request)
+	resp, err := s.sendCodex(context.Background(), s.codexTarget(), body)
+	if nil != err {
+		t.Fatal(err)
+	}
+	closeIO(resp.Body)
+
+	// 请求结束后缓冲区被下一个请求复用
+	copy(body, bytes.Repeat([]byte("x"), len(body)))
+	close(tr.overwritten)
+	if sent := <-tr.sent; request != sent {
+		t.Fatalf("hedged request sent %q, want %q", sent, request)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultHookTimeout是未配置hook_timeout_ms时每次执行钩子的最长时间
+	defaultHookTimeout = 2 * time.Second
+	// defaultHookConcurrency是未配置hook_concurrency时每个钩子同时执行的最大数量
+	defaultHookConcurrency = 4
+	// defaultHookFailures是未配置hook_failure_threshold时停用钩子的连续失败次数
+	defaultHookFailures = 5
+	// defaultHookCooldown是未配置hook_cooldown_seconds时钩子停用的时长
+	defaultHookCooldown = time.Minute
+	// maxHookOutput是钩子标准输出的最大字节数，超过时按失败处理
+	maxHookOutput = 16 << 20
+)
+
+// 钩子一次执行的结果，记录在override_hook_runs_total中
+const (
+	hookOk       = "ok"       // 执行成功
+	hookRejected = "rejected" // pre_request_hook拒绝了请求
+	hookFailed   = "failed"   // 无法启动、超时、没有输出的非零退出或输出不是JSON
+	hookSkipped  = "skipped"  // 钩子已停用或并发已满，没有执行
+)
+
+// hookRunner执行一个外部命令，限制每次执行的时间和同时执行的数量，连续失败时暂时停用
+type hookRunner struct {
+	name      string // 配置项名称，用于日志和指标
+	argv      []string
+	filter    bool // 输出替换请求体：非零退出且有输出时拒绝请求，有输出时必须是JSON
+	timeout   time.Duration
+	slots     chan struct{}
+	threshold int
+	cooldown  time.Duration
+	metrics   *metrics
+
+	mu       sync.Mutex
+	failures int       // 连续失败次数
+	disabled time.Time // 停用到的时间
+}
+
+// newHookRunner创建钩子，argv为空时返回nil
+func newHookRunner(name string, argv []string, filter bool, cfg *config, m *metrics) *hookRunner {
+	if 0 == len(argv) {
+		return nil
+	}
+
+	h := &hookRunner{
+		name:      name,
+		argv:      argv,
+		filter:    filter,
+		timeout:   time.Duration(cfg.HookTimeoutMs) * time.Millisecond,
+		threshold: cfg.HookFailureThreshold,
+		cooldown:  time.Duration(cfg.HookCooldown) * time.Second,
+		metrics:   m,
+	}
+	if h.timeout <= 0 {
+		h.timeout = defaultHookTimeout
+	}
+	concurrency := cfg.HookConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultHookConcurrency
+	}
+	h.slots = make(chan struct{}, concurrency)
+	if h.threshold <= 0 {
+		h.threshold = defaultHookFailures
+	}
+	if h.cooldown <= 0 {
+		h.cooldown = defaultHookCooldown
+	}
+	log.Printf("%s enabled: %s\n", name, strings.Join(argv, " "))
+
+	return h
+}
+
+// checkHooks检查pre_request_hook和post_response_hook配置的命令存在并且可以执行
+func checkHooks(cfg *config) error {
+	for _, hook := range []struct {
+		name string
+		argv []string
+	}{{"pre_request_hook", cfg.PreRequestHook}, {"post_response_hook", cfg.PostResponseHook}} {
+		if 0 == len(hook.argv) {
+			continue
+		}
+		if "" == hook.argv[0] {
+			return fmt.Errorf("%s: empty command", hook.name)
+		}
+		if _, err := exec.LookPath(hook.argv[0]); nil != err {
+			return fmt.Errorf("%s: %w", hook.name, err)
+		}
+	}
+	return nil
+}
+
+// available返回钩子是否没有被停用
+func (h *hookRunner) available() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().After(h.disabled)
+}
+
+// result记录一次执行的结果，连续失败达到阈值时停用钩子，停用后第一次成功时恢复
+func (h *hookRunner) result(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if nil == err {
+		if h.failures >= h.threshold {
+			log.Printf("%s succeeded again, re-enabled\n", h.name)
+		}
+		h.failures = 0
+		return
+	}
+
+	h.failures++
+	logError("%s failed: %v\n", h.name, err)
+	if h.failures >= h.threshold {
+		h.disabled = time.Now().Add(h.cooldown)
+		logError("!!! %s failed %d times in a row, skipping it for %s: %v\n", h.name, h.failures, h.cooldown, err)
+	}
+}
+
+// errHookRejected表示钩子以非零状态退出并在标准输出中给出了拒绝的原因
+var errHookRejected = errors.New("rejected by hook")
+
+// run把input写入钩子的标准输入并返回标准输出。没有空闲的并发名额或钩子已停用时ok为false。
+// filter钩子非零退出且标准输出不为空时返回errHookRejected，其他错误计入连续失败
+func (h *hookRunner) run(input []byte, env []string) (output []byte, ok bool, err error) {
+	if !h.available() {
+		h.metrics.inc("override_hook_runs_total", "hook", h.name, "result", hookSkipped)
+		return nil, false, nil
+	}
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	default:
+		h.metrics.inc("override_hook_runs_total", "hook", h.name, "result", hookSkipped)
+		return nil, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.argv[0], h.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &limitedBuffer{buf: &stdout, limit: maxHookOutput}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, limit: defaultLogBodyLimit}
+	cmd.Env = append(os.Environ(), env...)
+	// 超时后子进程留下的管道不会一直占用钩子
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case nil != ctx.Err():
+		err = fmt.Errorf("timed out after %s", h.timeout)
+	case h.filter && errors.As(err, &exitErr) && 0 != len(bytes.TrimSpace(stdout.Bytes())):
+		h.metrics.inc("override_hook_runs_total", "hook", h.name, "result", hookRejected)
+		h.result(nil)
+		return stdout.Bytes(), true, errHookRejected
+	case nil != err && stderr.Len() > 0:
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if nil == err && stdout.Len() > maxHookOutput {
+		err = fmt.Errorf("output exceeds %d bytes", maxHookOutput)
+	}
+	if output := bytes.TrimSpace(stdout.Bytes()); nil == err && h.filter && 0 != len(output) && !json.Valid(output) {
+		err = errors.New("output is not valid JSON")
+	}
+	if nil != err {
+		h.metrics.inc("override_hook_runs_total", "hook", h.name, "result", hookFailed)
+		h.result(err)
+		return nil, true, err
+	}
+
+	h.metrics.inc("override_hook_runs_total", "hook", h.name, "result", hookOk)
+	h.result(nil)
+	return stdout.Bytes(), true, nil
+}
+
+// limitedBuffer最多保存limit+1个字节，多出的内容被丢弃，用于判断输出是否超过限制
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+// Write实现io.Writer
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit + 1 - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// hookEnv返回传给钩子的环境变量
+func hookEnv(rec *usageRecord) []string {
+	return []string{
+		"OVERRIDE_ENDPOINT=" + rec.Endpoint,
+		"OVERRIDE_MODEL=" + rec.Model,
+		"OVERRIDE_MAPPED_MODEL=" + rec.MappedModel,
+	}
+}
+
+// preRequestHook把转换后的请求体交给pre_request_hook，返回钩子修改后的请求体。
+// 钩子拒绝请求时返回拒绝的原因；钩子失败、停用或繁忙时原样返回请求体，不影响请求
+func (s *ProxyService) preRequestHook(c *gin.Context, rec *usageRecord, body []byte) ([]byte, string) {
+	if nil == s.preHook {
+		return body, ""
+	}
+
+	output, ran, err := s.preHook.run(body, hookEnv(rec))
+	if errors.Is(err, errHookRejected) {
+		reason := strings.TrimSpace(string(output))
+		log.Printf("%s request rejected by pre_request_hook: %s\n", s.label(rec.Endpoint), s.sanitizeLogBody([]byte(reason)))
+		_ = c.Error(errors.New("rejected by pre_request_hook"))
+		return body, reason
+	}
+	if !ran || nil != err {
+		return body, ""
+	}
+
+	// 没有输出表示不修改请求体
+	if output = bytes.TrimSpace(output); 0 == len(output) {
+		return body, ""
+	}
+	return output, ""
+}
+
+// hookSummary是post_response_hook在标准输入中收到的请求摘要
+type hookSummary struct {
+	Time             time.Time `json:"time"`
+	Endpoint         string    `json:"endpoint"`
+	Model            string    `json:"model"`
+	MappedModel      string    `json:"mapped_model"`
+	Upstream         string    `json:"upstream,omitempty"`
+	Tenant           string    `json:"tenant,omitempty"`
+	Status           int       `json:"status"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	LatencyMs        int64     `json:"latency_ms"`
+	FirstTokenMs     int64     `json:"ttft_ms,omitempty"`
+}
+
+// postResponseHook在后台把请求摘要交给post_response_hook，钩子繁忙时丢弃，不等待钩子结束
+func (s *ProxyService) postResponseHook(rec *usageRecord) {
+	if nil == s.postHook {
+		return
+	}
+
+	summary, err := json.Marshal(hookSummary{
+		Time:             rec.Time.UTC(),
+		Endpoint:         rec.Endpoint,
+		Model:            rec.Model,
+		MappedModel:      rec.MappedModel,
+		Upstream:         rec.Upstream,
+		Tenant:           rec.Tenant,
+		Status:           rec.Status,
+		PromptTokens:     rec.PromptTokens,
+		CompletionTokens: rec.CompletionTokens,
+		Cost:             rec.Cost,
+		LatencyMs:        rec.Latency.Milliseconds(),
+		FirstTokenMs:     rec.FirstToken.Milliseconds(),
+	})
+	if nil != err {
+		return
+	}
+	env := hookEnv(rec)
+	go func() {
+		_, _, _ = s.postHook.run(summary, env)
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// imagesApiBase返回图片接口的上游地址，未配置images_api_base时使用chat_api_base
+func (s *ProxyService) imagesApiBase() string {
+	if "" == s.cfg.ImagesApiBase {
+		return s.cfg.ChatApiBase
+	}
+	return s.cfg.ImagesApiBase
+}
+
+// imagesTarget返回图片接口的上游，未配置images_api_base和images_api_key时使用Chat的配置
+func (s *ProxyService) imagesTarget() *upstreamTarget {
+	return &upstreamTarget{
+		name:         "images",
+		url:          upstreamUrl(s.imagesApiBase(), "/images/generations"),
+		keys:         s.imageKeys,
+		organization: s.cfg.ChatApiOrganization,
+		project:      s.cfg.ChatApiProject,
+	}
+}
+
+// checkImageRequest按images_max_n和images_sizes检查请求，超出限制时返回错误
+func (s *ProxyService) checkImageRequest(body []byte) error {
+	n := gjson.GetBytes(body, "n")
+	if limit := s.cfg.ImagesMaxN; limit > 0 && n.Int() > int64(limit) {
+		return fmt.Errorf("n must not exceed %d", limit)
+	}
+
+	size := gjson.GetBytes(body, "size").String()
+	if "" != size && 0 != len(s.cfg.ImagesSizes) && !slices.Contains(s.cfg.ImagesSizes, size) {
+		return fmt.Errorf("size must be one of %s", strings.Join(s.cfg.ImagesSizes, ", "))
+	}
+
+	return nil
+}
+
+// imageGenerations处理/v1/images/generations请求，映射模型并检查数量和尺寸后原样转发
+func (s *ProxyService) imageGenerations(c *gin.Context) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	rec := s.stats.begin(c, "images")
+	defer s.finishRecord(c, rec)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	if !gjson.ValidBytes(body) {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "request body is not valid JSON")
+		return
+	}
+	if err = s.checkImageRequest(body); nil != err {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	rec.Model = gjson.GetBytes(body, "model").String()
+	rec.MappedModel = rec.Model
+	if mapped, ok := s.cfg.ImagesModelMap[rec.Model]; ok {
+		rec.MappedModel = mapped
+		body, _ = sjson.SetBytes(body, "model", mapped)
+	}
+
+	target := s.imagesTarget()
+	target.forwarded = s.forwardedHeaders(c)
+	s.useTarget(c, rec, target)
+	resp, err := s.doUpstream(ctx, target, body)
+	s.relayPassthrough(c, target, resp, err)
+}
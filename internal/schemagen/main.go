@@ -0,0 +1,155 @@
+// schemagen从override的源代码中取出结构体和字段的注释，生成config-schema使用的说明。
+// 由schema.go中的go:generate调用，配置项增加或注释修改后执行go generate
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	output := flag.String("o", "schema_docs.go", "generated file")
+	flag.Parse()
+
+	if err := generate(".", *output); nil != err {
+		fmt.Fprintln(os.Stderr, "schemagen:", err)
+		os.Exit(1)
+	}
+}
+
+// generate解析dir中的源代码（不含测试和生成的文件），把注释写入output
+func generate(dir string, output string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if nil != err {
+		return err
+	}
+
+	decls := make(map[string]typeDecl)
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") || filepath.Base(name) == filepath.Base(output) {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if nil != err {
+			return err
+		}
+		collectTypes(file, decls)
+	}
+	if _, ok := decls["config"]; !ok {
+		return fmt.Errorf("no config struct in %s", dir)
+	}
+
+	c := &collector{decls: decls, seen: make(map[string]bool), fields: make(map[string]string), types: make(map[string]string)}
+	c.describe("config")
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by go run ./internal/schemagen; DO NOT EDIT.\n\npackage main\n\n")
+	writeMap(&buf, "schemaFieldDocs", "schemaFieldDocs是结构体字段的注释，类型名.字段名 -> 注释", c.fields)
+	buf.WriteString("\n")
+	writeMap(&buf, "schemaTypeDocs", "schemaTypeDocs是结构体类型的注释", c.types)
+
+	content, err := format.Source(buf.Bytes())
+	if nil != err {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, output), content, 0644)
+}
+
+// typeDecl是源代码中的一个类型定义
+type typeDecl struct {
+	doc  *ast.CommentGroup
+	expr ast.Expr
+}
+
+// collectTypes取出file中的类型定义
+func collectTypes(file *ast.File, decls map[string]typeDecl) {
+	for _, decl := range file.Decls {
+		decl, ok := decl.(*ast.GenDecl)
+		if !ok || token.TYPE != decl.Tok {
+			continue
+		}
+		for _, spec := range decl.Specs {
+			spec := spec.(*ast.TypeSpec)
+			doc := spec.Doc
+			if nil == doc {
+				doc = decl.Doc
+			}
+			decls[spec.Name.Name] = typeDecl{doc: doc, expr: spec.Type}
+		}
+	}
+}
+
+// collector从config开始沿着字段的类型记录结构体和字段的注释，只包含配置文件中能出现的类型
+type collector struct {
+	decls  map[string]typeDecl
+	seen   map[string]bool
+	fields map[string]string // 类型名.字段名 -> 注释
+	types  map[string]string // 结构体类型名 -> 注释
+}
+
+// describe记录类型name，结构体记录它和字段的注释（字段优先使用行尾注释），
+// 其他类型（如map）只沿着定义查找用到的结构体
+func (c *collector) describe(name string) {
+	decl, ok := c.decls[name]
+	if !ok || c.seen[name] {
+		return
+	}
+	c.seen[name] = true
+
+	st, ok := decl.expr.(*ast.StructType)
+	if !ok {
+		c.describeExpr(decl.expr)
+		return
+	}
+	if doc := strings.TrimSpace(decl.doc.Text()); "" != doc {
+		c.types[name] = doc
+	}
+	for _, field := range st.Fields.List {
+		comment := field.Comment
+		if nil == comment {
+			comment = field.Doc
+		}
+		if doc := strings.TrimSpace(comment.Text()); "" != doc {
+			for _, fieldName := range field.Names {
+				c.fields[name+"."+fieldName.Name] = doc
+			}
+		}
+		c.describeExpr(field.Type)
+	}
+}
+
+// describeExpr记录类型表达式（如*T、[]T、map[string]T）中用到的类型
+func (c *collector) describeExpr(expr ast.Expr) {
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			c.describe(ident.Name)
+		}
+		return true
+	})
+}
+
+// writeMap按key排序写出map，生成的文件内容稳定
+func writeMap(buf *bytes.Buffer, name string, doc string, values map[string]string) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(buf, "// %s\nvar %s = map[string]string{\n", doc, name)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "\t%s: %s,\n", strconv.Quote(key), strconv.Quote(values[key]))
+	}
+	buf.WriteString("}\n")
+}
@@ -0,0 +1,129 @@
+// Package sse逐个读取和编码Server-Sent Events事件，供需要检查或改写流式响应的功能共用。
+// 事件可以跨越任意多次读取，行结束符可以是LF、CRLF或单独的CR，以冒号开头的注释行保留在原始内容中
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Event是一个SSE事件
+type Event struct {
+	Raw  []byte // 原始内容，包含结尾的空行
+	Name string // event字段
+	Data []byte // 所有data字段按行拼接后的内容
+}
+
+// Done判断是否为结束事件data: [DONE]
+func (e *Event) Done() bool {
+	return bytes.Equal(e.Data, []byte("[DONE]"))
+}
+
+// SetData替换事件的data，多行内容拆成多个data字段，保证改写后的事件不会破坏流的分隔
+func (e *Event) SetData(data []byte) {
+	e.Data = data
+	e.Raw = Encode(e.Name, data)
+}
+
+// Encode按SSE格式编码一个事件
+func Encode(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	if "" != name {
+		buf.WriteString("event: " + name + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+// Reader从流中逐个读取SSE事件
+type Reader struct {
+	r      *bufio.Reader
+	skipLF bool // 上一行以CR结束且当时还没有收到后面的内容，如果下一个字节是LF则属于同一个CRLF
+}
+
+// NewReader创建Reader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// readLine读取一行，返回的内容包含行结束符
+func (r *Reader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.r.ReadByte()
+		if nil != err {
+			return line, err
+		}
+		if r.skipLF {
+			r.skipLF = false
+			if '\n' == b {
+				continue
+			}
+		}
+		line = append(line, b)
+
+		switch b {
+		case '\n':
+			return line, nil
+		case '\r':
+			// CRLF作为一个行结束符；单独的CR之后不等待更多数据，避免流在此处卡住
+			if 0 == r.r.Buffered() {
+				r.skipLF = true
+				return line, nil
+			}
+			if next, _ := r.r.Peek(1); len(next) > 0 && '\n' == next[0] {
+				_, _ = r.r.ReadByte()
+				line = append(line, '\n')
+			}
+			return line, nil
+		}
+	}
+}
+
+// Next读取下一个事件，流结束时返回io.EOF。流在事件中间结束时返回已读到的字段，
+// 其他读取错误原样返回
+func (r *Reader) Next() (*Event, error) {
+	event := &Event{}
+	var data [][]byte
+	fields := false
+	for {
+		line, err := r.readLine()
+		if 0 == len(line) && nil != err {
+			if fields {
+				event.Data = bytes.Join(data, []byte("\n"))
+				return event, nil
+			}
+			return nil, err
+		}
+		event.Raw = append(event.Raw, line...)
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if 0 == len(trimmed) {
+			if fields {
+				event.Data = bytes.Join(data, []byte("\n"))
+				return event, nil
+			}
+			continue
+		}
+
+		fields = true
+		if ':' == trimmed[0] {
+			continue
+		}
+		name, value, _ := bytes.Cut(trimmed, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(name) {
+		case "data":
+			data = append(data, value)
+		case "event":
+			event.Name = string(value)
+		}
+	}
+}
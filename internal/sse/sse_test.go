@@ -0,0 +1,205 @@
+package sse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// parsed是测试中比较的事件内容
+type parsed struct {
+	Name string
+	Data string
+}
+
+// readAll读取r中的所有事件，返回事件内容和拼接的原始内容
+func readAll(t testing.TB, r io.Reader) ([]parsed, []byte) {
+	t.Helper()
+
+	var events []parsed
+	var raw []byte
+	reader := NewReader(r)
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return events, raw
+		}
+		if nil != err {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, parsed{event.Name, string(event.Data)})
+		raw = append(raw, event.Raw...)
+	}
+}
+
+// chunkReader每次最多返回size字节，模拟上游把事件拆在多次TCP读取中
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if 0 == len(r.data) {
+		return 0, io.EOF
+	}
+	n := min(len(p), r.size, len(r.data))
+	n = copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []parsed
+	}{
+		{
+			name:   "single event",
+			stream: "data: {\"a\":1}\n\n",
+			want:   []parsed{{"", `{"a":1}`}},
+		},
+		{
+			name:   "done",
+			stream: "data: {\"a\":1}\n\ndata: [DONE]\n\n",
+			want:   []parsed{{"", `{"a":1}`}, {"", "[DONE]"}},
+		},
+		{
+			name:   "crlf",
+			stream: "data: one\r\n\r\ndata: two\r\n\r\n",
+			want:   []parsed{{"", "one"}, {"", "two"}},
+		},
+		{
+			name:   "lone cr",
+			stream: "data: one\r\rdata: two\r\r",
+			want:   []parsed{{"", "one"}, {"", "two"}},
+		},
+		{
+			name:   "comment lines",
+			stream: ": keep-alive\n\ndata: x\n: inline comment\n\n",
+			want:   []parsed{{"", ""}, {"", "x"}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: first\ndata: second\ndata:third\n\n",
+			want:   []parsed{{"", "first\nsecond\nthird"}},
+		},
+		{
+			name:   "event name",
+			stream: "event: message_start\ndata: {}\n\nevent: ping\ndata: {}\n\n",
+			want:   []parsed{{"message_start", "{}"}, {"ping", "{}"}},
+		},
+		{
+			name:   "leading blank lines",
+			stream: "\n\n\ndata: x\n\n",
+			want:   []parsed{{"", "x"}},
+		},
+		{
+			name:   "unknown fields ignored",
+			stream: "id: 7\nretry: 1000\ndata: x\n\n",
+			want:   []parsed{{"", "x"}},
+		},
+		{
+			name:   "only one leading space removed",
+			stream: "data:  indented\n\n",
+			want:   []parsed{{"", " indented"}},
+		},
+		{
+			name:   "stream ends without blank line",
+			stream: "data: a\n\ndata: b",
+			want:   []parsed{{"", "a"}, {"", "b"}},
+		},
+		{
+			name:   "empty stream",
+			stream: "",
+		},
+	}
+	for _, tt := range tests {
+		readers := map[string]func() io.Reader{
+			"whole":    func() io.Reader { return strings.NewReader(tt.stream) },
+			"one byte": func() io.Reader { return iotest.OneByteReader(strings.NewReader(tt.stream)) },
+			"split 3":  func() io.Reader { return &chunkReader{data: []byte(tt.stream), size: 3} },
+		}
+		for name, reader := range readers {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				events, _ := readAll(t, reader())
+				if !reflect.DeepEqual(tt.want, events) {
+					t.Fatalf("events = %q, want %q", events, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// TestReaderRaw检查原始内容保留注释和行结束符，转发时不改变事件
+func TestReaderRaw(t *testing.T) {
+	stream := ": ping\n\ndata: a\r\ndata: b\r\n\r\nevent: x\ndata: [DONE]\n\n"
+	_, raw := readAll(t, strings.NewReader(stream))
+	if stream != string(raw) {
+		t.Fatalf("raw = %q, want %q", raw, stream)
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	broken := errors.New("connection reset")
+	reader := NewReader(io.MultiReader(strings.NewReader("data: a\n\ndata: b\n"), iotest.ErrReader(broken)))
+
+	if event, err := reader.Next(); nil != err || "a" != string(event.Data) {
+		t.Fatalf("first event = %v, %v", event, err)
+	}
+	// 事件中间断开时返回已读到的字段，下一次读取返回错误
+	if event, err := reader.Next(); nil != err || "b" != string(event.Data) {
+		t.Fatalf("partial event = %v, %v", event, err)
+	}
+	if _, err := reader.Next(); !errors.Is(err, broken) {
+		t.Fatalf("err = %v, want %v", err, broken)
+	}
+}
+
+func TestSetData(t *testing.T) {
+	event := &Event{Name: "delta"}
+	event.SetData([]byte("line1\nline2"))
+	if want := "event: delta\ndata: line1\ndata: line2\n\n"; want != string(event.Raw) {
+		t.Fatalf("raw = %q, want %q", event.Raw, want)
+	}
+	if !(&Event{Data: []byte("[DONE]")}).Done() {
+		t.Fatal("[DONE] not recognized")
+	}
+}
+
+// normalizeCRLF把CRLF换成CR，一次读取结束在CR和LF之间时LF不计入原始内容
+func normalizeCRLF(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte("\r\n"), []byte("\r"))
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("data: {\"a\":1}\n\ndata: [DONE]\n\n"), uint8(1))
+	f.Add([]byte("data: a\r\ndata: b\r\n\r\n: c\r\n\r\n"), uint8(2))
+	f.Add([]byte("event: x\rdata: y\r\rdata"), uint8(3))
+	f.Add([]byte("\r\n\r\r\n\ndata:\n\n"), uint8(7))
+	f.Fuzz(func(t *testing.T, stream []byte, size uint8) {
+		whole, raw := readAll(t, bytes.NewReader(stream))
+		split, _ := readAll(t, &chunkReader{data: stream, size: int(size%16) + 1})
+		if !reflect.DeepEqual(whole, split) {
+			t.Fatalf("chunked read differs:\nwhole %q\nsplit %q", whole, split)
+		}
+		if !bytes.HasPrefix(normalizeCRLF(stream), normalizeCRLF(raw)) {
+			t.Fatalf("raw %q is not a prefix of the stream %q", raw, stream)
+		}
+
+		// 重新编码的事件解析后内容不变
+		for _, event := range whole {
+			if strings.ContainsAny(event.Data, "\r") {
+				t.Fatalf("data contains CR: %q", event.Data)
+			}
+			again, _ := readAll(t, bytes.NewReader(Encode(event.Name, []byte(event.Data))))
+			if want := []parsed{event}; !reflect.DeepEqual(want, again) {
+				t.Fatalf("Encode round trip = %q, want %q", again, want)
+			}
+		}
+	})
+}
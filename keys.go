@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 告警事件：上游拒绝了密钥
+const alertBadKey = "bad_key"
+
+// badKeyPrefix是停用的密钥在共用存储中的键前缀，完整的键为badkey/<上游名称>/<密钥的哈希>，值为恢复时间
+const badKeyPrefix = "badkey/"
+
+// keySyncInterval是从共用存储同步其他副本停用的密钥的间隔
+const keySyncInterval = 5 * time.Second
+
+// keyPool管理同一个上游的多个API密钥，轮流使用并跳过被上游拒绝的密钥
+type keyPool struct {
+	name     string        // 上游名称
+	keys     []string      // 所有密钥
+	cooldown time.Duration // 被拒绝的密钥停用时长
+	shared   store         // 多个副本共用的存储，使用redis存储时才设置
+
+	mu       sync.Mutex
+	next     int
+	badUntil map[string]time.Time // 被停用的密钥及恢复时间
+	rejected map[string]int       // 每个密钥被拒绝的次数
+}
+
+// keyStatus是密钥状态的快照，密钥已隐藏
+type keyStatus struct {
+	Key      string `json:"key"`
+	Bad      bool   `json:"bad"`
+	BadUntil string `json:"bad_until,omitempty"`
+	Rejected int    `json:"rejected"`
+}
+
+// newKeyPool合并单个密钥和密钥列表创建keyPool，cooldown单位为分钟
+func newKeyPool(name string, key string, keys []string, cooldown int) *keyPool {
+	if cooldown <= 0 {
+		cooldown = 60
+	}
+
+	pool := &keyPool{
+		name:     name,
+		cooldown: time.Duration(cooldown) * time.Minute,
+		badUntil: make(map[string]time.Time),
+		rejected: make(map[string]int),
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range append([]string{key}, keys...) {
+		if "" == k || seen[k] {
+			continue
+		}
+		seen[k] = true
+		pool.keys = append(pool.keys, k)
+	}
+
+	return pool
+}
+
+// size返回密钥数量
+func (p *keyPool) size() int {
+	return len(p.keys)
+}
+
+// pick轮流返回一个可用的密钥，全部停用时仍按顺序返回
+func (p *keyPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if 0 == len(p.keys) {
+		return ""
+	}
+
+	now := time.Now()
+	for i := 0; i < len(p.keys); i++ {
+		key := p.keys[(p.next+i)%len(p.keys)]
+		if until, ok := p.badUntil[key]; ok && now.Before(until) {
+			continue
+		}
+
+		delete(p.badUntil, key)
+		p.next = (p.next + i + 1) % len(p.keys)
+		return key
+	}
+
+	key := p.keys[p.next]
+	p.next = (p.next + 1) % len(p.keys)
+	return key
+}
+
+// current返回下一次将要使用的密钥，不改变轮换顺序
+func (p *keyPool) current() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if 0 == len(p.keys) {
+		return ""
+	}
+
+	return p.keys[p.next]
+}
+
+// sharedKey返回密钥在共用存储中的键，不保存密钥本身
+func (p *keyPool) sharedKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return badKeyPrefix + p.name + "/" + hex.EncodeToString(sum[:8])
+}
+
+// markBad停用密钥，返回该密钥被拒绝的累计次数。有共用存储时同时通知其他副本
+func (p *keyPool) markBad(key string) int {
+	p.mu.Lock()
+	until := time.Now().Add(p.cooldown)
+	p.badUntil[key] = until
+	p.rejected[key]++
+	count := p.rejected[key]
+	p.mu.Unlock()
+
+	if nil != p.shared {
+		if err := p.shared.put(p.sharedKey(key), []byte(strconv.FormatInt(until.Unix(), 10)), p.cooldown); nil != err {
+			logError("share %s bad key failed: %v\n", p.name, err)
+		}
+	}
+
+	return count
+}
+
+// restore恢复被停用的密钥
+func (p *keyPool) restore(key string) {
+	p.mu.Lock()
+	delete(p.badUntil, key)
+	p.mu.Unlock()
+
+	if nil != p.shared {
+		if err := p.shared.del(p.sharedKey(key)); nil != err {
+			logError("share %s restored key failed: %v\n", p.name, err)
+		}
+	}
+}
+
+// syncShared从共用存储读取所有副本停用的密钥，与本地的停用状态合并
+func (p *keyPool) syncShared() {
+	ids := make(map[string]string, len(p.keys))
+	for _, key := range p.keys {
+		ids[p.sharedKey(key)] = key
+	}
+
+	badUntil := make(map[string]time.Time)
+	err := p.shared.scan(badKeyPrefix+p.name+"/", func(id string, value []byte) bool {
+		key, ok := ids[id]
+		unix, err := strconv.ParseInt(string(value), 10, 64)
+		if ok && nil == err {
+			badUntil[key] = time.Unix(unix, 0)
+		}
+		return true
+	})
+	if nil != err {
+		logError("sync %s bad keys failed: %v\n", p.name, err)
+		return
+	}
+
+	// 同一个密钥取较晚的恢复时间，写入共用存储失败的本地停用不会被清除
+	now := time.Now()
+	p.mu.Lock()
+	for key, until := range p.badUntil {
+		if now.Before(until) && until.After(badUntil[key]) {
+			badUntil[key] = until
+		}
+	}
+	p.badUntil = badUntil
+	p.mu.Unlock()
+}
+
+// badKeys返回仍在停用中的密钥
+func (p *keyPool) badKeys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, until := range p.badUntil {
+		if now.Before(until) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// status返回所有密钥的状态
+func (p *keyPool) status() []keyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	result := make([]keyStatus, 0, len(p.keys))
+	for _, key := range p.keys {
+		ks := keyStatus{Key: redactSecret(key), Rejected: p.rejected[key]}
+		if until, ok := p.badUntil[key]; ok && now.Before(until) {
+			ks.Bad = true
+			ks.BadUntil = until.Format(time.RFC3339)
+		}
+		result = append(result, ks)
+	}
+
+	return result
+}
+
+// keyRejected处理上游以401/403拒绝密钥的情况
+func (s *ProxyService) keyRejected(pool *keyPool, key string, status int) {
+	count := pool.markBad(key)
+	s.metrics.inc("override_bad_keys_total", "upstream", pool.name)
+
+	text := fmt.Sprintf("[override] %s api key %s rejected with status %d (%d times), disabled for %s", s.label(pool.name), redactSecret(key), status, count, pool.cooldown)
+	logError("!!! %s\n", text)
+	s.alerter.notify(alertBadKey, pool.name, redactSecret(key), count, text)
+}
+
+// syncKeysLoop定期从Redis同步各上游停用的密钥，Redis不可用时保留本地的状态，服务关闭时退出
+func (s *ProxyService) syncKeysLoop(shared *redisStore, pools []*keyPool) {
+	ticker := time.NewTicker(keySyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if shared.down.Load() {
+				continue
+			}
+			for _, pool := range pools {
+				pool.syncShared()
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// probeKeys定期用/models接口检查被停用的密钥，恢复已经可用的密钥
+func (s *ProxyService) probeKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.probePool(s.chatKeys, s.cfg.ChatApiBase)
+		s.probePool(s.codexKeys, s.cfg.CodexApiBase)
+		if s.audioKeys != s.chatKeys {
+			s.probePool(s.audioKeys, s.audioApiBase())
+		}
+		if s.imageKeys != s.chatKeys {
+			s.probePool(s.imageKeys, s.imagesApiBase())
+		}
+		if s.rerankKeys != s.chatKeys {
+			s.probePool(s.rerankKeys, s.rerankApiBase())
+		}
+	}
+}
+
+// probePool检查一个上游被停用的密钥
+func (s *ProxyService) probePool(pool *keyPool, base string) {
+	for _, key := range pool.badKeys() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamUrl(base, "/models"), nil)
+		if nil != err {
+			cancel()
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		resp, err := s.client.Do(req)
+		cancel()
+		if nil != err {
+			continue
+		}
+		closeIO(resp.Body)
+
+		if resp.StatusCode == http.StatusOK {
+			pool.restore(key)
+			log.Printf("%s api key %s is valid again\n", pool.name, redactSecret(key))
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// 服务的生命周期状态
+const (
+	stateStarting int32 = iota // 已经开始监听，还在初始化
+	stateReady                 // 正常处理请求
+	stateDraining              // 正在停止，等待进行中的请求完成
+)
+
+// stateNames是生命周期状态在/readyz中的名称
+var stateNames = map[int32]string{
+	stateStarting: "starting",
+	stateReady:    "ready",
+	stateDraining: "draining",
+}
+
+// lifecycleRetryAfter是启动和停止期间返回503时建议客户端重试的秒数
+const lifecycleRetryAfter = "2"
+
+// lifecycle保存服务的生命周期状态，所有监听地址共用
+type lifecycle struct {
+	state atomic.Int32
+}
+
+// gate返回受生命周期控制的http.Handler，初始化完成后设置next再调用ready
+func (l *lifecycle) gate() *gatedHandler {
+	return &gatedHandler{lc: l}
+}
+
+// ready在初始化完成后开始正常处理请求
+func (l *lifecycle) ready() {
+	l.state.Store(stateReady)
+}
+
+// drain在停止时调用，之后的新请求返回503，进行中的请求不受影响
+func (l *lifecycle) drain() {
+	l.state.Store(stateDraining)
+}
+
+// gatedHandler在服务就绪之前和停止期间对新请求返回503和Retry-After，/readyz返回当前状态
+type gatedHandler struct {
+	lc   *lifecycle
+	next http.Handler // 初始化完成后的处理器，在ready之前设置
+}
+
+// ServeHTTP实现http.Handler
+func (g *gatedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := g.lc.state.Load()
+	if "/readyz" == r.URL.Path {
+		w.Header().Set("Content-Type", "application/json")
+		if stateReady != state {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write([]byte(`{"status":"` + stateNames[state] + `"}`))
+		return
+	}
+
+	if stateReady != state {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", lifecycleRetryAfter)
+		if stateDraining == state {
+			w.Header().Set("Connection", "close")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error":{"message":"override is ` + stateNames[state] + `","type":"unavailable","code":503}}`))
+		return
+	}
+
+	g.next.ServeHTTP(w, r)
+}
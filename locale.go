@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requestLocale返回回复使用的语言。开启locale_from_header时依次使用X-Override-Locale和Accept-Language请求头，
+// 都没有时使用chat_locale
+func (s *ProxyService) requestLocale(header http.Header) string {
+	if s.cfg.LocaleFromHeader {
+		if locale := normalizeLocale(header.Get("X-Override-Locale")); "" != locale {
+			return locale
+		}
+		if locale := preferredLanguage(header.Get("Accept-Language")); "" != locale {
+			return locale
+		}
+	}
+
+	if "" == s.cfg.ChatLocale {
+		return "zh_CN"
+	}
+	return s.cfg.ChatLocale
+}
+
+// normalizeLocale把zh-CN形式的语言标签转换为chat_locale使用的zh_CN形式
+func normalizeLocale(tag string) string {
+	return strings.ReplaceAll(strings.TrimSpace(tag), "-", "_")
+}
+
+// preferredLanguage返回Accept-Language中权重最高的语言，如zh-CN,zh;q=0.9,en;q=0.8返回zh_CN
+func preferredLanguage(acceptLanguage string) string {
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(item, ";")
+		tag = strings.TrimSpace(tag)
+		if "" == tag || "*" == tag {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if nil != err {
+				continue
+			}
+			q = parsed
+		}
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+
+	return normalizeLocale(best)
+}
+
+// localeModel返回locale_model_map中语言对应的模型，先匹配完整的语言如zh_CN，再匹配语言部分如zh
+func (s *ProxyService) localeModel(locale string) string {
+	if 0 == len(s.cfg.LocaleModelMap) {
+		return ""
+	}
+	if model, ok := s.cfg.LocaleModelMap[locale]; ok {
+		return model
+	}
+	language, _, _ := strings.Cut(locale, "_")
+	return s.cfg.LocaleModelMap[language]
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// 日志中上游错误内容的默认最大长度
+const defaultLogBodyLimit = 4096
+
+// secretPatterns匹配日志中看起来像密钥的内容
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]{8,}`),
+	regexp.MustCompile(`(?i)((?:api[_-]?key|access[_-]?token|secret|password)["']?\s*[:=]\s*["']?)[^"'\s,&}]{4,}`),
+	regexp.MustCompile(`\b(sk-)[A-Za-z0-9_-]{8,}`),
+}
+
+// sanitizeLogBody截断过长的内容、去除控制字符并隐藏密钥，用于记录上游返回的错误内容
+func (s *ProxyService) sanitizeLogBody(body []byte) string {
+	limit := s.cfg.LogBodyLimit
+	if limit <= 0 {
+		limit = defaultLogBodyLimit
+	}
+
+	truncated := len(body) > limit
+	if truncated {
+		body = body[:limit]
+	}
+
+	text := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.ToValidUTF8(string(body), ""))
+
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllString(text, "${1}[REDACTED]")
+	}
+
+	if truncated {
+		text += "...(truncated)"
+	}
+
+	return text
+}
+
+// reopenWriter把日志写入文件，收到信号时可以重新打开文件，配合logrotate使用
+type reopenWriter struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openLogFile以追加方式打开日志文件
+func openLogFile(path string) (*reopenWriter, error) {
+	w := &reopenWriter{path: path}
+	if err := w.reopen(); nil != err {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *reopenWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Write(p)
+}
+
+// reopen关闭当前文件并重新打开，logrotate移走旧文件后新日志写入新文件
+func (w *reopenWriter) reopen() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if nil != err {
+		return err
+	}
+
+	w.mu.Lock()
+	previous := w.file
+	w.file = file
+	w.mu.Unlock()
+
+	if nil != previous {
+		closeIO(previous)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestChatErrorBodyRelayedInFull检查日志中的错误内容被截断时，客户端仍然收到完整的上游响应体
+func TestChatErrorBodyRelayedInFull(t *testing.T) {
+	page := "<html>" + strings.Repeat("bad gateway ", 1000) + "Bearer sk-abcdefghijklmnop</html>"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(page))
+	}))
+	defer upstream.Close()
+
+	s, proxy := newTestProxy(t, &config{LogBodyLimit: 64}, upstream.URL)
+	status, _, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, nil)
+	if http.StatusBadGateway != status {
+		t.Fatalf("status = %d, want %d", status, http.StatusBadGateway)
+	}
+	if page != body {
+		t.Fatalf("client got %d bytes, want the full %d byte upstream body", len(body), len(page))
+	}
+
+	waitFor(t, func() bool { return len(s.recent.entries()) > 0 })
+	logged := s.recent.entries()[0].Error
+	if !strings.HasSuffix(logged, "...(truncated)") || len(logged) > 64+len("...(truncated)") {
+		t.Fatalf("logged error body not truncated: %q", logged)
+	}
+}
+
+func TestSanitizeLogBody(t *testing.T) {
+	s := &ProxyService{cfg: &config{}}
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"plain", "upstream error", "upstream error"},
+		{"control characters", "line1\nline2\x00", "line1 line2 "},
+		{"bearer token", "Authorization: Bearer abcdefghijklmnop", "Authorization: Bearer [REDACTED]"},
+		{"api key", `{"api_key": "abcdefgh"}`, `{"api_key": "[REDACTED]"}`},
+		{"openai key", "key sk-abcdefghijkl rejected", "key sk-[REDACTED] rejected"},
+	}
+	for _, tt := range tests {
+		if got := s.sanitizeLogBody([]byte(tt.body)); tt.want != got {
+			t.Errorf("%s: sanitizeLogBody(%q) = %q, want %q", tt.name, tt.body, got, tt.want)
+		}
+	}
+}
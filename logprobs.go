@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// logprobsFields是chat_strip_logprobs和codex_strip_logprobs从请求中删除的字段
+var logprobsFields = []string{"logprobs", "top_logprobs"}
+
+// stripLogprobs在配置了删除logprobs时从请求中删除相关字段
+func (s *ProxyService) stripLogprobs(endpoint string, body []byte) []byte {
+	if ("chat" == endpoint && s.cfg.ChatStripLogprobs) || ("codex" == endpoint && s.cfg.CodexStripLogprobs) {
+		return stripFields(body, logprobsFields)
+	}
+
+	return body
+}
+
+// rewriteLogprobs改写响应或流式事件中各choice的logprobs，没有改动时返回nil。
+// 配置了chat_drop_logprobs时删除聊天响应中的logprobs；代码补全响应的旧格式总是带有logprobs字段，
+// 上游没有返回或配置了codex_drop_logprobs时设为null
+func (s *ProxyService) rewriteLogprobs(endpoint string, data []byte) []byte {
+	codex := "codex" == endpoint
+	drop := (codex && s.cfg.CodexDropLogprobs) || ("chat" == endpoint && s.cfg.ChatDropLogprobs)
+	if !codex && !drop {
+		return nil
+	}
+
+	var changed []byte
+	gjson.GetBytes(data, "choices").ForEach(func(i, choice gjson.Result) bool {
+		logprobs := choice.Get("logprobs")
+		null := codex && (!logprobs.Exists() || (drop && gjson.Null != logprobs.Type))
+		remove := !codex && logprobs.Exists()
+		if !choice.IsObject() || (!null && !remove) {
+			return true
+		}
+
+		if nil == changed {
+			changed = data
+		}
+		path := "choices." + strconv.Itoa(int(i.Int())) + ".logprobs"
+		if null {
+			changed, _ = sjson.SetRawBytes(changed, path, []byte("null"))
+		} else {
+			changed, _ = sjson.DeleteBytes(changed, path)
+		}
+		return true
+	})
+
+	return changed
+}
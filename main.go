@@ -3,20 +3,30 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -26,21 +36,177 @@ const InstructModel = "deepseek-coder"
 
 type config struct {
 	// config结构体用于存储配置信息
-	Bind                 string            `json:"bind"`                   // 监听地址
-	ProxyUrl             string            `json:"proxy_url"`              // 代理URL
-	Timeout              int               `json:"timeout"`                // 请求超时时间
-	CodexApiBase         string            `json:"codex_api_base"`         // Codex API的基础URL
-	CodexApiKey          string            `json:"codex_api_key"`          // Codex API的密钥
-	CodexApiOrganization string            `json:"codex_api_organization"` // Codex API的组织
-	CodexApiProject      string            `json:"codex_api_project"`      // Codex API的项目
-	ChatApiBase          string            `json:"chat_api_base"`          // Chat API的基础URL
-	ChatApiKey           string            `json:"chat_api_key"`           // Chat API的密钥
-	ChatApiOrganization  string            `json:"chat_api_organization"`  // Chat API的组织
-	ChatApiProject       string            `json:"chat_api_project"`       // Chat API的项目
-	ChatModelDefault     string            `json:"chat_model_default"`     // 默认的Chat模型
-	ChatModelMap         map[string]string `json:"chat_model_map"`         // Chat模型映射
-	ChatMaxTokens        int               `json:"chat_max_tokens"`
-	ChatLocale           string            `json:"chat_locale"`
+	Bind                  string                `json:"bind"`                          // 监听地址
+	ProxyUrl              string                `json:"proxy_url"`                     // 代理URL
+	Timeout               int                   `json:"timeout"`                       // 请求超时时间
+	CodexApiBase          string                `json:"codex_api_base"`                // Codex API的基础URL
+	CodexApiKey           string                `json:"codex_api_key"`                 // Codex API的密钥
+	CodexApiOrganization  string                `json:"codex_api_organization"`        // Codex API的组织
+	CodexApiProject       string                `json:"codex_api_project"`             // Codex API的项目
+	ChatApiBase           string                `json:"chat_api_base"`                 // Chat API的基础URL
+	ChatApiKey            string                `json:"chat_api_key"`                  // Chat API的密钥
+	ChatApiOrganization   string                `json:"chat_api_organization"`         // Chat API的组织
+	ChatApiProject        string                `json:"chat_api_project"`              // Chat API的项目
+	ChatModelDefault      string                `json:"chat_model_default"`            // 默认的Chat模型
+	ChatModelMap          map[string]string     `json:"chat_model_map"`                // Chat模型映射
+	ChatMaxTokens         int                   `json:"chat_max_tokens"`               // 聊天请求max_tokens的上限
+	ChatLocale            string                `json:"chat_locale"`                   // 要求模型回复使用的语言，默认zh_CN
+	AlertWebhookUrl       string                `json:"alert_webhook_url"`             // 告警webhook地址
+	AlertFailureThreshold int                   `json:"alert_failure_threshold"`       // 触发告警的失败次数
+	AlertFailureWindow    int                   `json:"alert_failure_window"`          // 失败统计窗口（分钟）
+	AlertCooldown         int                   `json:"alert_cooldown"`                // 同类告警冷却时间（分钟）
+	StatsDb               string                `json:"stats_db"`                      // 用量统计SQLite数据库路径
+	ModelPrices           map[string]modelPrice `json:"model_prices"`                  // 模型单价，用于计算费用
+	AdminKey              string                `json:"admin_key"`                     // 管理接口的密钥
+	OtelEnabled           bool                  `json:"otel_enabled"`                  // 是否启用OpenTelemetry链路追踪
+	OtelEndpoint          string                `json:"otel_endpoint"`                 // OTLP HTTP导出地址
+	ExposeOverrideHeaders bool                  `json:"expose_override_headers"`       // 是否在响应头中返回实际模型和上游
+	LogBodyLimit          int                   `json:"log_body_limit"`                // 日志中上游错误内容的最大字节数
+	CodexApiKeys          []string              `json:"codex_api_keys"`                // Codex API的更多密钥，轮流使用
+	ChatApiKeys           []string              `json:"chat_api_keys"`                 // Chat API的更多密钥，轮流使用
+	BadKeyCooldown        int                   `json:"bad_key_cooldown"`              // 被上游拒绝的密钥停用时长（分钟）
+	KeyProbeInterval      int                   `json:"key_probe_interval"`            // 检查停用密钥的间隔（分钟）
+	GzipMinSize           int                   `json:"gzip_min_size"`                 // 响应体超过该字节数时gzip压缩，0为不压缩
+	ServeH2c              bool                  `json:"serve_h2c"`                     // 是否在监听地址上同时接受不加密的HTTP/2
+	ForceIpv4             bool                  `json:"force_ipv4"`                    // 只通过IPv4连接上游
+	DnsServers            []string              `json:"dns_servers"`                   // 解析上游地址使用的DNS服务器
+	HostOverrides         map[string]string     `json:"host_overrides"`                // 主机名到IP的固定映射
+	ChatModelRoutes       map[string]chatRoute  `json:"chat_model_routes"`             // 映射后的模型单独使用的上游
+	ChatApiPath           string                `json:"chat_api_path"`                 // Chat API的请求路径，默认/chat/completions
+	CodexApiPath          string                `json:"codex_api_path"`                // Codex API的请求路径，默认/chat/completions
+	ChatQueryParams       map[string]string     `json:"chat_query_params"`             // Chat API请求附加的查询参数
+	CodexQueryParams      map[string]string     `json:"codex_query_params"`            // Codex API请求附加的查询参数
+	ChatRetryOn           []string              `json:"chat_retry_on"`                 // 触发换模型重试的条件
+	ChatRetryModel        string                `json:"chat_retry_model"`              // 重试时使用的模型
+	ChatStripFields       []string              `json:"chat_strip_fields"`             // 从聊天请求中删除的字段，支持嵌套路径
+	CodexStripFields      []string              `json:"codex_strip_fields"`            // 从代码补全请求中删除的字段，支持嵌套路径
+	Debug                 bool                  `json:"debug"`                         // 是否打印调试日志
+	UserFieldMode         string                `json:"user_field_mode"`               // user字段的处理方式：passthrough、strip或hash
+	UserFieldSalt         string                `json:"user_field_salt"`               // 哈希user字段使用的盐，未配置时自动生成
+	RedactPatterns        []string              `json:"redact_patterns"`               // 转发前从提示内容中替换掉的正则表达式
+	RedactPlaceholder     string                `json:"redact_placeholder"`            // 替换敏感内容使用的文本，默认[REDACTED]
+	BlockPatterns         []string              `json:"block_patterns"`                // 提示内容匹配时拒绝请求的正则表达式
+	BlockReason           string                `json:"block_reason"`                  // 拒绝请求时返回的说明
+	MaxStreamDuration     int                   `json:"max_stream_duration_seconds"`   // 流式响应的最长时间（秒），0为不限制
+	MaxResponseBytes      int                   `json:"max_response_bytes"`            // 响应体的最大字节数，0为不限制
+	MaxConcurrency        int                   `json:"max_concurrency"`               // 同时发往上游的最大请求数，0为不限制
+	ChatReservedRatio     float64               `json:"chat_reserved_ratio"`           // 只给聊天请求使用的并发名额比例
+	CodexQueueTimeout     int                   `json:"codex_queue_timeout"`           // 代码补全请求排队的最长时间（毫秒），0为一直等待
+	CodexSupersede        bool                  `json:"codex_supersede"`               // 同一位置的新代码补全请求到达时取消旧请求
+	Quotas                map[string]quota      `json:"quotas"`                        // 客户端密钥到每日配额，*为默认配额
+	QuotaReset            string                `json:"quota_reset"`                   // 配额重置方式：utc_midnight或rolling
+	QuotaStateFile        string                `json:"quota_state_file"`              // 使用内存存储时保存配额用量的文件，默认quota_state.json
+	LogFile               string                `json:"log_file"`                      // 日志文件路径，未配置时输出到标准错误
+	WarmupIntervalSeconds int                   `json:"warmup_interval_seconds"`       // 空闲时向上游发送预热请求的间隔（秒），0为不预热
+	WarmupCodex           bool                  `json:"warmup_codex"`                  // 是否同时预热代码补全模型
+	AccessLog             string                `json:"access_log"`                    // 访问日志：all、errors或off
+	GinDebug              bool                  `json:"gin_debug"`                     // 使用gin的调试模式和默认的Logger、Recovery
+	UpstreamTTFBTimeout   int                   `json:"upstream_ttfb_timeout_seconds"` // 等待上游响应头的最长时间（秒），0为不单独限制
+	ChatPromptCache       bool                  `json:"chat_prompt_cache"`             // 保持聊天请求的前缀在多轮对话中不变，以命中上游的提示缓存
+	PredictionModels      []string              `json:"prediction_models"`             // 支持prediction字段的映射后模型，其他模型的请求会删除该字段
+	CodexPrediction       bool                  `json:"codex_prediction"`              // 上游支持时用代码补全请求的suffix构造prediction
+	ChatStreamOptions     string                `json:"chat_stream_options"`           // stream_options的处理方式：passthrough、strip或force
+	CodexStreamOptions    string                `json:"codex_stream_options"`          // 代码补全请求stream_options的处理方式
+	TokenCharsPerToken    float64               `json:"token_chars_per_token"`         // 没有内置词表的模型估算Token数时每Token的字符数，默认4
+	AudioApiBase          string                `json:"audio_api_base"`                // 音频接口的上游地址，默认使用chat_api_base
+	AudioApiKey           string                `json:"audio_api_key"`                 // 音频接口的密钥，默认使用Chat的密钥
+	AudioModelMap         map[string]string     `json:"audio_model_map"`               // 音频接口的模型映射
+	ImagesApiBase         string                `json:"images_api_base"`               // 图片接口的上游地址，默认使用chat_api_base
+	ImagesApiKey          string                `json:"images_api_key"`                // 图片接口的密钥，默认使用Chat的密钥
+	ImagesModelMap        map[string]string     `json:"images_model_map"`              // 图片接口的模型映射
+	ImagesMaxN            int                   `json:"images_max_n"`                  // 每个请求最多生成的图片数，0为不限制
+	ImagesSizes           []string              `json:"images_sizes"`                  // 允许的图片尺寸，为空时不限制
+	ModerationMode        string                `json:"moderation_mode"`               // 审核接口的处理方式：passthrough或stub，为空时不提供
+	RerankApiBase         string                `json:"rerank_api_base"`               // 重排接口的上游地址，默认使用chat_api_base
+	RerankApiKey          string                `json:"rerank_api_key"`                // 重排接口的密钥，默认使用Chat的密钥
+	RerankModelMap        map[string]string     `json:"rerank_model_map"`              // 重排接口的模型映射
+	ChatApiType           string                `json:"chat_api_type"`                 // Chat上游的类型：openai或azure，未配置时根据chat_api_base推断
+	ModelSyncDisabled     bool                  `json:"model_sync_disabled"`           // 不请求上游的模型列表，适用于无法访问外网的环境
+	ModelSyncInterval     int                   `json:"model_sync_interval"`           // 同步上游模型列表的间隔（分钟），默认60
+	LocaleFromHeader      bool                  `json:"locale_from_header"`            // 根据X-Override-Locale或Accept-Language请求头决定回复的语言
+	LocaleModelMap        map[string]string     `json:"locale_model_map"`              // 语言到模型的映射，如zh或zh_CN，优先于chat_model_map
+	ChatRules             []chatRule            `json:"chat_rules"`                    // 按消息内容选择模型和参数的规则，第一条匹配的生效
+	InvalidResponseStatus int                   `json:"invalid_response_status"`       // 上游以200返回错误或没有choices时返回的状态码，默认502
+	FinishReasonMap       map[string]string     `json:"finish_reason_map"`             // 非标准finish_reason到标准取值的映射，补充内置的映射
+	Profiles              profileSet            `json:"profiles"`                      // 以名称为路径前缀的独立配置，未设置的配置项使用顶层的配置
+	AdminBind             string                `json:"admin_bind"`                    // 管理接口的监听地址，配置后管理接口不再出现在bind上
+	UpstreamIdHeaders     []string              `json:"upstream_request_id_headers"`   // 记录到日志和错误响应中的上游请求ID响应头
+	ExpectContinue        bool                  `json:"upstream_expect_continue"`      // 请求体较大时先发送Expect: 100-continue，上游拒绝时不必上传请求体
+	ExpectContinueSize    int                   `json:"upstream_expect_continue_size"` // 使用Expect: 100-continue的最小请求体字节数，默认1MB
+	ChatModelMaxTokens    map[string]int        `json:"chat_model_max_tokens"`         // 映射后模型的max_tokens上限，与chat_max_tokens同时生效时取较小值
+	CodexModelMaxTokens   map[string]int        `json:"codex_model_max_tokens"`        // 代码补全模型的max_tokens上限
+	InjectMaxTokens       bool                  `json:"inject_max_tokens"`             // 客户端没有指定max_tokens时使用模型的上限
+	ChatTempDefault       *float64              `json:"chat_temperature_default"`      // 聊天请求没有temperature时使用的值
+	ChatTempMin           *float64              `json:"chat_temperature_min"`          // 聊天请求temperature的下限
+	ChatTempMax           *float64              `json:"chat_temperature_max"`          // 聊天请求temperature的上限
+	ChatTopPDefault       *float64              `json:"chat_top_p_default"`            // 聊天请求没有top_p时使用的值
+	ChatTopPMin           *float64              `json:"chat_top_p_min"`                // 聊天请求top_p的下限
+	ChatTopPMax           *float64              `json:"chat_top_p_max"`                // 聊天请求top_p的上限
+	CodexTempDefault      *float64              `json:"codex_temperature_default"`     // 代码补全请求没有temperature时使用的值
+	CodexTempMin          *float64              `json:"codex_temperature_min"`         // 代码补全请求temperature的下限
+	CodexTempMax          *float64              `json:"codex_temperature_max"`         // 代码补全请求temperature的上限
+	CodexTopPDefault      *float64              `json:"codex_top_p_default"`           // 代码补全请求没有top_p时使用的值
+	CodexTopPMin          *float64              `json:"codex_top_p_min"`               // 代码补全请求top_p的下限
+	CodexTopPMax          *float64              `json:"codex_top_p_max"`               // 代码补全请求top_p的上限
+	ReasoningModels       []string              `json:"reasoning_models"`              // 不接受采样参数的映射后模型，不处理temperature和top_p
+	ChatApiBases          []string              `json:"chat_api_bases"`                // 与chat_api_base一起负载均衡的更多Chat上游
+	ChatBalance           string                `json:"chat_balance"`                  // 多个Chat上游的分配方式：round_robin（默认）或affinity
+	Experiments           []experiment          `json:"experiments"`                   // A/B实验，按比例把请求改用另一个模型
+	IdleWarningMinutes    int                   `json:"idle_warning_minutes"`          // 超过该时长没有请求时记录提醒，0为不检查
+	TrafficSummary        bool                  `json:"traffic_summary"`               // 有请求时每分钟输出一行请求数、错误数和Token数的汇总
+	AllowUnknownConfig    bool                  `json:"allow_unknown_config"`          // 忽略未知的配置项，用于旧版本读取新版本的配置
+	RecentSize            int                   `json:"recent_size"`                   // /admin/recent和dashboard保存的最近请求和错误日志条数，默认20
+	UpstreamHmac          *hmacConfig           `json:"upstream_hmac"`                 // 为上游请求加上HMAC签名和Date请求头
+	TenantModels          tenantModelSet        `json:"tenant_models"`                 // 客户端密钥到该客户端的chat_model_map和chat_model_default
+	DrainDelaySeconds     int                   `json:"drain_delay_seconds"`           // 停止时先对新请求返回503的秒数，让负载均衡停止转发后再关闭监听
+	ChatCoalesce          bool                  `json:"chat_coalesce"`                 // 合并进行中的相同非流式聊天请求，流式请求只记录重复
+	ChatTokenExchange     *tokenExchange        `json:"chat_token_exchange"`           // 用长期凭据换取短期令牌作为Chat上游的密钥
+	ChatRawPassthrough    bool                  `json:"chat_raw_passthrough"`          // 聊天请求体原样转发，不做模型映射、参数限制等任何修改，只替换认证请求头
+	CodexRawPassthrough   bool                  `json:"codex_raw_passthrough"`         // 代码补全请求体原样转发，不做任何修改
+	ChatSequentialTools   bool                  `json:"chat_sequential_tool_calls"`    // 只保留聊天响应中的第一个工具调用，用于不能正确并行调用工具的上游
+	ChatStripLogprobs     bool                  `json:"chat_strip_logprobs"`           // 删除聊天请求中的logprobs和top_logprobs
+	CodexStripLogprobs    bool                  `json:"codex_strip_logprobs"`          // 删除代码补全请求中的logprobs和top_logprobs
+	ChatDropLogprobs      bool                  `json:"chat_drop_logprobs"`            // 删除聊天响应中的logprobs，减少转发的数据量
+	CodexDropLogprobs     bool                  `json:"codex_drop_logprobs"`           // 把代码补全响应中的logprobs设为null
+	CodexRedactPaths      string                `json:"codex_redact_paths"`            // 改写代码补全提示中的文件路径：basename、hash或rules
+	CodexPathRules        []pathRule            `json:"codex_path_rules"`              // codex_redact_paths为rules时改写路径的规则
+	AcceptHeaderDisabled  bool                  `json:"upstream_accept_disabled"`      // 不按请求体的stream设置上游请求的Accept
+	ReadHeaderTimeout     int                   `json:"read_header_timeout_seconds"`   // 读取请求头的最长时间（秒），默认10，负数为不限制
+	BodyReadTimeout       int                   `json:"body_read_timeout_seconds"`     // 读取请求体的最长时间（秒），默认30，负数为不限制，音频转写的上传不受限制
+	DailyBudget           float64               `json:"daily_budget"`                  // 每天（UTC）的花费预算，与model_prices的单位一致
+	BudgetDowngrade       []budgetStep          `json:"budget_downgrade"`              // 当天花费达到预算的百分比时改用的模型或拒绝聊天请求
+	UpstreamUserAgent     string                `json:"upstream_user_agent"`           // 上游请求的User-Agent，默认override/<版本>
+	UpstreamHeaders       map[string]string     `json:"upstream_headers"`              // 所有上游请求附加的请求头，如上游要求的OpenAI-Beta
+	ForwardHeaders        []string              `json:"forward_headers"`               // 转发给上游的客户端请求头，支持X-Stainless-*这样的前缀
+	ConversationStats     int                   `json:"conversation_stats"`            // 在内存中按对话统计聊天请求，值为最多保留的对话数，为0时不统计
+	ConversationIdle      int                   `json:"conversation_idle_minutes"`     // 对话多久没有新请求后输出汇总日志，默认30分钟
+	CodexInheritChat      bool                  `json:"codex_inherit_chat"`            // Codex的地址、密钥、组织和项目为空时使用Chat的配置
+	ChatStreamRecovery    int                   `json:"chat_stream_recovery_seconds"`  // 聊天流式响应中途中断时保存已生成内容的秒数，期间重试相同的请求时续写，为0时不开启
+	AlertPanicThreshold   int                   `json:"alert_panic_threshold"`         // 一小时内转换请求发生panic的次数超过该值时告警，默认10
+	ProxyProtocol         bool                  `json:"proxy_protocol"`                // bind前面的负载均衡发送PROXY protocol头部，从中取出客户端的真实地址，没有头部的连接被拒绝
+	Storage               string                `json:"storage"`                       // 配额等需要持久化的数据的存储：memory（默认）、sqlite或redis
+	StoragePath           string                `json:"storage_path"`                  // storage为sqlite时的数据库文件，默认override.db，可以与stats_db相同
+	StorageUrl            string                `json:"storage_url"`                   // storage为redis时的地址，如redis://:password@host:6379/0
+	ProbeOnStart          bool                  `json:"probe_on_start"`                // 启动时探测上游是否支持工具调用、JSON模式、stream_options和n，按结果删除不支持的字段
+	CorpusFile            string                `json:"corpus_file"`                   // 抽样保存请求提示的JSONL文件，用于离线评测，为空时不保存
+	CorpusEndpoints       []string              `json:"corpus_endpoints"`              // 保存语料的接口：codex和chat，默认只保存codex
+	CorpusSamplePercent   float64               `json:"corpus_sample_percent"`         // 保存的请求比例（0-100），默认100
+	CorpusCompletions     bool                  `json:"corpus_completions"`            // 同时保存上游返回的补全内容
+	CorpusMaxMB           int                   `json:"corpus_max_mb"`                 // 语料文件超过该大小（MB）时轮转，默认100
+	CorpusMaxFiles        int                   `json:"corpus_max_files"`              // 保留的轮转语料文件数，默认5
+	PreRequestHook        []string              `json:"pre_request_hook"`              // 转发前执行的命令及参数，标准输入为转换后的请求体，可以输出修改后的请求体或拒绝请求
+	PostResponseHook      []string              `json:"post_response_hook"`            // 请求结束后在后台执行的命令及参数，标准输入为请求摘要JSON
+	HookTimeoutMs         int                   `json:"hook_timeout_ms"`               // 每次执行钩子的最长时间（毫秒），默认2000
+	HookConcurrency       int                   `json:"hook_concurrency"`              // 每个钩子同时执行的最大数量，默认4，已满时跳过钩子
+	HookFailureThreshold  int                   `json:"hook_failure_threshold"`        // 钩子连续失败多少次后暂时停用，默认5
+	HookCooldown          int                   `json:"hook_cooldown_seconds"`         // 钩子停用的秒数，默认60
+	FirstTokenDeadline    int                   `json:"first_token_deadline_ms"`       // 聊天请求等待第一个数据事件（非流式为响应头）的最长时间（毫秒），超过时改用备用模型或上游，0为不限制
+	FirstTokenFallback    string                `json:"first_token_fallback_model"`    // 超过first_token_deadline_ms时改用的模型，默认chat_retry_model，都未配置时换负载均衡中的另一个上游
+	HedgeDelay            int                   `json:"hedge_delay_ms"`                // 代码补全请求超过这段时间（毫秒）没有响应时再发送一个相同的请求，0为不对冲
+	HedgeBudget           float64               `json:"hedge_budget_percent"`          // 每分钟最多对冲的代码补全请求比例，默认10
+	RoutesFile            string                `json:"routes_file"`                   // 只包含模型映射、路由规则和实验的配置文件，合并到config.json之上，冲突时以它为准
+
+	sources configSources // 配置项来自哪个文件
 }
 
 // readConfig用于读取配置文件并返回config结构体实例
@@ -51,50 +217,45 @@ func readConfig() *config {
 		log.Fatal(err)
 	}
 
-	_cfg := &config{}
-	// 解析配置文件内容到config结构体
-	err = json.Unmarshal(content, &_cfg)
+	// 环境变量覆盖配置项，拼错的变量名同样给出提示
+	overrides, unknown := envOverrides(os.Environ())
+	if len(unknown) > 0 {
+		log.Printf("WARNING: ignoring unknown environment variables (run override env-list to see supported names): %s\n", strings.Join(unknown, ", "))
+	}
+
+	// routes_file中的模型映射和路由规则合并到config.json之上
+	merged, sources, problems, overridden, err := loadRoutes(content, overrides)
 	if nil != err {
 		log.Fatal(err)
 	}
+	if len(overridden) > 0 {
+		log.Printf("%s overrides config.json: %s\n", sources.routesFile, strings.Join(overridden, ", "))
+	}
 
-	v := reflect.ValueOf(_cfg).Elem()
-	t := v.Type()
-
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		tag := t.Field(i).Tag.Get("json")
-		if tag == "" {
-			continue
-		}
+	_cfg := &config{}
+	// 解析配置文件内容到config结构体
+	err = json.Unmarshal(merged, &_cfg)
+	if nil != err {
+		log.Fatal(sources.describe(err.Error()))
+	}
+	_cfg.sources = sources
 
-		value, exists := os.LookupEnv("OVERRIDE_" + strings.ToUpper(tag))
-		if !exists {
-			continue
+	// 拼错的配置项会被静默忽略，默认拒绝启动
+	for i, problem := range unknownConfigKeys(content, reflect.TypeOf(_cfg), "") {
+		if "" != sources.routesFile {
+			problem = "config.json: " + problem
 		}
-
-		switch field.Kind() {
-		case reflect.String:
-			field.SetString(value)
-		case reflect.Bool:
-			if boolValue, err := strconv.ParseBool(value); err == nil {
-				field.SetBool(boolValue)
-			}
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
-				field.SetInt(intValue)
-			}
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-			if uintValue, err := strconv.ParseUint(value, 10, 64); err == nil {
-				field.SetUint(uintValue)
-			}
-		case reflect.Float32, reflect.Float64:
-			if floatValue, err := strconv.ParseFloat(value, field.Type().Bits()); err == nil {
-				field.SetFloat(floatValue)
-			}
+		problems = slices.Insert(problems, i, problem)
+	}
+	if len(problems) > 0 {
+		if !_cfg.AllowUnknownConfig {
+			log.Fatalf("unknown config keys (set allow_unknown_config to ignore them):\n  %s\n", strings.Join(problems, "\n  "))
 		}
+		log.Printf("WARNING: ignoring unknown config keys: %s\n", strings.Join(problems, ", "))
 	}
 
+	applyEnvOverrides(_cfg, overrides)
+
 	return _cfg
 }
 
@@ -105,12 +266,27 @@ func getClient(cfg *config) (*http.Client, error) {
 		DisableKeepAlives: false,
 	}
 
+	// 配置了IPv4、DNS或主机映射时使用自定义的连接方式
+	if dialContext := newDialContext(cfg); nil != dialContext {
+		transport.DialContext = dialContext
+	}
+
 	// 配置HTTP/2
 	err := http2.ConfigureTransport(transport)
 	if nil != err {
 		return nil, err
 	}
 
+	// 限制等待响应头的时间，流式响应的总时长仍由timeout控制
+	if cfg.UpstreamTTFBTimeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(cfg.UpstreamTTFBTimeout) * time.Second
+	}
+
+	// 等待上游确认100-continue的最长时间，超时后照常发送请求体
+	if cfg.ExpectContinue {
+		transport.ExpectContinueTimeout = expectContinueTimeout
+	}
+
 	// 如果配置了代理URL，则设置代理
 	if "" != cfg.ProxyUrl {
 		proxyUrl, err := url.Parse(cfg.ProxyUrl)
@@ -121,9 +297,27 @@ func getClient(cfg *config) (*http.Client, error) {
 		transport.Proxy = http.ProxyURL(proxyUrl)
 	}
 
+	// 配置了upstream_hmac时最后签名，签名覆盖headerTransport设置的请求头
+	signer, err := newHmacSigner(cfg)
+	if nil != err {
+		return nil, err
+	}
+	var roundTripper http.RoundTripper = transport
+	if nil != signer {
+		roundTripper = &signTransport{base: transport, signer: signer}
+	}
+
+	// 所有上游请求带上User-Agent和upstream_headers
+	roundTripper = newHeaderTransport(cfg, roundTripper)
+
+	// 启用链路追踪时包装transport
+	if cfg.OtelEnabled {
+		roundTripper = traceTransport(roundTripper)
+	}
+
 	// 创建HTTP客户端实例
 	client := &http.Client{
-		Transport: transport,
+		Transport: roundTripper,
 		Timeout:   time.Duration(cfg.Timeout) * time.Second,
 	}
 
@@ -140,6 +334,21 @@ func abortCodex(c *gin.Context, status int) {
 	c.Abort()
 }
 
+// abortWithError以OpenAI格式的错误JSON中断请求处理
+func abortWithError(c *gin.Context, status int, errType string, message string) {
+	body := gin.H{
+		"message": message,
+		"type":    errType,
+		"code":    status,
+	}
+	// 上游已经返回响应头时附上上游的请求ID，方便向上游反馈问题
+	if ids := upstreamRequestIds(c.Keys); len(ids) > 0 {
+		body["upstream_request_ids"] = ids
+	}
+	setRecentError(c, message)
+	c.AbortWithStatusJSON(status, gin.H{"error": body})
+}
+
 // closeIO用于关闭io.Closer类型的实例
 func closeIO(c io.Closer) {
 	// 关闭资源并记录错误
@@ -149,187 +358,908 @@ func closeIO(c io.Closer) {
 	}
 }
 
+// sortedKeys返回map中排序后的键
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
 // ProxyService定义了代理服务的相关方法和属性
 type ProxyService struct {
-	cfg    *config      // 配置信息
-	client *http.Client // HTTP客户端实例
+	cfg     *config        // 配置信息
+	client  *http.Client   // HTTP客户端实例
+	alerter *alerter       // 告警推送
+	stats   *statsRecorder // 用量统计
+	metrics *metrics       // Prometheus指标
+
+	chatKeys   *keyPool            // Chat API密钥
+	codexKeys  *keyPool            // Codex API密钥
+	audioKeys  *keyPool            // 音频接口的密钥，未配置时与Chat相同
+	imageKeys  *keyPool            // 图片接口的密钥，未配置时与Chat相同
+	rerankKeys *keyPool            // 重排接口的密钥，未配置时与Chat相同
+	routeKeys  map[string]*keyPool // 模型路由单独配置的密钥
+	userSalt   string              // 哈希user字段使用的盐
+
+	redactPatterns []*regexp.Regexp // 转发前替换的敏感内容
+	blockPatterns  []*regexp.Regexp // 匹配时拒绝请求
+	chatRules      []chatRule       // 按消息内容选择模型的规则
+	scheduler      *scheduler       // 并发限制和优先级调度
+	inflight       *inflightCodex   // 进行中的代码补全请求
+	rateLimits     *rateLimits      // 上游最近返回的限流信息
+	quotas         *quotaTracker    // 客户端配额
+	store          store            // 配额等需要持久化的数据
+	traffic        lastTraffic      // 各端点最近一次真实请求的时间
+	tokenizer      *tokenizer       // 计算请求的Token数
+	catalog        *modelCatalog    // 上游模型列表
+	backends       *backendPool     // 负载均衡的Chat上游，未配置chat_api_bases时为nil
+	done           chan struct{}    // 关闭服务时关闭，通知后台goroutine退出
+	recent         *recentRing      // 最近的请求，供/admin/recent使用
+	tenants        tenantModelSet   // 客户端标识到该客户端的模型映射
+	coalescer      *chatCoalescer   // 合并相同的聊天请求，未开启chat_coalesce时为nil
+	tokens         *tokenSource     // Chat上游换取的令牌，未配置chat_token_exchange时为nil
+	paths          *pathRedactor    // 改写代码补全提示中的文件路径，未配置codex_redact_paths时为nil
+	budget         *budgetTracker   // 当天的花费，未配置budget_downgrade时为nil
+	inherited      []string         // codex_inherit_chat时从Chat配置继承的配置项
+	recovery       *streamRecovery  // 中断的聊天流式响应已生成的内容，未配置chat_stream_recovery_seconds时为nil
+	capabilities   *capabilityProbe // 上游能力的探测结果
+	corpus         *corpusWriter    // 抽样保存的语料，未配置corpus_file时为nil
+	preHook        *hookRunner      // pre_request_hook，未配置时为nil
+	postHook       *hookRunner      // post_response_hook，未配置时为nil
+	hedger         *codexHedger     // 代码补全请求的对冲，未配置hedge_delay_ms时为nil
+	feedbacks      *feedbackIndex   // 等待采纳反馈的请求
+	profile        string           // 配置档名称，顶层配置为空
 }
 
 // NewProxyService用于创建一个新的ProxyService实例
 func NewProxyService(cfg *config) (*ProxyService, error) {
-	client, err := getClient(cfg)
+	return newProxyService(cfg, "", newMetrics())
+}
+
+// configParts是newConfigParts根据配置创建的组件，不打开统计数据库和存储，也不启动后台任务
+type configParts struct {
+	client         *http.Client
+	routeKeys      map[string]*keyPool
+	inherited      []string
+	redactPatterns []*regexp.Regexp
+	blockPatterns  []*regexp.Regexp
+	chatRules      []chatRule
+	backends       *backendPool
+	paths          *pathRedactor
+	tokens         *tokenSource
+}
+
+// newConfigParts执行配置的全部检查并创建不依赖存储的组件，返回所有问题。newProxyService和
+// candidateService都使用它，启动时和/admin/config/validate的检查一致
+func newConfigParts(cfg *config) (*configParts, []error) {
+	var problems []error
+	check := func(err error) {
+		if nil != err {
+			problems = append(problems, err)
+		}
+	}
+
+	p := &configParts{}
+	var err error
+	p.client, err = getClient(cfg)
+	check(err)
+	p.routeKeys, err = newRouteKeys(cfg)
+	check(err)
+	check(checkRetryOn(cfg.ChatRetryOn))
+	check(resolveChatApiType(cfg))
+	p.inherited, err = inheritChat(cfg)
+	check(err)
+	check(checkModerationMode(cfg.ModerationMode))
+	check(checkExperiments(cfg.Experiments))
+	check(checkSampling(cfg))
+	check(checkHedge(cfg))
+	check(checkStreamOptions("chat_stream_options", cfg.ChatStreamOptions))
+	check(checkStreamOptions("codex_stream_options", cfg.CodexStreamOptions))
+	check(checkUserFieldMode(cfg.UserFieldMode))
+	p.redactPatterns, err = compilePatterns("redact_patterns", cfg.RedactPatterns)
+	check(err)
+	p.blockPatterns, err = compilePatterns("block_patterns", cfg.BlockPatterns)
+	check(err)
+	p.chatRules, err = compileChatRules(cfg.ChatRules)
+	check(err)
+	check(checkQuotaReset(cfg.QuotaReset))
+	check(checkStorage(cfg))
+	check(checkCorpus(cfg))
+	p.backends, err = newBackendPool(cfg)
+	check(err)
+	p.paths, err = newPathRedactor(cfg)
+	check(err)
+	check(checkForwardHeaders(cfg))
+	if nil != p.client {
+		p.tokens, err = newTokenSource(cfg, p.client)
+		check(err)
+	}
+	_, err = newBudgetTracker(cfg, nil)
+	check(err)
+	check(checkHooks(cfg))
+
+	return p, problems
+}
+
+// newProxyService创建配置档profile的ProxyService，计数记到m中
+func newProxyService(cfg *config, profile string, m *metrics) (*ProxyService, error) {
+	parts, problems := newConfigParts(cfg)
+	if len(problems) > 0 {
+		return nil, problems[0]
+	}
+
+	stats, err := newStatsRecorder(cfg)
 	if nil != err {
 		return nil, err
 	}
 
-	return &ProxyService{
-		cfg:    cfg,
-		client: client,
-	}, nil
+	userSalt, err := loadUserSalt(cfg)
+	if nil != err {
+		return nil, err
+	}
+
+	storage, err := openStore(cfg, profile)
+	if nil != err {
+		return nil, err
+	}
+
+	quotas, err := newQuotaTracker(cfg, storage)
+	if nil != err {
+		_ = storage.close()
+		return nil, err
+	}
+
+	budget, err := newBudgetTracker(cfg, stats.db)
+	if nil != err {
+		return nil, err
+	}
+
+	corpus, err := newCorpusWriter(cfg, m)
+	if nil != err {
+		return nil, err
+	}
+
+	routeKeys := parts.routeKeys
+	s := &ProxyService{
+		cfg:       cfg,
+		client:    parts.client,
+		alerter:   newAlerter(cfg),
+		stats:     stats,
+		metrics:   m,
+		chatKeys:  newKeyPool("chat", cfg.ChatApiKey, cfg.ChatApiKeys, cfg.BadKeyCooldown),
+		codexKeys: newKeyPool("codex", cfg.CodexApiKey, cfg.CodexApiKeys, cfg.BadKeyCooldown),
+		routeKeys: routeKeys,
+		userSalt:  userSalt,
+
+		redactPatterns: parts.redactPatterns,
+		blockPatterns:  parts.blockPatterns,
+		chatRules:      parts.chatRules,
+		scheduler:      newScheduler(cfg),
+		inflight:       newInflightCodex(),
+		rateLimits:     newRateLimits(),
+		quotas:         quotas,
+		store:          storage,
+		tokenizer:      newTokenizer(cfg),
+		catalog:        &modelCatalog{},
+		profile:        profile,
+		backends:       parts.backends,
+		done:           make(chan struct{}),
+		recent:         newRing[recentRequest](recentSize(cfg)),
+		tenants:        newTenantModels(cfg),
+		coalescer:      newChatCoalescer(cfg),
+		tokens:         parts.tokens,
+		paths:          parts.paths,
+		budget:         budget,
+		inherited:      parts.inherited,
+		recovery:       newStreamRecovery(cfg),
+		capabilities:   newCapabilityProbe(),
+		corpus:         corpus,
+		preHook:        newHookRunner("pre_request_hook", cfg.PreRequestHook, true, cfg, m),
+		postHook:       newHookRunner("post_response_hook", cfg.PostResponseHook, false, cfg, m),
+		hedger:         newCodexHedger(cfg),
+		feedbacks:      newFeedbackIndex(),
+	}
+	stats.scheduler = s.scheduler
+	stats.limits = s.rateLimits
+	stats.quotas = s.quotas
+	stats.catalog = s.catalog
+	stats.capabilities = s.capabilities
+	stats.threads = newConversationTracker(cfg)
+	stats.keyPools = []*keyPool{s.chatKeys, s.codexKeys}
+	s.audioKeys = s.chatKeys
+	if "" != cfg.AudioApiKey {
+		s.audioKeys = newKeyPool("audio", cfg.AudioApiKey, nil, cfg.BadKeyCooldown)
+		stats.keyPools = append(stats.keyPools, s.audioKeys)
+	}
+	s.imageKeys = s.chatKeys
+	if "" != cfg.ImagesApiKey {
+		s.imageKeys = newKeyPool("images", cfg.ImagesApiKey, nil, cfg.BadKeyCooldown)
+		stats.keyPools = append(stats.keyPools, s.imageKeys)
+	}
+	s.rerankKeys = s.chatKeys
+	if "" != cfg.RerankApiKey {
+		s.rerankKeys = newKeyPool("rerank", cfg.RerankApiKey, nil, cfg.BadKeyCooldown)
+		stats.keyPools = append(stats.keyPools, s.rerankKeys)
+	}
+	for _, model := range sortedKeys(routeKeys) {
+		stats.keyPools = append(stats.keyPools, routeKeys[model])
+	}
+	// 使用Redis时多个副本共用停用的密钥
+	if shared, ok := storage.(*redisStore); ok {
+		for _, pool := range stats.keyPools {
+			pool.shared = storage
+		}
+		go s.syncKeysLoop(shared, stats.keyPools)
+	}
+
+	interval := cfg.KeyProbeInterval
+	if interval <= 0 {
+		interval = 10
+	}
+	go s.probeKeys(time.Duration(interval) * time.Minute)
+
+	if cfg.WarmupIntervalSeconds > 0 {
+		go s.warmupLoop(time.Duration(cfg.WarmupIntervalSeconds) * time.Second)
+	}
+
+	s.metrics.gauge("override_last_request_age_seconds", func() float64 {
+		return s.lastRequestAge().Seconds()
+	})
+	if cfg.IdleWarningMinutes > 0 || cfg.TrafficSummary {
+		go s.heartbeatLoop()
+	}
+	if nil != stats.threads {
+		go s.conversationLoop()
+	}
+
+	if cfg.ProbeOnStart {
+		go s.probeCapabilities()
+	}
+
+	if !cfg.ModelSyncDisabled && "" != cfg.ChatApiBase {
+		interval := cfg.ModelSyncInterval
+		if interval <= 0 {
+			interval = defaultModelSyncInterval
+		}
+		go s.modelSyncLoop(time.Duration(interval) * time.Minute)
+	}
+
+	return s, nil
 }
 
-// InitRoutes用于初始化ProxyService的路由
-func (s *ProxyService) InitRoutes(e *gin.Engine) {
+// close在服务停止时通知后台goroutine退出，保存还在内存中的统计和配额用量并关闭存储
+func (s *ProxyService) close() {
+	close(s.done)
+	s.stats.db.close()
+	if nil != s.quotas {
+		if err := s.quotas.save(); nil != err {
+			logError("save quota state failed: %v\n", err)
+		}
+	}
+	if err := s.store.close(); nil != err {
+		logError("close storage failed: %v\n", err)
+	}
+	s.corpus.close()
+}
+
+// InitRoutes用于初始化ProxyService的路由，管理接口注册到admin，未配置admin_bind时admin与e相同
+func (s *ProxyService) InitRoutes(e *gin.Engine, admin *gin.Engine) {
+	// 启用链路追踪时为每个请求创建server span
+	if s.cfg.OtelEnabled {
+		e.Use(otelgin.Middleware(serviceName))
+		if admin != e {
+			admin.Use(otelgin.Middleware(serviceName))
+		}
+	}
+
+	// 限制读取请求体的时间，慢速发送请求体的客户端不会一直占用连接
+	e.Use(s.bodyDeadline)
+	if admin != e {
+		admin.Use(s.bodyDeadline)
+	}
+
+	s.registerRoutes(e, admin)
+}
+
+// registerRoutes把ProxyService的接口注册到e，管理接口注册到admin，配置档的接口注册在它的路径前缀下
+func (s *ProxyService) registerRoutes(e gin.IRoutes, admin gin.IRoutes) {
+	// 管理接口
+	admin.GET("/stats", s.requireAdmin, s.stats.handleStats)
+	admin.GET("/metrics", s.requireAdmin, s.metrics.handleMetrics)
+	admin.GET("/dashboard", s.dashboard)
+	admin.GET("/dashboard/data", s.requireAdmin, s.dashboardData)
+	admin.GET("/admin/recent", s.requireAdmin, s.recentRequests)
+	admin.POST("/admin/dry-run/chat", s.requireAdmin, s.dryRunChat)
+	admin.POST("/admin/dry-run/codex", s.requireAdmin, s.dryRunCodex)
+	admin.POST("/v1/transform", s.requireAdmin, s.transformRequest)
+	admin.POST("/admin/replay/:id", s.requireAdmin, s.replayRequest)
+	admin.POST("/admin/config/validate", s.requireAdmin, s.validateConfig)
+	admin.POST("/admin/probe", s.requireAdmin, s.probeRequest)
+
 	// 绑定POST请求处理函数
 	e.POST("/v1/chat/completions", s.completions)
+	e.POST("/v1/messages", s.messages)
 	e.POST("/v1/engines/copilot-codex/completions", s.codeCompletions)
+	e.POST("/v1/token_count", s.tokenCount)
+	e.POST("/v1/audio/transcriptions", s.audioTranscriptions)
+	e.POST("/v1/audio/speech", s.audioSpeech)
+	e.POST("/v1/images/generations", s.imageGenerations)
+	e.POST("/v1/rerank", s.rerank)
+	e.POST("/v1/feedback", s.completionFeedback)
+	e.GET("/v1/models", s.listModels)
+	e.GET("/version", versionInfo)
+	e.HEAD("/v1/models", s.listModels)
+
+	// 浏览器访问代理接口时说明请求方式
+	e.GET("/v1/chat/completions", requirePost)
+	e.GET("/v1/messages", requirePost)
+	e.GET("/v1/engines/copilot-codex/completions", requirePost)
+	if "" != s.cfg.ModerationMode {
+		e.POST("/v1/moderations", s.moderations)
+	}
 }
 
-// completions处理聊天模型的完成请求
-func (s *ProxyService) completions(c *gin.Context) {
-	ctx := c.Request.Context()
+// finishRecord在请求结束时汇总统计，启用链路追踪时补充span属性
+func (s *ProxyService) finishRecord(c *gin.Context, rec *usageRecord) {
+	s.stats.finish(c, rec)
+	s.stats.threads.record(rec)
+	s.traffic.touch(rec.Endpoint)
+	s.quotas.addTokens(rec.Tenant, rec.PromptTokens+rec.CompletionTokens)
+	s.budget.add(rec.Cost)
+	s.writeCorpus(c, rec)
+	s.postResponseHook(rec)
+	s.logPromptCache(rec)
+	s.metrics.inc("override_requests_total", "endpoint", rec.Endpoint, "status", strconv.Itoa(rec.Status))
+	if rec.FirstToken > 0 && http.StatusOK == rec.Status {
+		s.metrics.observe("override_ttft_seconds", rec.FirstToken.Seconds(), "endpoint", rec.Endpoint, "model", rec.MappedModel)
+	}
+	s.recordRecent(c, rec)
+	s.feedbacks.remember(c, rec)
+	if s.cfg.OtelEnabled {
+		annotateSpan(c.Request.Context(), rec)
+	}
+}
 
-	// 读取请求体
-	body, err := io.ReadAll(c.Request.Body)
-	if nil != err {
-		c.AbortWithStatus(http.StatusBadRequest)
+// useTarget把选中的上游记入请求记录，开启expose_override_headers时返回实际使用的模型和上游
+func (s *ProxyService) useTarget(c *gin.Context, rec *usageRecord, target *upstreamTarget) {
+	rec.Upstream = target.name
+	if !s.cfg.ExposeOverrideHeaders {
 		return
 	}
 
-	// 处理模型映射
-	model := gjson.GetBytes(body, "model").String()
-	if mapped, ok := s.cfg.ChatModelMap[model]; ok {
-		model = mapped
-	} else {
-		model = s.cfg.ChatModelDefault
+	c.Header("X-Override-Model", rec.MappedModel)
+	c.Header("X-Override-Upstream", target.url)
+}
+
+// 上游请求错误的分类
+const (
+	upstreamCanceled  = "canceled"  // 客户端取消了请求
+	upstreamTimeout   = "timeout"   // 上游超时
+	upstreamTransport = "transport" // 连接等传输层错误
+)
+
+// upstreamError对上游请求的错误分类计数并记录日志，返回分类和可以返回给客户端的错误信息
+func (s *ProxyService) upstreamError(upstream string, err error) (string, string) {
+	kind := upstreamTransport
+	var netErr net.Error
+	if errors.Is(err, context.Canceled) {
+		kind = upstreamCanceled
+	} else if errors.Is(err, errTTFBTimeout) || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = upstreamTimeout
+	}
+	s.metrics.inc("override_upstream_errors_total", "upstream", upstream, "kind", kind)
+
+	// 客户端主动取消不是错误
+	if upstreamCanceled == kind {
+		return kind, ""
+	}
+
+	// 错误信息中注明是哪个超时
+	message := s.sanitizeLogBody([]byte(err.Error()))
+	if upstreamTimeout == kind && !errors.Is(err, errTTFBTimeout) {
+		message = fmt.Sprintf("upstream request exceeded timeout (%ds): %s", s.cfg.Timeout, message)
+	}
+	logError("request %s %s: %s\n", s.label(upstream), kind, message)
+	s.upstreamFailed(upstream, message)
+
+	return kind, message
+}
+
+// upstreamFailed记录一次上游失败，用于告警和健康统计
+func (s *ProxyService) upstreamFailed(upstream string, sample string) {
+	s.alerter.recordFailure(upstream, sample)
+	s.stats.recordUpstream(upstream, sample)
+}
+
+// requireAdmin校验管理接口的密钥，未配置admin_key时不做限制
+func (s *ProxyService) requireAdmin(c *gin.Context) {
+	if "" == s.cfg.AdminKey {
+		return
+	}
+
+	key := c.GetHeader("X-Admin-Key")
+	if "" == key {
+		key = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(s.cfg.AdminKey)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin key"})
+	}
+}
+
+// transformChat处理聊天请求体，返回转换后的请求体、请求的模型和映射后的模型。features是客户端选择的功能
+func (s *ProxyService) transformChat(body []byte, header http.Header, features featureSet) ([]byte, string, string) {
+	// 处理模型映射，客户端选择raw-model时使用请求的模型
+	requested := gjson.GetBytes(body, "model").String()
+	model := requested
+	locale := s.requestLocale(header)
+	if !features.has(featureRawModel) {
+		model = s.mapChatModel(requested, header)
+		if localeModel := s.localeModel(locale); "" != localeModel {
+			model = localeModel
+		}
+	}
+	// 按消息内容匹配的规则优先于其他映射
+	if rule := s.matchChatRule(body); nil != rule {
+		if "" != rule.Model && !features.has(featureRawModel) {
+			model = rule.Model
+		}
+		body = rule.applyParams(body)
 	}
 	// 更新请求体中的模型字段
-	body, _ = sjson.SetBytes(body, "model", model)
-	// 删除请求体中的intent字段
-
-	if !gjson.GetBytes(body, "function_call").Exists() {
-		messages := gjson.GetBytes(body, "messages").Array()
-		lastIndex := len(messages) - 1
-		if !strings.Contains(messages[lastIndex].Get("content").String(), "Respond in the following locale") {
-			locale := s.cfg.ChatLocale
-			if locale == "" {
-				locale = "zh_CN"
+	body, _ = sjson.SetBytesOptions(body, "model", model, inPlace)
+
+	if !gjson.GetBytes(body, "function_call").Exists() && !features.has(featureNoLocale) {
+		if s.cfg.ChatPromptCache {
+			body = s.systemLocale(body, locale)
+		} else {
+			messages := gjson.GetBytes(body, "messages").Array()
+			lastIndex := len(messages) - 1
+			if !strings.Contains(messages[lastIndex].Get("content").String(), "Respond in the following locale") {
+				body, _ = sjson.SetBytes(body, "messages."+strconv.Itoa(lastIndex)+".content", messages[lastIndex].Get("content").String()+localeInstruction(locale))
 			}
-			body, _ = sjson.SetBytes(body, "messages."+strconv.Itoa(lastIndex)+".content", messages[lastIndex].Get("content").String()+"Respond in the following locale: "+locale+".")
 		}
 	}
 
-	body, _ = sjson.DeleteBytes(body, "intent")
-	body, _ = sjson.DeleteBytes(body, "intent_threshold")
-	body, _ = sjson.DeleteBytes(body, "intent_content")
+	// 删除上游不支持的字段
+	strip := s.chatStripFields()
+	if s.cfg.Debug {
+		logUnknownFields("chat", body, chatKnownFields, strip)
+	}
+	body = stripFields(body, strip)
+	body = stripFields(body, s.cfg.ChatModelRoutes[model].StripFields)
+	body = s.stripLogprobs("chat", body)
+	body = s.transformUser(body)
+	body = s.redactPrompt("chat", body)
+	body = s.transformPrediction("chat", body, model)
+	body = s.transformSampling("chat", body, model)
 
+	// 先按模型限制，再按全局限制，最终取请求、模型和全局上限中的最小值
+	body = s.capMaxTokens(body, s.cfg.ChatModelMaxTokens[model])
 	if int(gjson.GetBytes(body, "max_tokens").Int()) > s.cfg.ChatMaxTokens {
-		body, _ = sjson.SetBytes(body, "max_tokens", s.cfg.ChatMaxTokens)
+		body, _ = sjson.SetBytesOptions(body, "max_tokens", s.cfg.ChatMaxTokens, inPlace)
 	}
 
-	// 构建转发请求
-	proxyUrl := s.cfg.ChatApiBase + "/chat/completions"
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyUrl, io.NopCloser(bytes.NewBuffer(body)))
+	return body, requested, model
+}
+
+// transformCodex处理代码补全请求体，返回转换后的请求体、请求的模型和实际使用的模型
+func (s *ProxyService) transformCodex(body []byte) ([]byte, string, string) {
+	requested := gjson.GetBytes(body, "model").String()
+
+	// 删除上游不支持的字段
+	strip := s.codexStripFields()
+	if s.cfg.Debug {
+		logUnknownFields("codex", body, codexKnownFields, strip)
+	}
+	body = stripFields(body, strip)
+	body = s.stripLogprobs("codex", body)
+	body = s.transformUser(body)
+	body = s.redactPrompt("codex", body)
+	body = s.redactCodexPaths(body)
+	body = s.transformPrediction("codex", body, InstructModel)
+	body = s.transformSampling("codex", body, InstructModel)
+	body = s.capMaxTokens(body, s.cfg.CodexModelMaxTokens[InstructModel])
+	body, _ = sjson.SetBytesOptions(body, "model", InstructModel, inPlace)
+
+	return body, requested, InstructModel
+}
+
+// completions处理聊天模型的完成请求
+func (s *ProxyService) completions(c *gin.Context) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	rec := s.stats.begin(c, "chat")
+	rec.features = s.requestFeatures(c)
+	defer s.finishRecord(c, rec)
+	timing := newServerTiming(c)
+
+	// 读取请求体，请求结束后归还缓冲区
+	body, release, err := readBody(c.Request.Body)
+	defer release()
+	timing.add("body-read", timing.since())
 	if nil != err {
-		c.AbortWithStatus(http.StatusInternalServerError)
+		c.AbortWithStatus(bodyReadStatus(err))
 		return
 	}
+	s.keepRecentBody(c, body)
 
-	// 设置请求头
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+s.cfg.ChatApiKey)
-	if "" != s.cfg.ChatApiOrganization {
-		req.Header.Set("OpenAI-Organization", s.cfg.ChatApiOrganization)
+	if s.blockRequest(c, "chat", body) {
+		abortWithError(c, http.StatusForbidden, "policy_violation", s.blockReason())
+		return
 	}
-	if "" != s.cfg.ChatApiProject {
-		req.Header.Set("OpenAI-Project", s.cfg.ChatApiProject)
+
+	if reason, ok := s.quotas.allow(rec.Tenant); !ok {
+		log.Printf("chat request of tenant %s rejected: %s\n", rec.Tenant, reason)
+		s.alerter.recordExhausted(alertQuotaExceeded, rec.Tenant, reason)
+		abortWithError(c, http.StatusTooManyRequests, "quota_exceeded", reason)
+		return
 	}
 
-	// 发送请求并处理响应
-	resp, err := s.client.Do(req)
-	if nil != err {
-		if errors.Is(err, context.Canceled) {
-			c.AbortWithStatus(http.StatusRequestTimeout)
+	// 对话标识和实验分组需要在删除字段之前取出
+	conversation := ""
+	if nil != s.backends || nil != s.stats.threads {
+		conversation = conversationId(body)
+	}
+	if nil != s.stats.threads && "" != conversation {
+		rec.turn = newConversationTurn(conversation, len(gjson.GetBytes(body, "messages").Array()), len(body))
+	}
+	// 转换阶段的panic只影响当前请求
+	if !s.guardTransform(c, "chat", body, func() {
+		if s.cfg.ChatRawPassthrough {
+			rec.Model, rec.MappedModel = rawModel(body)
+		} else {
+			subject := s.experimentSubject(c, "chat", body)
+			body, rec.Model, rec.MappedModel = s.transformChat(body, c.Request.Header, rec.features)
+			body = s.applyExperiment(c, rec, subject, body)
+		}
+	}) {
+		return
+	}
+	// 当天花费达到预算的一定比例时改用更便宜的模型或拒绝请求
+	if model, changed := s.budgetModel(rec.MappedModel); changed {
+		if "" == model {
+			s.metrics.inc("override_budget_blocked_total")
+			abortWithError(c, http.StatusTooManyRequests, "budget_exceeded", "daily budget exhausted")
 			return
 		}
+		s.metrics.inc("override_budget_downgrades_total")
+		c.Header("X-Override-Downgraded", rec.MappedModel)
+		body, _ = sjson.SetBytes(body, "model", model)
+		rec.MappedModel = model
+	}
+	// 客户端重试之前中途中断的流式请求时，让上游从已生成的内容之后续写
+	recoveryKey := s.recovery.recoveryKey(c, body)
+	recovered := s.recovery.take(recoveryKey)
+	if nil != recovered {
+		body = continuationBody(body, recovered.content)
+		s.metrics.inc("override_stream_recoveries_total")
+		log.Printf("%s recovering interrupted stream: continuing after %d bytes\n", s.label("completions"), len(recovered.content))
+	}
+	target := s.chatTarget(rec.MappedModel)
+	target.forwarded = s.targetHeaders(c, target)
+	s.balanceChat(rec, target, conversation)
+	if s.chatDisabled(target) {
+		abortWithError(c, http.StatusServiceUnavailable, "unavailable", "chat upstream not configured")
+		return
+	}
+	s.useTarget(c, rec, target)
+	body, rejection := s.preRequestHook(c, rec, body)
+	if "" != rejection {
+		abortWithError(c, http.StatusForbidden, "hook_rejected", rejection)
+		return
+	}
+	s.keepReplay(c, rec, body)
+	s.keepCorpus(c, rec, body)
+
+	timing.add("transform", timing.since())
+
+	// 相同的非流式请求在进行时等待它的响应，不再请求上游
+	ticket, served := s.coalesceChat(ctx, c, target, body, cancel)
+	if served {
+		return
+	}
+	defer ticket.finish()
 
-		log.Println("request conversation failed:", err.Error())
-		c.AbortWithStatus(http.StatusInternalServerError)
+	// 等待并发名额，聊天请求优先
+	if err := s.scheduler.acquire(ctx, priorityChat, 0); nil != err {
+		c.AbortWithStatus(http.StatusRequestTimeout)
+		return
+	}
+	defer s.scheduler.release()
+	timing.add("queue", timing.since())
+
+	// 发送请求并处理响应，记录连接过程用于排查上游失败
+	ctx, conn := withConnTrace(ctx)
+	target, body, resp, err := s.sendChat(ctx, rec, target, body)
+	if nil == err {
+		target, resp, err = s.retryChat(ctx, rec, target, body, resp)
+		s.useTarget(c, rec, target)
+	}
+	rec.FirstByte = time.Since(rec.Time)
+	rec.responded(conn.sentAt())
+	ttfb := timing.since()
+	timing.add("upstream-ttfb", ttfb)
+	s.addConnTiming(timing, conn)
+	if nil != err {
+		kind, message := s.upstreamError(target.name, err)
+		s.logConnTrace(target.name, kind, conn)
+		switch kind {
+		case upstreamCanceled:
+			c.AbortWithStatus(http.StatusRequestTimeout)
+		case upstreamTimeout:
+			abortWithError(c, http.StatusGatewayTimeout, "timeout_error", message)
+		default:
+			abortWithError(c, http.StatusBadGateway, "upstream_error", message)
+		}
 		return
 	}
 	defer closeIO(resp.Body)
+	s.rateLimits.record(c, target, resp)
+	s.recordRequestId(c, resp)
+	encoding := upstreamEncoding(target, resp)
+
+	// 部分网关以200返回错误内容，转换为错误响应，避免插件静默失败
+	if message, body := invalidChatResponse(resp); "" != message {
+		sample := s.sanitizeLogBody(body)
+		logError("request %s failed: %s: %s\n", s.label("completions"), message, sample)
+		s.metrics.inc("override_invalid_responses_total", "upstream", target.name)
+		s.upstreamFailed(target.name, sample)
+		abortWithError(c, s.invalidResponseStatus(), "upstream_error", message)
+		return
+	}
 
 	if resp.StatusCode != http.StatusOK { // 记录失败的请求
 		body, _ := io.ReadAll(resp.Body)
-		log.Println("request completions failed:", string(body))
+		timing.add("upstream-total", ttfb+timing.since())
+		sample := s.sanitizeLogBody(body)
+		if "" != encoding {
+			sample = fmt.Sprintf("status %d with %s encoded body", resp.StatusCode, encoding)
+		}
+		logError("request %s failed: %s\n", s.label("completions"), sample)
+		s.upstreamFailed(target.name, sample)
+		setRecentError(c, sample)
 
-		resp.Body = io.NopCloser(bytes.NewBuffer(body))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	} else {
+		s.stats.recordUpstream(target.name, "")
+	}
+
+	// 把非流式响应交给等待的相同请求；读取失败时不交出不完整的响应，等待的请求各自请求上游。
+	// 压缩的响应不交出，等待的请求可能不接受同样的编码
+	contentType := resp.Header.Get("Content-Type")
+	if nil != ticket && !ticket.stream && !isEventStream(contentType) && "" == encoding {
+		content, err := io.ReadAll(resp.Body)
+		if nil != err {
+			ticket.publish(nil)
+			kind, message := s.upstreamError(target.name, err)
+			switch kind {
+			case upstreamCanceled:
+				c.AbortWithStatus(http.StatusRequestTimeout)
+			case upstreamTimeout:
+				abortWithError(c, http.StatusGatewayTimeout, "timeout_error", message)
+			default:
+				abortWithError(c, http.StatusBadGateway, "upstream_error", message)
+			}
+			return
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(content))
+		ticket.publish(&coalescedResponse{status: resp.StatusCode, contentType: contentType, body: content})
 	}
 
 	// 返回响应状态码和头信息
 	c.Status(resp.StatusCode)
-	contentType := resp.Header.Get("Content-Type")
 	if "" != contentType {
 		c.Header("Content-Type", contentType)
 	}
+	if "" != encoding {
+		c.Header("Content-Encoding", encoding)
+	}
+	recovering := nil != recovered && http.StatusOK == resp.StatusCode && isEventStream(contentType) && "" == encoding
+	if recovering {
+		c.Header("X-Override-Recovered", strconv.Itoa(len(recovered.content)))
+	}
+
+	// 返回响应体，同时提取用量；usage由代理强制开启时不转发给客户端。原样转发的压缩响应无法解析，直接转发
+	timing.declareTrailer(c)
+	var src io.Reader = resp.Body
+	var partial *partialCapture
+	if "" == encoding {
+		rec.capture = newUsageCapture(contentType)
+		var capture io.Writer = s.corpusCapture(c, contentType, rec.capture)
+		if "" != recoveryKey && http.StatusOK == resp.StatusCode && isEventStream(contentType) {
+			previous := ""
+			if recovering {
+				previous = recovered.content
+			}
+			partial = newPartialCapture(previous)
+			capture = io.MultiWriter(capture, partial)
+		}
+		src = io.TeeReader(resp.Body, capture)
+		if isEventStream(contentType) && target.forcesUsage(body) {
+			src = newUsageFilter(src)
+		}
+		if !rec.features.has(featureRawToolCalls) {
+			var err error
+			if src, err = s.normalizeToolCalls(target, contentType, src); nil != err {
+				switch kind, message := s.upstreamError(target.name, err); kind {
+				case upstreamCanceled:
+					c.AbortWithStatus(http.StatusRequestTimeout)
+				case upstreamTimeout:
+					abortWithError(c, http.StatusGatewayTimeout, "timeout_error", message)
+				default:
+					abortWithError(c, http.StatusBadGateway, "upstream_error", message)
+				}
+				return
+			}
+		}
+		// 续写时先把之前已生成的内容发给客户端
+		if recovering {
+			src = io.MultiReader(bytes.NewReader(replayChunk(rec.MappedModel, recovered.content)), src)
+		}
+	}
+	s.relayBody(c, rec.Endpoint, contentType, src, cancel)
+	if nil != partial {
+		s.recovery.save(recoveryKey, partial.interrupted())
+	}
 
-	// 返回响应体
-	_, _ = io.Copy(c.Writer, resp.Body)
+	relay := timing.since()
+	if resp.StatusCode == http.StatusOK {
+		timing.add("upstream-total", ttfb+relay)
+	}
+	timing.add("relay", relay)
+	timing.trailer(c)
 }
 
 // codeCompletions处理代码补全请求
 func (s *ProxyService) codeCompletions(c *gin.Context) {
-	ctx := c.Request.Context()
+	// 没有配置Codex上游时直接返回空结果，启动时已经记录
+	if "" == s.cfg.CodexApiBase {
+		abortCodex(c, http.StatusOK)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	rec := s.stats.begin(c, "codex")
+	rec.features = s.requestFeatures(c)
+	defer s.finishRecord(c, rec)
+	timing := newServerTiming(c)
 
 	// 模拟处理耗时操作
 	time.Sleep(100 * time.Millisecond)
+	timing.add("delay", timing.since())
 	// 检查上下文是否被取消
 	if ctx.Err() != nil {
 		abortCodex(c, http.StatusRequestTimeout)
 		return
 	}
 
-	// 读取请求体
-	body, err := io.ReadAll(c.Request.Body)
+	// 读取请求体，请求结束后归还缓冲区
+	body, release, err := readBody(c.Request.Body)
+	defer release()
+	timing.add("body-read", timing.since())
 	if nil != err {
-		abortCodex(c, http.StatusBadRequest)
+		abortCodex(c, bodyReadStatus(err))
 		return
 	}
+	s.keepRecentBody(c, body)
 
-	// 处理请求体字段
-	body, _ = sjson.DeleteBytes(body, "extra")
-	body, _ = sjson.DeleteBytes(body, "nwo")
-	body, _ = sjson.SetBytes(body, "model", InstructModel)
+	// 被拒绝的补全请求返回空结果，避免编辑器弹出错误
+	if s.blockRequest(c, "codex", body) {
+		abortCodex(c, http.StatusOK)
+		return
+	}
 
-	// 构建转发请求
-	proxyUrl := s.cfg.CodexApiBase + "/chat/completions"
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyUrl, io.NopCloser(bytes.NewBuffer(body)))
-	if nil != err {
-		abortCodex(c, http.StatusInternalServerError)
+	if reason, ok := s.quotas.allow(rec.Tenant); !ok {
+		log.Printf("codex request of tenant %s rejected: %s\n", rec.Tenant, reason)
+		s.alerter.recordExhausted(alertQuotaExceeded, rec.Tenant, reason)
+		abortCodex(c, http.StatusTooManyRequests)
 		return
 	}
 
-	// 设置请求头
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+s.cfg.CodexApiKey)
-	if "" != s.cfg.CodexApiOrganization {
-		req.Header.Set("OpenAI-Organization", s.cfg.CodexApiOrganization)
+	// 同一位置的新请求会取消还在进行的旧请求
+	if s.cfg.CodexSupersede {
+		var superseding bool
+		var done func()
+		ctx, superseding, done = s.inflight.track(ctx, supersedeKey(c, body))
+		defer done()
+		if superseding {
+			s.metrics.inc("override_codex_superseded_total")
+		}
 	}
-	if "" != s.cfg.CodexApiProject {
-		req.Header.Set("OpenAI-Project", s.cfg.CodexApiProject)
+
+	// 转换阶段的panic只影响当前请求
+	if !s.guardTransform(c, "codex", body, func() {
+		if s.cfg.CodexRawPassthrough {
+			rec.Model, rec.MappedModel = rawModel(body)
+		} else {
+			subject := s.experimentSubject(c, "codex", body)
+			body, rec.Model, rec.MappedModel = s.transformCodex(body)
+			body = s.applyExperiment(c, rec, subject, body)
+		}
+	}) {
+		return
+	}
+	target := s.codexTarget()
+	target.forwarded = s.targetHeaders(c, target)
+	s.useTarget(c, rec, target)
+	// 被钩子拒绝的代码补全与block_patterns一样返回空结果
+	body, rejection := s.preRequestHook(c, rec, body)
+	if "" != rejection {
+		abortCodex(c, http.StatusOK)
+		return
 	}
+	s.keepReplay(c, rec, body)
+	s.keepCorpus(c, rec, body)
 
-	// 发送请求并处理响应
-	resp, err := s.client.Do(req)
-	if nil != err {
-		if errors.Is(err, context.Canceled) {
-			abortCodex(c, http.StatusRequestTimeout)
+	timing.add("transform", timing.since())
+
+	// 等待并发名额，排队太久的代码补全直接丢弃，插件稍后会重新请求
+	timeout := time.Duration(s.cfg.CodexQueueTimeout) * time.Millisecond
+	if err := s.scheduler.acquire(ctx, priorityCodex, timeout); nil != err {
+		if abortSuperseded(c, ctx) {
 			return
 		}
+		if errors.Is(err, errQueueTimeout) {
+			log.Println("codex request dropped: queued longer than codex_queue_timeout")
+			s.metrics.inc("override_queue_dropped_total", "priority", "codex")
+			abortCodex(c, http.StatusServiceUnavailable)
+		} else {
+			abortCodex(c, http.StatusRequestTimeout)
+		}
+		return
+	}
+	defer s.scheduler.release()
+	timing.add("queue", timing.since())
 
-		log.Println("request completions failed:", err.Error())
-		abortCodex(c, http.StatusInternalServerError)
+	// 发送请求并处理响应，记录连接过程用于排查上游失败
+	ctx, conn := withConnTrace(ctx)
+	resp, err := s.sendCodex(ctx, target, body)
+	rec.FirstByte = time.Since(rec.Time)
+	rec.responded(conn.sentAt())
+	ttfb := timing.since()
+	timing.add("upstream-ttfb", ttfb)
+	s.addConnTiming(timing, conn)
+	if nil != err {
+		if abortSuperseded(c, ctx) {
+			return
+		}
+		kind, _ := s.upstreamError(target.name, err)
+		s.logConnTrace(target.name, kind, conn)
+		switch kind {
+		case upstreamCanceled:
+			abortCodex(c, http.StatusRequestTimeout)
+		case upstreamTimeout:
+			abortCodex(c, http.StatusGatewayTimeout)
+		default:
+			abortCodex(c, http.StatusBadGateway)
+		}
 		return
 	}
 	defer closeIO(resp.Body)
+	s.rateLimits.record(c, target, resp)
+	s.recordRequestId(c, resp)
+	encoding := upstreamEncoding(target, resp)
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		log.Println("request completions failed:", string(body))
+		timing.add("upstream-total", ttfb+timing.since())
+		sample := s.sanitizeLogBody(body)
+		if "" != encoding {
+			sample = fmt.Sprintf("status %d with %s encoded body", resp.StatusCode, encoding)
+		}
+		logError("request %s failed: %s\n", s.label("completions"), sample)
+		s.upstreamFailed(target.name, sample)
+		setRecentError(c, sample)
 
 		abortCodex(c, resp.StatusCode)
 		return
 	}
+	s.stats.recordUpstream(target.name, "")
 
 	// 返回响应状态码和头信息
 	c.Status(resp.StatusCode)
@@ -337,32 +1267,251 @@ func (s *ProxyService) codeCompletions(c *gin.Context) {
 	if "" != contentType {
 		c.Header("Content-Type", contentType)
 	}
+	if "" != encoding {
+		c.Header("Content-Encoding", encoding)
+	}
 
-	// 返回响应体
-	_, _ = io.Copy(c.Writer, resp.Body)
+	// 返回响应体，同时提取用量；usage由代理强制开启时不转发给客户端。原样转发的压缩响应无法解析，直接转发
+	timing.declareTrailer(c)
+	var src io.Reader = resp.Body
+	if "" == encoding {
+		rec.capture = newUsageCapture(contentType)
+		src = io.TeeReader(resp.Body, s.corpusCapture(c, contentType, rec.capture))
+		if isEventStream(contentType) && target.forcesUsage(body) {
+			src = newUsageFilter(src)
+		}
+	}
+	s.relayBody(c, rec.Endpoint, contentType, src, cancel)
+
+	relay := timing.since()
+	timing.add("upstream-total", ttfb+relay)
+	timing.add("relay", relay)
+	timing.trailer(c)
 }
 
+// shutdownTimeout是停止服务时等待进行中请求完成的最长时间
+const shutdownTimeout = 30 * time.Second
+
 // main函数负责服务的初始化和启动
 func main() {
+	// Windows上以服务方式运行或执行service子命令时由对应的平台代码处理
+	if runPlatform() {
+		return
+	}
+
+	// check子命令检查配置、代理、上游连通性和密钥后退出
+	if len(os.Args) > 1 && "check" == os.Args[1] {
+		os.Exit(runCheck())
+	}
+
+	// config-schema子命令输出配置文件的JSON Schema，用于编辑器校验和补全
+	if len(os.Args) > 1 && "config-schema" == os.Args[1] {
+		os.Exit(runConfigSchema())
+	}
+
+	// env-list子命令列出可以用环境变量覆盖的配置项
+	if len(os.Args) > 1 && "env-list" == os.Args[1] {
+		os.Exit(runEnvList())
+	}
+
+	// replay子命令通过管理接口重放最近的请求
+	if len(os.Args) > 1 && "replay" == os.Args[1] {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	// 收到中断或终止信号时优雅停止
+	stop := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		close(stop)
+	}()
+
+	err := serve(stop, "")
+	if nil != err {
+		log.Fatal(err)
+	}
+}
+
+// serve启动服务并阻塞到stop被关闭，未配置log_file时日志写入defaultLogFile，为空则输出到标准错误
+func serve(stop <-chan struct{}, defaultLogFile string) error {
 	cfg := readConfig()
+	recentErrors.resize(recentSize(cfg))
+	if "" == cfg.LogFile {
+		cfg.LogFile = defaultLogFile
+	}
+
+	// 配置了log_file时日志和访问日志都写入文件，收到SIGUSR2时重新打开
+	var logFile *reopenWriter
+	if "" != cfg.LogFile {
+		var err error
+		logFile, err = openLogFile(cfg.LogFile)
+		if nil != err {
+			return err
+		}
+		log.SetOutput(logFile)
+		gin.DefaultWriter = logFile
+		gin.DefaultErrorWriter = logFile
+	}
 
-	// 设置Gin运行模式为Release
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	shutdownTracing, err := initTracing(cfg)
+	if nil != err {
+		return err
+	}
+	defer func() {
+		_ = shutdownTracing(context.Background())
+	}()
+
+	// 未配置监听地址时只监听本机，启动前校验监听地址
+	if "" == cfg.Bind {
+		cfg.Bind = defaultBind
+		log.Printf("bind is not configured, using %s\n", defaultBind)
+	}
+	network, addr, err := parseBind("bind", cfg.Bind)
+	if nil != err {
+		return err
+	}
+	adminNetwork, adminAddr := "", ""
+	if "" != cfg.AdminBind {
+		if adminNetwork, adminAddr, err = parseBind("admin_bind", cfg.AdminBind); nil != err {
+			return err
+		}
+	}
+
+	// 先开始监听再初始化，初始化完成之前的请求返回503，客户端不会因为连接被拒绝而长时间退避
+	lc := &lifecycle{}
+	gate := lc.gate()
+
+	// 开启h2c时同一个地址同时接受HTTP/1.1和不加密的HTTP/2
+	var handler http.Handler = gate
+	if cfg.ServeH2c {
+		handler = h2c.NewHandler(gate, &http2.Server{})
+	}
+
+	// 请求头必须在read_header_timeout_seconds内发完；不设置ReadTimeout，请求体由bodyDeadline按接口限制
+	readHeaderTimeout := configTimeout(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ConnState:         trackConn,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	// 使用systemd传入的socket或监听addr
+	listener, err := listen(network, addr)
+	if nil != err {
+		return fmt.Errorf("listen on bind %s: %w", cfg.Bind, err)
+	}
+	if cfg.ProxyProtocol {
+		listener = newProxyListener(listener, readHeaderTimeout)
+	}
+	logListening("proxy", listener, cfg.ServeH2c)
+	servers := []*http.Server{server}
+	listeners := []net.Listener{listener}
+
+	adminGate := gate
+	if "" != cfg.AdminBind {
+		adminListener, err := listenBind(adminNetwork, adminAddr)
+		if nil != err {
+			closeIO(listener)
+			return fmt.Errorf("listen on admin_bind %s: %w", cfg.AdminBind, err)
+		}
+		logListening("admin", adminListener, false)
+		adminGate = lc.gate()
+		servers = append(servers, &http.Server{Addr: cfg.AdminBind, Handler: adminGate, ReadHeaderTimeout: readHeaderTimeout})
+		listeners = append(listeners, adminListener)
+	}
+
+	// 启动服务，初始化失败时关闭
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(servers[i], listeners[i])
+	}
+	fail := func(err error) error {
+		for _, server := range servers {
+			closeIO(server)
+		}
+		return err
+	}
+
+	// 创建gin引擎，默认使用自己的Recovery和访问日志
+	r, err := newEngine(cfg)
+	if nil != err {
+		return fail(err)
+	}
+
+	// 配置档以修改前的顶层配置为默认值
+	profiles, err := profileConfigs(cfg)
+	if nil != err {
+		return fail(cfg.sources.describeError(err))
+	}
 
 	proxyService, err := NewProxyService(cfg)
 	if nil != err {
-		log.Fatal(err)
-		return
+		return fail(cfg.sources.describeError(err))
 	}
+	defer proxyService.close()
 
-	// 初始化路由
-	proxyService.InitRoutes(r)
+	// 配置了admin_bind时管理接口使用单独的gin引擎和监听地址
+	admin := r
+	if "" != cfg.AdminBind {
+		if admin, err = newEngine(cfg); nil != err {
+			return fail(err)
+		}
+	}
 
-	// 启动服务
-	err = r.Run(cfg.Bind)
+	// 初始化路由
+	proxyService.InitRoutes(r, admin)
+	proxyService.logUpstreams()
+	profileServices, err := proxyService.initProfiles(r, admin, profiles)
 	if nil != err {
-		log.Fatal(err)
-		return
+		return fail(err)
+	}
+	for _, profileService := range profileServices {
+		defer profileService.close()
 	}
+	go proxyService.handleSignals(logFile)
+
+	// 初始化完成，开始正常处理请求
+	gate.next = r
+	adminGate.next = admin
+	lc.ready()
+
+	// 停止时先对新请求返回503，再不接受新连接，等待进行中的请求完成
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-stop
+		log.Println("shutting down")
+		sdNotify("STOPPING=1")
+		lc.drain()
+		if cfg.DrainDelaySeconds > 0 {
+			time.Sleep(time.Duration(cfg.DrainDelaySeconds) * time.Second)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); nil != err {
+				logError("shutdown failed: %v\n", err)
+			}
+		}
+	}()
+
+	// 通知systemd服务已就绪
+	sdNotify("READY=1")
+	go sdWatchdog(stop)
+
+	// 任一服务异常退出时返回错误
+	for range servers {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	<-stopped
+
+	return nil
 }
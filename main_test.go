@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestProxy创建聊天和代码补全上游都指向upstream的ProxyService，返回代理的测试服务器
+func newTestProxy(t testing.TB, cfg *config, upstream string) (*ProxyService, *httptest.Server) {
+	t.Helper()
+
+	if nil == cfg {
+		cfg = &config{}
+	}
+	if "" == cfg.ChatApiBase {
+		cfg.ChatApiBase = upstream + "/v1"
+	}
+	if "" == cfg.CodexApiBase {
+		cfg.CodexApiBase = upstream + "/v1"
+	}
+	if "" == cfg.ChatApiKey {
+		cfg.ChatApiKey = "sk-chat-test"
+	}
+	if "" == cfg.CodexApiKey {
+		cfg.CodexApiKey = "sk-codex-test"
+	}
+	if "" == cfg.AccessLog {
+		cfg.AccessLog = "off"
+	}
+	cfg.ModelSyncDisabled = true
+
+	s, err := newProxyService(cfg, "", newMetrics())
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.close)
+
+	r, err := newEngine(cfg)
+	if nil != err {
+		t.Fatal(err)
+	}
+	s.InitRoutes(r, r)
+	proxy := httptest.NewServer(r)
+	t.Cleanup(proxy.Close)
+
+	return s, proxy
+}
+
+// newTestContext创建处理一个请求的gin.Context
+func newTestContext(method string, path string, body io.Reader) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, path, body)
+	return c, w
+}
+
+// postTest向代理发送POST请求，返回状态码、响应头和响应体
+func postTest(t *testing.T, proxy *httptest.Server, path string, body string, header map[string]string) (int, http.Header, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, proxy.URL+path, strings.NewReader(body))
+	if nil != err {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := proxy.Client().Do(req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer closeIO(resp.Body)
+
+	content, err := io.ReadAll(resp.Body)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(content)
+}
+
+// waitFor等待cond成立，请求的统计在响应结束后才汇总
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metrics是以Prometheus文本格式输出的简单计数器集合
+type metrics struct {
+	mu       sync.Mutex
+	counters map[string]map[string]float64 // 指标名 -> 标签 -> 值
+
+	gauges map[string]map[string]func() float64 // 指标名 -> 标签 -> 输出时计算值的函数
+
+	histograms map[string]map[string]*histogram // 指标名 -> 标签 -> 直方图
+
+	parent *metrics // 不为nil时计数记到parent中，并加上labels
+	labels []string
+}
+
+// newMetrics创建metrics
+func newMetrics() *metrics {
+	return &metrics{
+		counters:   make(map[string]map[string]float64),
+		gauges:     make(map[string]map[string]func() float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// with返回记到m中并固定加上labels的metrics，用于区分配置档
+func (m *metrics) with(labels ...string) *metrics {
+	return &metrics{parent: m, labels: labels}
+}
+
+// inc将计数器加一，labels为成对的标签名和标签值
+func (m *metrics) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+// add将计数器增加v
+func (m *metrics) add(name string, v float64, labels ...string) {
+	if nil != m.parent {
+		m.parent.add(name, v, append(slices.Clone(m.labels), labels...)...)
+		return
+	}
+
+	key := formatLabels(labels)
+
+	m.mu.Lock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.counters[name] = series
+	}
+	series[key] += v
+	m.mu.Unlock()
+}
+
+// gauge注册一个在输出时计算值的gauge
+func (m *metrics) gauge(name string, value func() float64, labels ...string) {
+	if nil != m.parent {
+		m.parent.gauge(name, value, append(slices.Clone(m.labels), labels...)...)
+		return
+	}
+
+	key := formatLabels(labels)
+
+	m.mu.Lock()
+	series, ok := m.gauges[name]
+	if !ok {
+		series = make(map[string]func() float64)
+		m.gauges[name] = series
+	}
+	series[key] = value
+	m.mu.Unlock()
+}
+
+// latencyBuckets是耗时直方图各桶的上限，单位为秒
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram是一个直方图序列，counts[i]是不大于latencyBuckets[i]的观测数
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe把v记入直方图，使用latencyBuckets
+func (m *metrics) observe(name string, v float64, labels ...string) {
+	if nil != m.parent {
+		m.parent.observe(name, v, append(slices.Clone(m.labels), labels...)...)
+		return
+	}
+
+	key := formatLabels(labels)
+
+	m.mu.Lock()
+	series, ok := m.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[name] = series
+	}
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{labels: slices.Clone(labels), counts: make([]uint64, len(latencyBuckets))}
+		series[key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+	m.mu.Unlock()
+}
+
+// formatLabels把标签格式化为{k="v",...}
+func formatLabels(labels []string) string {
+	if 0 == len(labels) {
+		return ""
+	}
+
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// handleMetrics处理/metrics请求
+func (m *metrics) handleMetrics(c *gin.Context) {
+	if nil != m.parent {
+		m.parent.handleMetrics(c)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		series := m.counters[name]
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %g\n", name, key, series[key])
+		}
+	}
+
+	for _, name := range sortedKeys(m.gauges) {
+		series := m.gauges[name]
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		for _, key := range sortedKeys(series) {
+			fmt.Fprintf(&b, "%s%s %g\n", name, key, series[key]())
+		}
+	}
+
+	for _, name := range sortedKeys(m.histograms) {
+		series := m.histograms[name]
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		for _, key := range sortedKeys(series) {
+			h := series[key]
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(append(slices.Clone(h.labels), "le", fmt.Sprint(bound))), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(append(slices.Clone(h.labels), "le", "+Inf")), h.count)
+			fmt.Fprintf(&b, "%s_sum%s %g\n", name, key, h.sum)
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	accessLogAll    = "all"    // 记录所有请求
+	accessLogErrors = "errors" // 只记录状态码不是2xx的请求
+	accessLogOff    = "off"    // 不记录
+)
+
+// newEngine创建gin引擎，gin_debug时使用gin默认的调试模式、Logger和Recovery
+func newEngine(cfg *config) (*gin.Engine, error) {
+	if cfg.GinDebug {
+		gin.SetMode(gin.DebugMode)
+		r := gin.Default()
+		routeErrors(r, cfg)
+		return r, nil
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	routeErrors(r, cfg)
+
+	// 访问日志在最外层，发生panic的请求也会被记录
+	access, err := accessLog(cfg.AccessLog)
+	if nil != err {
+		return nil, err
+	}
+	if nil != access {
+		r.Use(access)
+	}
+	r.Use(recovery())
+
+	return r, nil
+}
+
+// routeErrors让未知路径返回JSON格式的404，已知路径使用了不支持的方法时返回405和允许的方法，
+// 用浏览器或curl测试时能看出服务在运行、是请求方式不对
+func routeErrors(r *gin.Engine, cfg *config) {
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(func(c *gin.Context) {
+		// gin在调用前已经设置了Allow
+		allowed := c.Writer.Header().Get("Allow")
+		abortWithError(c, http.StatusMethodNotAllowed, "invalid_request_error", fmt.Sprintf("method %s is not allowed on %s, allowed: %s", c.Request.Method, c.Request.URL.Path, allowed))
+	})
+	r.NoRoute(func(c *gin.Context) {
+		if cfg.Debug {
+			log.Printf("no route for %s %s\n", c.Request.Method, c.Request.URL.Path)
+		}
+		abortWithError(c, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("unknown path %s", c.Request.URL.Path))
+	})
+}
+
+// requirePost回应对代理接口的GET请求，说明需要POST JSON请求体，避免被误认为服务没有运行
+func requirePost(c *gin.Context) {
+	c.Header("Allow", http.MethodPost)
+	abortWithError(c, http.StatusMethodNotAllowed, "invalid_request_error", fmt.Sprintf("override is running; %s requires a POST request with a JSON body", c.Request.URL.Path))
+}
+
+// recovery捕获处理请求时的panic，记录调用栈并返回OpenAI格式的错误
+func recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if nil == err {
+				return
+			}
+			// http.ErrAbortHandler用于中断连接，交给net/http处理
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			logError("panic recovered: %s %s: %v\n%s", c.Request.Method, c.Request.URL.Path, err, debug.Stack())
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			abortWithError(c, http.StatusInternalServerError, "server_error", "internal server error")
+		}()
+
+		c.Next()
+	}
+}
+
+// accessLog根据access_log返回访问日志中间件，off时返回nil
+func accessLog(mode string) (gin.HandlerFunc, error) {
+	var skip gin.Skipper
+	switch mode {
+	case "", accessLogAll:
+	case accessLogErrors:
+		skip = func(c *gin.Context) bool {
+			status := c.Writer.Status()
+			return status >= 200 && status < 300 && 0 == len(c.Errors)
+		}
+	case accessLogOff:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported access_log: %s", mode)
+	}
+
+	return gin.LoggerWithConfig(gin.LoggerConfig{
+		Formatter: formatAccessLog,
+		Skip:      skip,
+	}), nil
+}
+
+// formatAccessLog格式化一行访问日志，包含c.Error记录的说明（如命中的block_patterns）
+func formatAccessLog(param gin.LogFormatterParams) string {
+	line := fmt.Sprintf("[GIN] %s | %3d | %13v | %15s | %-7s %#v",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency.Truncate(time.Microsecond),
+		param.ClientIP,
+		param.Method,
+		param.Path,
+	)
+	if rec := recordOf(param.Keys); nil != rec {
+		line += formatRecord(rec)
+	}
+	if ids := upstreamRequestIds(param.Keys); len(ids) > 0 {
+		line += " | " + formatRequestIds(ids)
+	}
+	if message := strings.TrimSpace(param.ErrorMessage); "" != message {
+		line += " | " + strings.ReplaceAll(message, "\n", "; ")
+	}
+
+	return line + "\n"
+}
+
+// formatRecord返回访问日志中请求记录的部分：请求和映射后的模型、上游、负载均衡结果、实验分组、首字节和首个Token时间
+func formatRecord(rec *usageRecord) string {
+	var line string
+	if "" != rec.Model || "" != rec.MappedModel {
+		line += " | model=" + rec.Model
+		if rec.MappedModel != rec.Model {
+			line += "->" + rec.MappedModel
+		}
+	}
+	if "" != rec.Upstream {
+		line += " upstream=" + rec.Upstream
+	}
+	if rec.FirstByte > 0 {
+		line += " ttfb=" + rec.FirstByte.Truncate(time.Millisecond).String()
+	}
+	if rec.FirstToken > 0 {
+		line += " ttft=" + rec.FirstToken.Truncate(time.Millisecond).String()
+	}
+	if "" != rec.Backend {
+		line += " | " + rec.Backend
+	}
+	if "" != rec.Experiment {
+		line += " | experiment=" + rec.Experiment
+	}
+
+	return line
+}
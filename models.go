@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 未配置model_sync_interval时同步上游模型列表的间隔（分钟）
+const defaultModelSyncInterval = 60
+
+// modelCatalog缓存从Chat上游同步的模型列表
+type modelCatalog struct {
+	mu      sync.Mutex
+	models  []string  // 上游模型ID
+	updated time.Time // 最近一次同步成功的时间
+	err     string    // 最近一次同步的错误
+}
+
+// list返回缓存的模型ID
+func (m *modelCatalog) list() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.models
+}
+
+// status返回/stats中展示的模型列表缓存状态
+func (m *modelCatalog) status() gin.H {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := gin.H{"models": len(m.models)}
+	if !m.updated.IsZero() {
+		result["updated"] = m.updated
+		result["age_seconds"] = int64(time.Since(m.updated).Seconds())
+	}
+	if "" != m.err {
+		result["error"] = m.err
+	}
+
+	return result
+}
+
+// fetchModels请求Chat上游的/models接口，返回模型ID
+func (s *ProxyService) fetchModels() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	target := s.chatTarget("")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, withQuery(upstreamUrl(s.cfg.ChatApiBase, "/models"), s.cfg.ChatQueryParams), nil)
+	if nil != err {
+		return nil, err
+	}
+	key, err := target.credential(ctx)
+	if nil != err {
+		return nil, err
+	}
+	target.setHeaders(req, key)
+
+	resp, err := s.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer closeIO(resp.Body)
+
+	body, err := io.ReadAll(resp.Body)
+	if nil != err {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, s.sanitizeLogBody(body))
+	}
+
+	var models []string
+	for _, model := range gjson.GetBytes(body, "data.#.id").Array() {
+		models = append(models, model.String())
+	}
+	slices.Sort(models)
+
+	return models, nil
+}
+
+// syncModels同步上游模型列表，并检查模型映射的目标是否存在，返回是否同步成功
+func (s *ProxyService) syncModels() bool {
+	models, err := s.fetchModels()
+
+	s.catalog.mu.Lock()
+	if nil != err {
+		s.catalog.err = err.Error()
+	} else {
+		s.catalog.models, s.catalog.updated, s.catalog.err = models, time.Now(), ""
+	}
+	s.catalog.mu.Unlock()
+
+	if nil != err {
+		logError("sync %s models failed: %v\n", s.label("upstream"), err)
+		return false
+	}
+
+	s.checkModelTargets(models, func(name string, model string) {
+		log.Printf("WARNING: %s points at %s, which is not in the upstream model list\n", s.label(name), model)
+	})
+
+	return true
+}
+
+// checkModelTargets检查chat_model_default和chat_model_map的目标是否在上游模型列表中，对缺失的目标调用missing
+func (s *ProxyService) checkModelTargets(models []string, missing func(name string, model string)) {
+	// 单独配置了上游的模型不在Chat上游的列表中
+	check := func(name string, model string) {
+		if _, routed := s.cfg.ChatModelRoutes[model]; routed || "" == model {
+			return
+		}
+		if !slices.Contains(models, model) {
+			missing(name, model)
+		}
+	}
+	check("chat_model_default", s.cfg.ChatModelDefault)
+	for _, alias := range sortedKeys(s.cfg.ChatModelMap) {
+		check("chat_model_map."+alias, s.cfg.ChatModelMap[alias])
+	}
+	// 客户端以客户端标识表示，不在日志中出现密钥
+	for _, tenant := range sortedKeys(s.tenants) {
+		models := s.tenants[tenant]
+		check("tenant_models."+tenant+".chat_model_default", models.ChatModelDefault)
+		for _, alias := range sortedKeys(models.ChatModelMap) {
+			check("tenant_models."+tenant+".chat_model_map."+alias, models.ChatModelMap[alias])
+		}
+	}
+}
+
+// modelSyncLoop启动时和之后每隔interval同步一次上游模型列表，失败时一分钟后重试
+func (s *ProxyService) modelSyncLoop(interval time.Duration) {
+	for {
+		wait := interval
+		if !s.syncModels() && wait > time.Minute {
+			wait = time.Minute
+		}
+		time.Sleep(wait)
+	}
+}
+
+// listModels处理/v1/models请求，返回同步的上游模型和chat_model_map中的别名，配置了tenant_models的客户端还会看到自己的别名
+func (s *ProxyService) listModels(c *gin.Context) {
+	tenant := s.tenantModelsOf(c.Request.Header)
+	ids := slices.Clone(s.catalog.list())
+	ids = append(ids, sortedKeys(tenant.ChatModelMap)...)
+	ids = append(ids, sortedKeys(s.cfg.ChatModelMap)...)
+	if 0 == len(ids) {
+		if "" != tenant.ChatModelDefault {
+			ids = append(ids, tenant.ChatModelDefault)
+		} else if "" != s.cfg.ChatModelDefault {
+			ids = append(ids, s.cfg.ChatModelDefault)
+		}
+	}
+
+	data := make([]gin.H, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		data = append(data, gin.H{"id": id, "object": "model", "created": 0, "owned_by": "override"})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
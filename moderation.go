@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// moderation_mode的取值
+const (
+	moderationPassthrough = "passthrough" // 转发给Chat上游
+	moderationStub        = "stub"        // 不请求上游，所有输入都不标记
+)
+
+// moderationCategories是OpenAI审核接口返回的分类
+var moderationCategories = []string{
+	"harassment", "harassment/threatening", "hate", "hate/threatening", "illicit", "illicit/violent",
+	"self-harm", "self-harm/instructions", "self-harm/intent", "sexual", "sexual/minors",
+	"violence", "violence/graphic",
+}
+
+// checkModerationMode校验moderation_mode
+func checkModerationMode(mode string) error {
+	switch mode {
+	case "", moderationPassthrough, moderationStub:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported moderation_mode: %s", mode)
+}
+
+// moderationInputs返回审核请求中的输入数：字符串数组每个元素是一个输入，文本和图片组成的数组是一个输入
+func moderationInputs(body []byte) int {
+	input := gjson.GetBytes(body, "input")
+	if !input.IsArray() {
+		return 1
+	}
+
+	inputs := input.Array()
+	if 0 == len(inputs) || inputs[0].IsObject() {
+		return 1
+	}
+	return len(inputs)
+}
+
+// moderations处理/v1/moderations请求
+func (s *ProxyService) moderations(c *gin.Context) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	body, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	if !gjson.ValidBytes(body) || !gjson.GetBytes(body, "input").Exists() {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "input is required")
+		return
+	}
+
+	if moderationStub == s.cfg.ModerationMode {
+		s.moderationStub(c, body)
+		return
+	}
+
+	target := s.chatTarget("")
+	target.name = "moderation"
+	target.forwarded = s.forwardedHeaders(c)
+	target.url = withQuery(upstreamUrl(s.cfg.ChatApiBase, "/moderations"), s.cfg.ChatQueryParams)
+	resp, err := s.doUpstream(ctx, target, body)
+	s.relayPassthrough(c, target, resp, err)
+}
+
+// moderationStub为每个输入返回未标记的审核结果，用于没有审核接口的上游
+func (s *ProxyService) moderationStub(c *gin.Context, body []byte) {
+	model := gjson.GetBytes(body, "model").String()
+	if "" == model {
+		model = "omni-moderation-latest"
+	}
+
+	categories := make(gin.H, len(moderationCategories))
+	scores := make(gin.H, len(moderationCategories))
+	for _, category := range moderationCategories {
+		categories[category] = false
+		scores[category] = 0
+	}
+
+	results := make([]gin.H, moderationInputs(body))
+	for i := range results {
+		results[i] = gin.H{
+			"flagged":         false,
+			"categories":      categories,
+			"category_scores": scores,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      "modr-override",
+		"model":   model,
+		"results": results,
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 未配置alert_panic_threshold时一小时内允许的转换panic次数
+const defaultPanicThreshold = 10
+
+// newPanicId生成一次panic的ID，同时出现在错误响应和日志中，用于对照
+func newPanicId() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return "panic-" + hex.EncodeToString(buf)
+}
+
+// guardTransform执行请求的转换阶段，发生panic时不影响其他请求：返回OpenAI格式的错误，
+// 请求体不是合法JSON时为400，否则为500；按路由计数，并在日志中记录隐藏了密钥的请求体以便复现。
+// 发生panic时返回false，调用方应直接返回
+func (s *ProxyService) guardTransform(c *gin.Context, route string, body []byte, transform func()) (ok bool) {
+	defer func() {
+		err := recover()
+		if nil == err {
+			return
+		}
+
+		ok = false
+		id := newPanicId()
+		s.metrics.inc("override_transform_panics_total", "route", route)
+		s.stats.recordPanic(route)
+		s.alerter.recordPanic(route, fmt.Sprint(err))
+		logError("ERROR: %s transform panic %s: %v\nbody: %s\n%s", s.label(route), id, err, s.sanitizeLogBody(body), debug.Stack())
+
+		status, errType := http.StatusInternalServerError, "server_error"
+		if !gjson.ValidBytes(body) {
+			status, errType = http.StatusBadRequest, "invalid_request_error"
+		}
+		abortWithError(c, status, errType, fmt.Sprintf("failed to process the request (id: %s)", id))
+	}()
+
+	transform()
+	return true
+}
+
+// recordPanic按路由累计转换阶段的panic次数，在/stats中展示
+func (r *statsRecorder) recordPanic(route string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if nil == r.panics {
+		r.panics = make(map[string]int64)
+	}
+	r.panics[route]++
+}
+
+// recordPanic记录一次转换阶段的panic，一小时内的次数超过alert_panic_threshold时触发告警
+func (a *alerter) recordPanic(route string, sample string) {
+	if nil == a {
+		return
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	recent := a.panics[:0]
+	for _, t := range a.panics {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	a.panics = recent
+	count := len(recent)
+	a.mu.Unlock()
+
+	if count <= a.panicMax {
+		return
+	}
+
+	text := fmt.Sprintf("[override] %d request transform panics in the last hour, latest on %s: %s", count, route, sample)
+	a.notify(alertTransformPanics, "", sample, count, text)
+}
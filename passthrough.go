@@ -0,0 +1,9 @@
+package main
+
+import "github.com/tidwall/gjson"
+
+// rawModel返回原样转发的请求中的模型，请求的模型和实际使用的模型相同
+func rawModel(body []byte) (string, string) {
+	model := gjson.GetBytes(body, "model").String()
+	return model, model
+}
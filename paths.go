@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// codex_redact_paths的取值
+const (
+	pathsBasename = "basename" // 只保留文件名
+	pathsHash     = "hash"     // 目录替换为稳定的短哈希，保留文件名
+	pathsRules    = "rules"    // 按codex_path_rules改写
+)
+
+// promptPathLine匹配Copilot在代码补全提示中写入的文件路径注释，如"# Path: src/app.py"
+// 和相邻文件片段的"// Compare this snippet from src/util.ts:"，其他位置的路径不处理。
+// 第2组是路径，注释的结尾（"-->"、"*/"和片段说明结尾的冒号）不属于路径
+var promptPathLine = regexp.MustCompile(`(?m)^([ \t]*(?:#|//|--|;|%|'|<!--|/\*|\*)[ \t]*(?:Path:|Compare this snippet from)[ \t]*)(.*?)(:?[ \t]*(?:-->|\*/)?[ \t]*\r?)$`)
+
+// pathRule是codex_path_rules中的一条改写规则
+type pathRule struct {
+	Pattern string `json:"pattern"` // 匹配路径的正则表达式
+	Replace string `json:"replace"` // 替换的内容，可以使用$1等引用分组
+}
+
+// compiledPathRule是编译后的pathRule
+type compiledPathRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// pathRedactor改写代码补全请求中的文件路径
+type pathRedactor struct {
+	mode  string
+	rules []compiledPathRule
+}
+
+// newPathRedactor创建pathRedactor，未配置codex_redact_paths时返回nil
+func newPathRedactor(cfg *config) (*pathRedactor, error) {
+	r := &pathRedactor{mode: cfg.CodexRedactPaths}
+	switch cfg.CodexRedactPaths {
+	case "":
+		return nil, nil
+	case pathsBasename, pathsHash:
+	case pathsRules:
+		if 0 == len(cfg.CodexPathRules) {
+			return nil, fmt.Errorf("codex_redact_paths: %q requires codex_path_rules", pathsRules)
+		}
+		for i, rule := range cfg.CodexPathRules {
+			re, err := regexp.Compile(rule.Pattern)
+			if nil != err {
+				return nil, fmt.Errorf("codex_path_rules[%d]: %w", i, err)
+			}
+			r.rules = append(r.rules, compiledPathRule{re: re, replace: rule.Replace})
+		}
+	default:
+		return nil, fmt.Errorf("codex_redact_paths: unknown mode %q, expected %s, %s or %s", cfg.CodexRedactPaths, pathsBasename, pathsHash, pathsRules)
+	}
+
+	return r, nil
+}
+
+// splitPath把路径拆成目录和文件名，同时支持/和Windows的\
+func splitPath(path string) (string, string) {
+	i := strings.LastIndexAny(path, `/\`)
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// redact改写一个路径
+func (r *pathRedactor) redact(path string) string {
+	switch r.mode {
+	case pathsBasename:
+		_, name := splitPath(path)
+		return name
+	case pathsHash:
+		dir, name := splitPath(path)
+		if "" == dir {
+			return name
+		}
+		sum := sha256.Sum256([]byte(dir))
+		return hex.EncodeToString(sum[:4]) + "/" + name
+	}
+
+	for _, rule := range r.rules {
+		path = rule.re.ReplaceAllString(path, rule.replace)
+	}
+	return path
+}
+
+// redactText改写文本中Copilot路径注释里的路径，返回改写后的文本和改写的路径数
+func (r *pathRedactor) redactText(text string) (string, int) {
+	count := 0
+	text = promptPathLine.ReplaceAllStringFunc(text, func(line string) string {
+		match := promptPathLine.FindStringSubmatch(line)
+		if "" == match[2] {
+			return line
+		}
+		redacted := r.redact(match[2])
+		if redacted == match[2] {
+			return line
+		}
+		count++
+		return match[1] + redacted + match[3]
+	})
+
+	return text, count
+}
+
+// redactCodexPaths在配置了codex_redact_paths时改写代码补全请求的prompt、suffix中的路径注释，
+// 以及extra中名称带有path或file的字符串字段
+func (s *ProxyService) redactCodexPaths(body []byte) []byte {
+	if nil == s.paths {
+		return body
+	}
+
+	count := 0
+	for _, path := range promptPaths(body) {
+		text := gjson.GetBytes(body, path).String()
+		if redacted, n := s.paths.redactText(text); n > 0 {
+			body, _ = sjson.SetBytes(body, path, redacted)
+			count += n
+		}
+	}
+
+	gjson.GetBytes(body, "extra").ForEach(func(key, value gjson.Result) bool {
+		name := strings.ToLower(key.String())
+		if gjson.String != value.Type || !(strings.Contains(name, "path") || strings.Contains(name, "file")) {
+			return true
+		}
+		if redacted := s.paths.redact(value.String()); redacted != value.String() {
+			body, _ = sjson.SetBytes(body, "extra."+gjson.Escape(key.String()), redacted)
+			count++
+		}
+		return true
+	})
+
+	if count > 0 && s.cfg.Debug {
+		log.Printf("redacted %d file paths from codex request\n", count)
+	}
+
+	return body
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// updateGolden为true时用当前的输出重写testdata中的期望结果：go test -run TestRedactCodexPaths -update
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// pathTestRules把各系统的用户目录改写为~
+var pathTestRules = []pathRule{
+	{Pattern: `^/(?:Users|home)/[^/]+/`, Replace: "~/"},
+	{Pattern: `^[A-Za-z]:\\Users\\[^\\]+\\`, Replace: `~\`},
+}
+
+// redactedText把改写后请求中会被改写的字段按行排列，期望结果文件比转义后的JSON易读
+func redactedText(body []byte) []byte {
+	var buf bytes.Buffer
+	for _, field := range []string{"prompt", "suffix"} {
+		buf.WriteString("----- " + field + " -----\n")
+		buf.WriteString(gjson.GetBytes(body, field).String())
+		buf.WriteString("\n")
+	}
+	buf.WriteString("----- extra -----\n")
+	buf.WriteString(gjson.GetBytes(body, "extra").Raw)
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// TestRedactCodexPaths用Copilot各编辑器实际发送的提示检查三种模式：只改写路径注释和extra中的路径字段，
+// 代码中的路径原样保留。期望结果在testdata/codexpaths/<请求>.<模式>.golden中
+func TestRedactCodexPaths(t *testing.T) {
+	requests, err := filepath.Glob("testdata/codexpaths/*.json")
+	if nil != err || 0 == len(requests) {
+		t.Fatalf("no fixtures: %v", err)
+	}
+
+	for _, mode := range []string{pathsBasename, pathsHash, pathsRules} {
+		paths, err := newPathRedactor(&config{CodexRedactPaths: mode, CodexPathRules: pathTestRules})
+		if nil != err {
+			t.Fatal(err)
+		}
+		s := &ProxyService{cfg: &config{}, paths: paths}
+
+		for _, request := range requests {
+			name := strings.TrimSuffix(filepath.Base(request), ".json")
+			t.Run(name+"/"+mode, func(t *testing.T) {
+				body, err := os.ReadFile(request)
+				if nil != err {
+					t.Fatal(err)
+				}
+				redacted := s.redactCodexPaths(body)
+
+				// 路径注释中不能留下用户名，代码中的路径不改写
+				for _, match := range promptPathLine.FindAllStringSubmatch(gjson.GetBytes(redacted, "prompt").String(), -1) {
+					for _, user := range []string{"alice", "bob", "carol"} {
+						if strings.Contains(match[2], user) {
+							t.Errorf("path comment still names the user: %q", match[0])
+						}
+					}
+				}
+				for _, line := range strings.Split(gjson.GetBytes(body, "prompt").String(), "\n") {
+					if !promptPathLine.MatchString(line) && !strings.Contains(gjson.GetBytes(redacted, "prompt").String(), line) {
+						t.Errorf("code line changed: %q", line)
+					}
+				}
+				for _, field := range []string{"max_tokens", "stream", "extra.language"} {
+					if gjson.GetBytes(body, field).Raw != gjson.GetBytes(redacted, field).Raw {
+						t.Errorf("%s changed", field)
+					}
+				}
+
+				got := redactedText(redacted)
+				golden := filepath.Join("testdata", "codexpaths", name+"."+mode+".golden")
+				if *updateGolden {
+					if err = os.WriteFile(golden, got, 0644); nil != err {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(golden)
+				if nil != err {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(want, got) {
+					t.Fatalf("redacted request differs from %s:\n%s", golden, got)
+				}
+			})
+		}
+	}
+}
+
+// TestRedactCodexPathsOff检查未配置codex_redact_paths时请求原样转发
+func TestRedactCodexPathsOff(t *testing.T) {
+	body, err := os.ReadFile("testdata/codexpaths/vscode_python.json")
+	if nil != err {
+		t.Fatal(err)
+	}
+	s := &ProxyService{cfg: &config{}}
+	if redacted := s.redactCodexPaths(body); !bytes.Equal(body, redacted) {
+		t.Fatalf("request changed without codex_redact_paths:\n%s", redacted)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// defaultRedactPlaceholder是未配置redact_placeholder时替换敏感内容使用的文本
+const defaultRedactPlaceholder = "[REDACTED]"
+
+// compilePatterns编译配置中的正则表达式，name用于错误信息。空的正则匹配所有内容，视为配置错误，
+// 这样编译结果的序号与配置中的序号一致
+func compilePatterns(name string, patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for i, pattern := range patterns {
+		if "" == pattern {
+			return nil, fmt.Errorf("%s[%d]: empty pattern", name, i)
+		}
+		re, err := regexp.Compile(pattern)
+		if nil != err {
+			return nil, fmt.Errorf("%s[%d]: %w", name, i, err)
+		}
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+// promptPaths返回请求体中需要检查的文本字段路径：消息内容（字符串或分段的text）以及补全的prompt和suffix
+func promptPaths(body []byte) []string {
+	var paths []string
+	gjson.GetBytes(body, "messages").ForEach(func(i, message gjson.Result) bool {
+		prefix := "messages." + i.String() + ".content"
+		content := message.Get("content")
+		if gjson.String == content.Type {
+			paths = append(paths, prefix)
+		} else if content.IsArray() {
+			content.ForEach(func(j, part gjson.Result) bool {
+				if gjson.String == part.Get("text").Type {
+					paths = append(paths, prefix+"."+j.String()+".text")
+				}
+				return true
+			})
+		}
+		return true
+	})
+
+	for _, field := range []string{"prompt", "suffix"} {
+		value := gjson.GetBytes(body, field)
+		if gjson.String == value.Type {
+			paths = append(paths, field)
+		} else if value.IsArray() {
+			for i := range value.Array() {
+				paths = append(paths, field+"."+strconv.Itoa(i))
+			}
+		}
+	}
+
+	return paths
+}
+
+// redactPrompt把请求文本中匹配redact_patterns的内容替换为占位文本，并记录替换次数
+func (s *ProxyService) redactPrompt(endpoint string, body []byte) []byte {
+	if 0 == len(s.redactPatterns) {
+		return body
+	}
+
+	count := 0
+	for _, path := range promptPaths(body) {
+		text := gjson.GetBytes(body, path).String()
+		redacted, n := s.redactText(text)
+		if n > 0 {
+			count += n
+			body, _ = sjson.SetBytes(body, path, redacted)
+		}
+	}
+
+	if count > 0 {
+		log.Printf("redacted %d matches from %s request\n", count, endpoint)
+		s.metrics.add("override_redactions_total", float64(count), "endpoint", endpoint)
+	}
+
+	return body
+}
+
+// redactText把text中匹配redact_patterns的内容替换为占位文本，返回替换后的文本和替换次数
+func (s *ProxyService) redactText(text string) (string, int) {
+	placeholder := s.cfg.RedactPlaceholder
+	if "" == placeholder {
+		placeholder = defaultRedactPlaceholder
+	}
+
+	count := 0
+	for _, re := range s.redactPatterns {
+		text = re.ReplaceAllStringFunc(text, func(string) string {
+			count++
+			return placeholder
+		})
+	}
+
+	return text, count
+}
+
+// defaultBlockReason是未配置block_reason时拒绝请求返回的说明
+const defaultBlockReason = "request blocked by policy"
+
+// blockedBy检查请求文本是否匹配block_patterns，返回匹配的规则序号，未匹配时返回-1
+func (s *ProxyService) blockedBy(body []byte) int {
+	if 0 == len(s.blockPatterns) {
+		return -1
+	}
+
+	for _, path := range promptPaths(body) {
+		text := gjson.GetBytes(body, path).String()
+		for i, re := range s.blockPatterns {
+			if re.MatchString(text) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// blockRequest检查请求是否需要拒绝，需要时记录日志并在访问日志中标注规则序号，不记录匹配的内容
+func (s *ProxyService) blockRequest(c *gin.Context, endpoint string, body []byte) bool {
+	id := s.blockedBy(body)
+	if id < 0 {
+		return false
+	}
+
+	log.Printf("blocked %s request by block_patterns[%d]\n", endpoint, id)
+	s.metrics.inc("override_blocked_requests_total", "endpoint", endpoint)
+	_ = c.Error(fmt.Errorf("blocked by block_patterns[%d]", id))
+
+	return true
+}
+
+// blockReason返回拒绝请求时的说明
+func (s *ProxyService) blockReason() string {
+	if "" == s.cfg.BlockReason {
+		return defaultBlockReason
+	}
+	return s.cfg.BlockReason
+}
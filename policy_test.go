@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompilePatternsRejectsEmpty(t *testing.T) {
+	_, err := compilePatterns("block_patterns", []string{"secret", "", "codename"})
+	if nil == err || !strings.Contains(err.Error(), "block_patterns[1]") {
+		t.Fatalf("err = %v, want an error naming block_patterns[1]", err)
+	}
+}
+
+func TestBlockedByReportsConfigIndex(t *testing.T) {
+	patterns, err := compilePatterns("block_patterns", []string{"alpha", "project-x", "omega"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	s := &ProxyService{blockPatterns: patterns}
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"messages":[{"role":"user","content":"about project-x"}]}`, 1},
+		{`{"messages":[{"role":"user","content":[{"type":"text","text":"omega"}]}]}`, 2},
+		{`{"prompt":"// alpha","suffix":""}`, 0},
+		{`{"messages":[{"role":"user","content":"nothing here"}]}`, -1},
+	}
+	for _, tt := range tests {
+		if got := s.blockedBy([]byte(tt.body)); tt.want != got {
+			t.Errorf("blockedBy(%s) = %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// 能力探测检查的上游功能
+const (
+	capabilityTools         = "tools"          // 工具调用
+	capabilityJsonMode      = "json_mode"      // response_format为json_object
+	capabilityStreamOptions = "stream_options" // 流式请求的stream_options
+	capabilityN             = "n"              // 一次返回多个回答
+)
+
+// probeTimeout是一次探测请求的最长时间
+const probeTimeout = 30 * time.Second
+
+// chatCapabilities和codexCapabilities是各类上游探测的功能，代码补全没有工具调用和JSON模式
+var (
+	chatCapabilities  = []string{capabilityTools, capabilityJsonMode, capabilityStreamOptions, capabilityN}
+	codexCapabilities = []string{capabilityStreamOptions, capabilityN}
+)
+
+// capabilityFields是上游不支持某个功能时从请求中删除的字段，stream_options改由上游的stream_options处理方式删除
+var capabilityFields = map[string][]string{
+	capabilityTools:    {"tools", "tool_choice", "parallel_tool_calls"},
+	capabilityJsonMode: {"response_format"},
+	capabilityN:        {"n"},
+}
+
+// upstreamCapabilities是一个上游的探测结果
+type upstreamCapabilities struct {
+	Model    string            `json:"model"`
+	Checked  time.Time         `json:"checked"`
+	Features map[string]bool   `json:"features,omitempty"` // 不在其中的功能没有得出结论，如上游返回5xx或超时
+	Details  map[string]string `json:"details,omitempty"`  // 不支持或没有结论的原因
+	Error    string            `json:"error,omitempty"`    // 最小请求也失败时的错误，此时不探测各功能
+}
+
+// capabilityProbe保存各上游的探测结果，按上游名称区分，如chat、chat:<模型>和codex
+type capabilityProbe struct {
+	running sync.Mutex // 同一时间只进行一轮探测
+
+	mu      sync.Mutex
+	results map[string]*upstreamCapabilities
+}
+
+// newCapabilityProbe创建空的探测结果，没有探测过的上游按配置处理
+func newCapabilityProbe() *capabilityProbe {
+	return &capabilityProbe{results: make(map[string]*upstreamCapabilities)}
+}
+
+// unsupported返回上游探测失败的功能，没有探测过时返回nil
+func (p *capabilityProbe) unsupported(upstream string) []string {
+	if nil == p {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	caps, ok := p.results[upstream]
+	if !ok {
+		return nil
+	}
+	var features []string
+	for _, feature := range sortedKeys(caps.Features) {
+		if !caps.Features[feature] {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// status返回/stats和dashboard中展示的探测结果
+func (p *capabilityProbe) status() map[string]upstreamCapabilities {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := make(map[string]upstreamCapabilities, len(p.results))
+	for name, caps := range p.results {
+		result[name] = *caps
+	}
+	return result
+}
+
+// applyCapabilities按探测结果删除上游不支持的字段，显式配置了stream_options处理方式时以配置为准
+func (s *ProxyService) applyCapabilities(target *upstreamTarget) {
+	for _, feature := range s.capabilities.unsupported(target.name) {
+		if capabilityStreamOptions == feature {
+			if "" == target.streamOptions {
+				target.streamOptions = streamOptionsStrip
+			}
+			continue
+		}
+		target.stripped = append(target.stripped, capabilityFields[feature]...)
+	}
+}
+
+// probeCapabilities依次探测Chat上游、各模型路由和Codex上游，保存并返回结果
+func (s *ProxyService) probeCapabilities() map[string]upstreamCapabilities {
+	s.capabilities.running.Lock()
+	defer s.capabilities.running.Unlock()
+
+	if "" != s.cfg.ChatApiBase {
+		s.probeUpstream(s.chatTarget(s.cfg.ChatModelDefault), s.cfg.ChatModelDefault, pingChatBody(s.cfg.ChatModelDefault), chatCapabilities)
+	}
+	for _, model := range sortedKeys(s.cfg.ChatModelRoutes) {
+		if target := s.chatTarget(model); !s.chatDisabled(target) && model != s.cfg.ChatModelDefault {
+			s.probeUpstream(target, model, pingChatBody(model), chatCapabilities)
+		}
+	}
+	if "" != s.cfg.CodexApiBase {
+		s.probeUpstream(s.codexTarget(), InstructModel, pingCodexBody(), codexCapabilities)
+	}
+
+	return s.capabilities.status()
+}
+
+// probeUpstream先发送最小的请求确认上游可用，再为每个功能发送一个max_tokens为1的请求。
+// 上游以4xx拒绝时认为不支持该功能，5xx、限流和网络错误不下结论
+func (s *ProxyService) probeUpstream(target *upstreamTarget, model string, base []byte, features []string) {
+	// 探测时原样发送请求体，不受已有的探测结果和stream_options配置影响
+	probe := *target
+	probe.streamOptions = streamOptionsPassthrough
+	probe.stripped = nil
+	probe.raw = false
+
+	caps := &upstreamCapabilities{Model: model, Checked: time.Now(), Features: make(map[string]bool), Details: make(map[string]string)}
+	if status, content, err := s.probeOnce(&probe, base); nil != err {
+		caps.Error = err.Error()
+	} else if http.StatusOK != status {
+		caps.Error = fmt.Sprintf("status %d: %s", status, s.sanitizeLogBody(content))
+	}
+
+	var summary []string
+	for _, feature := range features {
+		if "" != caps.Error {
+			break
+		}
+		status, content, err := s.probeOnce(&probe, probeBody(feature, base))
+		switch {
+		case nil != err:
+			caps.Details[feature] = err.Error()
+		case http.StatusOK == status && capabilityN == feature && len(gjson.GetBytes(content, "choices").Array()) < 2:
+			caps.Features[feature] = false
+			caps.Details[feature] = "n is ignored, only one choice returned"
+		case http.StatusOK == status:
+			caps.Features[feature] = true
+		case status >= 400 && status < 500 && http.StatusUnauthorized != status && http.StatusForbidden != status &&
+			http.StatusRequestTimeout != status && http.StatusTooManyRequests != status:
+			caps.Features[feature] = false
+			caps.Details[feature] = fmt.Sprintf("status %d: %s", status, s.sanitizeLogBody(content))
+		default:
+			caps.Details[feature] = fmt.Sprintf("status %d: %s", status, s.sanitizeLogBody(content))
+		}
+
+		result := "unknown"
+		if supported, ok := caps.Features[feature]; ok && supported {
+			result = "yes"
+		} else if ok {
+			result = "no"
+		}
+		summary = append(summary, feature+"="+result)
+	}
+
+	s.capabilities.mu.Lock()
+	s.capabilities.results[target.name] = caps
+	s.capabilities.mu.Unlock()
+
+	if "" != caps.Error {
+		logError("probe %s (%s) failed, keeping configured behavior: %s\n", s.label(target.name), model, caps.Error)
+		return
+	}
+	log.Printf("probe %s (%s): %s\n", s.label(target.name), model, strings.Join(summary, " "))
+	if unsupported := s.capabilities.unsupported(target.name); len(unsupported) > 0 {
+		log.Printf("%s does not support %s, these fields are stripped from its requests\n", s.label(target.name), strings.Join(unsupported, ", "))
+	}
+}
+
+// probeBody在最小的请求上加上探测feature需要的字段
+func probeBody(feature string, base []byte) []byte {
+	body := base
+	switch feature {
+	case capabilityTools:
+		body, _ = sjson.SetRawBytes(body, "tools", []byte(`[{"type":"function","function":{"name":"ping","description":"Does nothing.","parameters":{"type":"object","properties":{}}}}]`))
+	case capabilityJsonMode:
+		// OpenAI要求JSON模式的消息中出现json
+		body, _ = sjson.SetBytes(body, "messages.0.content", "Reply with an empty json object.")
+		body, _ = sjson.SetRawBytes(body, "response_format", []byte(`{"type":"json_object"}`))
+	case capabilityStreamOptions:
+		body, _ = sjson.SetBytes(body, "stream", true)
+		body, _ = sjson.SetRawBytes(body, "stream_options", []byte(`{"include_usage":true}`))
+	case capabilityN:
+		body, _ = sjson.SetBytes(body, "n", 2)
+	}
+	return body
+}
+
+// probeOnce发送一个探测请求，返回状态码和响应体
+func (s *ProxyService) probeOnce(target *upstreamTarget, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	resp, err := s.doUpstream(ctx, target, body)
+	if nil != err {
+		return 0, nil, errors.New(s.sanitizeLogBody([]byte(err.Error())))
+	}
+	defer closeIO(resp.Body)
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if nil != err {
+		return 0, nil, err
+	}
+	return resp.StatusCode, content, nil
+}
+
+// probeRequest处理POST /admin/probe，重新探测所有上游并返回结果
+func (s *ProxyService) probeRequest(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"capabilities": s.probeCapabilities()})
+}
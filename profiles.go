@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// profileSet是配置档名称到该配置档覆盖的配置项
+type profileSet map[string]json.RawMessage
+
+// profileNamePattern限制配置档名称，名称直接用作路径前缀
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// processFields是只对整个进程生效、不能在配置档中设置的配置项
+var processFields = []string{"bind", "admin_bind", "log_file", "access_log", "gin_debug", "serve_h2c", "proxy_protocol", "otel_enabled", "otel_endpoint", "allow_unknown_config", "drain_delay_seconds", "read_header_timeout_seconds", "body_read_timeout_seconds", "profiles", "routes_file"}
+
+// profileConfigs以顶层配置为默认值生成各配置档的完整配置，需要在顶层配置被NewProxyService修改之前调用
+func profileConfigs(cfg *config) (map[string]*config, error) {
+	if 0 == len(cfg.Profiles) {
+		return nil, nil
+	}
+
+	// 按配置项合并：配置档中出现的配置项整体替换顶层的值，映射类的配置项不会与顶层合并
+	content, err := json.Marshal(cfg)
+	if nil != err {
+		return nil, err
+	}
+	var defaults map[string]json.RawMessage
+	if err = json.Unmarshal(content, &defaults); nil != err {
+		return nil, err
+	}
+	delete(defaults, "profiles")
+
+	profiles := make(map[string]*config, len(cfg.Profiles))
+	for name, raw := range cfg.Profiles {
+		if !profileNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid profile name: %q", name)
+		}
+
+		var overrides map[string]json.RawMessage
+		if err = json.Unmarshal(raw, &overrides); nil != err {
+			return nil, fmt.Errorf("profiles.%s: %w", name, err)
+		}
+		fields := maps.Clone(defaults)
+		for field, value := range overrides {
+			for _, processField := range processFields {
+				if field == processField {
+					return nil, fmt.Errorf("profiles.%s: %s can only be set at the top level", name, field)
+				}
+			}
+			fields[field] = value
+		}
+
+		content, err = json.Marshal(fields)
+		if nil != err {
+			return nil, err
+		}
+		profile := &config{}
+		if err = json.Unmarshal(content, profile); nil != err {
+			return nil, fmt.Errorf("profiles.%s: %w", name, err)
+		}
+
+		// 统计数据库、配额状态文件、存储和语料文件不能与顶层共用，未单独配置时在文件名后加上配置档名称
+		if _, ok := overrides["stats_db"]; !ok && "" != profile.StatsDb {
+			profile.StatsDb = profileFile(profile.StatsDb, name)
+		}
+		if _, ok := overrides["quota_state_file"]; !ok {
+			path := profile.QuotaStateFile
+			if "" == path {
+				path = defaultQuotaStateFile
+			}
+			profile.QuotaStateFile = profileFile(path, name)
+		}
+		if _, ok := overrides["corpus_file"]; !ok && "" != profile.CorpusFile {
+			profile.CorpusFile = profileFile(profile.CorpusFile, name)
+		}
+		if _, ok := overrides["storage_path"]; !ok && storageSqlite == profile.Storage {
+			path := profile.StoragePath
+			if "" == path {
+				path = defaultStoragePath
+			}
+			profile.StoragePath = profileFile(path, name)
+		}
+		profiles[name] = profile
+	}
+
+	return profiles, nil
+}
+
+// profileFile在文件名和扩展名之间加上配置档名称
+func profileFile(path string, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + name + ext
+}
+
+// initProfiles为每个配置档创建ProxyService并把接口注册到/<名称>前缀下，计数和统计都按配置档区分
+func (s *ProxyService) initProfiles(e *gin.Engine, admin *gin.Engine, profiles map[string]*config) ([]*ProxyService, error) {
+	var services []*ProxyService
+	for _, name := range sortedKeys(profiles) {
+		profile, err := newProxyService(profiles[name], name, s.metrics.with("profile", name))
+		if nil != err {
+			for _, service := range services {
+				service.close()
+			}
+			return nil, fmt.Errorf("profiles.%s: %w", name, err)
+		}
+		services = append(services, profile)
+
+		profile.registerRoutes(e.Group("/"+name), admin.Group("/"+name))
+		profile.logUpstreams()
+		if nil == s.stats.profiles {
+			s.stats.profiles = make(map[string]*statsRecorder)
+		}
+		s.stats.profiles[name] = profile.stats
+	}
+
+	return services, nil
+}
+
+// label在名称前加上配置档名称，用于日志和告警
+func (s *ProxyService) label(name string) string {
+	if "" == s.profile {
+		return name
+	}
+
+	return s.profile + "/" + name
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// localeInstruction返回要求上游按指定语言回复的提示
+func localeInstruction(locale string) string {
+	return "Respond in the following locale: " + locale + "."
+}
+
+// systemLocale把语言提示放到开头的system消息中。
+// 追加到最后一条消息时，上一轮的消息在下一轮请求中已经不带提示，前缀发生变化，上游的提示缓存无法命中
+func (s *ProxyService) systemLocale(body []byte, locale string) []byte {
+	instruction := localeInstruction(locale)
+	first := gjson.GetBytes(body, "messages.0")
+	if "system" == first.Get("role").String() {
+		content := first.Get("content")
+		if strings.Contains(content.Raw, "Respond in the following locale") {
+			return body
+		}
+		if content.IsArray() {
+			part, _ := sjson.Set(`{"type":"text"}`, "text", instruction)
+			body, _ = sjson.SetRawBytes(body, "messages.0.content.-1", []byte(part))
+		} else {
+			body, _ = sjson.SetBytes(body, "messages.0.content", content.String()+"\n\n"+instruction)
+		}
+		return body
+	}
+
+	// 没有system消息时在开头插入一条
+	system, _ := sjson.Set(`{"role":"system"}`, "content", instruction)
+	messages := "[" + system
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		messages += "," + message.Raw
+	}
+	body, _ = sjson.SetRawBytes(body, "messages", []byte(messages+"]"))
+
+	return body
+}
+
+// logPromptCache记录上游返回的提示缓存命中情况，兼容OpenAI和DeepSeek的usage字段
+func (s *ProxyService) logPromptCache(rec *usageRecord) {
+	if 0 == rec.PromptTokens {
+		return
+	}
+
+	s.metrics.add("override_cached_prompt_tokens_total", float64(rec.CachedTokens), "model", rec.MappedModel)
+	if s.cfg.ChatPromptCache && "chat" == rec.Endpoint {
+		log.Printf("prompt cache %s: %d/%d prompt tokens cached\n", rec.MappedModel, rec.CachedTokens, rec.PromptTokens)
+	}
+}
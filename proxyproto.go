@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol v2的签名，v1以"PROXY "开头
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyV1Prefix    = []byte("PROXY ")
+)
+
+// v1的头部最长107字节（含\r\n）
+const maxProxyV1Header = 107
+
+// proxyListener接受前面有负载均衡（如HAProxy、AWS NLB）的连接，从PROXY protocol v1/v2头部中
+// 取出客户端的真实地址，之后RemoteAddr返回该地址，限流、访问日志等都使用它
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration // 发送头部的最长时间
+}
+
+// newProxyListener包装listener，timeout不大于0时使用默认的读取请求头时间
+func newProxyListener(listener net.Listener, timeout time.Duration) *proxyListener {
+	if timeout <= 0 {
+		timeout = defaultReadHeaderTimeout
+	}
+	return &proxyListener{Listener: listener, timeout: timeout}
+}
+
+// Accept实现net.Listener。头部在连接的goroutine中读取，不会阻塞Accept
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// proxyConn在第一次读取或获取RemoteAddr时解析PROXY protocol头部，没有头部或头部无效时关闭连接
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr // 头部中的源地址，LOCAL命令或UNKNOWN时为空
+	err    error
+}
+
+// init读取头部，只执行一次
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if nil != c.err {
+			log.Printf("proxy protocol: rejecting connection from %s: %v\n", c.Conn.RemoteAddr(), c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+// Read实现net.Conn，返回头部之后的数据
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if nil != c.err {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr实现net.Conn，返回头部中的客户端地址
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if nil != c.remote {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader读取并解析PROXY protocol头部，返回客户端地址
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(len(proxyV1Prefix))
+	if nil != err {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(reader)
+	}
+	if !bytes.HasPrefix(proxyV2Signature, prefix) {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+
+	return readProxyV2(reader)
+}
+
+// readProxyV1解析文本格式的头部：PROXY TCP4|TCP6|UNKNOWN 源地址 目的地址 源端口 目的端口\r\n
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Header {
+			return nil, errors.New("v1 header too long")
+		}
+		b, err := reader.ReadByte()
+		if nil != err {
+			return nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && "UNKNOWN" == fields[1] {
+		return nil, nil
+	}
+	if 6 != len(fields) || ("TCP4" != fields[1] && "TCP6" != fields[1]) {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if nil == ip || nil != err || ("TCP4" == fields[1]) != (nil != ip.To4()) {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2解析二进制格式的头部，只使用TCP over IPv4/IPv6的地址，LOCAL命令和其他协议保留连接本身的地址
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); nil != err {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("invalid v2 signature")
+	}
+	if 0x20 != header[12]&0xf0 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); nil != err {
+		return nil, fmt.Errorf("reading v2 addresses: %w", err)
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL：负载均衡自己的连接，如健康检查
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", header[12]&0x0f)
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("v2 IPv4 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("v2 IPv6 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	quotaResetMidnight = "utc_midnight" // 每天UTC零点重置
+	quotaResetRolling  = "rolling"      // 统计最近24小时
+
+	// defaultQuotaStateFile是未配置quota_state_file时保存配额用量的文件
+	defaultQuotaStateFile = "quota_state.json"
+	// quotaDefaultKey是quotas中对所有客户端生效的默认配额
+	quotaDefaultKey = "*"
+
+	// quotaPrefix是用量在存储中的键前缀，完整的键为quota/<tenant>/<hour>/tokens或requests
+	quotaPrefix = "quota/"
+	// quotaTTL是用量在存储中保留的时间，略长于统计窗口
+	quotaTTL = 25 * time.Hour
+)
+
+// quota是一个客户端每天可以使用的额度，0为不限制
+type quota struct {
+	Tokens   int64 `json:"tokens"`   // 每天的Token数
+	Requests int64 `json:"requests"` // 每天的请求数
+}
+
+// quotaUsage是一个小时内的用量
+type quotaUsage struct {
+	Tokens   int64 `json:"tokens"`
+	Requests int64 `json:"requests"`
+}
+
+// quotaStatus是/stats中一个客户端的配额状态
+type quotaStatus struct {
+	TokensUsed        int64  `json:"tokens_used"`
+	TokensRemaining   *int64 `json:"tokens_remaining,omitempty"`
+	RequestsUsed      int64  `json:"requests_used"`
+	RequestsRemaining *int64 `json:"requests_remaining,omitempty"`
+}
+
+// quotaTracker按客户端统计用量并检查配额，用量按小时分桶保存在存储中。使用内存存储时定期保存到
+// quota_state_file，重启后不会清零；使用SQLite或Redis存储时由存储本身持久化
+type quotaTracker struct {
+	limits   map[string]quota // 客户端标识（与统计中的tenant一致）到配额
+	fallback *quota
+	rolling  bool
+	store    store
+	path     string      // 保存用量的文件，使用SQLite或Redis存储时为空
+	dirty    atomic.Bool // 上次保存之后用量有变化
+}
+
+// quotaTenant返回客户端密钥对应的标识，与tenantOf的计算方式一致
+func quotaTenant(key string) string {
+	if !strings.HasPrefix(key, "Bearer ") {
+		key = "Bearer " + key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// quotaKey返回客户端在某个小时的用量在存储中的键，field为tokens或requests
+func quotaKey(tenant string, hour int64, field string) string {
+	return fmt.Sprintf("%s%s/%d/%s", quotaPrefix, tenant, hour, field)
+}
+
+// parseQuotaKey解析quotaKey生成的键
+func parseQuotaKey(key string) (tenant string, hour int64, field string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(key, quotaPrefix), "/")
+	if 3 != len(parts) {
+		return "", 0, "", false
+	}
+	hour, err := strconv.ParseInt(parts[1], 10, 64)
+	if nil != err {
+		return "", 0, "", false
+	}
+	return parts[0], hour, parts[2], true
+}
+
+// checkQuotaReset检查quota_reset的取值
+func checkQuotaReset(mode string) error {
+	switch mode {
+	case "", quotaResetMidnight, quotaResetRolling:
+		return nil
+	}
+	return fmt.Errorf("unsupported quota_reset: %s", mode)
+}
+
+// newQuotaTracker根据quotas创建quotaTracker，用量保存在st中，未配置时返回nil
+func newQuotaTracker(cfg *config, st store) (*quotaTracker, error) {
+	if 0 == len(cfg.Quotas) {
+		return nil, nil
+	}
+
+	t := &quotaTracker{
+		limits: make(map[string]quota),
+		store:  st,
+		path:   cfg.QuotaStateFile,
+	}
+	if err := checkQuotaReset(cfg.QuotaReset); nil != err {
+		return nil, err
+	}
+	t.rolling = quotaResetRolling == cfg.QuotaReset
+	if "" == t.path {
+		t.path = defaultQuotaStateFile
+	}
+
+	for key, q := range cfg.Quotas {
+		if quotaDefaultKey == key {
+			q := q
+			t.fallback = &q
+			continue
+		}
+		t.limits[quotaTenant(key)] = q
+	}
+
+	if err := t.load(); nil != err {
+		return nil, err
+	}
+	if _, ok := st.(*memoryStore); !ok {
+		// 存储本身会持久化，导入过的文件改名，避免下次启动重复导入
+		if _, err := os.Stat(t.path); nil == err {
+			if err = os.Rename(t.path, t.path+".imported"); nil != err {
+				return nil, err
+			}
+			log.Printf("imported quota usage from %s into %s storage\n", t.path, cfg.Storage)
+		}
+		t.path = ""
+		return t, nil
+	}
+	go t.saveLoop()
+
+	return t, nil
+}
+
+// limitOf返回客户端的配额
+func (t *quotaTracker) limitOf(tenant string) (quota, bool) {
+	if q, ok := t.limits[tenant]; ok {
+		return q, true
+	}
+	if nil != t.fallback {
+		return *t.fallback, true
+	}
+	return quota{}, false
+}
+
+// windowStart返回当前统计窗口的起始小时
+func (t *quotaTracker) windowStart(now time.Time) int64 {
+	if t.rolling {
+		return now.Add(-23*time.Hour).Unix() / 3600
+	}
+	midnight := now.UTC().Truncate(24 * time.Hour)
+	return midnight.Unix() / 3600
+}
+
+// usage返回各客户端在当前窗口的用量
+func (t *quotaTracker) usage(now time.Time) (map[string]quotaUsage, error) {
+	start := t.windowStart(now)
+	result := make(map[string]quotaUsage)
+	var bad error
+	err := t.store.scan(quotaPrefix, func(key string, value []byte) bool {
+		tenant, hour, field, ok := parseQuotaKey(key)
+		if !ok || hour < start {
+			return true
+		}
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if nil != err {
+			bad = fmt.Errorf("%s: %w", key, err)
+			return false
+		}
+		u := result[tenant]
+		switch field {
+		case "tokens":
+			u.Tokens += n
+		case "requests":
+			u.Requests += n
+		}
+		result[tenant] = u
+		return true
+	})
+	if nil == err {
+		err = bad
+	}
+
+	return result, err
+}
+
+// used返回客户端在当前窗口的用量和其中当前小时的用量，一次读取窗口内每个小时的键
+func (t *quotaTracker) used(tenant string, now time.Time) (quotaUsage, quotaUsage, error) {
+	var keys []string
+	for hour := t.windowStart(now); hour <= now.Unix()/3600; hour++ {
+		keys = append(keys, quotaKey(tenant, hour, "tokens"), quotaKey(tenant, hour, "requests"))
+	}
+	values, err := t.store.getAll(keys)
+	if nil != err {
+		return quotaUsage{}, quotaUsage{}, err
+	}
+
+	var total, current quotaUsage
+	for i, value := range values {
+		if nil == value {
+			continue
+		}
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if nil != err {
+			return quotaUsage{}, quotaUsage{}, fmt.Errorf("%s: %w", keys[i], err)
+		}
+		last := i >= len(keys)-2
+		if 0 == i%2 {
+			total.Tokens += n
+			if last {
+				current.Tokens = n
+			}
+		} else {
+			total.Requests += n
+			if last {
+				current.Requests = n
+			}
+		}
+	}
+
+	return total, current, nil
+}
+
+// allow检查客户端是否还有配额，有配额时计入一次请求，没有时返回说明。读写存储失败时放行请求。
+// 访问存储时不加锁：请求数由存储原子地加一，再用加一后的值检查，超出时撤回，
+// 同时到达的请求（包括其他副本的）不会一起越过配额
+func (t *quotaTracker) allow(tenant string) (string, bool) {
+	if nil == t {
+		return "", true
+	}
+	q, ok := t.limitOf(tenant)
+	if !ok {
+		return "", true
+	}
+
+	now := time.Now()
+	used, current, err := t.used(tenant, now)
+	if nil != err {
+		logError("read quota usage failed: %v\n", err)
+		return "", true
+	}
+	exhausted := fmt.Sprintf("daily request quota of %d exhausted", q.Requests)
+	if q.Requests > 0 && used.Requests >= q.Requests {
+		return exhausted, false
+	}
+	if q.Tokens > 0 && used.Tokens >= q.Tokens {
+		return fmt.Sprintf("daily token quota of %d exhausted", q.Tokens), false
+	}
+
+	key := quotaKey(tenant, now.Unix()/3600, "requests")
+	count, err := t.store.increment(key, 1, quotaTTL)
+	if nil != err {
+		logError("record quota usage failed: %v\n", err)
+		return "", true
+	}
+	t.dirty.Store(true)
+	// 之前各小时的请求数加上当前小时加一后的值
+	if q.Requests > 0 && used.Requests-current.Requests+count > q.Requests {
+		if _, err = t.store.increment(key, -1, quotaTTL); nil != err {
+			logError("record quota usage failed: %v\n", err)
+		}
+		return exhausted, false
+	}
+
+	return "", true
+}
+
+// addTokens在请求结束时计入使用的token
+func (t *quotaTracker) addTokens(tenant string, tokens int64) {
+	if nil == t || tokens <= 0 {
+		return
+	}
+	if _, ok := t.limitOf(tenant); !ok {
+		return
+	}
+
+	if _, err := t.store.increment(quotaKey(tenant, time.Now().Unix()/3600, "tokens"), tokens, quotaTTL); nil != err {
+		logError("record quota usage failed: %v\n", err)
+	}
+	t.dirty.Store(true)
+}
+
+// status返回各客户端当前窗口的用量和剩余配额
+func (t *quotaTracker) status() map[string]quotaStatus {
+	usage, err := t.usage(time.Now())
+	if nil != err {
+		logError("read quota usage failed: %v\n", err)
+	}
+
+	result := make(map[string]quotaStatus, len(usage))
+	for tenant, used := range usage {
+		q, _ := t.limitOf(tenant)
+		qs := quotaStatus{TokensUsed: used.Tokens, RequestsUsed: used.Requests}
+		if q.Tokens > 0 {
+			remaining := max(q.Tokens-used.Tokens, 0)
+			qs.TokensRemaining = &remaining
+		}
+		if q.Requests > 0 {
+			remaining := max(q.Requests-used.Requests, 0)
+			qs.RequestsRemaining = &remaining
+		}
+		result[tenant] = qs
+	}
+
+	return result
+}
+
+// load从文件读取保存的用量写入存储，24小时前的用量被忽略
+func (t *quotaTracker) load() error {
+	content, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+
+	var state map[string]map[string]*quotaUsage
+	if err = json.Unmarshal(content, &state); nil != err {
+		return fmt.Errorf("%s: %w", t.path, err)
+	}
+	now := time.Now()
+	oldest := now.Add(-24*time.Hour).Unix() / 3600
+	for tenant, hours := range state {
+		for hour, u := range hours {
+			h, err := strconv.ParseInt(hour, 10, 64)
+			// 按用量所在的小时计算剩余的保留时间
+			ttl := time.Unix(h*3600, 0).Add(quotaTTL).Sub(now)
+			if nil != err || h < oldest || nil == u || ttl <= 0 {
+				continue
+			}
+			if _, err = t.store.increment(quotaKey(tenant, h, "tokens"), u.Tokens, ttl); nil != err {
+				return err
+			}
+			if _, err = t.store.increment(quotaKey(tenant, h, "requests"), u.Requests, ttl); nil != err {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// save把存储中的用量写入文件，使用SQLite或Redis存储时不需要保存
+func (t *quotaTracker) save() error {
+	if nil == t || "" == t.path {
+		return nil
+	}
+	if !t.dirty.Swap(false) {
+		return nil
+	}
+
+	state := make(map[string]map[int64]*quotaUsage)
+	err := t.store.scan(quotaPrefix, func(key string, value []byte) bool {
+		tenant, hour, field, ok := parseQuotaKey(key)
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if !ok || nil != err {
+			return true
+		}
+		if nil == state[tenant] {
+			state[tenant] = make(map[int64]*quotaUsage)
+		}
+		u := state[tenant][hour]
+		if nil == u {
+			u = &quotaUsage{}
+			state[tenant][hour] = u
+		}
+		switch field {
+		case "tokens":
+			u.Tokens = n
+		case "requests":
+			u.Requests = n
+		}
+		return true
+	})
+	if nil != err {
+		return err
+	}
+	content, err := json.Marshal(state)
+	if nil != err {
+		return err
+	}
+
+	// 先写临时文件再改名，避免写到一半时退出导致文件损坏
+	tmp := t.path + ".tmp"
+	if err = os.WriteFile(tmp, content, 0600); nil != err {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// saveLoop每10秒保存一次用量
+func (t *quotaTracker) saveLoop() {
+	for range time.Tick(10 * time.Second) {
+		if err := t.save(); nil != err {
+			logError("save quota state failed: %v\n", err)
+		}
+	}
+}
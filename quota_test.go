@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestQuotaConcurrentReplicas检查两个副本共用Redis时，同时到达的请求不会一起越过请求数配额
+func TestQuotaConcurrentReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cfg := &config{Quotas: map[string]quota{"team-key": {Requests: 10}}, QuotaStateFile: t.TempDir() + "/quota_state.json"}
+
+	var trackers []*quotaTracker
+	for i := 0; i < 2; i++ {
+		st, err := openRedisStore("redis://"+mr.Addr(), "")
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer func() { _ = st.close() }()
+		tracker, err := newQuotaTracker(cfg, st)
+		if nil != err {
+			t.Fatal(err)
+		}
+		trackers = append(trackers, tracker)
+	}
+
+	tenant := quotaTenant("team-key")
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(tracker *quotaTracker) {
+			defer wg.Done()
+			if _, ok := tracker.allow(tenant); ok {
+				allowed.Add(1)
+			}
+		}(trackers[i%2])
+	}
+	wg.Wait()
+
+	if 10 != allowed.Load() {
+		t.Fatalf("allowed %d requests, want 10", allowed.Load())
+	}
+	// 被拒绝的请求撤回了计数
+	if used, _, err := trackers[0].used(tenant, time.Now()); nil != err || 10 != used.Requests {
+		t.Fatalf("recorded requests = %d, %v, want 10", used.Requests, err)
+	}
+	if reason, ok := trackers[1].allow(tenant); ok || "daily request quota of 10 exhausted" != reason {
+		t.Fatalf("allow after exhaustion = %q, %v", reason, ok)
+	}
+}
+
+// failingStore的写入总是失败，模拟共用存储不可用
+type failingStore struct {
+	*memoryStore
+}
+
+func (s failingStore) put(string, []byte, time.Duration) error {
+	return errors.New("storage unavailable")
+}
+
+// TestKeyPoolSyncKeepsLocalCooldown检查从共用存储同步时保留本地停用的密钥，同一个密钥取较晚的恢复时间
+func TestKeyPoolSyncKeepsLocalCooldown(t *testing.T) {
+	shared := newMemoryStore()
+	defer func() { _ = shared.close() }()
+
+	// 另一个副本停用了sk-b，写入共用存储
+	other := newKeyPool("chat", "sk-a", []string{"sk-b", "sk-c"}, 1)
+	other.shared = shared
+	other.markBad("sk-b")
+
+	// 本副本停用sk-a时共用存储不可用，sk-b在本地停用得更久
+	pool := newKeyPool("chat", "sk-a", []string{"sk-b", "sk-c"}, 1)
+	pool.shared = failingStore{shared}
+	pool.markBad("sk-a")
+	later := time.Now().Add(time.Hour)
+	pool.mu.Lock()
+	pool.badUntil["sk-b"] = later
+	pool.mu.Unlock()
+
+	pool.shared = shared
+	pool.syncShared()
+
+	bad := pool.badKeys()
+	sort.Strings(bad)
+	if 2 != len(bad) || "sk-a" != bad[0] || "sk-b" != bad[1] {
+		t.Fatalf("bad keys = %q, want sk-a and sk-b", bad)
+	}
+	pool.mu.Lock()
+	until := pool.badUntil["sk-b"]
+	pool.mu.Unlock()
+	if !until.Equal(later) {
+		t.Fatalf("sk-b restored at %s, want the later local %s", until, later)
+	}
+	if key := pool.pick(); "sk-c" != key {
+		t.Fatalf("pick = %s, want sk-c", key)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimitHeaders是上游返回的限流信息响应头
+var rateLimitHeaders = []string{
+	"X-Ratelimit-Limit-Requests",
+	"X-Ratelimit-Limit-Tokens",
+	"X-Ratelimit-Remaining-Requests",
+	"X-Ratelimit-Remaining-Tokens",
+	"X-Ratelimit-Reset-Requests",
+	"X-Ratelimit-Reset-Tokens",
+}
+
+// rateLimitState是某个上游密钥最近一次返回的限流信息
+type rateLimitState struct {
+	Upstream string            `json:"upstream"`
+	Key      string            `json:"key"`
+	Headers  map[string]string `json:"headers"`
+	Updated  string            `json:"updated"`
+}
+
+// rateLimits按上游和密钥分别记录最近的限流信息
+type rateLimits struct {
+	mu     sync.Mutex
+	states map[string]*rateLimitState
+}
+
+// newRateLimits创建rateLimits
+func newRateLimits() *rateLimits {
+	return &rateLimits{states: make(map[string]*rateLimitState)}
+}
+
+// requestKey返回上游请求使用的密钥
+func requestKey(target *upstreamTarget, req *http.Request) string {
+	if apiTypeAzure == target.apiType {
+		return req.Header.Get("api-key")
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// record记录上游响应中的限流信息，并原样转发给客户端
+func (r *rateLimits) record(c *gin.Context, target *upstreamTarget, resp *http.Response) {
+	headers := make(map[string]string)
+	for _, name := range rateLimitHeaders {
+		if value := resp.Header.Get(name); "" != value {
+			headers[strings.ToLower(name)] = value
+			c.Header(name, value)
+		}
+	}
+	if 0 == len(headers) {
+		return
+	}
+
+	key := ""
+	if nil != resp.Request {
+		key = requestKey(target, resp.Request)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.states[target.name+"\x00"+key] = &rateLimitState{
+		Upstream: target.name,
+		Key:      redactSecret(key),
+		Headers:  headers,
+		Updated:  time.Now().Format(time.RFC3339),
+	}
+}
+
+// status返回各上游密钥最近的限流信息，按上游排序
+func (r *rateLimits) status() []rateLimitState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]rateLimitState, 0, len(r.states))
+	for _, state := range r.states {
+		result = append(result, *state)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Upstream != result[j].Upstream {
+			return result[i].Upstream < result[j].Upstream
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	return result
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRecentSize是未配置recent_size时保存的最近请求和错误日志条数
+const defaultRecentSize = 20
+
+// recentErrorKey是gin.Context中保存请求错误摘要的键，供/admin/recent使用
+const recentErrorKey = "override_recent_error"
+
+// recentBodyKey是gin.Context中保存请求体的键，只在开启debug时保存
+const recentBodyKey = "override_recent_body"
+
+// recentErrorLimit是错误摘要保存的最大字节数
+const recentErrorLimit = 512
+
+// ring是保存最近size条记录的环形缓冲，容量固定，内存占用有上限
+type ring[T any] struct {
+	mu    sync.Mutex
+	items []T
+	next  int
+	full  bool
+}
+
+// newRing创建容量为size的ring
+func newRing[T any](size int) *ring[T] {
+	return &ring[T]{items: make([]T, size)}
+}
+
+// add添加一条记录，缓冲已满时覆盖最早的记录
+func (r *ring[T]) add(item T) {
+	r.mu.Lock()
+	r.items[r.next] = item
+	r.next = (r.next + 1) % len(r.items)
+	if 0 == r.next {
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// entries按时间顺序返回缓冲中的记录
+func (r *ring[T]) entries() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]T{}, r.items[:r.next]...)
+	}
+
+	return append(append([]T{}, r.items[r.next:]...), r.items[:r.next]...)
+}
+
+// resize把容量改为size，保留最新的记录
+func (r *ring[T]) resize(size int) {
+	items := r.entries()
+	if len(items) > size {
+		items = items[len(items)-size:]
+	}
+
+	r.mu.Lock()
+	r.items = make([]T, size)
+	r.next = copy(r.items, items) % size
+	r.full = len(items) == size
+	r.mu.Unlock()
+}
+
+// recentRequest是/admin/recent中的一条请求记录，只在开启debug时包含请求体
+type recentRequest struct {
+	Id          string `json:"id"`
+	Time        string `json:"time"`
+	Route       string `json:"route"`
+	Model       string `json:"model"`
+	MappedModel string `json:"mapped_model,omitempty"`
+	Upstream    string `json:"upstream,omitempty"`
+	Status      int    `json:"status"`
+	LatencyMs   int64  `json:"latency_ms"`
+	Error       string `json:"error,omitempty"`
+	RequestId   string `json:"request_id,omitempty"` // 上游返回的第一个请求ID
+	Body        string `json:"body,omitempty"`
+	Replayable  bool   `json:"replayable,omitempty"` // 保存了发往上游的请求体，可以用/admin/replay重放
+
+	replay *replayBody
+}
+
+// recentRing保存最近的请求
+type recentRing = ring[recentRequest]
+
+// recentSize返回保存的最近请求和错误日志条数
+func recentSize(cfg *config) int {
+	if cfg.RecentSize > 0 {
+		return cfg.RecentSize
+	}
+
+	return defaultRecentSize
+}
+
+// setRecentError记录请求的错误摘要
+func setRecentError(c *gin.Context, message string) {
+	if len(message) > recentErrorLimit {
+		message = strings.ToValidUTF8(message[:recentErrorLimit], "")
+	}
+	c.Set(recentErrorKey, message)
+}
+
+// keepRecentBody在开启debug时保存隐藏了密钥并截断的请求体，未开启时不保存任何请求内容
+func (s *ProxyService) keepRecentBody(c *gin.Context, body []byte) {
+	if s.cfg.Debug {
+		c.Set(recentBodyKey, s.sanitizeLogBody(body))
+	}
+}
+
+// recordRecent把结束的请求加入最近请求列表，需要在统计汇总之后调用
+func (s *ProxyService) recordRecent(c *gin.Context, rec *usageRecord) {
+	route := c.FullPath()
+	if "" == route {
+		route = c.Request.URL.Path
+	}
+
+	replay, _ := c.Keys[replayKey].(*replayBody)
+	s.recent.add(recentRequest{
+		Id:          newRecentId(),
+		Time:        rec.Time.Format(time.RFC3339),
+		Route:       route,
+		Model:       rec.Model,
+		MappedModel: rec.MappedModel,
+		Upstream:    rec.Upstream,
+		Status:      rec.Status,
+		LatencyMs:   rec.Latency.Milliseconds(),
+		Error:       c.GetString(recentErrorKey),
+		RequestId:   c.Writer.Header().Get("X-Upstream-Request-Id"),
+		Body:        c.GetString(recentBodyKey),
+		Replayable:  nil != replay,
+		replay:      replay,
+	})
+}
+
+// recentRequests返回最近的请求和错误日志
+func (s *ProxyService) recentRequests(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"requests": s.recent.entries(),
+		"errors":   recentErrors.entries(),
+	})
+}
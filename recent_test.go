@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestRecentErrorsOnlyErrors检查/admin/recent的errors只包含错误日志，普通日志不会挤掉错误
+func TestRecentErrorsOnlyErrors(t *testing.T) {
+	_, proxy := newTestProxy(t, nil, "http://127.0.0.1:1")
+	for i := 0; i < 2*defaultRecentSize; i++ {
+		log.Println("routine info line")
+	}
+	logError("write stats db failed: %s\n", "disk full")
+	for i := 0; i < 2*defaultRecentSize; i++ {
+		log.Println("routine info line")
+	}
+
+	resp, err := proxy.Client().Get(proxy.URL + "/admin/recent")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer closeIO(resp.Body)
+	var recent struct {
+		Errors []string `json:"errors"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&recent); nil != err || http.StatusOK != resp.StatusCode {
+		t.Fatalf("status %d, decode: %v", resp.StatusCode, err)
+	}
+
+	found := false
+	for _, line := range recent.Errors {
+		if strings.Contains(line, "routine info line") {
+			t.Fatalf("info line in recent errors: %q", line)
+		}
+		found = found || strings.Contains(line, "write stats db failed: disk full")
+	}
+	if !found {
+		t.Fatalf("error line missing from recent errors: %q", recent.Errors)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// 中断的流式响应最多保存的请求数和每个请求保存的内容长度，超过时不再保存
+const (
+	maxRecoveryEntries = 1000
+	maxRecoveryContent = 256 << 10
+)
+
+// recoveryTail是续写提示中引用的已生成内容的结尾长度
+const recoveryTail = 200
+
+// recoveryPrompt是续写时追加的用户消息，%s为已生成内容的结尾
+const recoveryPrompt = "Your previous reply was cut off. Continue exactly from where it stopped, without repeating anything already written. It ended with:\n%s"
+
+// partialAnswer是中断的流式响应已经生成的内容
+type partialAnswer struct {
+	content string
+	expires time.Time
+}
+
+// streamRecovery保存中途中断的聊天流式响应已经生成的内容，客户端在chat_stream_recovery_seconds内
+// 重试完全相同的请求时，先把保存的内容发给客户端，再让上游续写剩下的部分
+type streamRecovery struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	partials map[string]*partialAnswer
+}
+
+// newStreamRecovery创建streamRecovery，未配置chat_stream_recovery_seconds时返回nil
+func newStreamRecovery(cfg *config) *streamRecovery {
+	if cfg.ChatStreamRecovery <= 0 {
+		return nil
+	}
+
+	return &streamRecovery{
+		ttl:      time.Duration(cfg.ChatStreamRecovery) * time.Second,
+		partials: make(map[string]*partialAnswer),
+	}
+}
+
+// recoveryKey返回请求的标识：同一客户端发送的转换后请求体完全相同时相同。
+// 只处理单个choice的流式请求，其他请求返回空
+func (r *streamRecovery) recoveryKey(c *gin.Context, body []byte) string {
+	if nil == r || !gjson.GetBytes(body, "stream").Bool() || gjson.GetBytes(body, "n").Int() > 1 {
+		return ""
+	}
+
+	sum := sha256.Sum256(append([]byte(tenantOf(c)+"\x00"), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// take取出key对应的未过期内容，取出后删除，同一内容只续写一次
+func (r *streamRecovery) take(key string) *partialAnswer {
+	if nil == r || "" == key {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	partial, ok := r.partials[key]
+	if !ok {
+		return nil
+	}
+	delete(r.partials, key)
+	if time.Now().After(partial.expires) {
+		return nil
+	}
+
+	return partial
+}
+
+// save保存中断的请求已经生成的内容，同时清理过期的内容
+func (r *streamRecovery) save(key string, content string) {
+	if nil == r || "" == key || "" == content || len(content) > maxRecoveryContent {
+		return
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, partial := range r.partials {
+		if now.After(partial.expires) {
+			delete(r.partials, k)
+		}
+	}
+	if len(r.partials) >= maxRecoveryEntries {
+		return
+	}
+	r.partials[key] = &partialAnswer{content: content, expires: now.Add(r.ttl)}
+}
+
+// continuationBody在请求的消息后追加已生成的内容和续写提示
+func continuationBody(body []byte, content string) []byte {
+	tail := content
+	if len(tail) > recoveryTail {
+		tail = strings.ToValidUTF8(tail[len(tail)-recoveryTail:], "")
+	}
+
+	body, _ = sjson.SetBytes(body, "messages.-1", map[string]string{"role": "assistant", "content": content})
+	body, _ = sjson.SetBytes(body, "messages.-1", map[string]string{"role": "user", "content": fmt.Sprintf(recoveryPrompt, tail)})
+	return body
+}
+
+// replayChunk返回把已生成的内容发给客户端的流式事件
+func replayChunk(model string, content string) []byte {
+	chunk := []byte(`{"id":"chatcmpl-recovered","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"role":"assistant"},"finish_reason":null}]}`)
+	chunk, _ = sjson.SetBytes(chunk, "created", time.Now().Unix())
+	chunk, _ = sjson.SetBytes(chunk, "model", model)
+	chunk, _ = sjson.SetBytes(chunk, "choices.0.delta.content", content)
+
+	return append(append([]byte("data: "), chunk...), "\n\n"...)
+}
+
+// partialCapture从上游的流式响应中累计第一个choice生成的内容，并记录响应是否正常结束
+type partialCapture struct {
+	buf       []byte
+	content   strings.Builder
+	finished  bool // 收到了finish_reason
+	toolCalls bool // 响应中有工具调用，不能用文本续写
+}
+
+// newPartialCapture创建partialCapture，content是续写之前已经生成的内容
+func newPartialCapture(content string) *partialCapture {
+	p := &partialCapture{}
+	p.content.WriteString(content)
+	return p
+}
+
+// Write实现io.Writer，按行解析流式响应
+func (p *partialCapture) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	rest := p.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := bytes.TrimSpace(rest[:i])
+		rest = rest[i+1:]
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+
+		choice := gjson.GetBytes(bytes.TrimSpace(line[5:]), "choices.0")
+		if choice.Get("delta.tool_calls").Exists() {
+			p.toolCalls = true
+		}
+		if gjson.String == choice.Get("finish_reason").Type {
+			p.finished = true
+		}
+		if p.content.Len() <= maxRecoveryContent {
+			p.content.WriteString(choice.Get("delta.content").String())
+		}
+	}
+	p.buf = append(p.buf[:0], rest...)
+
+	return len(data), nil
+}
+
+// interrupted返回响应没有正常结束时已经生成的文本内容，正常结束或有工具调用时返回空
+func (p *partialCapture) interrupted() string {
+	if p.finished || p.toolCalls {
+		return ""
+	}
+	return p.content.String()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	storageRedis = "redis" // 保存在storage_url指定的Redis中，多个副本共用配额和停用的密钥
+
+	// redisTimeout是一次Redis操作的最长时间，超时后按Redis不可用处理
+	redisTimeout = 500 * time.Millisecond
+	// redisRetryInterval是Redis不可用时检查其是否恢复的间隔
+	redisRetryInterval = 5 * time.Second
+)
+
+// redisIncrement把键加上ARGV[1]，键没有过期时间时设置为ARGV[2]毫秒，与store.increment的语义一致
+var redisIncrement = redis.NewScript(`
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and -1 == redis.call('PTTL', KEYS[1]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value
+`)
+
+// redisStore是保存在Redis中的store，键前加上prefix以区分配置档。Redis不可用时打印警告并改用本地内存，
+// 这期间各副本分别计数，Redis恢复后重新使用Redis，本地的计数不会合并回去
+type redisStore struct {
+	client *redis.Client
+	addr   string // 用于日志的地址，不含密码
+	prefix string
+	local  *memoryStore
+	down   atomic.Bool
+	stop   chan struct{}
+}
+
+// openRedisStore连接rawUrl指定的Redis，连接失败时不返回错误，先使用本地内存并在后台重试。rawUrl已由checkStorage检查
+func openRedisStore(rawUrl string, profile string) (*redisStore, error) {
+	opt, err := redis.ParseURL(rawUrl)
+	if nil != err {
+		return nil, fmt.Errorf("storage_url: %w", err)
+	}
+	opt.ContextTimeoutEnabled = true
+	opt.MaxRetries = 1
+	if 0 == opt.DialTimeout {
+		opt.DialTimeout = time.Second
+	}
+
+	s := &redisStore{
+		client: redis.NewClient(opt),
+		addr:   opt.Addr,
+		prefix: "override:",
+		local:  newMemoryStore(),
+		stop:   make(chan struct{}),
+	}
+	if "" != profile {
+		s.prefix += profile + ":"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opt.DialTimeout+redisTimeout)
+	defer cancel()
+	if err = s.client.Ping(ctx).Err(); nil != err {
+		s.failed(err)
+	}
+	go s.retryLoop()
+
+	return s, nil
+}
+
+// failed在err表示Redis不可用时改用本地内存并返回true，第一次失败时打印警告。
+// 键不存在和Redis返回的命令错误不算不可用
+func (s *redisStore) failed(err error) bool {
+	var reply redis.Error
+	if nil == err || errors.Is(err, redis.Nil) || errors.As(err, &reply) {
+		return false
+	}
+	if s.down.CompareAndSwap(false, true) {
+		logError("!!! redis storage at %s is unreachable, falling back to local-only quotas and key cooldowns: %v\n", s.addr, err)
+	}
+	return true
+}
+
+// retryLoop在Redis不可用时定期检查，恢复后重新使用Redis
+func (s *redisStore) retryLoop() {
+	ticker := time.NewTicker(redisRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !s.down.Load() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+			err := s.client.Ping(ctx).Err()
+			cancel()
+			if nil == err {
+				s.down.Store(false)
+				log.Printf("redis storage at %s is reachable again, usage counted locally during the outage is not merged\n", s.addr)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// context返回一次Redis操作使用的context
+func (s *redisStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
+
+// get实现store
+func (s *redisStore) get(key string) ([]byte, bool, error) {
+	if !s.down.Load() {
+		ctx, cancel := s.context()
+		defer cancel()
+		value, err := s.client.Get(ctx, s.prefix+key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil, false, nil
+		}
+		if !s.failed(err) {
+			return value, nil == err, err
+		}
+	}
+	return s.local.get(key)
+}
+
+// getAll实现store，一次MGET读取所有键
+func (s *redisStore) getAll(keys []string) ([][]byte, error) {
+	if 0 == len(keys) {
+		return nil, nil
+	}
+	if !s.down.Load() {
+		ctx, cancel := s.context()
+		defer cancel()
+		prefixed := make([]string, len(keys))
+		for i, key := range keys {
+			prefixed[i] = s.prefix + key
+		}
+		result, err := s.client.MGet(ctx, prefixed...).Result()
+		if !s.failed(err) {
+			if nil != err {
+				return nil, err
+			}
+			values := make([][]byte, len(keys))
+			for i, value := range result {
+				if text, ok := value.(string); ok {
+					values[i] = []byte(text)
+				}
+			}
+			return values, nil
+		}
+	}
+	return s.local.getAll(keys)
+}
+
+// put实现store
+func (s *redisStore) put(key string, value []byte, ttl time.Duration) error {
+	if !s.down.Load() {
+		ctx, cancel := s.context()
+		defer cancel()
+		err := s.client.Set(ctx, s.prefix+key, value, max(ttl, 0)).Err()
+		if !s.failed(err) {
+			return err
+		}
+	}
+	return s.local.put(key, value, ttl)
+}
+
+// increment实现store，读取、增加和设置过期时间在一个脚本中完成
+func (s *redisStore) increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	if !s.down.Load() {
+		ctx, cancel := s.context()
+		defer cancel()
+		value, err := redisIncrement.Run(ctx, s.client, []string{s.prefix + key}, delta, max(ttl, 0).Milliseconds()).Int64()
+		if !s.failed(err) {
+			return value, err
+		}
+	}
+	return s.local.increment(key, delta, ttl)
+}
+
+// del实现store
+func (s *redisStore) del(key string) error {
+	if !s.down.Load() {
+		ctx, cancel := s.context()
+		defer cancel()
+		err := s.client.Del(ctx, s.prefix+key).Err()
+		if !s.failed(err) {
+			return err
+		}
+	}
+	return s.local.del(key)
+}
+
+// scan实现store，用SCAN找出匹配的键再一次读取它们的值，用于/stats等不在请求路径上的地方
+func (s *redisStore) scan(prefix string, fn func(key string, value []byte) bool) error {
+	if s.down.Load() {
+		return s.local.scan(prefix, fn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisTimeout)
+	defer cancel()
+	var keys []string
+	iter := s.client.Scan(ctx, 0, escapeRedisPattern(s.prefix+prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), s.prefix))
+	}
+	if err := iter.Err(); s.failed(err) {
+		return s.local.scan(prefix, fn)
+	} else if nil != err {
+		return err
+	}
+	sort.Strings(keys)
+
+	values, err := s.getAll(keys)
+	if nil != err {
+		return err
+	}
+	for i, key := range keys {
+		// SCAN和MGET之间过期的键
+		if nil == values[i] {
+			continue
+		}
+		if !fn(key, values[i]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// close实现store
+func (s *redisStore) close() error {
+	close(s.stop)
+	_ = s.local.close()
+	return s.client.Close()
+}
+
+// escapeRedisPattern转义SCAN MATCH中有特殊含义的字符
+func escapeRedisPattern(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
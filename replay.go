@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// replayKey是gin.Context中保存可重放请求的键，只在开启debug时保存
+const replayKey = "override_replay"
+
+// maxReplayBody是保存用于重放的请求体的最大字节数，超过时不保存
+const maxReplayBody = 1 << 20
+
+// replayBody是发往上游的转换后的请求，保存在最近请求列表中，供/admin/replay重新发送
+type replayBody struct {
+	endpoint string // chat或codex
+	upstream string // 原请求使用的上游名称
+	model    string // 客户端请求的模型
+	mapped   string // 发往上游的模型
+	body     []byte
+}
+
+// newRecentId生成最近请求列表中一条记录的ID
+func newRecentId() string {
+	buf := make([]byte, 6)
+	_, _ = rand.Read(buf)
+	return "req-" + hex.EncodeToString(buf)
+}
+
+// keepReplay在开启debug时保存即将发往上游的请求体，请求结束后随最近请求一起保存，可以用/admin/replay重放
+func (s *ProxyService) keepReplay(c *gin.Context, rec *usageRecord, body []byte) {
+	if !s.cfg.Debug || len(body) > maxReplayBody {
+		return
+	}
+
+	c.Set(replayKey, &replayBody{
+		endpoint: rec.Endpoint,
+		upstream: rec.Upstream,
+		model:    rec.Model,
+		mapped:   rec.MappedModel,
+		body:     bytes.Clone(body),
+	})
+}
+
+// findRecent按记录ID或上游请求ID查找最近的请求，有多条时返回最新的
+func (s *ProxyService) findRecent(id string) (recentRequest, bool) {
+	entries := s.recent.entries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if id == entries[i].Id || id == entries[i].RequestId {
+			return entries[i], true
+		}
+	}
+
+	return recentRequest{}, false
+}
+
+// replayTarget返回名称对应的上游：chat、codex或chat:<chat_model_routes中的模型>
+func (s *ProxyService) replayTarget(name string) *upstreamTarget {
+	switch name {
+	case "chat":
+		return s.chatTarget("")
+	case "codex":
+		return s.codexTarget()
+	}
+	if model, ok := strings.CutPrefix(name, "chat:"); ok {
+		if _, ok := s.cfg.ChatModelRoutes[model]; ok {
+			return s.chatTarget(model)
+		}
+	}
+
+	return nil
+}
+
+// replayRequest处理POST /admin/replay/:id，把最近请求中保存的转换后请求体重新发给原来的上游或upstream参数指定的上游，
+// 原样返回上游的响应。重放默认不计入统计、配额和花费，record=true时按原请求的接口计入。未配置admin_key时不提供
+func (s *ProxyService) replayRequest(c *gin.Context) {
+	if "" == s.cfg.AdminKey {
+		abortWithError(c, http.StatusForbidden, "permission_error", "replay requires admin_key to be configured")
+		return
+	}
+
+	id := c.Param("id")
+	entry, ok := s.findRecent(id)
+	if !ok || nil == entry.replay {
+		abortWithError(c, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("request %s not found or its body was not recorded; bodies are kept only with debug enabled", id))
+		return
+	}
+
+	name := c.DefaultQuery("upstream", entry.replay.upstream)
+	target := s.replayTarget(name)
+	if nil == target {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("unknown upstream %q, expected chat, codex or chat:<model in chat_model_routes>", name))
+		return
+	}
+	if ("codex" == name && "" == s.cfg.CodexApiBase) || ("codex" != name && s.chatDisabled(target)) {
+		abortWithError(c, http.StatusServiceUnavailable, "unavailable", fmt.Sprintf("upstream %s is not configured", name))
+		return
+	}
+
+	var rec *usageRecord
+	if record, _ := strconv.ParseBool(c.Query("record")); record {
+		rec = s.stats.begin(c, entry.replay.endpoint)
+		rec.Model, rec.MappedModel, rec.Upstream = entry.replay.model, entry.replay.mapped, target.name
+		defer s.finishRecord(c, rec)
+	}
+
+	log.Printf("replay: %s request %s to %s\n", s.label(entry.replay.endpoint), id, target.name)
+	resp, err := s.doUpstream(c.Request.Context(), target, entry.replay.body)
+	if nil != err {
+		message := s.sanitizeLogBody([]byte(err.Error()))
+		logError("replay: %s request %s failed: %s\n", s.label(entry.replay.endpoint), id, message)
+		abortWithError(c, http.StatusBadGateway, "upstream_error", message)
+		return
+	}
+	defer closeIO(resp.Body)
+	s.recordRequestId(c, resp)
+
+	contentType := resp.Header.Get("Content-Type")
+	c.Header("X-Override-Replay", id)
+	if "" != contentType {
+		c.Header("Content-Type", contentType)
+	}
+	c.Status(resp.StatusCode)
+
+	var src io.Reader = resp.Body
+	if nil != rec {
+		rec.capture = newUsageCapture(contentType)
+		src = io.TeeReader(resp.Body, rec.capture)
+	}
+	_, _ = io.Copy(flushWriter{c.Writer}, src)
+	log.Printf("replay: %s request %s finished with status %d\n", s.label(entry.replay.endpoint), id, resp.StatusCode)
+}
+
+// runReplay执行replay子命令：通过管理接口重放最近的请求，响应体输出到标准输出
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	upstream := flags.String("upstream", "", "send to this upstream instead of the original one: chat, codex or chat:<model>")
+	record := flags.Bool("record", false, "count the replay in stats, quotas and budget")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: override replay [-upstream name] [-record] <request-id>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); nil != err {
+		return 2
+	}
+	if 1 != flags.NArg() {
+		flags.Usage()
+		return 2
+	}
+
+	cfg := readConfig()
+	bind := cfg.AdminBind
+	if "" == bind {
+		bind = cfg.Bind
+	}
+	if "" == bind {
+		bind = defaultBind
+	}
+	network, addr, err := parseBind("bind", bind)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// 监听所有地址时连接本机
+	host := "override"
+	if "tcp" == network {
+		h, port, _ := net.SplitHostPort(addr)
+		if "" == h || "0.0.0.0" == h || "::" == h {
+			h = "127.0.0.1"
+		}
+		host = net.JoinHostPort(h, port)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			if "unix" == network {
+				return dialer.DialContext(ctx, "unix", addr)
+			}
+			return dialer.DialContext(ctx, "tcp", host)
+		},
+	}}
+
+	query := url.Values{}
+	if "" != *upstream {
+		query.Set("upstream", *upstream)
+	}
+	if *record {
+		query.Set("record", "true")
+	}
+	target := url.URL{Scheme: "http", Host: host, Path: "/admin/replay/" + flags.Arg(0), RawQuery: query.Encode()}
+	req, err := http.NewRequest(http.MethodPost, target.String(), nil)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if "" != cfg.AdminKey {
+		req.Header.Set("X-Admin-Key", cfg.AdminKey)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer closeIO(resp.Body)
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	fmt.Fprintf(os.Stderr, "\nreplay %s: %s in %s\n", flags.Arg(0), resp.Status, time.Since(start).Round(time.Millisecond))
+
+	if resp.StatusCode >= 400 {
+		return 1
+	}
+	return 0
+}
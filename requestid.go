@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRequestIdHeaders是未配置upstream_request_id_headers时记录的上游请求ID响应头
+var defaultRequestIdHeaders = []string{"x-request-id", "cf-ray", "anthropic-request-id"}
+
+// upstreamIdsKey是gin.Context中保存上游请求ID的键，值为响应头名称到值的映射
+const upstreamIdsKey = "override_upstream_request_ids"
+
+// requestIdHeaders返回需要记录的上游请求ID响应头，配置为空列表时不记录
+func (s *ProxyService) requestIdHeaders() []string {
+	if nil == s.cfg.UpstreamIdHeaders {
+		return defaultRequestIdHeaders
+	}
+
+	return s.cfg.UpstreamIdHeaders
+}
+
+// recordRequestId从上游响应头中取出请求ID，保存到请求上下文中供访问日志和错误响应使用，第一个存在的ID以X-Upstream-Request-Id返回给客户端
+func (s *ProxyService) recordRequestId(c *gin.Context, resp *http.Response) {
+	ids := make(map[string]string)
+	for _, name := range s.requestIdHeaders() {
+		value := resp.Header.Get(name)
+		if "" == value {
+			continue
+		}
+		if 0 == len(ids) {
+			c.Header("X-Upstream-Request-Id", value)
+		}
+		ids[strings.ToLower(name)] = value
+	}
+	if len(ids) > 0 {
+		c.Set(upstreamIdsKey, ids)
+	}
+}
+
+// upstreamRequestIds返回记录的上游请求ID，上游请求没有返回响应头时为nil
+func upstreamRequestIds(keys map[string]any) map[string]string {
+	ids, _ := keys[upstreamIdsKey].(map[string]string)
+	return ids
+}
+
+// formatRequestIds把上游请求ID格式化为name=value，按名称排序
+func formatRequestIds(ids map[string]string) string {
+	parts := make([]string, 0, len(ids))
+	for _, name := range sortedKeys(ids) {
+		parts = append(parts, name+"="+ids[name])
+	}
+
+	return strings.Join(parts, " ")
+}
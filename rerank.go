@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// rerankApiBase返回重排接口的上游地址，未配置rerank_api_base时使用chat_api_base
+func (s *ProxyService) rerankApiBase() string {
+	if "" == s.cfg.RerankApiBase {
+		return s.cfg.ChatApiBase
+	}
+	return s.cfg.RerankApiBase
+}
+
+// rerankTarget返回重排接口的上游，兼容Cohere和Jina的/rerank接口
+func (s *ProxyService) rerankTarget() *upstreamTarget {
+	return &upstreamTarget{
+		name:         "rerank",
+		url:          upstreamUrl(s.rerankApiBase(), "/rerank"),
+		keys:         s.rerankKeys,
+		organization: s.cfg.ChatApiOrganization,
+		project:      s.cfg.ChatApiProject,
+	}
+}
+
+// rerank处理/v1/rerank请求，映射模型后转发，并记录上游计费的用量
+func (s *ProxyService) rerank(c *gin.Context) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	rec := s.stats.begin(c, "rerank")
+	defer s.finishRecord(c, rec)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	if !gjson.ValidBytes(body) {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "request body is not valid JSON")
+		return
+	}
+
+	rec.Model = gjson.GetBytes(body, "model").String()
+	rec.MappedModel = rec.Model
+	if mapped, ok := s.cfg.RerankModelMap[rec.Model]; ok {
+		rec.MappedModel = mapped
+		body, _ = sjson.SetBytes(body, "model", mapped)
+	}
+
+	target := s.rerankTarget()
+	target.forwarded = s.forwardedHeaders(c)
+	s.useTarget(c, rec, target)
+	resp, err := s.doUpstream(ctx, target, body)
+	if nil != err || resp.StatusCode != http.StatusOK {
+		s.relayPassthrough(c, target, resp, err)
+		return
+	}
+	defer closeIO(resp.Body)
+	s.recordRequestId(c, resp)
+
+	result, err := io.ReadAll(resp.Body)
+	if nil != err {
+		_, message := s.upstreamError(target.name, err)
+		abortWithError(c, http.StatusBadGateway, "upstream_error", message)
+		return
+	}
+	s.stats.recordUpstream(target.name, "")
+
+	// Cohere返回meta.billed_units.search_units，Jina返回usage.total_tokens
+	units := gjson.GetBytes(result, "meta.billed_units.search_units").Int()
+	rec.PromptTokens = gjson.GetBytes(result, "usage.total_tokens").Int()
+	if units > 0 {
+		s.metrics.add("override_rerank_search_units_total", float64(units), "model", rec.MappedModel)
+	}
+	log.Printf("rerank %s: %d documents, %d search units, %d tokens\n", rec.MappedModel,
+		len(gjson.GetBytes(body, "documents").Array()), units, rec.PromptTokens)
+
+	c.Data(http.StatusOK, resp.Header.Get("Content-Type"), result)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"override/internal/sse"
+)
+
+const (
+	retryContentFilter = "content_filter" // 上游因内容过滤中止了回答
+	retryEmptyContent  = "empty_content"  // 上游没有返回任何内容
+)
+
+// checkRetryOn校验chat_retry_on中的条件，除两种内容条件外只接受HTTP状态码
+func checkRetryOn(conditions []string) error {
+	for _, cond := range conditions {
+		if retryContentFilter == cond || retryEmptyContent == cond {
+			continue
+		}
+		if code, err := strconv.Atoi(cond); nil != err || code < 100 || code > 599 {
+			return fmt.Errorf("chat_retry_on: unsupported condition: %s", cond)
+		}
+	}
+
+	return nil
+}
+
+// bodyReader把已读取的部分放回响应体前面，同时保留原来的Close
+type bodyReader struct {
+	io.Reader
+	io.Closer
+}
+
+// retryCondition检查上游响应是否满足重试条件，返回命中的条件；
+// 检查时读取的内容会放回resp.Body，未命中时调用方可以照常转发
+func (s *ProxyService) retryCondition(resp *http.Response) string {
+	retryOn := s.cfg.ChatRetryOn
+	if status := strconv.Itoa(resp.StatusCode); slices.Contains(retryOn, status) {
+		return status
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	if !slices.Contains(retryOn, retryContentFilter) && !slices.Contains(retryOn, retryEmptyContent) {
+		return ""
+	}
+
+	var read bytes.Buffer
+	var cond string
+	if isEventStream(resp.Header.Get("Content-Type")) {
+		cond = peekStream(io.TeeReader(resp.Body, &read))
+	} else {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxCaptureSize))
+		read.Write(body)
+		cond = completionCondition(gjson.GetBytes(body, "choices.0"), "message")
+	}
+	resp.Body = bodyReader{io.MultiReader(&read, resp.Body), resp.Body}
+
+	if "" != cond && slices.Contains(retryOn, cond) {
+		return cond
+	}
+	return ""
+}
+
+// completionCondition根据choice判断是否被内容过滤或内容为空，field为message或delta
+func completionCondition(choice gjson.Result, field string) string {
+	if "content_filter" == choice.Get("finish_reason").String() {
+		return retryContentFilter
+	}
+	if hasContent(choice.Get(field)) {
+		return ""
+	}
+	return retryEmptyContent
+}
+
+// hasContent判断message或delta中是否有实际内容
+func hasContent(message gjson.Result) bool {
+	return "" != message.Get("content").String() ||
+		message.Get("tool_calls").Exists() ||
+		message.Get("function_call").Exists()
+}
+
+// peekStream读取流式响应直到出现第一段实际内容，期间遇到内容过滤或流结束则返回对应的条件
+func peekStream(r io.Reader) string {
+	events := sse.NewReader(r)
+	for {
+		event, err := events.Next()
+		if nil != err {
+			return retryEmptyContent
+		}
+		if event.Done() {
+			return retryEmptyContent
+		}
+
+		choice := gjson.GetBytes(event.Data, "choices.0")
+		if !choice.Exists() {
+			continue
+		}
+		if cond := completionCondition(choice, "delta"); retryEmptyContent != cond {
+			return cond
+		}
+	}
+}
+
+// retryChat在响应满足chat_retry_on的条件时改用chat_retry_model重新请求一次；
+// 流式响应只在尚未向客户端写出任何内容时重试，重试最多一次。原样转发时不修改请求体，不重试
+func (s *ProxyService) retryChat(ctx context.Context, rec *usageRecord, target *upstreamTarget, body []byte, resp *http.Response) (*upstreamTarget, *http.Response, error) {
+	model := s.cfg.ChatRetryModel
+	if "" == model || 0 == len(s.cfg.ChatRetryOn) || model == rec.MappedModel || target.raw {
+		return target, resp, nil
+	}
+
+	cond := s.retryCondition(resp)
+	if "" == cond {
+		return target, resp, nil
+	}
+	closeIO(resp.Body)
+
+	log.Printf("retry chat completion with %s instead of %s: %s\n", model, rec.MappedModel, cond)
+	s.metrics.inc("override_chat_retries_total", "condition", cond)
+	if resp.StatusCode != http.StatusOK {
+		s.upstreamFailed(target.name, "status "+strconv.Itoa(resp.StatusCode))
+	}
+
+	body, err := sjson.SetBytes(body, "model", model)
+	if nil != err {
+		return target, nil, fmt.Errorf("retry with %s: %w", model, err)
+	}
+	body = stripFields(body, s.cfg.ChatModelRoutes[model].StripFields)
+	rec.MappedModel = model
+	forwarded := target.forwarded
+	target = s.chatTarget(model)
+	target.forwarded = forwarded
+	resp, err = s.doUpstream(ctx, target, body)
+
+	return target, resp, err
+}
+
+// retryStream在流式响应第一个数据事件到达前中断时重新请求一次上游，
+// 此时客户端还没有收到任何内容，可以安全重试
+func (s *ProxyService) retryStream(ctx context.Context, target *upstreamTarget, body []byte, resp *http.Response) (*http.Response, error) {
+	// 原样转发的压缩流无法按事件读取，不等待第一个数据事件
+	if resp.StatusCode != http.StatusOK || !isEventStream(resp.Header.Get("Content-Type")) || "" != upstreamEncoding(target, resp) {
+		return resp, nil
+	}
+
+	err := bufferFirstEvent(resp)
+	if nil == err {
+		return resp, nil
+	}
+	closeIO(resp.Body)
+	// 客户端取消或超过first_token_deadline_ms时不重试
+	if nil != ctx.Err() {
+		return nil, err
+	}
+
+	log.Printf("%s stream failed before the first event, retrying: %v\n", target.name, err)
+	s.metrics.inc("override_stream_retries_total", "upstream", target.name)
+	s.upstreamFailed(target.name, err.Error())
+
+	resp, err = s.doUpstream(ctx, target, body)
+	if nil != err || resp.StatusCode != http.StatusOK || !isEventStream(resp.Header.Get("Content-Type")) {
+		return resp, err
+	}
+	if err = bufferFirstEvent(resp); nil != err {
+		closeIO(resp.Body)
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// errFirstTokenDeadline表示上游在first_token_deadline_ms内没有返回第一个数据事件
+var errFirstTokenDeadline = errors.New("no first token within first_token_deadline_ms")
+
+// firstTokenFallback返回超过first_token_deadline_ms时改用的模型：first_token_fallback_model，默认chat_retry_model。
+// 都未配置、与当前模型相同或原样转发时返回空
+func (s *ProxyService) firstTokenFallback(rec *usageRecord, target *upstreamTarget) string {
+	model := s.cfg.FirstTokenFallback
+	if "" == model {
+		model = s.cfg.ChatRetryModel
+	}
+	if model == rec.MappedModel || target.raw {
+		return ""
+	}
+	return model
+}
+
+// sendChat发送聊天请求，流式响应等到第一个数据事件。配置了first_token_deadline_ms时，上游在这段时间内
+// 没有返回第一个数据事件（非流式请求为响应头）就取消请求，改用备用模型或负载均衡中的另一个上游重新请求一次，
+// 此时还没有向客户端写出任何内容。返回最终使用的上游和请求体
+func (s *ProxyService) sendChat(ctx context.Context, rec *usageRecord, target *upstreamTarget, body []byte) (*upstreamTarget, []byte, *http.Response, error) {
+	deadline := time.Duration(s.cfg.FirstTokenDeadline) * time.Millisecond
+	fallback := s.firstTokenFallback(rec, target)
+	switchable := "" != fallback || (nil != s.backends && "" != target.backend && len(s.backends.bases) > 1)
+	if deadline <= 0 || !switchable {
+		resp, err := s.doUpstream(ctx, target, body)
+		if nil == err {
+			resp, err = s.retryStream(ctx, target, body, resp)
+		}
+		s.backendResult(target, statusOf(resp), err)
+		return target, body, resp, err
+	}
+
+	attempt, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(deadline, func() {
+		cancel(errFirstTokenDeadline)
+	})
+	resp, err := s.doUpstream(attempt, target, body)
+	if nil == err {
+		resp, err = s.retryStream(attempt, target, body, resp)
+	}
+	timer.Stop()
+	if !errors.Is(context.Cause(attempt), errFirstTokenDeadline) {
+		s.backendResult(target, statusOf(resp), err)
+		if nil != err {
+			cancel(nil)
+			return target, body, resp, err
+		}
+		// 响应体读完关闭时才能释放attempt
+		resp.Body = cancelBody{resp.Body, func() { cancel(nil) }}
+		return target, body, resp, nil
+	}
+	if nil == err {
+		closeIO(resp.Body)
+	}
+
+	// 慢的上游与失败的上游一样暂时不再被负载均衡选中
+	s.metrics.inc("override_first_token_switches_total", "upstream", target.name, "backend", redactUrl(target.backend))
+	if nil != s.backends && "" != target.backend {
+		s.backends.result(target.backend, true)
+	}
+	forwarded := target.forwarded
+	if "" != fallback {
+		log.Printf("%s sent no first token within %s, switching from %s to %s\n", s.label(target.name), deadline, rec.MappedModel, fallback)
+		switched, err := sjson.SetBytes(body, "model", fallback)
+		if nil != err {
+			return target, body, nil, fmt.Errorf("switch to %s: %w", fallback, err)
+		}
+		body = stripFields(switched, s.cfg.ChatModelRoutes[fallback].StripFields)
+		rec.MappedModel = fallback
+		target = s.chatTarget(fallback)
+	} else {
+		log.Printf("%s backend %s sent no first token within %s, switching backend\n", s.label(target.name), redactUrl(target.backend), deadline)
+		target = s.chatTarget(rec.MappedModel)
+	}
+	target.forwarded = forwarded
+	s.balanceChat(rec, target, "")
+
+	resp, err = s.doUpstream(ctx, target, body)
+	if nil == err {
+		resp, err = s.retryStream(ctx, target, body, resp)
+	}
+	s.backendResult(target, statusOf(resp), err)
+	return target, body, resp, err
+}
+
+// statusOf返回响应的状态码，请求失败时为0
+func statusOf(resp *http.Response) int {
+	if nil == resp {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// invalidChatResponse检查状态码为200的非流式聊天响应，body中有error对象或没有choices时返回说明和原始内容
+func invalidChatResponse(resp *http.Response) (string, []byte) {
+	// 原样转发的压缩响应无法检查
+	if resp.StatusCode != http.StatusOK || isEventStream(resp.Header.Get("Content-Type")) || "" != resp.Header.Get("Content-Encoding") {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body = bodyReader{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if nil != err {
+		return "", nil
+	}
+
+	result := gjson.ParseBytes(body)
+	if errObj := result.Get("error"); errObj.Exists() {
+		message := errObj.Get("message").String()
+		if "" == message {
+			message = errObj.String()
+		}
+		return "upstream returned an error with status 200: " + message, body
+	}
+	if !result.Get("choices").IsArray() {
+		return "upstream response has no choices", body
+	}
+
+	return "", nil
+}
+
+// invalidResponseStatus返回invalid_response_status，默认502
+func (s *ProxyService) invalidResponseStatus() int {
+	if s.cfg.InvalidResponseStatus > 0 {
+		return s.cfg.InvalidResponseStatus
+	}
+	return http.StatusBadGateway
+}
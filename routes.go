@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// routesFields是routes_file中可以出现的配置项：模型映射、按模型的参数、路由规则和实验，都不含密钥
+var routesFields = []string{
+	"chat_model_default", "chat_model_map", "chat_model_routes", "chat_retry_model", "chat_retry_on",
+	"first_token_fallback_model", "locale_model_map", "chat_rules", "experiments", "budget_downgrade",
+	"model_prices", "chat_model_max_tokens", "codex_model_max_tokens", "prediction_models", "reasoning_models",
+	"audio_model_map", "images_model_map", "rerank_model_map",
+}
+
+// routeSecretFields是chat_model_routes中只能写在config.json里的字段，同名的路由合并后仍然生效
+var routeSecretFields = []string{"api_key", "headers"}
+
+// configSources记录配置项来自哪个文件，检查配置时用来指出问题所在的文件
+type configSources struct {
+	routesFile string   // 为空表示没有配置routes_file
+	routed     []string // 出现在routes_file中的顶层配置项
+}
+
+// readRoutesFile读取并检查routes_file，返回其中的配置项和拼错的配置项，错误信息以文件名开头
+func readRoutesFile(path string) (map[string]json.RawMessage, []string, error) {
+	content, err := os.ReadFile(path)
+	if nil != err {
+		return nil, nil, fmt.Errorf("routes_file: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(content, &fields); nil != err {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	known := configTags()
+	var problems []string
+	for _, key := range sortedKeys(fields) {
+		if slices.Contains(routesFields, key) || !slices.Contains(known, key) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s is not allowed in routes_file, keep it in config.json", key))
+	}
+	var routes map[string]json.RawMessage
+	if raw, ok := fields["chat_model_routes"]; ok && nil == json.Unmarshal(raw, &routes) {
+		for _, name := range sortedKeys(routes) {
+			var route map[string]json.RawMessage
+			_ = json.Unmarshal(routes[name], &route)
+			for _, field := range routeSecretFields {
+				if _, ok := route[field]; ok {
+					problems = append(problems, fmt.Sprintf("chat_model_routes.%s.%s is not allowed in routes_file, keep it in config.json", name, field))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+
+	return fields, unknownConfigKeys(content, reflect.TypeOf(config{}), ""), nil
+}
+
+// loadRoutes在config.json或环境变量配置了routes_file时读取该文件并合并到content之上，返回合并后的内容、
+// 配置项的来源、routes_file中拼错的配置项（以文件名开头）和被routes_file覆盖的配置项
+func loadRoutes(content []byte, overrides map[string]envValue) ([]byte, configSources, []string, []string, error) {
+	sources := configSources{routesFile: gjson.GetBytes(content, "routes_file").String()}
+	if override, ok := overrides["routes_file"]; ok {
+		sources.routesFile = override.value
+	}
+	if "" == sources.routesFile {
+		return content, sources, nil, nil, nil
+	}
+
+	routes, unknown, err := readRoutesFile(sources.routesFile)
+	if nil != err {
+		return nil, sources, nil, nil, err
+	}
+	merged, overridden, err := mergeRoutes(content, routes)
+	if nil != err {
+		return nil, sources, nil, nil, fmt.Errorf("config.json: %w", err)
+	}
+	sources.routed = sortedKeys(routes)
+	for i, problem := range unknown {
+		unknown[i] = sources.routesFile + ": " + problem
+	}
+
+	return merged, sources, unknown, overridden, nil
+}
+
+// mergeRoutes把routes_file中的配置项合并到config.json的内容上：对象按键逐层合并，其他值整体替换，
+// 冲突时以routes_file为准。返回合并后的内容和被routes_file覆盖的配置项
+func mergeRoutes(content []byte, routes map[string]json.RawMessage) ([]byte, []string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); nil != err {
+		return nil, nil, err
+	}
+
+	var overridden []string
+	for _, key := range sortedKeys(routes) {
+		fields[key] = mergeJSON(fields[key], routes[key], key, &overridden)
+	}
+	merged, err := json.Marshal(fields)
+	if nil != err {
+		return nil, nil, err
+	}
+	return merged, overridden, nil
+}
+
+// mergeJSON合并一个配置项，两边都是对象时逐个键合并，否则使用over，base中不同的值记录到overridden
+func mergeJSON(base json.RawMessage, over json.RawMessage, path string, overridden *[]string) json.RawMessage {
+	var baseFields, overFields map[string]json.RawMessage
+	if nil == json.Unmarshal(base, &baseFields) && nil == json.Unmarshal(over, &overFields) && nil != baseFields && nil != overFields {
+		for _, key := range sortedKeys(overFields) {
+			baseFields[key] = mergeJSON(baseFields[key], overFields[key], path+"."+key, overridden)
+		}
+		merged, err := json.Marshal(baseFields)
+		if nil == err {
+			return merged
+		}
+	}
+
+	if 0 != len(base) && "null" != string(base) && !jsonEqual(base, over) {
+		*overridden = append(*overridden, path)
+	}
+	return over
+}
+
+// jsonEqual比较两个JSON值，忽略空白
+func jsonEqual(a json.RawMessage, b json.RawMessage) bool {
+	var x, y bytes.Buffer
+	if nil != json.Compact(&x, a) || nil != json.Compact(&y, b) {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(x.Bytes(), y.Bytes())
+}
+
+// configTags返回所有配置项的json标签
+func configTags() []string {
+	t := reflect.TypeOf(config{})
+	var tags []string
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if "" != tag && "-" != tag {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// describe在配置了routes_file时在问题前加上所在的文件：问题中最先出现的配置项来自routes_file时为routes_file，
+// 否则为config.json。没有提到配置项的问题原样返回
+func (src configSources) describe(problem string) string {
+	if "" == src.routesFile {
+		return problem
+	}
+
+	first, key := -1, ""
+	for _, tag := range configTags() {
+		if i := configTagIndex(problem, tag); i >= 0 && (first < 0 || i < first) {
+			first, key = i, tag
+		}
+	}
+	switch {
+	case first < 0:
+		return problem
+	case slices.Contains(src.routed, key):
+		return src.routesFile + ": " + problem
+	default:
+		return "config.json: " + problem
+	}
+}
+
+// describeError与describe相同，用于错误
+func (src configSources) describeError(err error) error {
+	if nil == err || "" == src.routesFile {
+		return err
+	}
+	return errors.New(src.describe(err.Error()))
+}
+
+// configTagIndex返回tag作为完整的配置项名称在text中第一次出现的位置，前后不能是字母、数字或下划线
+func configTagIndex(text string, tag string) int {
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], tag)
+		if i < 0 {
+			return -1
+		}
+		start, end := offset+i, offset+i+len(tag)
+		if (0 == start || !isTagChar(text[start-1])) && (end == len(text) || !isTagChar(text[end])) {
+			return start
+		}
+		offset = start + 1
+	}
+}
+
+// isTagChar返回c能否出现在配置项名称中
+func isTagChar(c byte) bool {
+	return '_' == c || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
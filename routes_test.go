@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestLoadRoutes检查routes_file合并到config.json之上：对象逐层合并，冲突时以routes_file为准，
+// 路由的api_key和headers留在config.json中；routes_file中的密钥和非路由配置项被拒绝。
+// 期望中的ROUTES替换为routes_file的路径
+func TestLoadRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		routes     string
+		merged     string
+		overridden []string
+		unknown    []string
+		err        string
+	}{
+		{
+			"nested merge",
+			`{"routes_file":"ROUTES","chat_api_key":"sk","chat_model_map":{"a":"x","b":"y"},"chat_retry_on":["timeout"],
+			  "chat_model_routes":{"fast":{"url":"http://old","api_key":"sk-fast","headers":{"X-A":"1"}}}}`,
+			`{"chat_model_map":{"b":"z","c":"w"},"chat_retry_on":["timeout"],
+			  "chat_model_routes":{"fast":{"url":"http://new","strip_fields":["user"]},"slow":{"url":"http://slow"}}}`,
+			`{"routes_file":"ROUTES","chat_api_key":"sk","chat_model_map":{"a":"x","b":"z","c":"w"},"chat_retry_on":["timeout"],
+			  "chat_model_routes":{"fast":{"url":"http://new","api_key":"sk-fast","headers":{"X-A":"1"},"strip_fields":["user"]},"slow":{"url":"http://slow"}}}`,
+			[]string{"chat_model_map.b", "chat_model_routes.fast.url"},
+			nil,
+			"",
+		},
+		{
+			"values replaced",
+			`{"routes_file":"ROUTES","chat_retry_on":["timeout","5xx"],"chat_model_default":null,"chat_model_map":"none"}`,
+			`{"chat_retry_on":["429"],"chat_model_default":"gpt-4o","chat_model_map":{"a":"b"}}`,
+			`{"routes_file":"ROUTES","chat_retry_on":["429"],"chat_model_default":"gpt-4o","chat_model_map":{"a":"b"}}`,
+			[]string{"chat_model_map", "chat_retry_on"},
+			nil,
+			"",
+		},
+		{
+			"misspelled key",
+			`{"routes_file":"ROUTES"}`,
+			`{"chat_model_mapp":{}}`,
+			`{"routes_file":"ROUTES","chat_model_mapp":{}}`,
+			nil,
+			[]string{"ROUTES: chat_model_mapp (did you mean chat_model_map?)"},
+			"",
+		},
+		{
+			"secret",
+			`{"routes_file":"ROUTES"}`,
+			`{"chat_api_key":"sk","chat_model_map":{}}`,
+			"", nil, nil,
+			"ROUTES: chat_api_key is not allowed in routes_file, keep it in config.json",
+		},
+		{
+			"non-routing key",
+			`{"routes_file":"ROUTES"}`,
+			`{"timeout":30,"admin_key":"k"}`,
+			"", nil, nil,
+			"ROUTES: admin_key is not allowed in routes_file, keep it in config.json; timeout is not allowed in routes_file, keep it in config.json",
+		},
+		{
+			"route secret",
+			`{"routes_file":"ROUTES","chat_model_routes":{"fast":{"api_key":"sk-fast"}}}`,
+			`{"chat_model_routes":{"fast":{"url":"http://new","api_key":"sk-other","headers":{"X-A":"2"}}}}`,
+			"", nil, nil,
+			"ROUTES: chat_model_routes.fast.api_key is not allowed in routes_file, keep it in config.json; " +
+				"chat_model_routes.fast.headers is not allowed in routes_file, keep it in config.json",
+		},
+		{"invalid routes", `{"routes_file":"ROUTES"}`, `{"chat_model_map":`, "", nil, nil, "ROUTES: unexpected end of JSON input"},
+		{"invalid config", `{"routes_file":"ROUTES",}`, `{}`, "", nil, nil, "config.json: invalid character '}' looking for beginning of object key string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			if err := os.WriteFile(path, []byte(tt.routes), 0o600); nil != err {
+				t.Fatal(err)
+			}
+			// routes_file的路径放在JSON字符串中，Windows路径的反斜杠需要转义
+			replace := func(s string) string { return strings.ReplaceAll(s, "ROUTES", path) }
+			quoted := func(s string) string { return strings.ReplaceAll(s, `"ROUTES"`, jsonString(path)) }
+
+			merged, sources, unknown, overridden, err := loadRoutes([]byte(quoted(tt.config)), nil)
+			if "" != tt.err {
+				if nil == err || replace(tt.err) != err.Error() {
+					t.Fatalf("err = %v, want %s", err, replace(tt.err))
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+			if !sameJSON(t, merged, quoted(tt.merged)) {
+				t.Errorf("merged = %s, want %s", merged, quoted(tt.merged))
+			}
+			if !reflect.DeepEqual(tt.overridden, overridden) {
+				t.Errorf("overridden = %q, want %q", overridden, tt.overridden)
+			}
+			var want []string
+			for _, problem := range tt.unknown {
+				want = append(want, replace(problem))
+			}
+			if !reflect.DeepEqual(want, unknown) {
+				t.Errorf("unknown = %q, want %q", unknown, want)
+			}
+			if path != sources.routesFile {
+				t.Errorf("routesFile = %s, want %s", sources.routesFile, path)
+			}
+		})
+	}
+}
+
+// TestLoadRoutesOverride检查环境变量中的routes_file优先于config.json，没有配置时原样返回config.json的内容
+func TestLoadRoutesOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(`{"chat_model_default":"gpt-4o"}`), 0o600); nil != err {
+		t.Fatal(err)
+	}
+
+	content := []byte(`{"routes_file":"missing.json","chat_model_default":"deepseek-chat"}`)
+	merged, sources, _, overridden, err := loadRoutes(content, map[string]envValue{"routes_file": {name: "OVERRIDE_ROUTES_FILE", value: path}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !sameJSON(t, merged, `{"routes_file":"missing.json","chat_model_default":"gpt-4o"}`) || !reflect.DeepEqual([]string{"chat_model_default"}, overridden) {
+		t.Errorf("merged = %s, overridden = %q", merged, overridden)
+	}
+	if !reflect.DeepEqual([]string{"chat_model_default"}, sources.routed) {
+		t.Errorf("routed = %q", sources.routed)
+	}
+
+	content = []byte(`{"chat_model_default":"deepseek-chat"}`)
+	merged, sources, _, _, err = loadRoutes(content, nil)
+	if nil != err || string(content) != string(merged) || "" != sources.routesFile {
+		t.Errorf("without routes_file: %s, %+v, %v", merged, sources, err)
+	}
+}
+
+// TestConfigSourcesDescribe检查问题按其中最先出现的完整配置项加上所在的文件
+func TestConfigSourcesDescribe(t *testing.T) {
+	src := configSources{routesFile: "routes.json", routed: []string{"chat_model_map", "chat_model_routes"}}
+	tests := []struct {
+		src     configSources
+		problem string
+		want    string
+	}{
+		{src, "chat_model_map.a: unknown model", "routes.json: chat_model_map.a: unknown model"},
+		{src, "chat_model_routes.fast.url: missing scheme", "routes.json: chat_model_routes.fast.url: missing scheme"},
+		{src, "chat_api_key is empty", "config.json: chat_api_key is empty"},
+		{src, "chat_api_base is used when chat_model_map has no match", "config.json: chat_api_base is used when chat_model_map has no match"},
+		{src, "chat_model_map overrides chat_model_default", "routes.json: chat_model_map overrides chat_model_default"},
+		{src, "my_chat_model_map is not a config key", "my_chat_model_map is not a config key"},
+		{src, "listen tcp: address in use", "listen tcp: address in use"},
+		{configSources{}, "chat_model_map.a: unknown model", "chat_model_map.a: unknown model"},
+	}
+	for _, tt := range tests {
+		if got := tt.src.describe(tt.problem); tt.want != got {
+			t.Errorf("describe(%q) = %q, want %q", tt.problem, got, tt.want)
+		}
+	}
+
+	if err := src.describeError(errors.New("chat_model_routes: bad")); nil == err || "routes.json: chat_model_routes: bad" != err.Error() {
+		t.Errorf("describeError = %v", err)
+	}
+	if nil != src.describeError(nil) {
+		t.Error("describeError(nil) != nil")
+	}
+}
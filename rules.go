@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// chat_rules中match的取值
+const (
+	ruleMatchSystem = "system" // 只匹配第一条system消息
+	ruleMatchAny    = "any"    // 匹配任意一条消息
+)
+
+// chatRule按消息内容选择模型和参数，用于区分面板聊天、行内聊天和生成提交信息等请求
+type chatRule struct {
+	Name    string         `json:"name"`    // 规则名称，显示在日志和dry-run中
+	Pattern string         `json:"pattern"` // 匹配消息内容的正则表达式
+	Match   string         `json:"match"`   // 匹配的消息：system（默认）或any
+	Model   string         `json:"model"`   // 命中时使用的模型，为空时仍按chat_model_map映射
+	Params  map[string]any `json:"params"`  // 命中时覆盖的请求参数，如temperature、max_tokens
+
+	re *regexp.Regexp
+}
+
+// compileChatRules校验并编译chat_rules
+func compileChatRules(rules []chatRule) ([]chatRule, error) {
+	compiled := make([]chatRule, len(rules))
+	for i, rule := range rules {
+		switch rule.Match {
+		case "":
+			rule.Match = ruleMatchSystem
+		case ruleMatchSystem, ruleMatchAny:
+		default:
+			return nil, fmt.Errorf("chat_rules[%d]: unsupported match: %s", i, rule.Match)
+		}
+
+		re, err := regexp.Compile(rule.Pattern)
+		if nil != err {
+			return nil, fmt.Errorf("chat_rules[%d]: %w", i, err)
+		}
+		rule.re = re
+		if "" == rule.Name {
+			rule.Name = "chat_rules[" + strconv.Itoa(i) + "]"
+		}
+		compiled[i] = rule
+	}
+
+	return compiled, nil
+}
+
+// messageText返回消息的文本内容，分段内容按顺序拼接
+func messageText(message gjson.Result) string {
+	content := message.Get("content")
+	if !content.IsArray() {
+		return content.String()
+	}
+
+	text := ""
+	for _, part := range content.Array() {
+		text += part.Get("text").String()
+	}
+	return text
+}
+
+// matches判断规则是否匹配请求中的消息
+func (r *chatRule) matches(messages []gjson.Result) bool {
+	for _, message := range messages {
+		if ruleMatchSystem == r.Match {
+			if "system" != message.Get("role").String() {
+				continue
+			}
+			return r.re.MatchString(messageText(message))
+		}
+		if r.re.MatchString(messageText(message)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchChatRule按顺序返回第一条匹配的规则，没有匹配时返回nil
+func (s *ProxyService) matchChatRule(body []byte) *chatRule {
+	if 0 == len(s.chatRules) {
+		return nil
+	}
+
+	messages := gjson.GetBytes(body, "messages").Array()
+	for i := range s.chatRules {
+		if s.chatRules[i].matches(messages) {
+			return &s.chatRules[i]
+		}
+	}
+
+	return nil
+}
+
+// applyParams用规则中的参数覆盖请求体
+func (r *chatRule) applyParams(body []byte) []byte {
+	for _, name := range sortedKeys(r.Params) {
+		body, _ = sjson.SetBytes(body, name, r.Params[name])
+	}
+	return body
+}
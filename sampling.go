@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// samplingRange是一个采样参数的默认值和取值范围，未配置的项为nil
+type samplingRange struct {
+	field string
+	def   *float64
+	min   *float64
+	max   *float64
+}
+
+// samplingRanges返回端点的temperature和top_p配置
+func samplingRanges(cfg *config, endpoint string) []samplingRange {
+	if "codex" == endpoint {
+		return []samplingRange{
+			{"temperature", cfg.CodexTempDefault, cfg.CodexTempMin, cfg.CodexTempMax},
+			{"top_p", cfg.CodexTopPDefault, cfg.CodexTopPMin, cfg.CodexTopPMax},
+		}
+	}
+
+	return []samplingRange{
+		{"temperature", cfg.ChatTempDefault, cfg.ChatTempMin, cfg.ChatTempMax},
+		{"top_p", cfg.ChatTopPDefault, cfg.ChatTopPMin, cfg.ChatTopPMax},
+	}
+}
+
+// checkSampling校验采样参数的范围，默认值必须在范围内
+func checkSampling(cfg *config) error {
+	for _, endpoint := range []string{"chat", "codex"} {
+		for _, r := range samplingRanges(cfg, endpoint) {
+			if nil != r.min && nil != r.max && *r.min > *r.max {
+				return fmt.Errorf("%s_%s_min is greater than %s_%s_max", endpoint, r.field, endpoint, r.field)
+			}
+			if nil != r.def && r.clamp(*r.def) != *r.def {
+				return fmt.Errorf("%s_%s_default is outside the configured range", endpoint, r.field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// clamp把v限制在范围内
+func (r samplingRange) clamp(v float64) float64 {
+	if nil != r.min && v < *r.min {
+		return *r.min
+	}
+	if nil != r.max && v > *r.max {
+		return *r.max
+	}
+
+	return v
+}
+
+// transformSampling在请求没有temperature、top_p时填入默认值，超出范围时限制到范围内；推理模型不接受采样参数，不做处理
+func (s *ProxyService) transformSampling(endpoint string, body []byte, model string) []byte {
+	if slices.Contains(s.cfg.ReasoningModels, model) {
+		return body
+	}
+
+	for _, r := range samplingRanges(s.cfg, endpoint) {
+		value := gjson.GetBytes(body, r.field)
+		if !value.Exists() || gjson.Null == value.Type {
+			if nil != r.def {
+				body, _ = sjson.SetBytesOptions(body, r.field, *r.def, inPlace)
+			}
+			continue
+		}
+		if v := r.clamp(value.Float()); v != value.Float() {
+			body, _ = sjson.SetBytesOptions(body, r.field, v, inPlace)
+		}
+	}
+
+	return body
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	priorityChat  = 0 // 聊天请求优先获得并发名额
+	priorityCodex = 1 // 代码补全请求
+)
+
+// priorityNames是各优先级在/stats中的名称
+var priorityNames = [2]string{"chat", "codex"}
+
+// errQueueTimeout表示请求排队超过codex_queue_timeout被丢弃
+var errQueueTimeout = errors.New("queue timeout")
+
+// waiter是排队等待名额的请求
+type waiter struct {
+	ready chan struct{}
+}
+
+// scheduler限制发往上游的并发数，有空闲名额时先分配给排队的聊天请求，
+// 并为聊天请求保留一部分名额
+type scheduler struct {
+	slots    int // 总名额
+	reserved int // 只给聊天请求使用的名额
+
+	mu      sync.Mutex
+	active  int
+	queues  [2][]*waiter
+	dropped [2]int64
+}
+
+// queueStatus是/stats中各优先级的排队状态
+type queueStatus struct {
+	Queued  int   `json:"queued"`
+	Dropped int64 `json:"dropped"`
+}
+
+// newScheduler根据max_concurrency创建scheduler，未配置时返回nil，不限制并发
+func newScheduler(cfg *config) *scheduler {
+	if cfg.MaxConcurrency <= 0 {
+		return nil
+	}
+
+	reserved := int(float64(cfg.MaxConcurrency) * cfg.ChatReservedRatio)
+	if reserved >= cfg.MaxConcurrency {
+		reserved = cfg.MaxConcurrency - 1
+	}
+	if reserved < 0 {
+		reserved = 0
+	}
+
+	return &scheduler{slots: cfg.MaxConcurrency, reserved: reserved}
+}
+
+// limit返回该优先级可以使用的名额
+func (s *scheduler) limit(priority int) int {
+	if priorityChat == priority {
+		return s.slots
+	}
+	return s.slots - s.reserved
+}
+
+// admit判断该优先级的请求现在能否直接获得名额，调用方需持有锁
+func (s *scheduler) admit(priority int) bool {
+	for p := priorityChat; p <= priority; p++ {
+		if len(s.queues[p]) > 0 {
+			return false
+		}
+	}
+	return s.active < s.limit(priority)
+}
+
+// dispatch把空闲名额按优先级分配给排队的请求，调用方需持有锁
+func (s *scheduler) dispatch() {
+	for priority := range s.queues {
+		for len(s.queues[priority]) > 0 && s.active < s.limit(priority) {
+			w := s.queues[priority][0]
+			s.queues[priority] = s.queues[priority][1:]
+			s.active++
+			close(w.ready)
+		}
+	}
+}
+
+// acquire等待一个名额，timeout大于0时排队超时返回errQueueTimeout
+func (s *scheduler) acquire(ctx context.Context, priority int, timeout time.Duration) error {
+	if nil == s {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.admit(priority) {
+		s.active++
+		s.mu.Unlock()
+		return nil
+	}
+	w := &waiter{ready: make(chan struct{})}
+	s.queues[priority] = append(s.queues[priority], w)
+	s.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+		err = errQueueTimeout
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 超时的同时已经分配到名额，直接使用
+	select {
+	case <-w.ready:
+		return nil
+	default:
+	}
+
+	for i, queued := range s.queues[priority] {
+		if queued == w {
+			s.queues[priority] = append(s.queues[priority][:i], s.queues[priority][i+1:]...)
+			break
+		}
+	}
+	if errors.Is(err, errQueueTimeout) {
+		s.dropped[priority]++
+	}
+
+	return err
+}
+
+// tryAcquire在有空闲名额时直接获得名额并返回true，不排队
+func (s *scheduler) tryAcquire(priority int) bool {
+	if nil == s {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.admit(priority) {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// release归还名额
+func (s *scheduler) release() {
+	if nil == s {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	s.dispatch()
+}
+
+// status返回当前的并发和排队状态
+func (s *scheduler) status() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queues := make(map[string]queueStatus, len(s.queues))
+	for priority, queue := range s.queues {
+		queues[priorityNames[priority]] = queueStatus{Queued: len(queue), Dropped: s.dropped[priority]}
+	}
+
+	return map[string]any{
+		"slots":    s.slots,
+		"reserved": s.reserved,
+		"active":   s.active,
+		"queues":   queues,
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// 字段和结构体的说明由go generate从源代码的注释生成到schema_docs.go，增加配置项或修改注释后需要重新生成
+//go:generate go run ./internal/schemagen -o schema_docs.go
+
+// enumValue是注释中可以作为枚举取值的单词
+var enumValue = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// commentEnum从“处理方式：passthrough、strip或force”这样的注释中取出枚举取值，没有时返回nil
+func commentEnum(comment string) []string {
+	i := strings.LastIndex(comment, "：")
+	if i < 0 {
+		return nil
+	}
+	list, _, _ := strings.Cut(comment[i+len("："):], "，")
+	list = strings.ReplaceAll(list, "（默认）", "")
+
+	var values []string
+	for _, part := range strings.Split(list, "、") {
+		for _, value := range strings.Split(part, "或") {
+			value = strings.TrimSpace(value)
+			if !enumValue.MatchString(value) {
+				return nil
+			}
+			values = append(values, value)
+		}
+	}
+	if len(values) < 2 {
+		return nil
+	}
+
+	return values
+}
+
+// schemaBuilder根据结构体的反射信息生成JSON Schema，结构体放在$defs中
+type schemaBuilder struct {
+	fields map[string]string
+	types  map[string]string
+	defs   map[string]any
+}
+
+// typeSchema返回类型t的schema
+func (b *schemaBuilder) typeSchema(t reflect.Type) map[string]any {
+	for reflect.Pointer == t.Kind() {
+		t = t.Elem()
+	}
+
+	// 配置档的值是完整配置的子集
+	if reflect.TypeOf(profileSet{}) == t {
+		return map[string]any{"type": "object", "additionalProperties": map[string]any{"$ref": "#"}}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if reflect.Uint8 == t.Elem().Kind() {
+			return map[string]any{}
+		}
+		return map[string]any{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.defs[t.Name()]; !ok {
+			b.defs[t.Name()] = nil // 先占位，避免递归的类型无限展开
+			b.defs[t.Name()] = b.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	}
+
+	return map[string]any{}
+}
+
+// structSchema返回结构体的schema，与unknownConfigKeys一致，不允许未知的字段
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if "" == name || "-" == name {
+			continue
+		}
+
+		schema := b.typeSchema(field.Type)
+		if comment := b.fields[t.Name()+"."+field.Name]; "" != comment {
+			schema["description"] = comment
+			if enum := commentEnum(comment); nil != enum && "string" == schema["type"] {
+				schema["enum"] = enum
+			}
+		}
+		properties[name] = schema
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+	if comment := b.types[t.Name()]; "" != comment {
+		schema["description"] = comment
+	}
+	return schema
+}
+
+// configSchema返回配置文件的JSON Schema
+func configSchema() map[string]any {
+	b := &schemaBuilder{fields: schemaFieldDocs, types: schemaTypeDocs, defs: make(map[string]any)}
+	schema := b.structSchema(reflect.TypeOf(config{}))
+	delete(b.defs, "config")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "override config.json"
+	schema["$defs"] = b.defs
+
+	return schema
+}
+
+// runConfigSchema执行config-schema子命令，把配置文件的JSON Schema输出到标准输出
+func runConfigSchema() int {
+	content, err := json.MarshalIndent(configSchema(), "", "  ")
+	if nil != err {
+		fmt.Fprintln(os.Stderr, "generate config schema failed:", err)
+		return 1
+	}
+	fmt.Println(string(content))
+
+	return 0
+}
@@ -0,0 +1,235 @@
+// Code generated by go run ./internal/schemagen; DO NOT EDIT.
+
+package main
+
+// schemaFieldDocs是结构体字段的注释，类型名.字段名 -> 注释
+var schemaFieldDocs = map[string]string{
+	"budgetStep.Block":              "拒绝聊天请求",
+	"budgetStep.Model":              "改用的模型",
+	"budgetStep.Percent":            "daily_budget的百分比",
+	"chatRoute.ApiKey":              "密钥",
+	"chatRoute.ApiType":             "openai或azure",
+	"chatRoute.Headers":             "额外的请求头",
+	"chatRoute.Sequential":          "只保留响应中的第一个工具调用，用于不能正确并行调用工具的上游",
+	"chatRoute.StreamOptions":       "stream_options的处理方式：passthrough、strip或force",
+	"chatRoute.StripFields":         "在chat_strip_fields之外删除的字段，如不支持parallel_tool_calls的上游",
+	"chatRoute.Url":                 "完整的请求地址",
+	"chatRule.Match":                "匹配的消息：system（默认）或any",
+	"chatRule.Model":                "命中时使用的模型，为空时仍按chat_model_map映射",
+	"chatRule.Name":                 "规则名称，显示在日志和dry-run中",
+	"chatRule.Params":               "命中时覆盖的请求参数，如temperature、max_tokens",
+	"chatRule.Pattern":              "匹配消息内容的正则表达式",
+	"config.AcceptHeaderDisabled":   "不按请求体的stream设置上游请求的Accept",
+	"config.AccessLog":              "访问日志：all、errors或off",
+	"config.AdminBind":              "管理接口的监听地址，配置后管理接口不再出现在bind上",
+	"config.AdminKey":               "管理接口的密钥",
+	"config.AlertCooldown":          "同类告警冷却时间（分钟）",
+	"config.AlertFailureThreshold":  "触发告警的失败次数",
+	"config.AlertFailureWindow":     "失败统计窗口（分钟）",
+	"config.AlertPanicThreshold":    "一小时内转换请求发生panic的次数超过该值时告警，默认10",
+	"config.AlertWebhookUrl":        "告警webhook地址",
+	"config.AllowUnknownConfig":     "忽略未知的配置项，用于旧版本读取新版本的配置",
+	"config.AudioApiBase":           "音频接口的上游地址，默认使用chat_api_base",
+	"config.AudioApiKey":            "音频接口的密钥，默认使用Chat的密钥",
+	"config.AudioModelMap":          "音频接口的模型映射",
+	"config.BadKeyCooldown":         "被上游拒绝的密钥停用时长（分钟）",
+	"config.Bind":                   "监听地址",
+	"config.BlockPatterns":          "提示内容匹配时拒绝请求的正则表达式",
+	"config.BlockReason":            "拒绝请求时返回的说明",
+	"config.BodyReadTimeout":        "读取请求体的最长时间（秒），默认30，负数为不限制，音频转写的上传不受限制",
+	"config.BudgetDowngrade":        "当天花费达到预算的百分比时改用的模型或拒绝聊天请求",
+	"config.ChatApiBase":            "Chat API的基础URL",
+	"config.ChatApiBases":           "与chat_api_base一起负载均衡的更多Chat上游",
+	"config.ChatApiKey":             "Chat API的密钥",
+	"config.ChatApiKeys":            "Chat API的更多密钥，轮流使用",
+	"config.ChatApiOrganization":    "Chat API的组织",
+	"config.ChatApiPath":            "Chat API的请求路径，默认/chat/completions",
+	"config.ChatApiProject":         "Chat API的项目",
+	"config.ChatApiType":            "Chat上游的类型：openai或azure，未配置时根据chat_api_base推断",
+	"config.ChatBalance":            "多个Chat上游的分配方式：round_robin（默认）或affinity",
+	"config.ChatCoalesce":           "合并进行中的相同非流式聊天请求，流式请求只记录重复",
+	"config.ChatDropLogprobs":       "删除聊天响应中的logprobs，减少转发的数据量",
+	"config.ChatLocale":             "要求模型回复使用的语言，默认zh_CN",
+	"config.ChatMaxTokens":          "聊天请求max_tokens的上限",
+	"config.ChatModelDefault":       "默认的Chat模型",
+	"config.ChatModelMap":           "Chat模型映射",
+	"config.ChatModelMaxTokens":     "映射后模型的max_tokens上限，与chat_max_tokens同时生效时取较小值",
+	"config.ChatModelRoutes":        "映射后的模型单独使用的上游",
+	"config.ChatPromptCache":        "保持聊天请求的前缀在多轮对话中不变，以命中上游的提示缓存",
+	"config.ChatQueryParams":        "Chat API请求附加的查询参数",
+	"config.ChatRawPassthrough":     "聊天请求体原样转发，不做模型映射、参数限制等任何修改，只替换认证请求头",
+	"config.ChatReservedRatio":      "只给聊天请求使用的并发名额比例",
+	"config.ChatRetryModel":         "重试时使用的模型",
+	"config.ChatRetryOn":            "触发换模型重试的条件",
+	"config.ChatRules":              "按消息内容选择模型和参数的规则，第一条匹配的生效",
+	"config.ChatSequentialTools":    "只保留聊天响应中的第一个工具调用，用于不能正确并行调用工具的上游",
+	"config.ChatStreamOptions":      "stream_options的处理方式：passthrough、strip或force",
+	"config.ChatStreamRecovery":     "聊天流式响应中途中断时保存已生成内容的秒数，期间重试相同的请求时续写，为0时不开启",
+	"config.ChatStripFields":        "从聊天请求中删除的字段，支持嵌套路径",
+	"config.ChatStripLogprobs":      "删除聊天请求中的logprobs和top_logprobs",
+	"config.ChatTempDefault":        "聊天请求没有temperature时使用的值",
+	"config.ChatTempMax":            "聊天请求temperature的上限",
+	"config.ChatTempMin":            "聊天请求temperature的下限",
+	"config.ChatTokenExchange":      "用长期凭据换取短期令牌作为Chat上游的密钥",
+	"config.ChatTopPDefault":        "聊天请求没有top_p时使用的值",
+	"config.ChatTopPMax":            "聊天请求top_p的上限",
+	"config.ChatTopPMin":            "聊天请求top_p的下限",
+	"config.CodexApiBase":           "Codex API的基础URL",
+	"config.CodexApiKey":            "Codex API的密钥",
+	"config.CodexApiKeys":           "Codex API的更多密钥，轮流使用",
+	"config.CodexApiOrganization":   "Codex API的组织",
+	"config.CodexApiPath":           "Codex API的请求路径，默认/chat/completions",
+	"config.CodexApiProject":        "Codex API的项目",
+	"config.CodexDropLogprobs":      "把代码补全响应中的logprobs设为null",
+	"config.CodexInheritChat":       "Codex的地址、密钥、组织和项目为空时使用Chat的配置",
+	"config.CodexModelMaxTokens":    "代码补全模型的max_tokens上限",
+	"config.CodexPathRules":         "codex_redact_paths为rules时改写路径的规则",
+	"config.CodexPrediction":        "上游支持时用代码补全请求的suffix构造prediction",
+	"config.CodexQueryParams":       "Codex API请求附加的查询参数",
+	"config.CodexQueueTimeout":      "代码补全请求排队的最长时间（毫秒），0为一直等待",
+	"config.CodexRawPassthrough":    "代码补全请求体原样转发，不做任何修改",
+	"config.CodexRedactPaths":       "改写代码补全提示中的文件路径：basename、hash或rules",
+	"config.CodexStreamOptions":     "代码补全请求stream_options的处理方式",
+	"config.CodexStripFields":       "从代码补全请求中删除的字段，支持嵌套路径",
+	"config.CodexStripLogprobs":     "删除代码补全请求中的logprobs和top_logprobs",
+	"config.CodexSupersede":         "同一位置的新代码补全请求到达时取消旧请求",
+	"config.CodexTempDefault":       "代码补全请求没有temperature时使用的值",
+	"config.CodexTempMax":           "代码补全请求temperature的上限",
+	"config.CodexTempMin":           "代码补全请求temperature的下限",
+	"config.CodexTopPDefault":       "代码补全请求没有top_p时使用的值",
+	"config.CodexTopPMax":           "代码补全请求top_p的上限",
+	"config.CodexTopPMin":           "代码补全请求top_p的下限",
+	"config.ConversationIdle":       "对话多久没有新请求后输出汇总日志，默认30分钟",
+	"config.ConversationStats":      "在内存中按对话统计聊天请求，值为最多保留的对话数，为0时不统计",
+	"config.CorpusCompletions":      "同时保存上游返回的补全内容",
+	"config.CorpusEndpoints":        "保存语料的接口：codex和chat，默认只保存codex",
+	"config.CorpusFile":             "抽样保存请求提示的JSONL文件，用于离线评测，为空时不保存",
+	"config.CorpusMaxFiles":         "保留的轮转语料文件数，默认5",
+	"config.CorpusMaxMB":            "语料文件超过该大小（MB）时轮转，默认100",
+	"config.CorpusSamplePercent":    "保存的请求比例（0-100），默认100",
+	"config.DailyBudget":            "每天（UTC）的花费预算，与model_prices的单位一致",
+	"config.Debug":                  "是否打印调试日志",
+	"config.DnsServers":             "解析上游地址使用的DNS服务器",
+	"config.DrainDelaySeconds":      "停止时先对新请求返回503的秒数，让负载均衡停止转发后再关闭监听",
+	"config.ExpectContinue":         "请求体较大时先发送Expect: 100-continue，上游拒绝时不必上传请求体",
+	"config.ExpectContinueSize":     "使用Expect: 100-continue的最小请求体字节数，默认1MB",
+	"config.Experiments":            "A/B实验，按比例把请求改用另一个模型",
+	"config.ExposeOverrideHeaders":  "是否在响应头中返回实际模型和上游",
+	"config.FinishReasonMap":        "非标准finish_reason到标准取值的映射，补充内置的映射",
+	"config.FirstTokenDeadline":     "聊天请求等待第一个数据事件（非流式为响应头）的最长时间（毫秒），超过时改用备用模型或上游，0为不限制",
+	"config.FirstTokenFallback":     "超过first_token_deadline_ms时改用的模型，默认chat_retry_model，都未配置时换负载均衡中的另一个上游",
+	"config.ForceIpv4":              "只通过IPv4连接上游",
+	"config.ForwardHeaders":         "转发给上游的客户端请求头，支持X-Stainless-*这样的前缀",
+	"config.GinDebug":               "使用gin的调试模式和默认的Logger、Recovery",
+	"config.GzipMinSize":            "响应体超过该字节数时gzip压缩，0为不压缩",
+	"config.HedgeBudget":            "每分钟最多对冲的代码补全请求比例，默认10",
+	"config.HedgeDelay":             "代码补全请求超过这段时间（毫秒）没有响应时再发送一个相同的请求，0为不对冲",
+	"config.HookConcurrency":        "每个钩子同时执行的最大数量，默认4，已满时跳过钩子",
+	"config.HookCooldown":           "钩子停用的秒数，默认60",
+	"config.HookFailureThreshold":   "钩子连续失败多少次后暂时停用，默认5",
+	"config.HookTimeoutMs":          "每次执行钩子的最长时间（毫秒），默认2000",
+	"config.HostOverrides":          "主机名到IP的固定映射",
+	"config.IdleWarningMinutes":     "超过该时长没有请求时记录提醒，0为不检查",
+	"config.ImagesApiBase":          "图片接口的上游地址，默认使用chat_api_base",
+	"config.ImagesApiKey":           "图片接口的密钥，默认使用Chat的密钥",
+	"config.ImagesMaxN":             "每个请求最多生成的图片数，0为不限制",
+	"config.ImagesModelMap":         "图片接口的模型映射",
+	"config.ImagesSizes":            "允许的图片尺寸，为空时不限制",
+	"config.InjectMaxTokens":        "客户端没有指定max_tokens时使用模型的上限",
+	"config.InvalidResponseStatus":  "上游以200返回错误或没有choices时返回的状态码，默认502",
+	"config.KeyProbeInterval":       "检查停用密钥的间隔（分钟）",
+	"config.LocaleFromHeader":       "根据X-Override-Locale或Accept-Language请求头决定回复的语言",
+	"config.LocaleModelMap":         "语言到模型的映射，如zh或zh_CN，优先于chat_model_map",
+	"config.LogBodyLimit":           "日志中上游错误内容的最大字节数",
+	"config.LogFile":                "日志文件路径，未配置时输出到标准错误",
+	"config.MaxConcurrency":         "同时发往上游的最大请求数，0为不限制",
+	"config.MaxResponseBytes":       "响应体的最大字节数，0为不限制",
+	"config.MaxStreamDuration":      "流式响应的最长时间（秒），0为不限制",
+	"config.ModelPrices":            "模型单价，用于计算费用",
+	"config.ModelSyncDisabled":      "不请求上游的模型列表，适用于无法访问外网的环境",
+	"config.ModelSyncInterval":      "同步上游模型列表的间隔（分钟），默认60",
+	"config.ModerationMode":         "审核接口的处理方式：passthrough或stub，为空时不提供",
+	"config.OtelEnabled":            "是否启用OpenTelemetry链路追踪",
+	"config.OtelEndpoint":           "OTLP HTTP导出地址",
+	"config.PostResponseHook":       "请求结束后在后台执行的命令及参数，标准输入为请求摘要JSON",
+	"config.PreRequestHook":         "转发前执行的命令及参数，标准输入为转换后的请求体，可以输出修改后的请求体或拒绝请求",
+	"config.PredictionModels":       "支持prediction字段的映射后模型，其他模型的请求会删除该字段",
+	"config.ProbeOnStart":           "启动时探测上游是否支持工具调用、JSON模式、stream_options和n，按结果删除不支持的字段",
+	"config.Profiles":               "以名称为路径前缀的独立配置，未设置的配置项使用顶层的配置",
+	"config.ProxyProtocol":          "bind前面的负载均衡发送PROXY protocol头部，从中取出客户端的真实地址，没有头部的连接被拒绝",
+	"config.ProxyUrl":               "代理URL",
+	"config.QuotaReset":             "配额重置方式：utc_midnight或rolling",
+	"config.QuotaStateFile":         "使用内存存储时保存配额用量的文件，默认quota_state.json",
+	"config.Quotas":                 "客户端密钥到每日配额，*为默认配额",
+	"config.ReadHeaderTimeout":      "读取请求头的最长时间（秒），默认10，负数为不限制",
+	"config.ReasoningModels":        "不接受采样参数的映射后模型，不处理temperature和top_p",
+	"config.RecentSize":             "/admin/recent和dashboard保存的最近请求和错误日志条数，默认20",
+	"config.RedactPatterns":         "转发前从提示内容中替换掉的正则表达式",
+	"config.RedactPlaceholder":      "替换敏感内容使用的文本，默认[REDACTED]",
+	"config.RerankApiBase":          "重排接口的上游地址，默认使用chat_api_base",
+	"config.RerankApiKey":           "重排接口的密钥，默认使用Chat的密钥",
+	"config.RerankModelMap":         "重排接口的模型映射",
+	"config.RoutesFile":             "只包含模型映射、路由规则和实验的配置文件，合并到config.json之上，冲突时以它为准",
+	"config.ServeH2c":               "是否在监听地址上同时接受不加密的HTTP/2",
+	"config.StatsDb":                "用量统计SQLite数据库路径",
+	"config.Storage":                "配额等需要持久化的数据的存储：memory（默认）、sqlite或redis",
+	"config.StoragePath":            "storage为sqlite时的数据库文件，默认override.db，可以与stats_db相同",
+	"config.StorageUrl":             "storage为redis时的地址，如redis://:password@host:6379/0",
+	"config.TenantModels":           "客户端密钥到该客户端的chat_model_map和chat_model_default",
+	"config.Timeout":                "请求超时时间",
+	"config.TokenCharsPerToken":     "没有内置词表的模型估算Token数时每Token的字符数，默认4",
+	"config.TrafficSummary":         "有请求时每分钟输出一行请求数、错误数和Token数的汇总",
+	"config.UpstreamHeaders":        "所有上游请求附加的请求头，如上游要求的OpenAI-Beta",
+	"config.UpstreamHmac":           "为上游请求加上HMAC签名和Date请求头",
+	"config.UpstreamIdHeaders":      "记录到日志和错误响应中的上游请求ID响应头",
+	"config.UpstreamTTFBTimeout":    "等待上游响应头的最长时间（秒），0为不单独限制",
+	"config.UpstreamUserAgent":      "上游请求的User-Agent，默认override/<版本>",
+	"config.UserFieldMode":          "user字段的处理方式：passthrough、strip或hash",
+	"config.UserFieldSalt":          "哈希user字段使用的盐，未配置时自动生成",
+	"config.WarmupCodex":            "是否同时预热代码补全模型",
+	"config.WarmupIntervalSeconds":  "空闲时向上游发送预热请求的间隔（秒），0为不预热",
+	"config.sources":                "配置项来自哪个文件",
+	"configSources.routed":          "出现在routes_file中的顶层配置项",
+	"configSources.routesFile":      "为空表示没有配置routes_file",
+	"experiment.Endpoint":           "实验的端点：chat或codex",
+	"experiment.Id":                 "实验ID，出现在访问日志、/stats和X-Override-Experiment响应头中",
+	"experiment.Model":              "实验组使用的模型",
+	"experiment.Percent":            "使用model的请求比例（0-100）",
+	"hmacConfig.Algo":               "摘要算法：sha256（默认）、sha512或sha1",
+	"hmacConfig.Header":             "签名所在的请求头，默认X-Signature",
+	"hmacConfig.IncludeHeaders":     "参与签名的请求头，默认只有date",
+	"hmacConfig.KeyFile":            "从文件读取签名密钥，与secret二选一",
+	"hmacConfig.Secret":             "签名密钥，支持${ENV}",
+	"modelPrice.Completion":         "补全的单价",
+	"modelPrice.Prompt":             "提示的单价",
+	"pathRule.Pattern":              "匹配路径的正则表达式",
+	"pathRule.Replace":              "替换的内容，可以使用$1等引用分组",
+	"quota.Requests":                "每天的请求数",
+	"quota.Tokens":                  "每天的Token数",
+	"tenantModels.ChatModelDefault": "两个映射都没有对应项时使用的模型，为空时使用全局默认模型",
+	"tenantModels.ChatModelMap":     "该客户端的模型映射，没有对应项时使用全局映射",
+	"tokenExchange.AuthScheme":      "Authorization中凭据的前缀，默认Bearer，GitHub为token",
+	"tokenExchange.Body":            "请求体，支持${ENV}",
+	"tokenExchange.ContentType":     "请求体的类型，默认application/json",
+	"tokenExchange.Credential":      "长期凭据，支持${ENV}",
+	"tokenExchange.CredentialFile":  "从文件读取长期凭据，与credential二选一",
+	"tokenExchange.ExpiresPath":     "过期时间在响应中的路径，默认expires_at，值可以是Unix时间戳、剩余秒数或RFC3339时间",
+	"tokenExchange.Method":          "请求方法，默认GET，配置了body时默认POST",
+	"tokenExchange.TokenPath":       "令牌在响应中的路径，默认token",
+	"tokenExchange.Url":             "换取令牌的地址",
+}
+
+// schemaTypeDocs是结构体类型的注释
+var schemaTypeDocs = map[string]string{
+	"budgetStep":    "budgetStep是budget_downgrade中的一级：当天的花费达到daily_budget的percent时改用model或拒绝聊天请求",
+	"chatRoute":     "chatRoute是单个模型的上游配置，未填写的字段沿用全局的Chat配置",
+	"chatRule":      "chatRule按消息内容选择模型和参数，用于区分面板聊天、行内聊天和生成提交信息等请求",
+	"configSources": "configSources记录配置项来自哪个文件，检查配置时用来指出问题所在的文件",
+	"experiment":    "experiment是一个A/B实验：endpoint的请求按percent的比例改用model，其余请求作为对照组",
+	"hmacConfig":    "hmacConfig是上游请求的HMAC签名配置",
+	"modelPrice":    "modelPrice是模型的单价，单位为每百万Token",
+	"pathRule":      "pathRule是codex_path_rules中的一条改写规则",
+	"quota":         "quota是一个客户端每天可以使用的额度，0为不限制",
+	"tenantModels":  "tenantModels是单个客户端的模型映射，优先于全局的chat_model_map和chat_model_default",
+	"tokenExchange": "tokenExchange是用长期凭据换取短期令牌的配置，换取的令牌作为Bearer用于Chat上游",
+}
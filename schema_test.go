@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestConfigSchemaFields检查config和它用到的结构体的每个配置项都出现在schema中并且有说明，
+// 增加配置项后没有执行go generate时失败
+func TestConfigSchemaFields(t *testing.T) {
+	schema := configSchema()
+	defs := schema["$defs"].(map[string]any)
+
+	seen := make(map[reflect.Type]bool)
+	var check func(t reflect.Type, schema map[string]any)
+	check = func(typ reflect.Type, schema map[string]any) {
+		if seen[typ] {
+			return
+		}
+		seen[typ] = true
+
+		properties := schema["properties"].(map[string]any)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || "" == name || "-" == name {
+				continue
+			}
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				t.Errorf("%s.%s (%s) missing from the schema", typ.Name(), field.Name, name)
+				continue
+			}
+			if description, _ := property["description"].(string); "" == description {
+				t.Errorf("%s.%s (%s) has no description, run go generate", typ.Name(), field.Name, name)
+			}
+
+			// 沿着指针、切片和map找到字段用到的结构体
+			elem := field.Type
+			for reflect.Pointer == elem.Kind() || reflect.Slice == elem.Kind() || reflect.Map == elem.Kind() {
+				elem = elem.Elem()
+			}
+			if reflect.Struct == elem.Kind() && reflect.TypeOf(config{}) != elem {
+				def, ok := defs[elem.Name()].(map[string]any)
+				if !ok {
+					t.Errorf("%s missing from $defs", elem.Name())
+					continue
+				}
+				check(elem, def)
+			}
+		}
+	}
+	check(reflect.TypeOf(config{}), schema)
+}
+
+func TestCommentEnum(t *testing.T) {
+	tests := []struct {
+		comment string
+		want    []string
+	}{
+		{"处理方式：passthrough、strip或force", []string{"passthrough", "strip", "force"}},
+		{"访问日志：combined（默认）、json或off，按天轮转", []string{"combined", "json", "off"}},
+		{"摘要算法：sha256（默认）、sha512或sha1", []string{"sha256", "sha512", "sha1"}},
+		{"上游请求的User-Agent，默认override/<版本>", nil},
+		{"只有一个取值：on", nil},
+		{"说明：不是枚举的文字", nil},
+	}
+	for _, tt := range tests {
+		if got := commentEnum(tt.comment); !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("commentEnum(%q) = %q, want %q", tt.comment, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// runPlatform在非Windows平台上不做任何处理
+func runPlatform() bool {
+	return false
+}
@@ -0,0 +1,147 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	// windowsServiceName是安装的Windows服务名
+	windowsServiceName = "override"
+	// serviceLogFile是以服务方式运行且未配置log_file时使用的日志文件
+	serviceLogFile = "override.log"
+)
+
+// runPlatform处理service子命令，以Windows服务方式运行时接管启动流程，已处理时返回true
+func runPlatform() bool {
+	isService, err := svc.IsWindowsService()
+	if nil != err {
+		log.Fatal(err)
+	}
+
+	if isService {
+		// 服务的工作目录是system32，切换到程序所在目录读取config.json
+		exe, err := os.Executable()
+		if nil != err {
+			log.Fatal(err)
+		}
+		if err = os.Chdir(filepath.Dir(exe)); nil != err {
+			log.Fatal(err)
+		}
+
+		if err = svc.Run(windowsServiceName, windowsService{}); nil != err {
+			log.Fatal(err)
+		}
+		return true
+	}
+
+	if len(os.Args) > 1 && "service" == os.Args[1] {
+		if err = serviceCommand(os.Args[2:]); nil != err {
+			log.Fatal(err)
+		}
+		return true
+	}
+
+	return false
+}
+
+// windowsService实现svc.Handler，停止和关机请求走优雅停止流程
+type windowsService struct{}
+
+func (windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve(stop, serviceLogFile)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errs:
+			if nil != err {
+				log.Println(err)
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				if err := <-errs; nil != err {
+					log.Println(err)
+					return false, 1
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// serviceCommand执行override service install/uninstall/start/stop
+func serviceCommand(args []string) error {
+	if 0 == len(args) {
+		return fmt.Errorf("usage: override service install|uninstall|start|stop")
+	}
+
+	m, err := mgr.Connect()
+	if nil != err {
+		return err
+	}
+	defer func() {
+		_ = m.Disconnect()
+	}()
+
+	if "install" == args[0] {
+		exe, err := os.Executable()
+		if nil != err {
+			return err
+		}
+		s, err := m.CreateService(windowsServiceName, exe, mgr.Config{
+			DisplayName: "override",
+			Description: "GitHub Copilot proxy",
+			StartType:   mgr.StartAutomatic,
+		})
+		if nil != err {
+			return err
+		}
+		defer closeIO(s)
+		log.Println("service installed")
+		return nil
+	}
+
+	s, err := m.OpenService(windowsServiceName)
+	if nil != err {
+		return err
+	}
+	defer closeIO(s)
+
+	switch args[0] {
+	case "uninstall":
+		err = s.Delete()
+	case "start":
+		err = s.Start()
+	case "stop":
+		_, err = s.Control(svc.Stop)
+	default:
+		return fmt.Errorf("unknown service command: %s", args[0])
+	}
+	if nil != err {
+		return err
+	}
+
+	log.Printf("service %s done\n", args[0])
+	return nil
+}
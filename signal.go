@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// openConns记录当前打开的客户端连接数
+var openConns atomic.Int64
+
+// trackConn用作http.Server的ConnState，统计打开的连接数
+func trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		openConns.Add(1)
+	case http.StateClosed, http.StateHijacked:
+		openConns.Add(-1)
+	}
+}
+
+// dumpStats把运行时统计打印到日志
+func (s *ProxyService) dumpStats() {
+	snapshot := s.stats.snapshot()
+	snapshot["upstreams"] = s.stats.upstreamHealth()
+	snapshot["requests_per_minute"] = s.stats.requestsPerMinute()
+	snapshot["goroutines"] = runtime.NumGoroutine()
+	snapshot["open_conns"] = openConns.Load()
+
+	content, err := json.Marshal(snapshot)
+	if nil != err {
+		logError("dump stats failed: %v\n", err)
+		return
+	}
+	log.Println("stats:", string(content))
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals处理运行时信号：SIGUSR1打印统计，SIGUSR2重新打开日志文件
+func (s *ProxyService) handleSignals(logFile *reopenWriter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			s.dumpStats()
+		case syscall.SIGUSR2:
+			if nil == logFile {
+				continue
+			}
+			if err := logFile.reopen(); nil != err {
+				logError("reopen log file failed: %v\n", err)
+				continue
+			}
+			log.Println("log file reopened")
+		}
+	}
+}
@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// handleSignals在Windows上不处理信号，没有SIGUSR1和SIGUSR2
+func (s *ProxyService) handleSignals(_ *reopenWriter) {}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// hmacConfig是上游请求的HMAC签名配置
+type hmacConfig struct {
+	Header         string   `json:"header"`          // 签名所在的请求头，默认X-Signature
+	Secret         string   `json:"secret"`          // 签名密钥，支持${ENV}
+	KeyFile        string   `json:"key_file"`        // 从文件读取签名密钥，与secret二选一
+	Algo           string   `json:"algo"`            // 摘要算法：sha256（默认）、sha512或sha1
+	IncludeHeaders []string `json:"include_headers"` // 参与签名的请求头，默认只有date
+}
+
+// hmacSigner在发送前为上游请求签名
+type hmacSigner struct {
+	header  string
+	secret  []byte
+	hash    func() hash.Hash
+	include []string
+}
+
+// newHmacSigner创建hmacSigner，未配置upstream_hmac时返回nil
+func newHmacSigner(cfg *config) (*hmacSigner, error) {
+	h := cfg.UpstreamHmac
+	if nil == h {
+		return nil, nil
+	}
+
+	signer := &hmacSigner{header: h.Header, include: h.IncludeHeaders}
+	if "" == signer.header {
+		signer.header = "X-Signature"
+	}
+	if nil == signer.include {
+		signer.include = []string{"date"}
+	}
+
+	switch h.Algo {
+	case "", "sha256":
+		signer.hash = sha256.New
+	case "sha512":
+		signer.hash = sha512.New
+	case "sha1":
+		signer.hash = sha1.New
+	default:
+		return nil, fmt.Errorf("upstream_hmac: unsupported algo: %s", h.Algo)
+	}
+
+	switch {
+	case "" != h.Secret && "" != h.KeyFile:
+		return nil, errors.New("upstream_hmac: secret and key_file are mutually exclusive")
+	case "" != h.KeyFile:
+		content, err := os.ReadFile(h.KeyFile)
+		if nil != err {
+			return nil, fmt.Errorf("upstream_hmac: %w", err)
+		}
+		signer.secret = []byte(strings.TrimSpace(string(content)))
+	default:
+		signer.secret = []byte(os.ExpandEnv(h.Secret))
+	}
+	if 0 == len(signer.secret) {
+		return nil, errors.New("upstream_hmac: secret is empty")
+	}
+
+	return signer, nil
+}
+
+// sign设置Date请求头并签名，签名内容为每个参与签名的请求头一行name:value（名称小写），之后是一个空行和请求体。
+// 由signTransport在发送前调用，时间戳不受排队时间影响；请求体无法重新读取的流式上传不签名
+func (h *hmacSigner) sign(req *http.Request) error {
+	if nil == h {
+		return nil
+	}
+
+	var body []byte
+	if nil != req.GetBody {
+		reader, err := req.GetBody()
+		if nil != err {
+			return err
+		}
+		body, err = io.ReadAll(reader)
+		closeIO(reader)
+		if nil != err {
+			return err
+		}
+	} else if nil != req.Body && http.NoBody != req.Body {
+		return nil
+	}
+
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	mac := hmac.New(h.hash, h.secret)
+	for _, name := range h.include {
+		_, _ = io.WriteString(mac, strings.ToLower(name)+":"+req.Header.Get(name)+"\n")
+	}
+	_, _ = io.WriteString(mac, "\n")
+	_, _ = mac.Write(body)
+	req.Header.Set(h.header, hex.EncodeToString(mac.Sum(nil)))
+
+	return nil
+}
+
+// signTransport在其他请求头都设置完之后为上游请求签名，位于headerTransport之内，
+// include_headers可以包含User-Agent和upstream_headers，签名与实际发送的请求头一致
+type signTransport struct {
+	base   http.RoundTripper
+	signer *hmacSigner
+}
+
+// RoundTrip实现http.RoundTripper，headerTransport已经复制了请求，这里直接修改
+func (t *signTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.signer.sign(req); nil != err {
+		closeIO(req.Body)
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
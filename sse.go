@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+
+	"override/internal/sse"
+)
+
+// isEventStream判断响应类型是否为SSE流
+func isEventStream(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream")
+}
+
+// finishChunks是流式响应被中断时补发的结束事件，%s为finish_reason
+var finishChunks = map[string]string{
+	"chat":  `{"object":"chat.completion.chunk","choices":[{"index":0,"delta":{},"finish_reason":"%s"}]}`,
+	"codex": `{"object":"text_completion","choices":[{"index":0,"text":"","logprobs":null,"finish_reason":"%s"}]}`,
+}
+
+// writeFinish补发指定finish_reason的结束事件和[DONE]
+func writeFinish(c *gin.Context, endpoint string, reason string) {
+	_, _ = fmt.Fprintf(c.Writer, "data: "+finishChunks[endpoint]+"\n\ndata: [DONE]\n\n", reason)
+	c.Writer.Flush()
+}
+
+// bufferFirstEvent读取流式响应直到第一个带data的事件，读取的内容会放回resp.Body；
+// 在此之前流中断时返回错误，此时还没有向客户端写出任何内容
+func bufferFirstEvent(resp *http.Response) error {
+	var read bytes.Buffer
+	events := sse.NewReader(io.TeeReader(resp.Body, &read))
+	for {
+		event, err := events.Next()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if nil != err {
+			return err
+		}
+		if 0 != len(event.Data) {
+			break
+		}
+	}
+	resp.Body = bodyReader{io.MultiReader(&read, resp.Body), resp.Body}
+
+	return nil
+}
+
+// hasToken判断流式事件是否带有生成的内容：choices中的delta.content、text或delta.tool_calls不为空。
+// 只有角色、空内容或usage的事件不算首个Token
+func hasToken(data []byte) bool {
+	found := false
+	gjson.GetBytes(data, "choices").ForEach(func(_, choice gjson.Result) bool {
+		found = "" != choice.Get("delta.content").String() || "" != choice.Get("text").String() ||
+			len(choice.Get("delta.tool_calls").Array()) > 0
+		return !found
+	})
+	return found
+}
+
+// relayStream逐个事件转发SSE流并立即flush。流中途出错时补发finish_reason为error的事件和[DONE]；
+// 超过max_stream_duration_seconds或max_response_bytes时补发finish_reason为length的事件并取消上游请求
+func (s *ProxyService) relayStream(c *gin.Context, endpoint string, src io.Reader, cancel context.CancelFunc) {
+	var expired atomic.Bool
+	if seconds := s.cfg.MaxStreamDuration; seconds > 0 {
+		timer := time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+			expired.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	events := sse.NewReader(src)
+	rec := recordOf(c.Keys)
+	rawFinish := featuresOf(c).has(featureRawFinish)
+	done := false
+	written := 0
+	for {
+		event, err := events.Next()
+		if errors.Is(err, io.EOF) || (nil != err && done) {
+			return
+		}
+		if expired.Load() {
+			logError("%s stream truncated: exceeded max_stream_duration_seconds (%d)\n", endpoint, s.cfg.MaxStreamDuration)
+			writeFinish(c, endpoint, "length")
+			return
+		}
+		if errors.Is(err, errSuperseded) {
+			_, _ = io.WriteString(c.Writer, "data: [DONE]\n\n")
+			return
+		}
+		if nil != err {
+			logError("%s stream interrupted: %v\n", endpoint, err)
+			writeFinish(c, endpoint, "error")
+			return
+		}
+
+		// 首个Token时间在中继中测量，聊天和代码补全共用
+		if hasToken(event.Data) {
+			rec.firstEvent()
+		}
+
+		written += len(event.Raw)
+		if limit := s.cfg.MaxResponseBytes; limit > 0 && written > limit {
+			cancel()
+			logError("%s stream truncated: exceeded max_response_bytes (%d)\n", endpoint, limit)
+			writeFinish(c, endpoint, "length")
+			return
+		}
+
+		if !rawFinish {
+			if normalized := s.normalizeChoices(event.Data, true); nil != normalized {
+				event.SetData(normalized)
+			}
+		}
+		if rewritten := s.rewriteLogprobs(endpoint, event.Data); nil != rewritten {
+			event.SetData(rewritten)
+		}
+		if _, err = c.Writer.Write(event.Raw); nil != err {
+			return
+		}
+		c.Writer.Flush()
+		done = event.Done()
+	}
+}
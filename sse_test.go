@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStreamInterruptedMidStream检查上游在流中途断开连接时，客户端收到已转发的事件、finish_reason为error的事件和[DONE]
+func TestStreamInterruptedMidStream(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		path     string
+		request  string
+		event    string
+	}{
+		{
+			endpoint: "chat",
+			path:     "/v1/chat/completions",
+			request:  `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`,
+			event:    `{"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"partial"},"finish_reason":null}]}`,
+		},
+		{
+			endpoint: "codex",
+			path:     "/v1/engines/copilot-codex/completions",
+			request:  `{"prompt":"func main() {","suffix":"}","stream":true}`,
+			event:    `{"id":"cmpl-1","object":"text_completion","choices":[{"index":0,"text":"partial","finish_reason":null}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = io.WriteString(w, "data: "+tt.event+"\n\n")
+				w.(http.Flusher).Flush()
+				// 不发送结束的chunk直接关闭连接
+				panic(http.ErrAbortHandler)
+			}))
+			defer upstream.Close()
+
+			_, proxy := newTestProxy(t, nil, upstream.URL)
+			status, _, body := postTest(t, proxy, tt.path, tt.request, nil)
+			if http.StatusOK != status {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			if !strings.Contains(body, `partial`) {
+				t.Errorf("event sent before the drop was not relayed:\n%s", body)
+			}
+			if !strings.Contains(body, `"finish_reason":"error"`) {
+				t.Errorf("no finish_reason error event:\n%s", body)
+			}
+			if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+				t.Errorf("stream does not end with [DONE]:\n%s", body)
+			}
+		})
+	}
+}
+
+// TestStreamDroppedBeforeFirstEvent检查上游第一次在发出任何事件前断开连接时，代理用同样的请求体重新请求，
+// 请求带有Content-Length而不是chunked上传
+func TestStreamDroppedBeforeFirstEvent(t *testing.T) {
+	request := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	var attempts atomic.Int32
+	bodies := make(chan string, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(body)) || 0 != len(r.TransferEncoding) {
+			t.Errorf("attempt %d: Content-Length %d, Transfer-Encoding %v for a %d byte body", attempts.Load()+1, r.ContentLength, r.TransferEncoding, len(body))
+		}
+		bodies <- string(body)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if 1 == attempts.Add(1) {
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = io.WriteString(w, "data: {\"id\":\"chatcmpl-1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"ok\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	_, proxy := newTestProxy(t, nil, upstream.URL)
+	status, _, body := postTest(t, proxy, "/v1/chat/completions", request, nil)
+	if http.StatusOK != status || !strings.Contains(body, `"content":"ok"`) || strings.Contains(body, `"finish_reason":"error"`) {
+		t.Fatalf("status = %d, retried stream not relayed:\n%s", status, body)
+	}
+	if 2 != attempts.Load() {
+		t.Fatalf("upstream attempts = %d, want 2", attempts.Load())
+	}
+	if first, second := <-bodies, <-bodies; first != second {
+		t.Fatalf("retried body differs:\n%s\n%s", first, second)
+	}
+}
+
+// TestStreamFirstToken检查首个Token时间从第一个带有内容的事件开始计算，之前只有角色或空内容的事件不算
+func TestStreamFirstToken(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	tests := []struct {
+		name  string
+		empty string // 等待前发送的没有内容的事件
+		token string
+	}{
+		{"content", `{"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`, `{"choices":[{"index":0,"delta":{"content":"hi"}}]}`},
+		{"tool_calls", `{"choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[]}}]}`, `{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"f"}}]}}]}`},
+		{"text", `{"choices":[{"index":0,"text":""}]}`, `{"choices":[{"index":0,"text":"x"}]}`},
+	}
+	s, _ := newTestProxy(t, nil, "http://127.0.0.1:1")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := io.Pipe()
+			go func() {
+				_, _ = io.WriteString(dst, "data: "+tt.empty+"\n\n")
+				time.Sleep(delay)
+				_, _ = io.WriteString(dst, "data: "+tt.token+"\n\ndata: [DONE]\n\n")
+				_ = dst.Close()
+			}()
+
+			c, w := newTestContext(http.MethodPost, "/v1/chat/completions", nil)
+			rec := &usageRecord{}
+			rec.responded(time.Now())
+			c.Set(recordKey, rec)
+			s.relayStream(c, "chat", src, func() {})
+
+			if !strings.Contains(w.Body.String(), tt.token) {
+				t.Fatalf("token event not relayed:\n%s", w.Body.String())
+			}
+			if rec.FirstToken < delay {
+				t.Fatalf("ttft = %s, want at least %s", rec.FirstToken, delay)
+			}
+		})
+	}
+}
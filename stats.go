@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 非流式响应最多缓存这么多字节用于提取usage
+const maxCaptureSize = 4 << 20
+
+// modelPrice是模型的单价，单位为每百万Token
+type modelPrice struct {
+	Prompt     float64 `json:"prompt"`     // 提示的单价
+	Completion float64 `json:"completion"` // 补全的单价
+}
+
+// recordKey是gin.Context中保存usageRecord的键，访问日志等在请求结束后读取
+const recordKey = "override_record"
+
+// usageRecord是一次请求的用量记录，也是请求在各阶段之间共享的信息：请求和映射后的模型、租户、
+// 上游和实验分组在处理请求时填入一次，访问日志、指标、统计和最近请求列表都从这里读取
+type usageRecord struct {
+	Time             time.Time
+	Endpoint         string
+	Model            string // 客户端请求的模型
+	MappedModel      string // 映射后实际请求的模型
+	Tenant           string // 客户端密钥的哈希
+	Status           int
+	Latency          time.Duration
+	PromptTokens     int64
+	CompletionTokens int64
+	CachedTokens     int64 // 命中上游提示缓存的prompt Token数
+	Cost             float64
+	Experiment       string        // 实验ID和分组，如fimtest-1:b
+	Upstream         string        // 实际请求的上游名称
+	Backend          string        // 负载均衡的选择结果，如backend=https://a.example affinity=abc
+	FirstByte        time.Duration // 从请求开始到收到上游响应头的时间
+	FirstToken       time.Duration // 从上游请求写完到收到第一个SSE数据事件的时间，非流式响应为到收到响应头的时间
+
+	capture  *usageCapture
+	turn     *conversationTurn // 所属的对话，未开启conversation_stats时为nil
+	features featureSet        // 客户端在X-Override-Features中选择的功能
+	sent     time.Time         // 上游请求写完的时间
+	streamed bool              // SSE中继已经收到第一个数据事件
+}
+
+// ttftWindow是每个模型计算首个Token时间分位数时保留的最近请求数
+const ttftWindow = 1000
+
+// responded在收到上游响应头时记录首个Token的时间，流式响应之后由SSE中继更新
+func (r *usageRecord) responded(sent time.Time) {
+	r.sent = sent
+	r.FirstToken = time.Since(sent)
+}
+
+// firstEvent在SSE中继收到第一个带有内容的事件时记录首个Token的时间，之后的事件不再更新
+func (r *usageRecord) firstEvent() {
+	if nil == r || r.streamed || r.sent.IsZero() {
+		return
+	}
+	r.streamed = true
+	r.FirstToken = time.Since(r.sent)
+}
+
+// latencyPercentiles是最近请求耗时的分位数，单位为毫秒
+type latencyPercentiles struct {
+	Samples int   `json:"samples"`
+	P50     int64 `json:"p50"`
+	P90     int64 `json:"p90"`
+	P99     int64 `json:"p99"`
+}
+
+// percentilesOf计算samples中耗时的分位数，没有样本时返回nil
+func percentilesOf(samples *ring[time.Duration]) *latencyPercentiles {
+	if nil == samples {
+		return nil
+	}
+	values := samples.entries()
+	if 0 == len(values) {
+		return nil
+	}
+	slices.Sort(values)
+
+	at := func(p float64) int64 {
+		return values[int(p*float64(len(values)-1))].Milliseconds()
+	}
+	return &latencyPercentiles{Samples: len(values), P50: at(0.5), P90: at(0.9), P99: at(0.99)}
+}
+
+// modelStats是单个模型的内存汇总
+type modelStats struct {
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	CachedTokens     int64   `json:"cached_tokens"`
+	Cost             float64 `json:"cost"`
+
+	TTFT *latencyPercentiles `json:"ttft_ms,omitempty"` // 最近成功请求的首个Token时间，只在快照中计算
+
+	Feedback       int64    `json:"feedback,omitempty"`           // 收到采纳反馈的请求数
+	Accepted       int64    `json:"accepted,omitempty"`           // 被采纳的请求数，包括部分采纳
+	Partial        int64    `json:"partially_accepted,omitempty"` // 被部分采纳的请求数
+	AcceptanceRate *float64 `json:"acceptance_rate,omitempty"`    // accepted占feedback的比例，只在快照中计算
+
+	ttft *ring[time.Duration]
+}
+
+// snapshot返回汇总的副本，并计算首个Token时间的分位数
+func (ms *modelStats) snapshot() modelStats {
+	copied := *ms
+	copied.TTFT = percentilesOf(ms.ttft)
+	if ms.Feedback > 0 {
+		rate := float64(ms.Accepted) / float64(ms.Feedback)
+		copied.AcceptanceRate = &rate
+	}
+	copied.ttft = nil
+	return copied
+}
+
+// statsRecorder汇总请求统计，配置了stats_db时同时持久化到SQLite
+type statsRecorder struct {
+	prices       map[string]modelPrice
+	db           *statsDB
+	keyPools     []*keyPool
+	scheduler    *scheduler
+	limits       *rateLimits
+	quotas       *quotaTracker
+	catalog      *modelCatalog
+	capabilities *capabilityProbe
+	profiles     map[string]*statsRecorder // 各配置档的统计
+	threads      *conversationTracker      // 按对话的统计
+
+	mu        sync.Mutex
+	start     time.Time
+	total     int64
+	models    map[string]*modelStats
+	upstreams map[string]*upstreamStatus
+	arms      map[string]*modelStats // 实验各分组的汇总
+	panics    map[string]int64       // 各路由转换阶段的panic次数
+	minutes   [60]int64              // 最近60分钟每分钟的请求数
+	minuteAt  [60]int64              // minutes中每个槽位对应的分钟
+}
+
+// upstreamStatus记录上游最近的健康状况
+type upstreamStatus struct {
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastSuccess         string `json:"last_success,omitempty"`
+	LastFailure         string `json:"last_failure,omitempty"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// newStatsRecorder根据配置创建statsRecorder
+func newStatsRecorder(cfg *config) (*statsRecorder, error) {
+	r := &statsRecorder{
+		prices:    cfg.ModelPrices,
+		start:     time.Now(),
+		models:    make(map[string]*modelStats),
+		upstreams: make(map[string]*upstreamStatus),
+		arms:      make(map[string]*modelStats),
+	}
+
+	if "" != cfg.StatsDb {
+		db, err := openStatsDB(cfg.StatsDb)
+		if nil != err {
+			return nil, err
+		}
+		r.db = db
+	}
+
+	return r, nil
+}
+
+// begin开始记录一次请求
+func (r *statsRecorder) begin(c *gin.Context, endpoint string) *usageRecord {
+	rec := &usageRecord{
+		Time:     time.Now(),
+		Endpoint: endpoint,
+		Tenant:   tenantOf(c),
+	}
+	c.Set(recordKey, rec)
+
+	return rec
+}
+
+// recordOf返回请求的usageRecord，不统计用量的请求返回nil
+func recordOf(keys map[string]any) *usageRecord {
+	rec, _ := keys[recordKey].(*usageRecord)
+	return rec
+}
+
+// finish在请求结束时补全记录并汇总
+func (r *statsRecorder) finish(c *gin.Context, rec *usageRecord) {
+	rec.Latency = time.Since(rec.Time)
+	rec.Status = c.Writer.Status()
+	if nil != rec.capture {
+		rec.PromptTokens, rec.CompletionTokens = rec.capture.tokens()
+		rec.CachedTokens = rec.capture.cachedTokens()
+	}
+	if price, ok := r.prices[rec.MappedModel]; ok {
+		rec.Cost = (float64(rec.PromptTokens)*price.Prompt + float64(rec.CompletionTokens)*price.Completion) / 1e6
+	}
+
+	r.mu.Lock()
+	r.total++
+	minute := rec.Time.Unix() / 60
+	slot := minute % int64(len(r.minutes))
+	if r.minuteAt[slot] != minute {
+		r.minuteAt[slot] = minute
+		r.minutes[slot] = 0
+	}
+	r.minutes[slot]++
+	addStats(r.models, rec.MappedModel, rec)
+	if "" != rec.Experiment {
+		addStats(r.arms, rec.Experiment, rec)
+	}
+	r.mu.Unlock()
+
+	r.db.insert(rec)
+}
+
+// addStats把一次请求汇总到stats[name]
+func addStats(stats map[string]*modelStats, name string, rec *usageRecord) {
+	ms, ok := stats[name]
+	if !ok {
+		ms = &modelStats{}
+		stats[name] = ms
+	}
+	ms.Requests++
+	if rec.Status != http.StatusOK {
+		ms.Errors++
+	}
+	ms.PromptTokens += rec.PromptTokens
+	ms.CompletionTokens += rec.CompletionTokens
+	ms.CachedTokens += rec.CachedTokens
+	ms.Cost += rec.Cost
+	if rec.FirstToken > 0 && http.StatusOK == rec.Status {
+		if nil == ms.ttft {
+			ms.ttft = newRing[time.Duration](ttftWindow)
+		}
+		ms.ttft.add(rec.FirstToken)
+	}
+}
+
+// recordFeedback把一次采纳反馈汇总到模型和实验分组，只统计已经有请求记录的模型
+func (r *statsRecorder) recordFeedback(model string, experiment string, result string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	add := func(ms *modelStats) {
+		if nil == ms {
+			return
+		}
+		ms.Feedback++
+		if feedbackRejected != result {
+			ms.Accepted++
+		}
+		if feedbackPartial == result {
+			ms.Partial++
+		}
+	}
+	add(r.models[model])
+	if "" != experiment {
+		add(r.arms[experiment])
+	}
+}
+
+// totals返回所有模型的汇总
+func (r *statsRecorder) totals() modelStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var total modelStats
+	for _, ms := range r.models {
+		total.Requests += ms.Requests
+		total.Errors += ms.Errors
+		total.PromptTokens += ms.PromptTokens
+		total.CompletionTokens += ms.CompletionTokens
+		total.CachedTokens += ms.CachedTokens
+		total.Cost += ms.Cost
+	}
+
+	return total
+}
+
+// recordUpstream记录一次上游调用的结果，sample为空表示成功
+func (r *statsRecorder) recordUpstream(upstream string, sample string) {
+	now := time.Now().Format(time.RFC3339)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	us, ok := r.upstreams[upstream]
+	if !ok {
+		us = &upstreamStatus{}
+		r.upstreams[upstream] = us
+	}
+
+	if "" == sample {
+		us.ConsecutiveFailures = 0
+		us.LastSuccess = now
+		return
+	}
+
+	if len(sample) > 200 {
+		sample = sample[:200] + "..."
+	}
+	us.ConsecutiveFailures++
+	us.LastFailure = now
+	us.LastError = sample
+}
+
+// upstreamHealth返回各上游健康状况的快照
+func (r *statsRecorder) upstreamHealth() map[string]upstreamStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make(map[string]upstreamStatus, len(r.upstreams))
+	for name, us := range r.upstreams {
+		result[name] = *us
+	}
+
+	return result
+}
+
+// requestsPerMinute返回最近一分钟的请求数
+func (r *statsRecorder) requestsPerMinute() int64 {
+	now := time.Now().Unix()
+	minute := now / 60
+	prev := minute - 1
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 用当前分钟的计数加上上一分钟按剩余比例折算的计数，平滑分钟边界
+	var current, last int64
+	if slot := minute % int64(len(r.minutes)); r.minuteAt[slot] == minute {
+		current = r.minutes[slot]
+	}
+	if slot := prev % int64(len(r.minutes)); r.minuteAt[slot] == prev {
+		last = r.minutes[slot]
+	}
+
+	elapsed := now % 60
+	return current + last*(60-elapsed)/60
+}
+
+// snapshot返回内存统计的快照
+func (r *statsRecorder) snapshot() gin.H {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	models := make(map[string]modelStats, len(r.models))
+	for name, ms := range r.models {
+		models[name] = ms.snapshot()
+	}
+
+	keys := make(map[string][]keyStatus, len(r.keyPools))
+	for _, pool := range r.keyPools {
+		keys[pool.name] = pool.status()
+	}
+
+	result := gin.H{
+		"uptime_seconds": int64(time.Since(r.start).Seconds()),
+		"requests":       r.total,
+		"models":         models,
+		"keys":           keys,
+	}
+	if nil != r.scheduler {
+		result["concurrency"] = r.scheduler.status()
+	}
+	if nil != r.limits {
+		result["rate_limits"] = r.limits.status()
+	}
+	if nil != r.quotas {
+		result["quotas"] = r.quotas.status()
+	}
+	if nil != r.catalog {
+		result["upstream_models"] = r.catalog.status()
+	}
+	if nil != r.capabilities {
+		if caps := r.capabilities.status(); len(caps) > 0 {
+			result["capabilities"] = caps
+		}
+	}
+	if nil != r.threads {
+		result["conversations"] = r.threads.top()
+	}
+	if len(r.panics) > 0 {
+		result["panics"] = maps.Clone(r.panics)
+	}
+	if len(r.arms) > 0 {
+		arms := make(map[string]modelStats, len(r.arms))
+		for name, ms := range r.arms {
+			arms[name] = ms.snapshot()
+		}
+		result["experiments"] = arms
+	}
+	if len(r.profiles) > 0 {
+		profiles := make(gin.H, len(r.profiles))
+		for name, profile := range r.profiles {
+			profiles[name] = profile.snapshot()
+		}
+		result["profiles"] = profiles
+	}
+
+	return result
+}
+
+// handleStats处理/stats请求，带查询参数时从SQLite读取历史统计
+func (r *statsRecorder) handleStats(c *gin.Context) {
+	since := c.Query("since")
+	until := c.Query("until")
+	groupBy := c.Query("group_by")
+	if "" == since && "" == until && "" == groupBy {
+		c.JSON(http.StatusOK, r.snapshot())
+		return
+	}
+
+	if nil == r.db {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "stats_db is not configured"})
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	if "" != since {
+		if from, err = parseStatsTime(since); nil != err {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since: " + since})
+			return
+		}
+	}
+	if "" != until {
+		if to, err = parseStatsTime(until); nil != err {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid until: " + until})
+			return
+		}
+	}
+
+	var groups []string
+	if "" != groupBy {
+		groups = strings.Split(groupBy, ",")
+	}
+
+	rows, err := r.db.query(c.Request.Context(), from, to, groups)
+	if nil != err {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rows": rows})
+}
+
+// parseStatsTime解析日期或RFC3339格式的时间
+func parseStatsTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); nil == err {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// tenantOf返回客户端密钥的哈希，用于区分不同的调用方而不记录密钥本身
+func tenantOf(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	if "" == auth {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(auth))
+	return hex.EncodeToString(sum[:8])
+}
+
+// usageCapture从转发给客户端的响应中提取usage字段
+type usageCapture struct {
+	stream bool
+	buf    []byte
+	usage  gjson.Result
+}
+
+// newUsageCapture根据响应类型创建usageCapture
+func newUsageCapture(contentType string) *usageCapture {
+	return &usageCapture{stream: isEventStream(contentType)}
+}
+
+// Write实现io.Writer，流式响应按行解析，非流式响应缓存整个body
+func (u *usageCapture) Write(p []byte) (int, error) {
+	if !u.stream {
+		if len(u.buf)+len(p) <= maxCaptureSize {
+			u.buf = append(u.buf, p...)
+		}
+		return len(p), nil
+	}
+
+	u.buf = append(u.buf, p...)
+	rest := u.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := bytes.TrimSpace(rest[:i])
+		rest = rest[i+1:]
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+
+		usage := gjson.GetBytes(bytes.TrimSpace(line[5:]), "usage")
+		if usage.IsObject() {
+			u.usage = usage
+		}
+	}
+	u.buf = append(u.buf[:0], rest...)
+
+	return len(p), nil
+}
+
+// result返回提取到的usage字段
+func (u *usageCapture) result() gjson.Result {
+	if !u.stream {
+		return gjson.GetBytes(u.buf, "usage")
+	}
+
+	return u.usage
+}
+
+// tokens返回提取到的prompt和completion Token数
+func (u *usageCapture) tokens() (int64, int64) {
+	usage := u.result()
+	return usage.Get("prompt_tokens").Int(), usage.Get("completion_tokens").Int()
+}
+
+// cachedTokens返回命中上游提示缓存的Token数，OpenAI为prompt_tokens_details.cached_tokens，DeepSeek为prompt_cache_hit_tokens
+func (u *usageCapture) cachedTokens() int64 {
+	usage := u.result()
+	if cached := usage.Get("prompt_tokens_details.cached_tokens"); cached.Exists() {
+		return cached.Int()
+	}
+
+	return usage.Get("prompt_cache_hit_tokens").Int()
+}
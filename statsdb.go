@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// statsMigrations是按顺序执行的建表语句，已执行的版本记录在PRAGMA user_version中
+var statsMigrations = []string{
+	`CREATE TABLE requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts INTEGER NOT NULL,
+		endpoint TEXT NOT NULL,
+		model TEXT NOT NULL,
+		mapped_model TEXT NOT NULL,
+		tenant TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		latency_ms INTEGER NOT NULL,
+		prompt_tokens INTEGER NOT NULL,
+		completion_tokens INTEGER NOT NULL,
+		cost REAL NOT NULL
+	)`,
+	`CREATE INDEX idx_requests_ts ON requests (ts)`,
+}
+
+// statsGroups是/stats允许的group_by取值及对应的SQL表达式
+var statsGroups = map[string]string{
+	"endpoint":     "endpoint",
+	"model":        "model",
+	"mapped_model": "mapped_model",
+	"tenant":       "tenant",
+	"status":       "status",
+	"day":          "strftime('%Y-%m-%d', ts, 'unixepoch')",
+	"month":        "strftime('%Y-%m', ts, 'unixepoch')",
+}
+
+// sqlitePragmas在每个连接上执行：使用WAL，并在文件被其他连接或进程锁定时最多等待5秒，而不是立即返回SQLITE_BUSY。
+// stats_db和storage_path可以是同一个文件，两者各自持有一个连接
+const sqlitePragmas = "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+// openSqlite打开SQLite文件，SQLite只允许单个写入者，每个*sql.DB只使用一个连接
+func openSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?"+sqlitePragmas)
+	if nil != err {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+// statsDB负责把请求记录批量异步写入SQLite
+type statsDB struct {
+	db      *sql.DB
+	rows    chan *usageRecord
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// openStatsDB打开数据库、执行迁移并启动后台写入
+func openStatsDB(path string) (*statsDB, error) {
+	db, err := openSqlite(path)
+	if nil != err {
+		return nil, err
+	}
+
+	err = migrateStatsDB(db)
+	if nil != err {
+		closeIO(db)
+		return nil, err
+	}
+
+	s := &statsDB{
+		db:      db,
+		rows:    make(chan *usageRecord, 1024),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.loop()
+
+	return s, nil
+}
+
+// migrateStatsDB执行尚未执行的迁移
+func migrateStatsDB(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if nil != err {
+		return err
+	}
+
+	for i := version; i < len(statsMigrations); i++ {
+		tx, err := db.Begin()
+		if nil != err {
+			return err
+		}
+
+		if _, err = tx.Exec(statsMigrations[i]); nil == err {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if nil != err {
+			_ = tx.Rollback()
+			return fmt.Errorf("stats db migration %d failed: %w", i+1, err)
+		}
+
+		if err = tx.Commit(); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insert把记录放入写入队列，队列满时丢弃，不阻塞请求
+func (s *statsDB) insert(rec *usageRecord) {
+	if nil == s {
+		return
+	}
+
+	select {
+	case s.rows <- rec:
+	default:
+		logError("stats db queue is full, record dropped\n")
+	}
+}
+
+// loop定期把队列中的记录批量写入数据库
+func (s *statsDB) loop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*usageRecord, 0, 128)
+	for {
+		select {
+		case rec := <-s.rows:
+			batch = append(batch, rec)
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-ticker.C:
+			if 0 == len(batch) {
+				continue
+			}
+		case <-s.stop:
+			s.drain(batch)
+			return
+		}
+
+		err := s.write(batch)
+		if nil != err {
+			logError("write stats db failed: %s\n", err.Error())
+		}
+		batch = batch[:0]
+	}
+}
+
+// drain写入队列中剩余的记录并关闭数据库
+func (s *statsDB) drain(batch []*usageRecord) {
+	defer close(s.stopped)
+
+	for len(s.rows) > 0 {
+		batch = append(batch, <-s.rows)
+	}
+
+	if len(batch) > 0 {
+		if err := s.write(batch); nil != err {
+			logError("write stats db failed: %s\n", err.Error())
+		}
+	}
+	closeIO(s.db)
+}
+
+// close停止后台写入，写完队列中的记录后关闭数据库
+func (s *statsDB) close() {
+	if nil == s {
+		return
+	}
+
+	close(s.stop)
+	<-s.stopped
+}
+
+// write在一个事务中写入一批记录
+func (s *statsDB) write(batch []*usageRecord) error {
+	tx, err := s.db.Begin()
+	if nil != err {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO requests (ts, endpoint, model, mapped_model, tenant, status, latency_ms, prompt_tokens, completion_tokens, cost) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if nil != err {
+		_ = tx.Rollback()
+		return err
+	}
+	defer closeIO(stmt)
+
+	for _, rec := range batch {
+		_, err = stmt.Exec(rec.Time.Unix(), rec.Endpoint, rec.Model, rec.MappedModel, rec.Tenant, rec.Status,
+			rec.Latency.Milliseconds(), rec.PromptTokens, rec.CompletionTokens, rec.Cost)
+		if nil != err {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// query按时间范围和分组汇总历史记录
+func (s *statsDB) query(ctx context.Context, since, until time.Time, groups []string) ([]map[string]interface{}, error) {
+	var columns []string
+	for _, g := range groups {
+		expr, ok := statsGroups[strings.TrimSpace(g)]
+		if !ok {
+			return nil, fmt.Errorf("invalid group_by: %s", g)
+		}
+		columns = append(columns, expr)
+	}
+
+	var where []string
+	var args []interface{}
+	if !since.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, since.Unix())
+	}
+	if !until.IsZero() {
+		where = append(where, "ts < ?")
+		args = append(args, until.Unix())
+	}
+
+	query := "SELECT "
+	for _, col := range columns {
+		query += col + ", "
+	}
+	query += "COUNT(*), SUM(status != 200), SUM(prompt_tokens), SUM(completion_tokens), SUM(cost), AVG(latency_ms) FROM requests"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if len(columns) > 0 {
+		query += " GROUP BY " + strings.Join(columns, ", ") + " ORDER BY " + strings.Join(columns, ", ")
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if nil != err {
+		return nil, err
+	}
+	defer closeIO(rows)
+
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		keys := make([]interface{}, len(columns))
+		var requests int64
+		var errorCount, promptTokens, completionTokens sql.NullInt64
+		var cost, latency sql.NullFloat64
+
+		dest := make([]interface{}, 0, len(columns)+6)
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		dest = append(dest, &requests, &errorCount, &promptTokens, &completionTokens, &cost, &latency)
+		if err = rows.Scan(dest...); nil != err {
+			return nil, err
+		}
+
+		row := map[string]interface{}{
+			"requests":          requests,
+			"errors":            errorCount.Int64,
+			"prompt_tokens":     promptTokens.Int64,
+			"completion_tokens": completionTokens.Int64,
+			"cost":              cost.Float64,
+			"avg_latency_ms":    latency.Float64,
+		}
+		for i, g := range groups {
+			row[strings.TrimSpace(g)] = keys[i]
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	storageMemory = "memory" // 保存在进程内存中，重启后丢失
+	storageSqlite = "sqlite" // 保存在storage_path指定的SQLite文件中
+
+	// defaultStoragePath是storage为sqlite且未配置storage_path时使用的文件
+	defaultStoragePath = "override.db"
+	// storePurgeInterval是清理过期数据的间隔
+	storePurgeInterval = time.Minute
+)
+
+// store是配额等需要持久化的数据使用的键值存储，键按前缀组织，如quota/<tenant>/<hour>/tokens。
+// ttl不大于0表示不过期，过期的数据不再返回并定期清理
+type store interface {
+	// get返回键的值，键不存在或已过期时ok为false
+	get(key string) (value []byte, ok bool, err error)
+	// getAll按顺序返回多个键的值，不存在或已过期的键为nil
+	getAll(keys []string) ([][]byte, error)
+	// put写入键的值
+	put(key string, value []byte, ttl time.Duration) error
+	// increment把键的整数值加上delta并返回新值，键不存在或已过期时从0开始并使用ttl，已存在时保留原来的过期时间
+	increment(key string, delta int64, ttl time.Duration) (int64, error)
+	// del删除键
+	del(key string) error
+	// scan按键的顺序遍历以prefix开头的键，fn返回false时停止
+	scan(prefix string, fn func(key string, value []byte) bool) error
+	// close停止后台清理并释放资源
+	close() error
+}
+
+// openStore根据storage创建配置档profile使用的存储，默认为内存
+func openStore(cfg *config, profile string) (store, error) {
+	if err := checkStorage(cfg); nil != err {
+		return nil, err
+	}
+
+	switch cfg.Storage {
+	case storageSqlite:
+		path := cfg.StoragePath
+		if "" == path {
+			path = defaultStoragePath
+		}
+		return openSqliteStore(path)
+	case storageRedis:
+		return openRedisStore(cfg.StorageUrl, profile)
+	}
+
+	return newMemoryStore(), nil
+}
+
+// checkStorage检查存储的配置，不连接也不创建文件
+func checkStorage(cfg *config) error {
+	switch cfg.Storage {
+	case "", storageMemory, storageSqlite:
+		return nil
+	case storageRedis:
+		if "" == cfg.StorageUrl {
+			return errors.New("storage redis requires storage_url")
+		}
+		if _, err := redis.ParseURL(cfg.StorageUrl); nil != err {
+			return fmt.Errorf("storage_url: %w", err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported storage: %s, expected %s, %s or %s", cfg.Storage, storageMemory, storageSqlite, storageRedis)
+}
+
+// expiresAt返回ttl对应的过期时间（Unix秒），不过期时为0
+func expiresAt(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).Unix()
+}
+
+// memoryEntry是内存存储中的一个值
+type memoryEntry struct {
+	value   []byte
+	expires int64 // Unix秒，0为不过期
+}
+
+// expired返回值在now时是否已过期
+func (e memoryEntry) expired(now int64) bool {
+	return 0 != e.expires && e.expires <= now
+}
+
+// memoryStore是保存在内存中的store
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	stop    chan struct{}
+}
+
+// newMemoryStore创建内存存储并启动后台清理
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{entries: make(map[string]memoryEntry), stop: make(chan struct{})}
+	go s.purgeLoop()
+	return s
+}
+
+// get实现store
+func (s *memoryStore) get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || entry.expired(time.Now().Unix()) {
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+// getAll实现store
+func (s *memoryStore) getAll(keys []string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		if entry, ok := s.entries[key]; ok && !entry.expired(now) {
+			values[i] = entry.value
+		}
+	}
+	return values, nil
+}
+
+// put实现store
+func (s *memoryStore) put(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryEntry{value: value, expires: expiresAt(time.Now(), ttl)}
+	return nil
+}
+
+// increment实现store
+func (s *memoryStore) increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := s.entries[key]
+	if !ok || entry.expired(now.Unix()) {
+		entry = memoryEntry{expires: expiresAt(now, ttl)}
+	}
+
+	var current int64
+	if 0 != len(entry.value) {
+		n, err := strconv.ParseInt(string(entry.value), 10, 64)
+		if nil != err {
+			return 0, fmt.Errorf("increment %s: %w", key, err)
+		}
+		current = n
+	}
+	current += delta
+	entry.value = []byte(strconv.FormatInt(current, 10))
+	s.entries[key] = entry
+
+	return current, nil
+}
+
+// del实现store
+func (s *memoryStore) del(key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// scan实现store，遍历时不持有锁，fn中可以读写存储
+func (s *memoryStore) scan(prefix string, fn func(key string, value []byte) bool) error {
+	s.mu.Lock()
+	now := time.Now().Unix()
+	var keys []string
+	values := make(map[string][]byte)
+	for key, entry := range s.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			keys = append(keys, key)
+			values[key] = entry.value
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, values[key]) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// close实现store
+func (s *memoryStore) close() error {
+	close(s.stop)
+	return nil
+}
+
+// purgeLoop定期删除过期的值
+func (s *memoryStore) purgeLoop() {
+	ticker := time.NewTicker(storePurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			now := time.Now().Unix()
+			for key, entry := range s.entries {
+				if entry.expired(now) {
+					delete(s.entries, key)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sqliteStore是保存在SQLite文件中的store，可以与stats_db使用同一个文件
+type sqliteStore struct {
+	db   *sql.DB
+	stop chan struct{}
+}
+
+// openSqliteStore打开数据库、创建表并启动后台清理
+func openSqliteStore(path string) (*sqliteStore, error) {
+	db, err := openSqlite(path)
+	if nil != err {
+		return nil, err
+	}
+
+	// 不使用PRAGMA user_version，避免与stats_db的迁移冲突
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		expires INTEGER NOT NULL
+	)`)
+	if nil != err {
+		closeIO(db)
+		return nil, fmt.Errorf("storage %s: %w", path, err)
+	}
+
+	s := &sqliteStore{db: db, stop: make(chan struct{})}
+	go s.purgeLoop()
+
+	return s, nil
+}
+
+// get实现store
+func (s *sqliteStore) get(key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.QueryRow("SELECT value FROM kv WHERE key = ? AND (0 = expires OR expires > ?)", key, time.Now().Unix()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if nil != err {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// getAll实现store
+func (s *sqliteStore) getAll(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, _, err := s.get(key)
+		if nil != err {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// put实现store
+func (s *sqliteStore) put(key string, value []byte, ttl time.Duration) error {
+	_, err := s.db.Exec("INSERT INTO kv (key, value, expires) VALUES (?, ?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires = excluded.expires",
+		key, value, expiresAt(time.Now(), ttl))
+	return err
+}
+
+// increment实现store，在一条语句中完成读取和写入，多个进程共用文件时也不会丢失计数
+func (s *sqliteStore) increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	var current int64
+	err := s.db.QueryRow(`INSERT INTO kv (key, value, expires) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			value = CASE WHEN 0 != expires AND expires <= ? THEN excluded.value ELSE CAST(CAST(value AS INTEGER) + ? AS TEXT) END,
+			expires = CASE WHEN 0 != expires AND expires <= ? THEN excluded.expires ELSE expires END
+		RETURNING CAST(value AS INTEGER)`,
+		key, strconv.FormatInt(delta, 10), expiresAt(now, ttl), now.Unix(), delta, now.Unix()).Scan(&current)
+	if nil != err {
+		return 0, fmt.Errorf("increment %s: %w", key, err)
+	}
+	return current, nil
+}
+
+// del实现store
+func (s *sqliteStore) del(key string) error {
+	_, err := s.db.Exec("DELETE FROM kv WHERE key = ?", key)
+	return err
+}
+
+// scan实现store，先读出所有匹配的键再调用fn，fn中可以读写存储
+func (s *sqliteStore) scan(prefix string, fn func(key string, value []byte) bool) error {
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT key, value FROM kv WHERE substr(key, 1, ?) = ? AND (0 = expires OR expires > ?) ORDER BY key",
+		len(prefix), prefix, time.Now().Unix())
+	if nil != err {
+		return err
+	}
+
+	type pair struct {
+		key   string
+		value []byte
+	}
+	var pairs []pair
+	for rows.Next() {
+		var p pair
+		if err = rows.Scan(&p.key, &p.value); nil != err {
+			closeIO(rows)
+			return err
+		}
+		pairs = append(pairs, p)
+	}
+	closeIO(rows)
+	if err = rows.Err(); nil != err {
+		return err
+	}
+
+	for _, p := range pairs {
+		if !fn(p.key, p.value) {
+			break
+		}
+	}
+	return nil
+}
+
+// close实现store
+func (s *sqliteStore) close() error {
+	close(s.stop)
+	return s.db.Close()
+}
+
+// purgeLoop定期删除过期的值
+func (s *sqliteStore) purgeLoop() {
+	ticker := time.NewTicker(storePurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.db.Exec("DELETE FROM kv WHERE 0 != expires AND expires <= ?", time.Now().Unix()); nil != err {
+				logError("purge expired storage entries failed: %v\n", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
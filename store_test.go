@@ -0,0 +1,206 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// storeBackend创建一种store，advance让存储中的时间前进d
+type storeBackend struct {
+	name string
+	open func(t *testing.T) (store, func(d time.Duration))
+}
+
+var storeBackends = []storeBackend{
+	{
+		name: storageMemory,
+		open: func(t *testing.T) (store, func(time.Duration)) {
+			return newMemoryStore(), time.Sleep
+		},
+	},
+	{
+		name: storageSqlite,
+		open: func(t *testing.T) (store, func(time.Duration)) {
+			s, err := openSqliteStore(filepath.Join(t.TempDir(), "store.db"))
+			if nil != err {
+				t.Fatal(err)
+			}
+			return s, time.Sleep
+		},
+	},
+	{
+		name: storageRedis,
+		open: func(t *testing.T) (store, func(time.Duration)) {
+			mr := miniredis.RunT(t)
+			s, err := openRedisStore("redis://"+mr.Addr(), "team-b")
+			if nil != err {
+				t.Fatal(err)
+			}
+			if s.down.Load() {
+				t.Fatal("miniredis not reachable")
+			}
+			return s, mr.FastForward
+		},
+	},
+}
+
+// scanKeys返回scan遍历到的键和值，最多limit个
+func scanKeys(t *testing.T, s store, prefix string, limit int) map[string]string {
+	t.Helper()
+
+	found := make(map[string]string)
+	var order []string
+	err := s.scan(prefix, func(key string, value []byte) bool {
+		found[key] = string(value)
+		order = append(order, key)
+		return len(order) < limit
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i-1] >= order[i] {
+			t.Fatalf("scan order %q is not sorted", order)
+		}
+	}
+	return found
+}
+
+// TestStore对每种存储执行同样的操作，检查它们的行为一致
+func TestStore(t *testing.T) {
+	for _, backend := range storeBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Parallel()
+			s, advance := backend.open(t)
+			defer func() { _ = s.close() }()
+
+			if _, ok, err := s.get("missing"); ok || nil != err {
+				t.Fatalf("get missing = %v, %v", ok, err)
+			}
+
+			// 写入、覆盖和批量读取
+			for _, put := range []struct{ key, value string }{{"a", "1"}, {"b", "2"}, {"a", "3"}} {
+				if err := s.put(put.key, []byte(put.value), 0); nil != err {
+					t.Fatal(err)
+				}
+			}
+			if value, ok, err := s.get("a"); !ok || nil != err || "3" != string(value) {
+				t.Fatalf("get a = %q, %v, %v", value, ok, err)
+			}
+			values, err := s.getAll([]string{"b", "missing", "a"})
+			if nil != err || !reflect.DeepEqual([][]byte{[]byte("2"), nil, []byte("3")}, values) {
+				t.Fatalf("getAll = %q, %v", values, err)
+			}
+
+			// 计数从0开始累加，已有的值按整数累加
+			for i, want := range []int64{5, 3, 10} {
+				delta := []int64{5, -2, 7}[i]
+				if n, err := s.increment("counter", delta, 0); nil != err || want != n {
+					t.Fatalf("increment #%d = %d, %v, want %d", i+1, n, err, want)
+				}
+			}
+			if value, _, _ := s.get("counter"); "10" != string(value) {
+				t.Fatalf("counter = %q, want 10", value)
+			}
+
+			if err := s.del("b"); nil != err {
+				t.Fatal(err)
+			}
+			if _, ok, _ := s.get("b"); ok {
+				t.Fatal("deleted key still readable")
+			}
+
+			// 前缀中的通配符按字面匹配，遍历按键的顺序，fn返回false时停止
+			for _, key := range []string{"quota/a*b/2", "quota/a*b/1", "quota/axb/1", "quota/a*c/1"} {
+				if err := s.put(key, []byte(key), 0); nil != err {
+					t.Fatal(err)
+				}
+			}
+			want := map[string]string{"quota/a*b/1": "quota/a*b/1", "quota/a*b/2": "quota/a*b/2"}
+			if found := scanKeys(t, s, "quota/a*b/", 10); !reflect.DeepEqual(want, found) {
+				t.Fatalf("scan = %q, want %q", found, want)
+			}
+			if found := scanKeys(t, s, "quota/", 2); !reflect.DeepEqual(map[string]string{"quota/a*b/1": "quota/a*b/1", "quota/a*b/2": "quota/a*b/2"}, found) {
+				t.Fatalf("scan stopped early = %q", found)
+			}
+
+			// 过期后读取不到，也不会被遍历，计数重新从0开始；ttl不大于0的值不过期
+			if err := s.put("quota/t/ttl", []byte("x"), time.Second); nil != err {
+				t.Fatal(err)
+			}
+			if _, err := s.increment("quota/t/count", 4, time.Second); nil != err {
+				t.Fatal(err)
+			}
+			if _, err := s.increment("quota/t/count", 1, time.Hour); nil != err {
+				t.Fatal(err)
+			}
+			advance(2100 * time.Millisecond)
+			if _, ok, _ := s.get("quota/t/ttl"); ok {
+				t.Fatal("expired key still readable")
+			}
+			if found := scanKeys(t, s, "quota/t/", 10); 0 != len(found) {
+				t.Fatalf("scan returned expired keys: %q", found)
+			}
+			if n, err := s.increment("quota/t/count", 2, time.Second); nil != err || 2 != n {
+				t.Fatalf("increment after expiry = %d, %v, want 2", n, err)
+			}
+			if _, ok, _ := s.get("a"); !ok {
+				t.Fatal("key without ttl expired")
+			}
+		})
+	}
+}
+
+// TestSqliteSharedFile检查stats_db和storage_path使用同一个文件时，两个连接同时写入不会因为文件被锁定而失败
+func TestSqliteSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "override.db")
+	var stores []*sqliteStore
+	for i := 0; i < 2; i++ {
+		s, err := openSqliteStore(path)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer func() { _ = s.close() }()
+		stores = append(stores, s)
+	}
+	stats, err := openStatsDB(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer stats.close()
+
+	var mode string
+	if err = stores[0].db.QueryRow("PRAGMA journal_mode").Scan(&mode); nil != err || "wal" != mode {
+		t.Fatalf("journal_mode = %q, %v", mode, err)
+	}
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	errs := make(chan error, len(stores))
+	for _, s := range stores {
+		wg.Add(1)
+		go func(s *sqliteStore) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if _, err := s.increment("quota/shared/requests", 1, time.Hour); nil != err {
+					errs <- err
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if value, _, _ := stores[0].get("quota/shared/requests"); "400" != string(value) {
+		t.Fatalf("requests = %q, want 400", value)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"override/internal/sse"
+)
+
+// stream_options字段的处理方式
+const (
+	streamOptionsPassthrough = "passthrough" // 原样转发
+	streamOptionsStrip       = "strip"       // 删除，兼容不支持该字段的上游
+	streamOptionsForce       = "force"       // 流式请求总是要求上游返回usage
+)
+
+// checkStreamOptions校验stream_options的处理方式
+func checkStreamOptions(name string, mode string) error {
+	switch mode {
+	case "", streamOptionsPassthrough, streamOptionsStrip, streamOptionsForce:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported %s: %s", name, mode)
+}
+
+// withStreamOptions按上游的配置处理请求体中的stream_options
+func (t *upstreamTarget) withStreamOptions(body []byte) []byte {
+	switch t.streamOptions {
+	case streamOptionsStrip:
+		body, _ = sjson.DeleteBytes(body, "stream_options")
+	case streamOptionsForce:
+		if gjson.GetBytes(body, "stream").Bool() {
+			body, _ = sjson.SetBytes(body, "stream_options.include_usage", true)
+		}
+	}
+
+	return body
+}
+
+// forcesUsage判断usage是否由代理强制开启而不是客户端请求的，此时最后只有usage的事件不转发给客户端
+func (t *upstreamTarget) forcesUsage(body []byte) bool {
+	return !t.raw && streamOptionsForce == t.streamOptions &&
+		gjson.GetBytes(body, "stream").Bool() &&
+		!gjson.GetBytes(body, "stream_options.include_usage").Bool()
+}
+
+// usageFilter从SSE流中去掉只有usage、choices为空的事件，部分客户端收到这样的事件会出错
+type usageFilter struct {
+	events  *sse.Reader
+	pending []byte
+}
+
+// newUsageFilter创建usageFilter，src应当已经接入usageCapture，保证去掉的usage仍计入统计
+func newUsageFilter(src io.Reader) *usageFilter {
+	return &usageFilter{events: sse.NewReader(src)}
+}
+
+// Read实现io.Reader，每次最多返回一个事件
+func (f *usageFilter) Read(p []byte) (int, error) {
+	for 0 == len(f.pending) {
+		event, err := f.events.Next()
+		if nil != err {
+			return 0, err
+		}
+
+		data := gjson.ParseBytes(event.Data)
+		if data.Get("usage").IsObject() && 0 == len(data.Get("choices").Array()) {
+			continue
+		}
+		f.pending = event.Raw
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+
+	return n, nil
+}
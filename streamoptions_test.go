@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// usageStreamUpstream模拟上游：请求了include_usage时在最后发送只有usage、choices为空的事件，收到的请求体发到bodies
+func usageStreamUpstream(bodies chan<- []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"},\"finish_reason\":null}]}\n\n")
+		_, _ = io.WriteString(w, "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		if gjson.GetBytes(body, "stream_options.include_usage").Bool() {
+			_, _ = io.WriteString(w, "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":1,\"total_tokens\":8}}\n\n")
+		}
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+}
+
+func TestChatStreamOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		clientUsage   bool
+		upstreamField bool // 上游收到的请求中有stream_options
+		upstreamUsage bool // 上游收到的include_usage
+		relayedUsage  bool // 客户端收到usage事件
+		countedTokens bool // 统计中有usage的Token数
+	}{
+		{"passthrough without usage", streamOptionsPassthrough, false, false, false, false, false},
+		{"passthrough with usage", streamOptionsPassthrough, true, true, true, true, true},
+		{"default mode is passthrough", "", true, true, true, true, true},
+		{"strip", streamOptionsStrip, true, false, false, false, false},
+		{"force without client usage", streamOptionsForce, false, true, true, false, true},
+		{"force with client usage", streamOptionsForce, true, true, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies := make(chan []byte, 1)
+			upstream := usageStreamUpstream(bodies)
+			defer upstream.Close()
+
+			s, proxy := newTestProxy(t, &config{ChatStreamOptions: tt.mode}, upstream.URL)
+			request := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+			if tt.clientUsage {
+				request = `{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`
+			}
+			status, _, body := postTest(t, proxy, "/v1/chat/completions", request, nil)
+			if http.StatusOK != status {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+
+			sent := <-bodies
+			if field := gjson.GetBytes(sent, "stream_options"); tt.upstreamField != field.Exists() {
+				t.Errorf("upstream stream_options = %s, want present %v", field.Raw, tt.upstreamField)
+			}
+			if usage := gjson.GetBytes(sent, "stream_options.include_usage").Bool(); tt.upstreamUsage != usage {
+				t.Errorf("upstream include_usage = %v, want %v", usage, tt.upstreamUsage)
+			}
+			if relayed := strings.Contains(body, `"usage"`); tt.relayedUsage != relayed {
+				t.Errorf("usage event relayed = %v, want %v:\n%s", relayed, tt.relayedUsage, body)
+			}
+			if !strings.Contains(body, `"content":"hi"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+				t.Errorf("stream content or [DONE] missing:\n%s", body)
+			}
+
+			waitFor(t, func() bool { return 1 == s.stats.totals().Requests })
+			if counted := 7 == s.stats.totals().PromptTokens; tt.countedTokens != counted {
+				t.Errorf("prompt tokens = %d, want usage counted %v", s.stats.totals().PromptTokens, tt.countedTokens)
+			}
+		})
+	}
+}
+
+func TestCheckStreamOptions(t *testing.T) {
+	for _, mode := range []string{"", streamOptionsPassthrough, streamOptionsStrip, streamOptionsForce} {
+		if err := checkStreamOptions("chat_stream_options", mode); nil != err {
+			t.Errorf("checkStreamOptions(%q) = %v", mode, err)
+		}
+	}
+	if err := checkStreamOptions("chat_stream_options", "always"); nil == err {
+		t.Error("checkStreamOptions accepted an unknown mode")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// errSuperseded表示代码补全请求被同一位置的新请求取代
+var errSuperseded = errors.New("superseded by a newer completion request")
+
+// inflightRequest是一个进行中的代码补全请求
+type inflightRequest struct {
+	cancel context.CancelCauseFunc
+}
+
+// inflightCodex记录进行中的代码补全请求，同一位置的新请求到达时取消旧请求
+type inflightCodex struct {
+	mu       sync.Mutex
+	requests map[string]*inflightRequest
+}
+
+// newInflightCodex创建inflightCodex
+func newInflightCodex() *inflightCodex {
+	return &inflightCodex{requests: make(map[string]*inflightRequest)}
+}
+
+// supersedeKey根据客户端、编辑器会话和去掉最后一行的prompt计算请求位置，
+// 用户在同一行继续输入时新旧请求得到相同的key
+func supersedeKey(c *gin.Context, body []byte) string {
+	prompt := gjson.GetBytes(body, "prompt").String()
+	if i := strings.LastIndexByte(prompt, '\n'); i >= 0 {
+		prompt = prompt[:i]
+	}
+
+	sum := sha256.Sum256([]byte(tenantOf(c) + "\x00" + c.GetHeader("Vscode-Sessionid") + "\x00" + prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// track登记请求并取消同一key下进行中的旧请求，返回的ctx在被取代时以errSuperseded取消，
+// 请求结束后需要调用done
+func (f *inflightCodex) track(ctx context.Context, key string) (context.Context, bool, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	entry := &inflightRequest{cancel: cancel}
+
+	f.mu.Lock()
+	previous, superseding := f.requests[key]
+	f.requests[key] = entry
+	f.mu.Unlock()
+
+	if superseding {
+		previous.cancel(errSuperseded)
+	}
+
+	return ctx, superseding, func() {
+		f.mu.Lock()
+		if f.requests[key] == entry {
+			delete(f.requests, key)
+		}
+		f.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// abortSuperseded在请求已被新请求取代时返回[DONE]并中断处理
+func abortSuperseded(c *gin.Context, ctx context.Context) bool {
+	if !errors.Is(context.Cause(ctx), errSuperseded) {
+		return false
+	}
+
+	abortCodex(c, http.StatusOK)
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemd传递的第一个监听socket的文件描述符
+const listenFdsStart = 3
+
+// listen优先使用systemd socket activation传入的socket，没有时监听address
+func listen(network string, address string) (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return listenBind(network, address)
+	}
+
+	// 清除环境变量，避免被子进程继承
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer closeIO(file)
+
+	listener, err := net.FileListener(file)
+	if nil != err {
+		return nil, fmt.Errorf("systemd socket activation: %w", err)
+	}
+	log.Println("using socket from systemd:", listener.Addr())
+
+	return listener, nil
+}
+
+// sdNotify向systemd发送状态通知，没有NOTIFY_SOCKET时不做任何处理
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if "" == socket {
+		return
+	}
+
+	// 以@开头的是抽象socket
+	if '@' == socket[0] {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if nil != err {
+		logError("sd_notify failed: %v\n", err)
+		return
+	}
+	defer closeIO(conn)
+
+	if _, err = conn.Write([]byte(state)); nil != err {
+		logError("sd_notify failed: %v\n", err)
+	}
+}
+
+// sdWatchdog在systemd配置了WatchdogSec时按一半的间隔发送WATCHDOG=1，直到stop被关闭
+func sdWatchdog(stop <-chan struct{}) {
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); "" != pid && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sdNotify("WATCHDOG=1")
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+)
+
+// tenantModels是单个客户端的模型映射，优先于全局的chat_model_map和chat_model_default
+type tenantModels struct {
+	ChatModelMap     map[string]string `json:"chat_model_map"`     // 该客户端的模型映射，没有对应项时使用全局映射
+	ChatModelDefault string            `json:"chat_model_default"` // 两个映射都没有对应项时使用的模型，为空时使用全局默认模型
+}
+
+// tenantModelSet是客户端到模型映射的配置，配置中以客户端密钥为键，转换后以客户端标识为键
+type tenantModelSet map[string]tenantModels
+
+// newTenantModels把tenant_models的客户端密钥转换为与统计和配额一致的客户端标识
+func newTenantModels(cfg *config) tenantModelSet {
+	if 0 == len(cfg.TenantModels) {
+		return nil
+	}
+
+	tenants := make(tenantModelSet, len(cfg.TenantModels))
+	for key, models := range cfg.TenantModels {
+		tenants[quotaTenant(key)] = models
+	}
+
+	return tenants
+}
+
+// tenantModelsOf返回请求所属客户端的模型映射，没有配置时返回零值
+func (s *ProxyService) tenantModelsOf(header http.Header) tenantModels {
+	auth := header.Get("Authorization")
+	if "" == auth || 0 == len(s.tenants) {
+		return tenantModels{}
+	}
+
+	return s.tenants[quotaTenant(auth)]
+}
+
+// mapChatModel返回聊天请求实际使用的模型：依次查找客户端的映射和全局映射，都没有时使用客户端的默认模型或全局默认模型
+func (s *ProxyService) mapChatModel(requested string, header http.Header) string {
+	tenant := s.tenantModelsOf(header)
+	if mapped, ok := tenant.ChatModelMap[requested]; ok {
+		return mapped
+	}
+	if mapped, ok := s.cfg.ChatModelMap[requested]; ok {
+		return mapped
+	}
+	if "" != tenant.ChatModelDefault {
+		return tenant.ChatModelDefault
+	}
+
+	return s.cfg.ChatModelDefault
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// timingPhase是Server-Timing中的一个阶段
+type timingPhase struct {
+	name string
+	dur  time.Duration
+}
+
+// serverTiming记录请求各阶段耗时，在写响应头时输出Server-Timing
+type serverTiming struct {
+	phases []timingPhase
+	mark   time.Time
+}
+
+// newServerTiming创建serverTiming并替换c.Writer，保证任何路径写响应头前都带上已测得的阶段
+func newServerTiming(c *gin.Context) *serverTiming {
+	t := &serverTiming{mark: time.Now()}
+	c.Writer = &timingWriter{ResponseWriter: c.Writer, timing: t}
+
+	return t
+}
+
+// since返回距离上次标记的时间并重新标记
+func (t *serverTiming) since() time.Duration {
+	now := time.Now()
+	d := now.Sub(t.mark)
+	t.mark = now
+
+	return d
+}
+
+// add记录一个阶段的耗时
+func (t *serverTiming) add(name string, d time.Duration) {
+	t.phases = append(t.phases, timingPhase{name: name, dur: d})
+}
+
+// String返回Server-Timing头的值
+func (t *serverTiming) String() string {
+	parts := make([]string, 0, len(t.phases))
+	for _, p := range t.phases {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.1f", p.name, float64(p.dur.Microseconds())/1000))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// declareTrailer声明Server-Timing trailer，必须在写响应体之前调用
+func (t *serverTiming) declareTrailer(c *gin.Context) {
+	c.Header("Trailer", "Server-Timing")
+}
+
+// trailer在响应体写完后以trailer的形式输出包含转发耗时的完整Server-Timing
+func (t *serverTiming) trailer(c *gin.Context) {
+	c.Writer.Header().Set("Server-Timing", t.String())
+}
+
+// timingWriter在第一次写响应头前设置Server-Timing
+type timingWriter struct {
+	gin.ResponseWriter
+	timing *serverTiming
+}
+
+func (w *timingWriter) setHeader() {
+	if !w.Written() && len(w.timing.phases) > 0 {
+		w.Header().Set("Server-Timing", w.timing.String())
+	}
+}
+
+func (w *timingWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *timingWriter) Write(data []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *timingWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *timingWriter) Flush() {
+	w.setHeader()
+	w.ResponseWriter.Flush()
+}
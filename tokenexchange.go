@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// defaultTokenTTL是换取的令牌响应中没有过期时间时的有效期
+const defaultTokenTTL = 5 * time.Minute
+
+// tokenRefreshMargin是令牌过期之前提前换取新令牌的最长时间
+const tokenRefreshMargin = time.Minute
+
+// tokenExchange是用长期凭据换取短期令牌的配置，换取的令牌作为Bearer用于Chat上游
+type tokenExchange struct {
+	Url            string `json:"url"`             // 换取令牌的地址
+	Method         string `json:"method"`          // 请求方法，默认GET，配置了body时默认POST
+	Body           string `json:"body"`            // 请求体，支持${ENV}
+	ContentType    string `json:"content_type"`    // 请求体的类型，默认application/json
+	Credential     string `json:"credential"`      // 长期凭据，支持${ENV}
+	CredentialFile string `json:"credential_file"` // 从文件读取长期凭据，与credential二选一
+	AuthScheme     string `json:"auth_scheme"`     // Authorization中凭据的前缀，默认Bearer，GitHub为token
+	TokenPath      string `json:"token_path"`      // 令牌在响应中的路径，默认token
+	ExpiresPath    string `json:"expires_path"`    // 过期时间在响应中的路径，默认expires_at，值可以是Unix时间戳、剩余秒数或RFC3339时间
+}
+
+// tokenSource缓存换取的令牌，过期之前重新换取
+type tokenSource struct {
+	cfg        *tokenExchange
+	credential string
+	client     *http.Client
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+// newTokenSource创建tokenSource，未配置chat_token_exchange时返回nil。换取令牌使用client，与上游请求的代理和超时一致
+func newTokenSource(cfg *config, client *http.Client) (*tokenSource, error) {
+	exchange := cfg.ChatTokenExchange
+	if nil == exchange {
+		return nil, nil
+	}
+	if "" == exchange.Url {
+		return nil, errors.New("chat_token_exchange: url is required")
+	}
+
+	t := &tokenSource{cfg: exchange, client: client}
+	switch {
+	case "" != exchange.Credential && "" != exchange.CredentialFile:
+		return nil, errors.New("chat_token_exchange: credential and credential_file are mutually exclusive")
+	case "" != exchange.CredentialFile:
+		content, err := os.ReadFile(exchange.CredentialFile)
+		if nil != err {
+			return nil, fmt.Errorf("chat_token_exchange: %w", err)
+		}
+		t.credential = strings.TrimSpace(string(content))
+	default:
+		t.credential = os.ExpandEnv(exchange.Credential)
+	}
+	if "" == t.credential {
+		return nil, errors.New("chat_token_exchange: credential is empty")
+	}
+
+	return t, nil
+}
+
+// get返回有效的令牌。stale是上游拒绝的令牌，缓存的仍是它时强制重新换取；
+// 其他请求已经换取了新令牌时直接使用，不会重复换取
+func (t *tokenSource) get(ctx context.Context, stale string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if "" != t.token && t.token != stale && time.Now().Before(t.refreshAt) {
+		return t.token, nil
+	}
+	if err := t.exchange(ctx); nil != err {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+
+	return t.token, nil
+}
+
+// exchange用长期凭据换取令牌，调用方需持有锁
+func (t *tokenSource) exchange(ctx context.Context) error {
+	method := t.cfg.Method
+	var body io.Reader
+	if "" != t.cfg.Body {
+		body = strings.NewReader(os.ExpandEnv(t.cfg.Body))
+		if "" == method {
+			method = http.MethodPost
+		}
+	}
+	if "" == method {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, t.cfg.Url, body)
+	if nil != err {
+		return err
+	}
+	scheme := t.cfg.AuthScheme
+	if "" == scheme {
+		scheme = "Bearer"
+	}
+	req.Header.Set("Authorization", scheme+" "+t.credential)
+	req.Header.Set("Accept", "application/json")
+	if nil != body {
+		contentType := t.cfg.ContentType
+		if "" == contentType {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := t.client.Do(req)
+	if nil != err {
+		return err
+	}
+	defer closeIO(resp.Body)
+
+	content, err := io.ReadAll(resp.Body)
+	if nil != err {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	tokenPath, expiresPath := t.cfg.TokenPath, t.cfg.ExpiresPath
+	if "" == tokenPath {
+		tokenPath = "token"
+	}
+	if "" == expiresPath {
+		expiresPath = "expires_at"
+	}
+	token := gjson.GetBytes(content, tokenPath).String()
+	if "" == token {
+		return fmt.Errorf("no token at %s", tokenPath)
+	}
+
+	expires := parseExpiry(gjson.GetBytes(content, expiresPath))
+	ttl := time.Until(expires)
+	t.token = token
+	t.refreshAt = expires.Add(-max(0, min(tokenRefreshMargin, ttl/5)))
+	log.Printf("chat token exchanged, expires in %s\n", ttl.Round(time.Second))
+
+	return nil
+}
+
+// parseExpiry解析令牌的过期时间：大于10^9的数字为Unix时间戳，其他数字为剩余秒数，字符串为RFC3339时间，无法解析时使用defaultTokenTTL
+func parseExpiry(value gjson.Result) time.Time {
+	now := time.Now()
+	if gjson.String == value.Type {
+		if expires, err := time.Parse(time.RFC3339, value.String()); nil == err {
+			return expires
+		}
+		if number, err := strconv.ParseFloat(value.String(), 64); nil == err {
+			value = gjson.Result{Type: gjson.Number, Num: number}
+		}
+	}
+	if gjson.Number == value.Type && value.Num > 0 {
+		if value.Num > 1e9 {
+			return time.Unix(int64(value.Num), 0)
+		}
+		return now.Add(time.Duration(value.Num * float64(time.Second)))
+	}
+
+	return now.Add(defaultTokenTTL)
+}
+
+// doWithToken使用换取的令牌发送上游请求，上游返回401时强制换取一次新令牌并重试
+func (s *ProxyService) doWithToken(ctx context.Context, target *upstreamTarget, body []byte) (*http.Response, error) {
+	stale := ""
+	for {
+		token, err := target.tokens.get(ctx, stale)
+		if nil != err {
+			return nil, err
+		}
+		req, err := target.newRequest(ctx, body, token)
+		if nil != err {
+			return nil, err
+		}
+
+		resp, err := s.send(req)
+		if nil != err || resp.StatusCode != http.StatusUnauthorized || "" != stale {
+			return resp, err
+		}
+
+		closeIO(resp.Body)
+		log.Printf("%s rejected the exchanged token, refreshing\n", s.label(target.name))
+		stale = token
+	}
+}
+
+// credential返回上游请求使用的密钥或换取的令牌，用于不需要换密钥重试的请求
+func (t *upstreamTarget) credential(ctx context.Context) (string, error) {
+	if nil != t.tokens {
+		return t.tokens.get(ctx, "")
+	}
+
+	return t.keys.current(), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	tiktoken "github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/tidwall/gjson"
+)
+
+// 未配置token_chars_per_token时估算Token数使用的每Token字符数
+const defaultCharsPerToken = 4
+
+func init() {
+	// 使用内置的词表，不在运行时下载
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// tokenizer按模型计算Token数，OpenAI模型使用内置的tiktoken词表，其他模型按字符数估算
+type tokenizer struct {
+	charsPerToken float64
+
+	mu        sync.Mutex
+	encodings map[string]*tiktoken.Tiktoken // 按编码名缓存，加载词表较慢
+}
+
+// newTokenizer创建tokenizer
+func newTokenizer(cfg *config) *tokenizer {
+	charsPerToken := cfg.TokenCharsPerToken
+	if charsPerToken <= 0 {
+		charsPerToken = defaultCharsPerToken
+	}
+
+	return &tokenizer{charsPerToken: charsPerToken, encodings: make(map[string]*tiktoken.Tiktoken)}
+}
+
+// encodingName返回模型使用的tiktoken编码，未知模型返回空字符串
+func encodingName(model string) string {
+	if name, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return name
+	}
+	for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// encoding返回模型对应的编码，未知模型返回nil
+func (t *tokenizer) encoding(model string) *tiktoken.Tiktoken {
+	name := encodingName(model)
+	if "" == name {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if enc, ok := t.encodings[name]; ok {
+		return enc
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if nil != err {
+		return nil
+	}
+	t.encodings[name] = enc
+
+	return enc
+}
+
+// count返回文本的Token数，第二个返回值表示是否为估算
+func (t *tokenizer) count(model string, text string) (int, bool) {
+	if enc := t.encoding(model); nil != enc {
+		return len(enc.EncodeOrdinary(text)), false
+	}
+
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / t.charsPerToken)), true
+}
+
+// countChat按OpenAI的计算方法返回聊天请求的prompt Token数：每条消息额外3个Token，
+// 有name时再加1个，最后加上回复开头的3个Token。图片等非文本内容不计入
+func (t *tokenizer) countChat(model string, body []byte) (int, bool) {
+	total := 3
+	estimated := false
+	add := func(text string) {
+		if "" == text {
+			return
+		}
+		n, approx := t.count(model, text)
+		total += n
+		estimated = estimated || approx
+	}
+
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		total += 3
+		add(message.Get("role").String())
+		if name := message.Get("name"); name.Exists() {
+			total++
+			add(name.String())
+		}
+
+		content := message.Get("content")
+		if content.IsArray() {
+			for _, part := range content.Array() {
+				add(part.Get("text").String())
+			}
+		} else {
+			add(content.String())
+		}
+		for _, call := range message.Get("tool_calls").Array() {
+			add(call.Get("function.name").String())
+			add(call.Get("function.arguments").String())
+		}
+	}
+
+	// 工具定义没有公开的计算方法，按JSON文本计算
+	if tools := gjson.GetBytes(body, "tools"); tools.Exists() {
+		add(tools.Raw)
+	}
+
+	return total, estimated
+}
+
+// tokenCount处理/v1/token_count请求，按completions相同的转换计算请求将消耗的prompt Token数，不发送请求
+func (s *ProxyService) tokenCount(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	if !json.Valid(body) {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "request body is not valid JSON")
+		return
+	}
+	if 0 == len(gjson.GetBytes(body, "messages").Array()) {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "messages must be a non-empty array")
+		return
+	}
+
+	var model string
+	if !s.guardTransform(c, "token_count", body, func() {
+		body, _, model = s.transformChat(body, c.Request.Header, s.requestFeatures(c))
+	}) {
+		return
+	}
+	tokens, estimated := s.tokenizer.countChat(model, body)
+
+	c.JSON(http.StatusOK, gin.H{
+		"model":         model,
+		"prompt_tokens": tokens,
+		"estimated":     estimated,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestTokenizerCount检查OpenAI模型使用tiktoken词表计算，其他模型按每Token字符数估算
+func TestTokenizerCount(t *testing.T) {
+	tests := []struct {
+		model         string
+		charsPerToken float64
+		text          string
+		want          int
+		estimated     bool
+	}{
+		// OpenAI cookbook中的例子：cl100k_base编码为t、ik、token、 is、 great、!
+		{"gpt-4", 0, "tiktoken is great!", 6, false},
+		{"gpt-3.5-turbo-0125", 0, "tiktoken is great!", 6, false},
+		{"gpt-4o", 0, "hello world", 2, false},
+		// 默认每Token 4个字符，不足一个Token的部分向上取整，按字符而不是字节计算
+		{"claude-3-5-sonnet", 0, "abcdefghij", 3, true},
+		{"deepseek-chat", 0, "你好世界", 1, true},
+		{"deepseek-chat", 2, "abcdefghij", 5, true},
+		{"deepseek-chat", 0, "", 0, true},
+	}
+	for _, tt := range tests {
+		tk := newTokenizer(&config{TokenCharsPerToken: tt.charsPerToken})
+		if n, estimated := tk.count(tt.model, tt.text); tt.want != n || tt.estimated != estimated {
+			t.Errorf("count(%s, %q) = %d, %v, want %d, %v", tt.model, tt.text, n, estimated, tt.want, tt.estimated)
+		}
+	}
+}
+
+// TestTokenizerCountChat检查每条消息的3个Token、name的1个Token和回复开头的3个Token。
+// 每Token 1个字符时文本的Token数就是字符数
+func TestTokenizerCountChat(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		want      int
+		estimated bool
+	}{
+		// 没有需要计算的文本，不是估算
+		{"no messages", `{"messages":[]}`, 3, false},
+		// 3 + 3 + user(4) + hi(2)
+		{"one message", `{"messages":[{"role":"user","content":"hi"}]}`, 12, true},
+		// 12 + 1 + bob(3)
+		{"name", `{"messages":[{"role":"user","name":"bob","content":"hi"}]}`, 16, true},
+		// 3 + (3 + system(6) + be brief(8)) + (3 + user(4) + hi(2))
+		{"two messages", `{"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`, 29, true},
+		// 文本部分计入，图片不计入：3 + 3 + user(4) + ab(2) + cd(2)
+		{"content parts", `{"messages":[{"role":"user","content":[{"type":"text","text":"ab"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}},{"type":"text","text":"cd"}]}]}`, 14, true},
+		// 3 + 3 + assistant(9) + f(1) + {}(2)
+		{"tool calls", `{"messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]}]}`, 18, true},
+	}
+	tk := newTokenizer(&config{TokenCharsPerToken: 1})
+	for _, tt := range tests {
+		if n, estimated := tk.countChat("unknown-model", []byte(tt.body)); tt.want != n || tt.estimated != estimated {
+			t.Errorf("%s: countChat = %d, %v, want %d, %v", tt.name, n, estimated, tt.want, tt.estimated)
+		}
+	}
+
+	// tiktoken计算的结果不是估算
+	if n, estimated := newTokenizer(&config{}).countChat("gpt-4", []byte(`{"messages":[{"role":"user","content":"tiktoken is great!"}]}`)); 3+3+1+6 != n || estimated {
+		t.Errorf("countChat(gpt-4) = %d, %v, want 13 exact", n, estimated)
+	}
+}
+
+// TestTokenCountEndpoint检查/v1/token_count按模型映射后的模型计算，messages为空时返回400。
+// 请求关闭回复语言的说明，Token数只包含请求中的消息
+func TestTokenCountEndpoint(t *testing.T) {
+	cfg := &config{ChatModelDefault: "deepseek-chat", ChatModelMap: map[string]string{"my-model": "gpt-4"}, TokenCharsPerToken: 1}
+	_, proxy := newTestProxy(t, cfg, "http://127.0.0.1:1")
+	header := map[string]string{featuresHeader: featureNoLocale}
+
+	tests := []struct {
+		name      string
+		body      string
+		status    int
+		model     string
+		tokens    int
+		estimated bool
+	}{
+		{"mapped to gpt-4", `{"model":"my-model","messages":[{"role":"user","content":"tiktoken is great!"}]}`, http.StatusOK, "gpt-4", 13, false},
+		{"default model", `{"model":"other-model","messages":[{"role":"user","content":"hi"}]}`, http.StatusOK, "deepseek-chat", 12, true},
+		{"empty messages", `{"model":"my-model","messages":[]}`, http.StatusBadRequest, "", 0, false},
+		{"no messages", `{"model":"my-model"}`, http.StatusBadRequest, "", 0, false},
+		{"invalid json", `{"model":`, http.StatusBadRequest, "", 0, false},
+	}
+	for _, tt := range tests {
+		status, _, body := postTest(t, proxy, "/v1/token_count", tt.body, header)
+		if tt.status != status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, status, tt.status, body)
+			continue
+		}
+		if http.StatusOK != status {
+			continue
+		}
+
+		var result struct {
+			Model        string `json:"model"`
+			PromptTokens int    `json:"prompt_tokens"`
+			Estimated    bool   `json:"estimated"`
+		}
+		if err := json.Unmarshal([]byte(body), &result); nil != err {
+			t.Fatalf("%s: %v: %s", tt.name, err, body)
+		}
+		if tt.model != result.Model || tt.tokens != result.PromptTokens || tt.estimated != result.Estimated {
+			t.Errorf("%s: got %+v, want model %s, %d tokens, estimated %v", tt.name, result, tt.model, tt.tokens, tt.estimated)
+		}
+	}
+}
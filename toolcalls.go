@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"override/internal/sse"
+)
+
+// newToolCallId生成工具调用的id，用于上游没有返回id的调用
+func newToolCallId() string {
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return "call_" + hex.EncodeToString(buf)
+}
+
+// toolCallState是流式响应中一个choice的工具调用状态
+type toolCallState struct {
+	ids   []string // 各工具调用的id，下标为index
+	last  int      // 上一个增量所属的index，-1表示还没有
+	first int      // 第一个工具调用的index，只保留一个调用时使用，-1表示还没有
+}
+
+// toolCallFilter统一流式响应中的工具调用增量：补上缺少的index，保证同一调用的各增量id相同，
+// sequential时只保留每个choice的第一个工具调用，客户端执行后模型会再发起下一个调用
+type toolCallFilter struct {
+	events     *sse.Reader
+	sequential bool
+	choices    map[int64]*toolCallState
+	pending    []byte
+}
+
+// newToolCallFilter创建toolCallFilter
+func newToolCallFilter(src io.Reader, sequential bool) *toolCallFilter {
+	return &toolCallFilter{events: sse.NewReader(src), sequential: sequential, choices: make(map[int64]*toolCallState)}
+}
+
+// Read实现io.Reader，每次最多返回一个事件
+func (f *toolCallFilter) Read(p []byte) (int, error) {
+	if 0 == len(f.pending) {
+		event, err := f.events.Next()
+		if nil != err {
+			return 0, err
+		}
+		if !event.Done() && bytes.Contains(event.Data, []byte(`"tool_calls"`)) {
+			if normalized := f.normalize(event.Data); nil != normalized {
+				event.SetData(normalized)
+			}
+		}
+		f.pending = event.Raw
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+
+	return n, nil
+}
+
+// normalize改写一个事件中的工具调用增量，没有改动时返回nil
+func (f *toolCallFilter) normalize(data []byte) []byte {
+	var changed []byte
+	gjson.GetBytes(data, "choices").ForEach(func(i, choice gjson.Result) bool {
+		calls := choice.Get("delta.tool_calls")
+		if !calls.IsArray() {
+			return true
+		}
+
+		number := i.Int()
+		if index := choice.Get("index"); index.Exists() {
+			number = index.Int()
+		}
+		state, ok := f.choices[number]
+		if !ok {
+			state = &toolCallState{last: -1, first: -1}
+			f.choices[number] = state
+		}
+
+		modified := false
+		var kept []string
+		for _, call := range calls.Array() {
+			raw, index, fixed := state.normalizeCall(call)
+			modified = modified || fixed
+			if f.sequential && index != state.first {
+				modified = true
+				continue
+			}
+			kept = append(kept, raw)
+		}
+		if !modified {
+			return true
+		}
+
+		if nil == changed {
+			changed = data
+		}
+		path := "choices." + strconv.Itoa(int(i.Int())) + ".delta.tool_calls"
+		if 0 == len(kept) {
+			changed, _ = sjson.DeleteBytes(changed, path)
+		} else {
+			changed, _ = sjson.SetRawBytes(changed, path, []byte("["+strings.Join(kept, ",")+"]"))
+		}
+		return true
+	})
+
+	return changed
+}
+
+// normalizeCall补上一个增量的index和id，返回改写后的内容、所属的index和是否有改动。
+// 没有index时，带有新id或函数名的增量是新的调用，其他增量属于上一个调用
+func (state *toolCallState) normalizeCall(call gjson.Result) (string, int, bool) {
+	raw := call.Raw
+	id := call.Get("id").String()
+	fixed := false
+
+	index := state.last
+	if value := call.Get("index"); value.Exists() {
+		index = int(value.Int())
+	} else {
+		switch {
+		case "" != id:
+			index = len(state.ids)
+			for known, knownId := range state.ids {
+				if knownId == id {
+					index = known
+				}
+			}
+		case "" != call.Get("function.name").String() || index < 0:
+			index = len(state.ids)
+		}
+		raw, _ = sjson.Set(raw, "index", index)
+		fixed = true
+	}
+	state.last = index
+	if state.first < 0 {
+		state.first = index
+	}
+
+	for len(state.ids) <= index {
+		state.ids = append(state.ids, "")
+	}
+	switch {
+	case "" == state.ids[index]:
+		// 调用的第一个增量，没有id时生成一个
+		if "" == id {
+			id = newToolCallId()
+			raw, _ = sjson.Set(raw, "id", id)
+			fixed = true
+		}
+		state.ids[index] = id
+	case "" != id && id != state.ids[index]:
+		raw, _ = sjson.Set(raw, "id", state.ids[index])
+		fixed = true
+	}
+
+	return raw, index, fixed
+}
+
+// sequentialToolCalls在非流式响应中只保留每个choice的第一个工具调用，没有改动时返回nil
+func sequentialToolCalls(body []byte) []byte {
+	var changed []byte
+	gjson.GetBytes(body, "choices").ForEach(func(i, choice gjson.Result) bool {
+		calls := choice.Get("message.tool_calls").Array()
+		if len(calls) <= 1 {
+			return true
+		}
+
+		if nil == changed {
+			changed = body
+		}
+		changed, _ = sjson.SetRawBytes(changed, "choices."+strconv.Itoa(int(i.Int()))+".message.tool_calls", []byte("["+calls[0].Raw+"]"))
+		return true
+	})
+
+	return changed
+}
+
+// normalizeToolCalls统一聊天响应中的工具调用：流式响应补上缺少的index和id，
+// 上游配置了只保留一个工具调用时去掉其余的调用。非流式响应需要先读完，读取上游失败时返回错误
+func (s *ProxyService) normalizeToolCalls(target *upstreamTarget, contentType string, src io.Reader) (io.Reader, error) {
+	if isEventStream(contentType) {
+		return newToolCallFilter(src, target.sequential), nil
+	}
+	if !target.sequential || !strings.Contains(contentType, "json") {
+		return src, nil
+	}
+
+	body, err := io.ReadAll(src)
+	if nil != err {
+		return nil, err
+	}
+	if sequential := sequentialToolCalls(body); nil != sequential {
+		body = sequential
+	}
+	return bytes.NewReader(body), nil
+}
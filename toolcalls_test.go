@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tidwall/gjson"
+
+	"override/internal/sse"
+)
+
+// assembledCall是客户端按index拼接流式增量得到的一个工具调用
+type assembledCall struct {
+	Id        string
+	Name      string
+	Arguments string
+}
+
+// assembleToolCalls像客户端一样按index拼接流中的工具调用增量，检查每个增量都有index，
+// 每个调用的第一个增量带有id，之后的增量id不变
+func assembleToolCalls(t *testing.T, stream []byte) []assembledCall {
+	t.Helper()
+
+	var calls []assembledCall
+	reader := sse.NewReader(bytes.NewReader(stream))
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return calls
+		}
+		if nil != err {
+			t.Fatal(err)
+		}
+		if event.Done() {
+			continue
+		}
+		for _, call := range gjson.GetBytes(event.Data, "choices.0.delta.tool_calls").Array() {
+			index := call.Get("index")
+			if !index.Exists() {
+				t.Fatalf("delta without index: %s", call.Raw)
+			}
+			for len(calls) <= int(index.Int()) {
+				calls = append(calls, assembledCall{})
+			}
+			assembled := &calls[index.Int()]
+			id := call.Get("id").String()
+			switch {
+			case "" == assembled.Id && "" == id:
+				t.Fatalf("first delta of call %d without id: %s", index.Int(), call.Raw)
+			case "" == assembled.Id:
+				assembled.Id = id
+			case "" != id && id != assembled.Id:
+				t.Fatalf("call %d id changed from %s to %s", index.Int(), assembled.Id, id)
+			}
+			assembled.Name += call.Get("function.name").String()
+			assembled.Arguments += call.Get("function.arguments").String()
+		}
+	}
+}
+
+// toolCallFixture读取testdata/toolcalls中抓取的上游流式响应
+func toolCallFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	stream, err := os.ReadFile("testdata/toolcalls/" + name)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+var toolCallFixtures = []struct {
+	file string
+	want []assembledCall // Id为空表示由代理生成
+}{
+	{
+		file: "openai_parallel.sse",
+		want: []assembledCall{
+			{Id: "call_Wz3dGm8qT1", Name: "get_weather", Arguments: `{"city": "Paris"}`},
+			{Id: "call_Hq7pLx2vN4", Name: "get_time", Arguments: `{"timezone": "Europe/Paris"}`},
+		},
+	},
+	{
+		file: "gateway_no_index.sse",
+		want: []assembledCall{
+			{Id: "call_read_7f2", Name: "read_file", Arguments: `{"path":"src/main.go"}`},
+			{Id: "call_list_9c1", Name: "list_dir", Arguments: `{"path":"src"}`},
+		},
+	},
+	{
+		file: "missing_ids.sse",
+		want: []assembledCall{
+			{Name: "search_code", Arguments: `{"query": "func relayStream", "limit": 5}`},
+		},
+	},
+}
+
+// checkAssembled比较拼接结果，want中Id为空时只检查生成的id格式
+func checkAssembled(t *testing.T, want []assembledCall, got []assembledCall) {
+	t.Helper()
+
+	if len(want) != len(got) {
+		t.Fatalf("calls = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		expected := want[i]
+		if "" == expected.Id {
+			if !strings.HasPrefix(got[i].Id, "call_") {
+				t.Errorf("call %d: generated id %q", i, got[i].Id)
+			}
+			expected.Id = got[i].Id
+		}
+		if expected != got[i] {
+			t.Errorf("call %d = %+v, want %+v", i, got[i], expected)
+		}
+	}
+}
+
+func TestToolCallFilterReplay(t *testing.T) {
+	for _, tt := range toolCallFixtures {
+		for _, sequential := range []bool{false, true} {
+			name := tt.file
+			if sequential {
+				name += "/sequential"
+			}
+			t.Run(name, func(t *testing.T) {
+				stream := toolCallFixture(t, tt.file)
+				// 一次读一个字节，模拟事件拆在多次读取中
+				out, err := io.ReadAll(newToolCallFilter(iotest.OneByteReader(bytes.NewReader(stream)), sequential))
+				if nil != err {
+					t.Fatal(err)
+				}
+
+				want := tt.want
+				if sequential {
+					want = want[:1]
+				}
+				checkAssembled(t, want, assembleToolCalls(t, out))
+				if !bytes.HasSuffix(out, []byte("data: [DONE]\n\n")) {
+					t.Errorf("stream does not end with [DONE]:\n%s", out)
+				}
+			})
+		}
+	}
+}
+
+// TestToolCallReplayThroughProxy用抓取的流作为上游响应，检查客户端收到的工具调用
+func TestToolCallReplayThroughProxy(t *testing.T) {
+	for _, tt := range toolCallFixtures {
+		t.Run(tt.file, func(t *testing.T) {
+			stream := toolCallFixture(t, tt.file)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = w.Write(stream)
+			}))
+			defer upstream.Close()
+
+			_, proxy := newTestProxy(t, nil, upstream.URL)
+			status, _, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"get_weather"}}]}`, nil)
+			if http.StatusOK != status {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			checkAssembled(t, tt.want, assembleToolCalls(t, []byte(body)))
+		})
+	}
+}
+
+// TestNormalizeToolCallsReadError检查只保留一个工具调用时，读取非流式响应失败会返回错误而不是不完整的响应
+func TestNormalizeToolCallsReadError(t *testing.T) {
+	broken := errors.New("connection reset")
+	src := io.MultiReader(strings.NewReader(`{"choices":[{"index":0,"message":{"tool_calls":[`), iotest.ErrReader(broken))
+	s := &ProxyService{}
+	if _, err := s.normalizeToolCalls(&upstreamTarget{sequential: true}, "application/json", src); !errors.Is(err, broken) {
+		t.Fatalf("err = %v, want %v", err, broken)
+	}
+}
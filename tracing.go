@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 服务在trace中的名称
+const serviceName = "override"
+
+// initTracing初始化OTLP HTTP导出器，未启用时返回空操作的关闭函数
+func initTracing(cfg *config) (func(context.Context) error, error) {
+	if !cfg.OtelEnabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// 未配置otel_endpoint时使用OTEL_EXPORTER_OTLP_ENDPOINT等标准环境变量
+	var opts []otlptracehttp.Option
+	if "" != cfg.OtelEndpoint {
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.OtelEndpoint))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if nil != err {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if nil != err {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// traceTransport为上游请求创建client span并注入traceparent
+func traceTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return "upstream " + r.Method + " " + r.URL.Host
+	}))
+}
+
+// annotateSpan把请求的模型、状态和用量写入当前的server span
+func annotateSpan(ctx context.Context, rec *usageRecord) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("override.endpoint", rec.Endpoint),
+		attribute.String("override.model", rec.Model),
+		attribute.String("override.mapped_model", rec.MappedModel),
+		attribute.String("override.upstream", rec.Upstream),
+		attribute.Int("override.status", rec.Status),
+		attribute.Int64("override.prompt_tokens", rec.PromptTokens),
+		attribute.Int64("override.completion_tokens", rec.CompletionTokens),
+	)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// 上游API类型
+const (
+	apiTypeOpenAI = "openai"
+	apiTypeAzure  = "azure"
+)
+
+// chatRoute是单个模型的上游配置，未填写的字段沿用全局的Chat配置
+type chatRoute struct {
+	Url     string            `json:"url"`      // 完整的请求地址
+	ApiKey  string            `json:"api_key"`  // 密钥
+	ApiType string            `json:"api_type"` // openai或azure
+	Headers map[string]string `json:"headers"`  // 额外的请求头
+
+	StreamOptions string   `json:"stream_options"`              // stream_options的处理方式：passthrough、strip或force
+	StripFields   []string `json:"strip_fields"`                // 在chat_strip_fields之外删除的字段，如不支持parallel_tool_calls的上游
+	Sequential    bool     `json:"force_sequential_tool_calls"` // 只保留响应中的第一个工具调用，用于不能正确并行调用工具的上游
+}
+
+// upstreamTarget描述一次上游请求的目标
+type upstreamTarget struct {
+	name          string            // 上游名称，用于日志和统计
+	route         string            // 命中的模型路由，为空表示使用全局配置
+	url           string            // 请求地址
+	keys          *keyPool          // 密钥
+	apiType       string            // 上游API类型
+	organization  string            // OpenAI-Organization
+	project       string            // OpenAI-Project
+	headers       map[string]string // 额外的请求头
+	streamOptions string            // stream_options的处理方式
+	backend       string            // 负载均衡选中的上游基础地址，未启用时为空
+	tokens        *tokenSource      // 换取的令牌，设置时代替keys
+	raw           bool              // 原样转发请求体，不处理stream_options
+	stripped      []string          // 能力探测发现上游不支持而删除的字段
+	sequential    bool              // 只保留响应中的第一个工具调用
+	accept        bool              // 按请求体的stream设置Accept请求头
+	forwarded     http.Header       // 按forward_headers转发的客户端请求头
+}
+
+// 默认的上游请求路径
+const defaultApiPath = "/chat/completions"
+
+// upstreamUrl拼接基础地址和路径，基础地址以#结尾时原样使用，不追加路径
+func upstreamUrl(base string, path string) string {
+	if strings.HasSuffix(base, "#") {
+		return strings.TrimSuffix(base, "#")
+	}
+	if "" == path {
+		path = defaultApiPath
+	}
+
+	// 基础地址中可能带有查询参数，路径需要拼接在查询参数之前
+	u, err := url.Parse(base)
+	if nil != err {
+		return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + strings.TrimLeft(path, "/")
+
+	return u.String()
+}
+
+// withQuery把配置的查询参数合并到地址中，参数值支持${ENV}形式的环境变量
+func withQuery(rawUrl string, params map[string]string) string {
+	if 0 == len(params) {
+		return rawUrl
+	}
+
+	u, err := url.Parse(rawUrl)
+	if nil != err {
+		return rawUrl
+	}
+
+	query := u.Query()
+	for name, value := range params {
+		query.Set(name, os.ExpandEnv(value))
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// logUpstreams在启动时输出最终使用的上游地址和未配置的端点
+func (s *ProxyService) logUpstreams() {
+	if "" == s.cfg.ChatApiBase && nil == s.backends {
+		log.Printf("%s upstream: disabled (chat_api_base is empty), requests return 503\n", s.label("chat"))
+	} else {
+		log.Printf("%s upstream: %s\n", s.label("chat"), redactUrl(s.chatTarget("").url))
+	}
+	if "" == s.cfg.CodexApiBase {
+		log.Printf("%s upstream: disabled (codex_api_base is empty), completions return empty results\n", s.label("codex"))
+	} else if len(s.inherited) > 0 {
+		log.Printf("%s upstream: %s (%s inherited from chat)\n", s.label("codex"), redactUrl(s.codexTarget().url), strings.Join(s.inherited, ", "))
+	} else {
+		log.Printf("%s upstream: %s\n", s.label("codex"), redactUrl(s.codexTarget().url))
+	}
+	for _, model := range sortedKeys(s.cfg.ChatModelRoutes) {
+		log.Printf("%s upstream for %s: %s\n", s.label("chat"), model, redactUrl(s.chatTarget(model).url))
+	}
+}
+
+// chatDisabled返回聊天请求是否没有可用的上游：没有配置chat_api_base和chat_api_bases，模型路由也没有单独的地址
+func (s *ProxyService) chatDisabled(target *upstreamTarget) bool {
+	if "" != s.cfg.ChatApiBase || "" != target.backend {
+		return false
+	}
+	if route, ok := s.cfg.ChatModelRoutes[target.route]; ok && "" != route.Url {
+		return false
+	}
+
+	return true
+}
+
+// checkApiType校验上游API类型
+func checkApiType(apiType string) error {
+	switch apiType {
+	case "", apiTypeOpenAI, apiTypeAzure:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported api_type: %s", apiType)
+}
+
+// newRouteKeys为配置了api_key的模型路由创建密钥池
+func newRouteKeys(cfg *config) (map[string]*keyPool, error) {
+	pools := make(map[string]*keyPool)
+	for model, route := range cfg.ChatModelRoutes {
+		if err := checkApiType(route.ApiType); nil != err {
+			return nil, fmt.Errorf("chat_model_routes.%s: %w", model, err)
+		}
+		if err := checkStreamOptions("stream_options", route.StreamOptions); nil != err {
+			return nil, fmt.Errorf("chat_model_routes.%s: %w", model, err)
+		}
+
+		if "" != route.ApiKey {
+			pools[model] = newKeyPool("chat:"+model, route.ApiKey, nil, cfg.BadKeyCooldown)
+		}
+	}
+
+	return pools, nil
+}
+
+// chatTarget返回映射后的模型对应的Chat上游
+func (s *ProxyService) chatTarget(model string) *upstreamTarget {
+	target := &upstreamTarget{
+		name:          "chat",
+		url:           upstreamUrl(s.cfg.ChatApiBase, s.cfg.ChatApiPath),
+		keys:          s.chatKeys,
+		organization:  s.cfg.ChatApiOrganization,
+		project:       s.cfg.ChatApiProject,
+		apiType:       s.cfg.ChatApiType,
+		streamOptions: s.cfg.ChatStreamOptions,
+		tokens:        s.tokens,
+		raw:           s.cfg.ChatRawPassthrough,
+		sequential:    s.cfg.ChatSequentialTools,
+		accept:        !s.cfg.AcceptHeaderDisabled,
+	}
+
+	route, ok := s.cfg.ChatModelRoutes[model]
+	if !ok {
+		target.url = withQuery(target.url, s.cfg.ChatQueryParams)
+		s.applyCapabilities(target)
+		return target
+	}
+
+	target.name = "chat:" + model
+	target.route = model
+	if "" != route.ApiType {
+		target.apiType = route.ApiType
+	}
+	target.headers = route.Headers
+	if "" != route.StreamOptions {
+		target.streamOptions = route.StreamOptions
+	}
+	if route.Sequential {
+		target.sequential = true
+	}
+	if "" != route.Url {
+		target.url = route.Url
+	}
+	if pool, ok := s.routeKeys[model]; ok {
+		target.keys = pool
+		target.tokens = nil
+	}
+	target.url = withQuery(target.url, s.cfg.ChatQueryParams)
+	s.applyCapabilities(target)
+
+	return target
+}
+
+// codexTarget返回Codex上游
+func (s *ProxyService) codexTarget() *upstreamTarget {
+	target := &upstreamTarget{
+		name:          "codex",
+		url:           withQuery(upstreamUrl(s.cfg.CodexApiBase, s.cfg.CodexApiPath), s.cfg.CodexQueryParams),
+		keys:          s.codexKeys,
+		organization:  s.cfg.CodexApiOrganization,
+		project:       s.cfg.CodexApiProject,
+		streamOptions: s.cfg.CodexStreamOptions,
+		raw:           s.cfg.CodexRawPassthrough,
+		accept:        !s.cfg.AcceptHeaderDisabled,
+	}
+	s.applyCapabilities(target)
+
+	return target
+}
+
+// inheritChat在开启codex_inherit_chat时用Chat的地址、密钥、组织和项目补上Codex未配置的对应项，返回继承的配置项。
+// chat_api_base是Azure或以#结尾的完整地址时不能用于代码补全，需要单独配置codex_api_base
+func inheritChat(cfg *config) ([]string, error) {
+	if !cfg.CodexInheritChat {
+		return nil, nil
+	}
+
+	var inherited []string
+	if "" == cfg.CodexApiBase && "" != cfg.ChatApiBase {
+		if apiTypeAzure == cfg.ChatApiType || strings.HasSuffix(cfg.ChatApiBase, "#") {
+			return nil, errors.New("codex_inherit_chat: chat_api_base is a full or azure url, set codex_api_base instead")
+		}
+		cfg.CodexApiBase = cfg.ChatApiBase
+		inherited = append(inherited, "codex_api_base")
+	}
+	if "" == cfg.CodexApiKey && 0 == len(cfg.CodexApiKeys) && ("" != cfg.ChatApiKey || len(cfg.ChatApiKeys) > 0) {
+		cfg.CodexApiKey, cfg.CodexApiKeys = cfg.ChatApiKey, cfg.ChatApiKeys
+		inherited = append(inherited, "codex_api_key")
+	}
+	if "" == cfg.CodexApiOrganization && "" != cfg.ChatApiOrganization {
+		cfg.CodexApiOrganization = cfg.ChatApiOrganization
+		inherited = append(inherited, "codex_api_organization")
+	}
+	if "" == cfg.CodexApiProject && "" != cfg.ChatApiProject {
+		cfg.CodexApiProject = cfg.ChatApiProject
+		inherited = append(inherited, "codex_api_project")
+	}
+
+	return inherited, nil
+}
+
+// newRequest构建发往上游的请求
+func (t *upstreamTarget) newRequest(ctx context.Context, body []byte, key string) (*http.Request, error) {
+	if !t.raw {
+		body = t.withStreamOptions(body)
+		body = stripFields(body, t.stripped)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if nil != err {
+		return nil, err
+	}
+	// 明确设置长度和GetBody：不使用chunked上传，连接收到GOAWAY或被重置时net/http可以重新发送请求体
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	// 设置请求头。部分上游按Accept决定响应格式，按stream设置，不沿用客户端的值
+	req.Header.Set("Content-Type", "application/json")
+	if t.accept {
+		if gjson.GetBytes(body, "stream").Bool() {
+			req.Header.Set("Accept", "text/event-stream")
+		} else {
+			req.Header.Set("Accept", "application/json")
+		}
+	}
+	t.setHeaders(req, key)
+
+	return req, nil
+}
+
+// setHeaders设置密钥和上游需要的请求头，转发的客户端请求头不能覆盖它们
+func (t *upstreamTarget) setHeaders(req *http.Request, key string) {
+	for name, values := range t.forwarded {
+		req.Header[name] = values
+	}
+	if apiTypeAzure == t.apiType {
+		req.Header.Set("api-key", key)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	if "" != t.organization {
+		req.Header.Set("OpenAI-Organization", t.organization)
+	}
+	if "" != t.project {
+		req.Header.Set("OpenAI-Project", t.project)
+	}
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+}
+
+// doUpstream发送上游请求，上游以401/403拒绝密钥时停用该密钥并换下一个密钥重试
+func (s *ProxyService) doUpstream(ctx context.Context, target *upstreamTarget, body []byte) (*http.Response, error) {
+	if nil != target.tokens {
+		return s.doWithToken(ctx, target, body)
+	}
+
+	for attempt := 1; ; attempt++ {
+		key := target.keys.pick()
+		req, err := target.newRequest(ctx, body, key)
+		if nil != err {
+			return nil, err
+		}
+
+		resp, err := s.send(req)
+		if nil != err {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			return resp, nil
+		}
+
+		// 此时还没有向客户端写入任何内容，可以安全地换密钥重试
+		s.keyRejected(target.keys, key, resp.StatusCode)
+		if attempt >= target.keys.size() {
+			return resp, nil
+		}
+		closeIO(resp.Body)
+	}
+}
+
+// 上游请求使用Expect: 100-continue的默认阈值和等待时间
+const (
+	defaultExpectContinueSize = 1 << 20
+	expectContinueTimeout     = time.Second
+)
+
+// expectContinue在开启upstream_expect_continue且请求体超过阈值时为请求加上Expect: 100-continue。
+// 请求体由GetBody提供，上游拒绝后重试或换密钥时仍能重新发送
+func (s *ProxyService) expectContinue(req *http.Request) {
+	if !s.cfg.ExpectContinue || nil == req.GetBody {
+		return
+	}
+
+	size := s.cfg.ExpectContinueSize
+	if size <= 0 {
+		size = defaultExpectContinueSize
+	}
+	if req.ContentLength > int64(size) {
+		req.Header.Set("Expect", "100-continue")
+	}
+}
+
+// errTTFBTimeout表示上游在upstream_ttfb_timeout_seconds内没有返回响应头
+var errTTFBTimeout = errors.New("upstream did not send response headers within upstream_ttfb_timeout_seconds")
+
+// cancelBody在关闭响应体时取消对应的请求，释放请求的context
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close实现io.Closer
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// headerTimedOut返回err是否是transport的ResponseHeaderTimeout：它与send中的计时器时长相同，可能先触发。
+// 超时错误不是来自上层context，也不是整体的timeout时只能是等待响应头超时
+func (s *ProxyService) headerTimedOut(req *http.Request, err error, elapsed time.Duration) bool {
+	if !errors.Is(err, context.DeadlineExceeded) || nil != req.Context().Err() {
+		return false
+	}
+	return 0 == s.client.Timeout || elapsed < s.client.Timeout
+}
+
+// send发送上游请求，配置了upstream_ttfb_timeout_seconds时只限制等待响应头的时间，不影响之后的流式响应
+func (s *ProxyService) send(req *http.Request) (*http.Response, error) {
+	s.expectContinue(req)
+
+	seconds := s.cfg.UpstreamTTFBTimeout
+	if seconds <= 0 {
+		return s.client.Do(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+		cancel(errTTFBTimeout)
+	})
+
+	start := time.Now()
+	resp, err := s.client.Do(req.WithContext(ctx))
+	timer.Stop()
+	if errors.Is(context.Cause(ctx), errTTFBTimeout) || s.headerTimedOut(req, err, time.Since(start)) {
+		cancel(errTTFBTimeout)
+		if nil == err {
+			closeIO(resp.Body)
+		}
+		return nil, fmt.Errorf("%w (%ds)", errTTFBTimeout, seconds)
+	}
+	if nil != err {
+		cancel(nil)
+		return nil, err
+	}
+
+	// 响应体关闭时释放context，流式响应期间计时器已经停止
+	resp.Body = cancelBody{resp.Body, func() { cancel(nil) }}
+	return resp, nil
+}
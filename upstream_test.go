@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestUpstreamTTFBTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	_, proxy := newTestProxy(t, &config{Timeout: 60, UpstreamTTFBTimeout: 1}, upstream.URL)
+	start := time.Now()
+	status, _, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, nil)
+	if http.StatusGatewayTimeout != status {
+		t.Fatalf("status = %d, want %d: %s", status, http.StatusGatewayTimeout, body)
+	}
+	if !strings.Contains(body, "upstream_ttfb_timeout_seconds") {
+		t.Errorf("error does not name the timeout that fired: %s", body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %s, want about 1s", elapsed)
+	}
+}
+
+// TestUpstreamTTFBTimeoutStream检查收到响应头之后，流式响应的时长不受upstream_ttfb_timeout_seconds限制
+func TestUpstreamTTFBTimeoutStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			_, _ = w.Write([]byte("data: {\"id\":\"chatcmpl-1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"x\"}}]}\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(600 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer upstream.Close()
+
+	_, proxy := newTestProxy(t, &config{Timeout: 60, UpstreamTTFBTimeout: 1}, upstream.URL)
+	status, _, body := postTest(t, proxy, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	if http.StatusOK != status || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Fatalf("status = %d, stream cut short: %q", status, body)
+	}
+}
+
+// TestNewRequestReplayable检查上游请求带有Content-Length，GetBody可以多次取得同样的请求体
+func TestNewRequestReplayable(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	target := &upstreamTarget{url: "http://127.0.0.1:1/v1/chat/completions", keys: newKeyPool("chat", "sk-test", nil, 0)}
+	req, err := target.newRequest(context.Background(), body, "sk-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if int64(len(body)) != req.ContentLength {
+		t.Fatalf("ContentLength = %d, want %d", req.ContentLength, len(body))
+	}
+	for i := 0; i < 2; i++ {
+		replay, err := req.GetBody()
+		if nil != err {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(replay)
+		if !bytes.Equal(body, content) {
+			t.Fatalf("GetBody #%d = %s, want %s", i+1, content, body)
+		}
+	}
+}
+
+// serveRefusingH2处理一个HTTP/2连接：第一个请求读完请求体后以REFUSED_STREAM拒绝，之后的请求返回response。
+// 每个请求收到的请求体依次发送到bodies
+func serveRefusingH2(conn net.Conn, response string, bodies chan<- string) {
+	defer func() { _ = conn.Close() }()
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); nil != err {
+		return
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); nil != err {
+		return
+	}
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	received := make(map[uint32]*bytes.Buffer)
+	refused := false
+	for {
+		frame, err := framer.ReadFrame()
+		if nil != err {
+			return
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				_ = framer.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			received[f.StreamID] = &bytes.Buffer{}
+		case *http2.DataFrame:
+			// 归还连接的流量窗口，重新发送的请求体不会被阻塞
+			received[f.StreamID].Write(f.Data())
+			if len(f.Data()) > 0 {
+				_ = framer.WriteWindowUpdate(0, uint32(len(f.Data())))
+			}
+			if !f.StreamEnded() {
+				continue
+			}
+			bodies <- received[f.StreamID].String()
+			if !refused {
+				refused = true
+				_ = framer.WriteRSTStream(f.StreamID, http2.ErrCodeRefusedStream)
+				continue
+			}
+			block.Reset()
+			_ = encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			_ = encoder.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/json"})
+			_ = framer.WriteHeaders(http2.HeadersFrameParam{StreamID: f.StreamID, BlockFragment: block.Bytes(), EndHeaders: true})
+			_ = framer.WriteData(f.StreamID, true, []byte(response))
+		}
+	}
+}
+
+// countingTransport记录代理发出的上游请求数
+type countingTransport struct {
+	base  http.RoundTripper
+	calls atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls.Add(1)
+	return t.base.RoundTrip(req)
+}
+
+// TestTransportReplaysBody检查上游在返回响应头之前拒绝HTTP/2请求（REFUSED_STREAM，上游没有处理请求）时，
+// net/http在同一次代理请求内通过GetBody重新发送完整的请求体，代理不需要自己重试
+func TestTransportReplaysBody(t *testing.T) {
+	response := `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`
+	bodies := make(chan string, 4)
+	upstream := httptest.NewUnstartedServer(http.NotFoundHandler())
+	upstream.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	upstream.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		"h2": func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+			serveRefusingH2(conn, response, bodies)
+		},
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	s, proxy := newTestProxy(t, nil, upstream.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	s.client.Transport.(*headerTransport).base.(*http.Transport).TLSClientConfig.RootCAs = roots
+	counting := &countingTransport{base: s.client.Transport}
+	s.client.Transport = counting
+
+	// 请求体超过一个DATA帧（16KB），重新发送时需要从头读取
+	request := `{"model":"gpt-4o","messages":[{"role":"user","content":` + jsonString(strings.Repeat("func main() {}\n", 2500)) + `}]}`
+	status, _, body := postTest(t, proxy, "/v1/chat/completions", request, map[string]string{featuresHeader: featureNoLocale})
+	if http.StatusOK != status || !strings.Contains(body, `"content":"ok"`) {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	if calls := counting.calls.Load(); 1 != calls {
+		t.Fatalf("proxy sent %d upstream requests, want 1", calls)
+	}
+	close(bodies)
+	var received []string
+	for body := range bodies {
+		received = append(received, body)
+	}
+	if 2 != len(received) {
+		t.Fatalf("upstream got %d requests, want the refused one and the replay", len(received))
+	}
+	if received[0] != received[1] || len(received[1]) < 16<<10 {
+		t.Fatalf("replayed body differs or is truncated: %d vs %d bytes", len(received[0]), len(received[1]))
+	}
+}
+
+// TestExpectContinueReplaysBody检查开启upstream_expect_continue后，上游不读请求体就以401拒绝密钥时不上传请求体，
+// 换密钥重试时上游收到的请求体与不开启时逐字节相同
+func TestExpectContinueReplaysBody(t *testing.T) {
+	request := `{"prompt":` + jsonString(strings.Repeat("// large file\n", 5000)) + `,"suffix":"}","max_tokens":50}`
+
+	send := func(expect bool) (string, int32) {
+		var attempts atomic.Int32
+		bodies := make(chan string, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 开启时第一次请求不读取请求体就拒绝密钥，net/http不会发送100 Continue
+			if 1 == attempts.Add(1) && expect {
+				if "100-continue" != r.Header.Get("Expect") {
+					t.Errorf("Expect = %q, want 100-continue", r.Header.Get("Expect"))
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			bodies <- string(body)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"id":"cmpl-1","object":"text_completion","choices":[{"index":0,"text":"ok","finish_reason":"stop"}]}`)
+		}))
+		defer upstream.Close()
+
+		cfg := &config{CodexApiKeys: []string{"sk-codex-second"}, ExpectContinue: expect, ExpectContinueSize: 1024}
+		_, proxy := newTestProxy(t, cfg, upstream.URL)
+		status, _, body := postTest(t, proxy, "/v1/engines/copilot-codex/completions", request, nil)
+		if http.StatusOK != status {
+			t.Fatalf("expect %v: status = %d: %s", expect, status, body)
+		}
+		return <-bodies, attempts.Load()
+	}
+
+	plain, _ := send(false)
+	replayed, attempts := send(true)
+	if 2 != attempts {
+		t.Fatalf("upstream attempts = %d, want 2", attempts)
+	}
+	if plain != replayed {
+		t.Fatalf("replayed body differs from the body sent without expect continue (%d vs %d bytes)", len(replayed), len(plain))
+	}
+	if len(plain) < len(request)/2 {
+		t.Fatalf("upstream got %d bytes, want the whole prompt", len(plain))
+	}
+}
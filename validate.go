@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// maxValidateRequests是/admin/config/validate最多重新转换的最近请求数
+const maxValidateRequests = 100
+
+// configValidation是/admin/config/validate的结果
+type configValidation struct {
+	Valid    bool          `json:"valid"`
+	Errors   []string      `json:"errors"`
+	Warnings []string      `json:"warnings"`
+	Behavior *behaviorDiff `json:"behavior,omitempty"`
+}
+
+// behaviorDiff汇总最近的请求在候选配置下与当前配置的差异
+type behaviorDiff struct {
+	Compared int           `json:"compared"`
+	Changed  int           `json:"changed"`
+	Skipped  int           `json:"skipped"` // 没有保存请求体或请求体被截断的请求
+	Requests []requestDiff `json:"requests,omitempty"`
+}
+
+// requestDiff是一个请求在候选配置下的变化
+type requestDiff struct {
+	Id       string   `json:"id"`
+	Endpoint string   `json:"endpoint"`
+	Model    string   `json:"model"`
+	Changes  []string `json:"changes"`
+}
+
+// validateConfig处理POST /admin/config/validate：请求体是候选的config.json，按启动时的方式完整检查，
+// requests=N时用最近N个请求比较转换结果。只返回检查结果，不修改正在使用的配置
+func (s *ProxyService) validateConfig(c *gin.Context) {
+	content, err := io.ReadAll(c.Request.Body)
+	if nil != err {
+		abortWithError(c, bodyReadStatus(err), "invalid_request_error", err.Error())
+		return
+	}
+	if !gjson.ParseBytes(content).IsObject() {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "body must be the candidate config as a JSON object")
+		return
+	}
+	requests, err := strconv.Atoi(c.DefaultQuery("requests", "0"))
+	if nil != err || requests < 0 {
+		abortWithError(c, http.StatusBadRequest, "invalid_request_error", "requests must be a non-negative integer")
+		return
+	}
+
+	result := s.checkCandidate(content, min(requests, maxValidateRequests))
+	result.Valid = 0 == len(result.Errors)
+	c.JSON(http.StatusOK, result)
+}
+
+// checkCandidate检查候选配置，requests大于0时比较最近的请求在两份配置下的转换结果
+func (s *ProxyService) checkCandidate(content []byte, requests int) configValidation {
+	result := configValidation{Errors: []string{}, Warnings: []string{}}
+
+	// 与启动时一样合并routes_file并应用环境变量
+	overrides, _ := envOverrides(os.Environ())
+	merged, sources, unknown, _, err := loadRoutes(content, overrides)
+	if nil != err {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	cfg := &config{}
+	if err = json.Unmarshal(merged, cfg); nil != err {
+		result.Errors = append(result.Errors, sources.describe(err.Error()))
+		return result
+	}
+	cfg.sources = sources
+	for i, problem := range unknownConfigKeys(content, reflect.TypeOf(cfg), "") {
+		if "" != sources.routesFile {
+			problem = "config.json: " + problem
+		}
+		unknown = slices.Insert(unknown, i, problem)
+	}
+	if len(unknown) > 0 {
+		if cfg.AllowUnknownConfig {
+			result.Warnings = append(result.Warnings, "ignoring unknown config keys: "+strings.Join(unknown, ", "))
+		} else {
+			result.Errors = append(result.Errors, "unknown config keys: "+strings.Join(unknown, ", "))
+		}
+	}
+
+	applyEnvOverrides(cfg, overrides)
+	if len(overrides) > 0 {
+		result.Warnings = append(result.Warnings, "environment variables override: "+strings.Join(sortedKeys(overrides), ", "))
+	}
+
+	// 配置了routes_file时指出每个问题所在的文件
+	describe := func(problems []string) []string {
+		for i, problem := range problems {
+			problems[i] = sources.describe(problem)
+		}
+		return problems
+	}
+	if "" != cfg.Bind {
+		if _, _, err := parseBind("bind", cfg.Bind); nil != err {
+			result.Errors = append(result.Errors, sources.describe(err.Error()))
+		}
+	}
+	if "" != cfg.AdminBind {
+		if _, _, err := parseBind("admin_bind", cfg.AdminBind); nil != err {
+			result.Errors = append(result.Errors, sources.describe(err.Error()))
+		}
+	}
+	result.Errors = append(result.Errors, describe(checkConfigUrls(cfg))...)
+
+	// 配置档以未经修改的顶层配置为默认值
+	profiles, err := profileConfigs(cfg)
+	if nil != err {
+		result.Errors = append(result.Errors, sources.describe(err.Error()))
+	}
+	for _, name := range sortedKeys(profiles) {
+		for _, problem := range append(checkConfigUrls(profiles[name]), candidateProblems(profiles[name])...) {
+			result.Errors = append(result.Errors, sources.describe(fmt.Sprintf("profiles.%s: %s", name, problem)))
+		}
+	}
+
+	candidate, problems := s.candidateService(cfg)
+	result.Errors = append(result.Errors, describe(problems)...)
+	if nil == candidate {
+		return result
+	}
+
+	// 模型映射的目标按已同步的上游模型列表检查
+	models := s.catalog.list()
+	switch {
+	case cfg.ChatApiBase != s.cfg.ChatApiBase:
+		result.Warnings = append(result.Warnings, "chat_api_base differs from the running config, model targets were not checked against the synced model list")
+	case 0 == len(models):
+		result.Warnings = append(result.Warnings, "the upstream model list has not been synced, model targets were not checked")
+	default:
+		candidate.checkModelTargets(models, func(name string, model string) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s points at %s, which is not in the upstream model list", name, model))
+		})
+	}
+
+	if requests > 0 {
+		if !s.cfg.Debug {
+			result.Warnings = append(result.Warnings, "request bodies are recorded only with debug enabled, no recent requests to compare")
+		}
+		result.Behavior = s.compareRecent(candidate, requests)
+	}
+
+	return result
+}
+
+// checkConfigUrls检查上游、代理和告警地址的格式
+func checkConfigUrls(cfg *config) []string {
+	var problems []string
+	check := func(name string, rawUrl string, schemes ...string) {
+		if "" == rawUrl {
+			return
+		}
+		u, err := url.Parse(rawUrl)
+		if nil != err {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			return
+		}
+		if !slices.Contains(schemes, u.Scheme) || "" == u.Host {
+			problems = append(problems, fmt.Sprintf("%s: %q is not an absolute %s url", name, redactUrl(rawUrl), strings.Join(schemes, "/")))
+		}
+	}
+
+	check("proxy_url", cfg.ProxyUrl, "http", "https", "socks5", "socks5h")
+	check("chat_api_base", cfg.ChatApiBase, "http", "https")
+	for i, base := range cfg.ChatApiBases {
+		check(fmt.Sprintf("chat_api_bases[%d]", i), base, "http", "https")
+	}
+	check("codex_api_base", cfg.CodexApiBase, "http", "https")
+	check("audio_api_base", cfg.AudioApiBase, "http", "https")
+	check("images_api_base", cfg.ImagesApiBase, "http", "https")
+	check("rerank_api_base", cfg.RerankApiBase, "http", "https")
+	check("alert_webhook_url", cfg.AlertWebhookUrl, "http", "https")
+	for _, model := range sortedKeys(cfg.ChatModelRoutes) {
+		check("chat_model_routes."+model+".url", cfg.ChatModelRoutes[model].Url, "http", "https")
+	}
+
+	return problems
+}
+
+// candidateProblems执行newProxyService中的全部检查，返回所有问题。会读取签名密钥和令牌凭据文件，
+// 但不打开统计数据库和存储，也不启动后台任务
+func candidateProblems(cfg *config) []string {
+	_, problems := (&ProxyService{}).candidateService(cfg)
+	return problems
+}
+
+// candidateService检查候选配置并创建只用于转换请求的ProxyService，有问题时返回nil和所有问题。
+// 未配置user_field_salt时沿用当前的盐，不生成新的盐文件
+func (s *ProxyService) candidateService(cfg *config) (*ProxyService, []string) {
+	parts, errs := newConfigParts(cfg)
+	if len(errs) > 0 {
+		problems := make([]string, 0, len(errs))
+		for _, err := range errs {
+			problems = append(problems, err.Error())
+		}
+		return nil, problems
+	}
+
+	userSalt := cfg.UserFieldSalt
+	if "" == userSalt {
+		userSalt = s.userSalt
+	}
+
+	return &ProxyService{
+		cfg:            cfg,
+		client:         parts.client,
+		metrics:        newMetrics(),
+		chatKeys:       newKeyPool("chat", cfg.ChatApiKey, cfg.ChatApiKeys, cfg.BadKeyCooldown),
+		codexKeys:      newKeyPool("codex", cfg.CodexApiKey, cfg.CodexApiKeys, cfg.BadKeyCooldown),
+		routeKeys:      parts.routeKeys,
+		userSalt:       userSalt,
+		redactPatterns: parts.redactPatterns,
+		blockPatterns:  parts.blockPatterns,
+		chatRules:      parts.chatRules,
+		backends:       parts.backends,
+		paths:          parts.paths,
+		tenants:        newTenantModels(cfg),
+		catalog:        s.catalog,
+		profile:        s.profile,
+	}, nil
+}
+
+// compareRecent用当前和候选配置转换最近的请求，只列出有变化的请求。保存的请求没有请求头，
+// 按客户端和语言选择的模型映射不参与比较
+func (s *ProxyService) compareRecent(candidate *ProxyService, limit int) *behaviorDiff {
+	diff := &behaviorDiff{}
+	entries := s.recent.entries()
+	for i := len(entries) - 1; i >= 0 && diff.Compared+diff.Skipped < limit; i-- {
+		entry := entries[i]
+		if nil == entry.replay {
+			continue
+		}
+		body := []byte(entry.Body)
+		if !json.Valid(body) {
+			diff.Skipped++
+			continue
+		}
+
+		before, err := s.previewTransform(entry.replay.endpoint, body, http.Header{}, nil)
+		if nil != err {
+			diff.Skipped++
+			continue
+		}
+		after, err := candidate.previewTransform(entry.replay.endpoint, body, http.Header{}, nil)
+		if nil != err {
+			diff.Skipped++
+			continue
+		}
+
+		diff.Compared++
+		if changes := previewChanges(before, after); len(changes) > 0 {
+			diff.Changed++
+			diff.Requests = append(diff.Requests, requestDiff{Id: entry.Id, Endpoint: entry.replay.endpoint, Model: entry.Model, Changes: changes})
+		}
+	}
+
+	return diff
+}
+
+// previewChanges比较同一个请求的两次转换结果
+func previewChanges(before *transformPreview, after *transformPreview) []string {
+	var changes []string
+	changed := func(name string, a string, b string) {
+		if a != b {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, orNone(a), orNone(b)))
+		}
+	}
+	changed("mapped_model", before.mapped, after.mapped)
+	changed("upstream", before.target.name, after.target.name)
+	changed("rule", before.rule, after.rule)
+
+	beforeFields, afterFields := topLevelFields(before.body), topLevelFields(after.body)
+	var removed, added []string
+	for _, field := range beforeFields {
+		if !slices.Contains(afterFields, field) {
+			removed = append(removed, field)
+		}
+	}
+	for _, field := range afterFields {
+		if !slices.Contains(beforeFields, field) {
+			added = append(added, field)
+		}
+	}
+	if len(removed) > 0 {
+		changes = append(changes, "fields no longer sent: "+strings.Join(removed, ", "))
+	}
+	if len(added) > 0 {
+		changes = append(changes, "fields now sent: "+strings.Join(added, ", "))
+	}
+
+	if 0 == len(changes) && !bytes.Equal(before.body, after.body) {
+		changes = append(changes, "request body differs")
+	}
+
+	return changes
+}
+
+// topLevelFields返回请求体中的顶层字段
+func topLevelFields(body []byte) []string {
+	var fields []string
+	gjson.ParseBytes(body).ForEach(func(key, _ gjson.Result) bool {
+		fields = append(fields, key.String())
+		return true
+	})
+	return fields
+}
+
+// orNone把空值显示为(none)
+func orNone(value string) string {
+	if "" == value {
+		return "(none)"
+	}
+	return value
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestConfigChecksShared检查启动和/admin/config/validate对同一个配置报告同样的问题
+func TestConfigChecksShared(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config
+		want string
+	}{
+		{"missing pre hook", config{PreRequestHook: []string{"override-no-such-hook"}}, "pre_request_hook: "},
+		{"empty post hook", config{PostResponseHook: []string{"", "hook.py"}}, "post_response_hook: empty command"},
+		{"retry_on", config{ChatRetryOn: []string{"teapot"}}, "chat_retry_on"},
+		{"redact pattern", config{RedactPatterns: []string{"("}}, "redact_patterns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.ModelSyncDisabled = true
+			problems := candidateProblems(&cfg)
+			if 1 != len(problems) || !strings.Contains(problems[0], tt.want) {
+				t.Fatalf("validate problems = %q, want one containing %q", problems, tt.want)
+			}
+
+			cfg = tt.cfg
+			cfg.ModelSyncDisabled = true
+			if _, err := newProxyService(&cfg, "", newMetrics()); nil == err || problems[0] != err.Error() {
+				t.Fatalf("startup error = %v, want %q", err, problems[0])
+			}
+		})
+	}
+
+	// 能找到的命令通过检查
+	cfg := &config{PreRequestHook: []string{os.Args[0]}, PostResponseHook: []string{os.Args[0], "-test.run=none"}}
+	if problems := candidateProblems(cfg); 0 != len(problems) {
+		t.Fatalf("problems = %q", problems)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/sjson"
+)
+
+// lastTraffic记录各端点最近一次真实请求的时间（Unix秒），用于在有流量时跳过预热
+type lastTraffic struct {
+	chat  atomic.Int64
+	codex atomic.Int64
+	last  atomic.Int64 // 任一端点
+}
+
+// touch记录端点有真实请求
+func (t *lastTraffic) touch(endpoint string) {
+	now := time.Now().Unix()
+	t.last.Store(now)
+	switch endpoint {
+	case "chat":
+		t.chat.Store(now)
+	case "codex":
+		t.codex.Store(now)
+	}
+}
+
+// warmupLoop按warmup_interval_seconds定期向上游发送最小的请求，让上游保持模型已加载
+func (s *ProxyService) warmupLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		idleSince := time.Now().Add(-interval).Unix()
+
+		if "" != s.cfg.ChatApiBase && s.traffic.chat.Load() < idleSince {
+			s.warmup(s.chatTarget(s.cfg.ChatModelDefault), pingChatBody(s.cfg.ChatModelDefault))
+		}
+		if s.cfg.WarmupCodex && "" != s.cfg.CodexApiBase && s.traffic.codex.Load() < idleSince {
+			s.warmup(s.codexTarget(), pingCodexBody())
+		}
+	}
+}
+
+// pingChatBody返回预热和自检使用的最小Chat请求
+func pingChatBody(model string) []byte {
+	body, _ := sjson.SetBytes([]byte(`{"messages":[{"role":"user","content":"hi"}],"max_tokens":1}`), "model", model)
+	return body
+}
+
+// pingCodexBody返回预热和自检使用的最小Codex请求
+func pingCodexBody() []byte {
+	body, _ := sjson.SetBytes([]byte(`{"prompt":"\n","max_tokens":1}`), "model", InstructModel)
+	return body
+}
+
+// warmup发送一次预热请求，失败只记录日志，不影响用户请求的统计和告警
+func (s *ProxyService) warmup(target *upstreamTarget, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	resp, err := s.doUpstream(ctx, target, body)
+	if nil != err {
+		logError("warm up %s failed: %v\n", target.name, err)
+		return
+	}
+	defer closeIO(resp.Body)
+
+	content, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		logError("warm up %s failed: %d %s\n", target.name, resp.StatusCode, s.sanitizeLogBody(content))
+	}
+}